@@ -0,0 +1,353 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// heartbeatTimeout 超过该时间未收到心跳的数据节点视为不健康
+const heartbeatTimeout = 15 * time.Second
+
+// Heartbeat DataServer定时上报给ManagerServer
+type Heartbeat struct {
+	ID     string
+	Host   string
+	DocNum map[int]int //shard -> doc count
+}
+
+type AdminRequest struct {
+	NodeID string
+	Shard  int
+	From   string //node id
+	To     string //node id
+	Num    int
+}
+
+type NodeStatus struct {
+	Node     Node
+	Healthy  bool
+	LastSeen time.Time
+}
+
+type ShardStatus struct {
+	Shard     int
+	Leader    string   //node id
+	Followers []string //node id
+	DocNum    int      //主分片上报的文档数, -1表示未知
+}
+
+type ClusterStatus struct {
+	ShardingNum   int
+	ReplicateNum  int
+	ManagerLeader string
+	Nodes         []NodeStatus
+	Shards        []ShardStatus
+}
+
+// Heartbeat called by DataServer. 心跳只保存在leader内存中, 不经过raft复制
+func (m *ManagerServer) Heartbeat(request Heartbeat, response *Node) error {
+	if state, leader := m.raft.State(); state != Leader {
+		return &NotLeaderError{Leader: leader}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.heartbeats[request.ID] = heartbeatInfo{time: time.Now(), docNum: request.DocNum}
+	if n, ok := m.cluster.DataNodeCorpus[request.ID]; ok {
+		*response = n
+	}
+	return nil
+}
+
+// Status 返回节点与分片的分配、健康状态以及分片文档数
+func (m *ManagerServer) Status(request string, response *ClusterStatus) error {
+	state, leader := m.raft.State()
+	if state != Leader {
+		return &NotLeaderError{Leader: leader}
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	status := ClusterStatus{
+		ShardingNum:   m.cluster.ShardingNum,
+		ReplicateNum:  m.cluster.ReplicateNum,
+		ManagerLeader: leader,
+		Nodes:         make([]NodeStatus, 0),
+		Shards:        make([]ShardStatus, 0, m.cluster.ShardingNum),
+	}
+	for i := 0; i < m.cluster.ShardingNum; i++ {
+		status.Shards = append(status.Shards, ShardStatus{Shard: i, DocNum: -1})
+	}
+
+	clone := m.cluster.Clone()
+	for id, node := range clone.DataNodeCorpus {
+		hb, ok := m.heartbeats[id]
+		status.Nodes = append(status.Nodes, NodeStatus{
+			Node:     node,
+			Healthy:  ok && time.Since(hb.time) < heartbeatTimeout,
+			LastSeen: hb.time,
+		})
+		for _, shard := range node.LeaderSharding {
+			if shard >= len(status.Shards) {
+				continue
+			}
+			status.Shards[shard].Leader = id
+			if n, ok := hb.docNum[shard]; ok {
+				status.Shards[shard].DocNum = n
+			}
+		}
+		for _, shard := range node.FollowerSharding {
+			if shard < len(status.Shards) {
+				status.Shards[shard].Followers = append(status.Shards[shard].Followers, id)
+			}
+		}
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool {
+		return status.Nodes[i].Node.Host < status.Nodes[j].Node.Host
+	})
+	for i := range status.Shards {
+		sort.Strings(status.Shards[i].Followers)
+	}
+	*response = status
+	return nil
+}
+
+// DrainNode 下线节点, 节点上的分片拷贝到其他节点后重新分配
+func (m *ManagerServer) DrainNode(request AdminRequest, response *Cluster) error {
+	return m.admin(MetaCommand{Type: CmdDrainNode, Admin: request}, response)
+}
+
+// MoveShard 将From节点上的分片(主分片或备份分片)拷贝到To节点后迁移
+func (m *ManagerServer) MoveShard(request AdminRequest, response *Cluster) error {
+	return m.admin(MetaCommand{Type: CmdMoveShard, Admin: request}, response)
+}
+
+// PromoteShard 将NodeID节点上的备份分片提升为主分片, 原主分片降为备份分片
+func (m *ManagerServer) PromoteShard(request AdminRequest, response *Cluster) error {
+	return m.admin(MetaCommand{Type: CmdPromoteShard, Admin: request}, response)
+}
+
+// SetReplicateNum 修改分片副本数并重新分配分片, 新增的副本先从主分片拷贝
+func (m *ManagerServer) SetReplicateNum(request AdminRequest, response *Cluster) error {
+	return m.admin(MetaCommand{Type: CmdSetReplicateNum, Admin: request}, response)
+}
+
+// admin 先将分片拷贝到新分配的节点, 再通过raft切换路由
+func (m *ManagerServer) admin(cmd MetaCommand, response *Cluster) error {
+	if err := m.migrate(cmd); err != nil {
+		return err
+	}
+	return m.propose(cmd, response)
+}
+
+func (m *ManagerServer) propose(cmd MetaCommand, response *Cluster) error {
+	result, err := m.raft.Propose(cmd)
+	if err != nil {
+		return err
+	}
+	if r := result.(applyResult); r.Err != "" {
+		return errors.New(r.Err)
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	*response = *m.cluster.Clone()
+	return nil
+}
+
+// drainNode unsafe
+func (m *ManagerServer) drainNode(id string) error {
+	node, ok := m.cluster.DataNodeCorpus[id]
+	if !ok {
+		return fmt.Errorf("node %s not found", id)
+	}
+	if node.Draining {
+		return nil
+	}
+	if m.activeNodeNum() <= 1 {
+		return errors.New("can not drain the last available node")
+	}
+
+	node.Draining = true
+	m.cluster.DataNodeCorpus[id] = node
+	m.hash = m.hash.RemoveNode(id)
+	return m.ReBalance()
+}
+
+// moveShard unsafe
+func (m *ManagerServer) moveShard(shard int, from, to string) error {
+	if shard < 0 || shard >= m.cluster.ShardingNum {
+		return fmt.Errorf("invalid shard %d", shard)
+	}
+	src, ok := m.cluster.DataNodeCorpus[from]
+	if !ok {
+		return fmt.Errorf("node %s not found", from)
+	}
+	dst, ok := m.cluster.DataNodeCorpus[to]
+	if !ok {
+		return fmt.Errorf("node %s not found", to)
+	}
+	if dst.Draining {
+		return fmt.Errorf("node %s is draining", to)
+	}
+	if containsInt(dst.LeaderSharding, shard) || containsInt(dst.FollowerSharding, shard) {
+		return fmt.Errorf("node %s already has shard %d", to, shard)
+	}
+
+	if containsInt(src.LeaderSharding, shard) {
+		src.LeaderSharding = removeInt(src.LeaderSharding, shard)
+		dst.LeaderSharding = append(dst.LeaderSharding, shard)
+	} else if containsInt(src.FollowerSharding, shard) {
+		src.FollowerSharding = removeInt(src.FollowerSharding, shard)
+		dst.FollowerSharding = append(dst.FollowerSharding, shard)
+	} else {
+		return fmt.Errorf("node %s does not have shard %d", from, shard)
+	}
+	m.cluster.DataNodeCorpus[from] = src
+	m.cluster.DataNodeCorpus[to] = dst
+	m.pin(shard)
+	return nil
+}
+
+// promoteShard unsafe
+func (m *ManagerServer) promoteShard(shard int, id string) error {
+	node, ok := m.cluster.DataNodeCorpus[id]
+	if !ok {
+		return fmt.Errorf("node %s not found", id)
+	}
+	if containsInt(node.LeaderSharding, shard) {
+		return nil
+	}
+	if !containsInt(node.FollowerSharding, shard) {
+		return fmt.Errorf("node %s is not a follower of shard %d", id, shard)
+	}
+
+	for k, n := range m.cluster.DataNodeCorpus {
+		if containsInt(n.LeaderSharding, shard) {
+			n.LeaderSharding = removeInt(n.LeaderSharding, shard)
+			n.FollowerSharding = append(n.FollowerSharding, shard)
+			m.cluster.DataNodeCorpus[k] = n
+		}
+	}
+	node = m.cluster.DataNodeCorpus[id]
+	node.FollowerSharding = removeInt(node.FollowerSharding, shard)
+	node.LeaderSharding = append(node.LeaderSharding, shard)
+	m.cluster.DataNodeCorpus[id] = node
+	m.pin(shard)
+	return nil
+}
+
+// pin 记录手动调整后的分片位置, ReBalance时保留, unsafe
+func (m *ManagerServer) pin(shard int) {
+	var leader string
+	var followers []string
+	for id, node := range m.cluster.DataNodeCorpus {
+		if containsInt(node.LeaderSharding, shard) {
+			leader = id
+		} else if containsInt(node.FollowerSharding, shard) {
+			followers = append(followers, id)
+		}
+	}
+	sort.Strings(followers) //保证各ManagerServer上的结果一致
+	if m.cluster.Pinned == nil {
+		m.cluster.Pinned = make(map[int][]string)
+	}
+	m.cluster.Pinned[shard] = append([]string{leader}, followers...)
+}
+
+// placement 手动调整过的分片优先使用记录的位置, 跳过已下线的节点, 不足size个时用一致性哈希的结果补齐, unsafe
+func (m *ManagerServer) placement(pinned, hashed []string, size int) []string {
+	nodes := make([]string, 0, size)
+	for _, id := range append(append([]string{}, pinned...), hashed...) {
+		if len(nodes) == size {
+			break
+		}
+		if n, ok := m.cluster.DataNodeCorpus[id]; ok && !n.Draining && !containsString(nodes, id) {
+			nodes = append(nodes, id)
+		}
+	}
+	return nodes
+}
+
+// setReplicateNum unsafe
+func (m *ManagerServer) setReplicateNum(num int) error {
+	if num < 1 {
+		return fmt.Errorf("invalid replicate num %d", num)
+	}
+	m.cluster.ReplicateNum = num
+	return m.ReBalance()
+}
+
+func (m *ManagerServer) activeNodeNum() int {
+	n := 0
+	for _, node := range m.cluster.DataNodeCorpus {
+		if !node.Draining {
+			n++
+		}
+	}
+	return n
+}
+
+func containsInt(a []int, x int) bool {
+	for _, v := range a {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(a []string, x string) bool {
+	for _, v := range a {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+func removeInt(a []int, x int) []int {
+	r := make([]int, 0, len(a))
+	for _, v := range a {
+		if v != x {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+// AdminClient 集群管理接口
+type AdminClient struct {
+	manager *ManagerClient
+}
+
+func NewAdminClient(addrs []string) *AdminClient {
+	return &AdminClient{manager: NewManagerClient(addrs)}
+}
+
+func (c *AdminClient) Status() (*ClusterStatus, error) {
+	status := &ClusterStatus{}
+	if err := c.manager.Call("ManagerServer.Status", "admin", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *AdminClient) Drain(id string) error {
+	return c.manager.Call("ManagerServer.DrainNode", AdminRequest{NodeID: id}, &Cluster{})
+}
+
+func (c *AdminClient) Move(shard int, from, to string) error {
+	return c.manager.Call("ManagerServer.MoveShard", AdminRequest{Shard: shard, From: from, To: to}, &Cluster{})
+}
+
+func (c *AdminClient) Promote(shard int, id string) error {
+	return c.manager.Call("ManagerServer.PromoteShard", AdminRequest{Shard: shard, NodeID: id}, &Cluster{})
+}
+
+func (c *AdminClient) SetReplicateNum(num int) error {
+	return c.manager.Call("ManagerServer.SetReplicateNum", AdminRequest{Num: num}, &Cluster{})
+}
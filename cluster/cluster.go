@@ -2,7 +2,13 @@ package cluster
 
 import (
 	"errors"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/awesomefly/easysearch/util"
 )
 
 const (
@@ -11,13 +17,17 @@ const (
 	SearchNode  = 3
 )
 
+const nodeIDFile = "node.id"
+
 type Node struct {
-	ID   int
+	ID   string //节点首次启动时生成并保存在数据目录, 重启后不变
 	Type int
 	Host string //ip:port
 
 	LeaderSharding   []int //主分片
 	FollowerSharding []int //备份分片
+
+	Draining bool //下线中的节点不再分配分片
 }
 
 type Cluster struct {
@@ -25,7 +35,41 @@ type Cluster struct {
 	ReplicateNum int //数据备份数
 
 	SearchNodeCorpus []Node
-	DataNodeCorpus   map[string]Node
+	DataNodeCorpus   map[string]Node //node id -> node
+
+	Pinned map[int][]string //手动迁移或提升过的分片 shard -> node ids, 第一个为主分片, ReBalance时保留
+}
+
+// LoadNodeID 读取保存在dir中的节点ID, 不存在时生成新ID并保存. dir为空时不保存
+// 每个数据目录对应一个节点, 节点地址变化后ID不变; 同一台机器上的多个节点需使用不同的数据目录
+func LoadNodeID(dir string) (string, error) {
+	if dir == "" {
+		return util.NewUUID(), nil
+	}
+
+	file := filepath.Join(dir, nodeIDFile)
+	if data, err := ioutil.ReadFile(file); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	id := util.NewUUID()
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(id), 0660); err != nil {
+		return "", err
+	}
+	return id, os.Rename(tmp, file)
+}
+
+// NodeDataDir 同一配置启动多个节点时各节点的数据目录, 如./data/dataserver_127.0.0.1_1240
+func NodeDataDir(dataDir, role, addr string) string {
+	return filepath.Join(dataDir, role+"_"+strings.NewReplacer(":", "_", "/", "_").Replace(addr))
 }
 
 func NewCluster(shard, replicate int) *Cluster {
@@ -34,14 +78,36 @@ func NewCluster(shard, replicate int) *Cluster {
 		ReplicateNum:     replicate,
 		SearchNodeCorpus: make([]Node, 0),
 		DataNodeCorpus:   make(map[string]Node, 0),
+		Pinned:           make(map[int][]string, 0),
+	}
+}
+
+// Clone returns a deep copy of c
+func (c *Cluster) Clone() *Cluster {
+	clone := NewCluster(c.ShardingNum, c.ReplicateNum)
+	clone.SearchNodeCorpus = append(clone.SearchNodeCorpus, c.SearchNodeCorpus...)
+	for k, node := range c.DataNodeCorpus {
+		node.LeaderSharding = append([]int{}, node.LeaderSharding...)
+		node.FollowerSharding = append([]int{}, node.FollowerSharding...)
+		clone.DataNodeCorpus[k] = node
+	}
+	for shard, ids := range c.Pinned {
+		clone.Pinned[shard] = append([]string{}, ids...)
 	}
+	return clone
 }
 
 func (c *Cluster) Add(node Node) error {
 	switch node.Type {
 	case DataNode:
-		c.DataNodeCorpus[node.Host] = node
+		c.DataNodeCorpus[node.ID] = node
 	case SearchNode:
+		for i := range c.SearchNodeCorpus {
+			if c.SearchNodeCorpus[i].ID == node.ID { //重启后重复注册
+				c.SearchNodeCorpus[i] = node
+				return nil
+			}
+		}
 		c.SearchNodeCorpus = append(c.SearchNodeCorpus, node)
 	default:
 		return errors.New("invalid node type")
@@ -0,0 +1,56 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/awesomefly/easysearch/config"
+)
+
+func TestLoadNodeID(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "node")
+	defer os.RemoveAll(dir)
+
+	id, err := LoadNodeID(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 36, len(id))
+
+	//重启后地址变化, ID不变
+	again, err := LoadNodeID(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, id, again)
+
+	other, err := LoadNodeID(filepath.Join(dir, "other"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, other)
+}
+
+func TestNodeDataDir(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "node")
+	defer os.RemoveAll(dir)
+
+	manager := serveFake(t, "ManagerServer", &fakeManager{cluster: NewCluster(2, 1)})
+	host, port, _ := net.SplitHostPort(manager)
+	managerPort, _ := strconv.Atoi(port)
+	conf := config.Config{
+		Store:   config.Storage{IndexFile: filepath.Join(dir, "idx"), DataDir: dir},
+		Cluster: config.Cluster{ShardingNum: 2, ReplicateNum: 1, ManageServer: config.Server{Host: host, Port: managerPort}},
+	}
+
+	//同一配置启动的多个DataServer, 与-servername all相同, 每个节点使用各自的数据目录
+	ids := make(map[string]bool)
+	for _, p := range []int{1240, 1241} {
+		c := conf
+		c.Server = config.Server{Host: "127.0.0.1", Port: p}
+		c.Store.DataDir = NodeDataDir(conf.Store.DataDir, "dataserver", c.Server.Address())
+		ids[NewDataServer(&c).self.ID] = true
+	}
+	assert.Equal(t, 2, len(ids))
+	assert.Equal(t, filepath.Join(dir, "dataserver_127.0.0.1_1240"), NodeDataDir(dir, "dataserver", "127.0.0.1:1240"))
+}
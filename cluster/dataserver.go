@@ -1,75 +1,208 @@
 package cluster
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/util"
 
 	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/paraphrase/serving"
 	"github.com/awesomefly/easysearch/search"
 )
 
 type DataServer struct {
+	lock    sync.RWMutex
 	self    Node
 	cluster Cluster
+	config  *config.Config
+	manager *ManagerClient
 
-	sharding map[int]*search.Searcher
-	server   *Server
+	sharding    map[int]*search.Searcher
+	pipeline    search.Pipeline     //所有分片共用的多阶段排序参数
+	expander    *serving.Expander   //所有分片共用的查询扩展, 未配置时为nil
+	highlighter *search.Highlighter //所有分片共用的高亮及文档原文, Highlight.Enabled为false时为nil
+	texts       *search.MemoryStore //高亮使用的文档原文, 只加载本节点分片的文档
+	postings    *index.PostingCache //所有分片共用的倒排表缓存, Cache.PostingMB为0时为nil
+	server      *Server
+
+	oplogs     map[int]*OpLog       //主分片操作日志
+	applied    map[int]int64        //备份分片已应用的序列号
+	epochs     map[int]string       //备份分片已应用的操作所属的主分片操作日志, Epoch变化后序列号重新开始
+	shardLocks map[int]*sync.Mutex  //保证同一分片的写操作按序列号顺序执行
+	handoffs   map[int]time.Time    //迁移中的主分片, 截止时间前拒绝写入
+	migrations map[string]migration //迁移中的分片快照, 目标节点下载完成后释放
 }
 
 func NewDataServer(config *config.Config) *DataServer {
+	if len(config.Store.IndexFile) == 0 {
+		panic("index file is empty.")
+	}
+	dir := config.Store.DataDir
+	if dir == "" {
+		dir = filepath.Dir(config.Store.IndexFile)
+	}
+	id, err := LoadNodeID(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	pipeline, err := search.NewPipeline(config.Ranking)
+	if err != nil {
+		panic(err)
+	}
+	expander, err := serving.ExpanderFromConfig(config)
+	if err != nil {
+		panic(err)
+	}
+	var highlighter *search.Highlighter
+	var texts *search.MemoryStore
+	if config.Highlight.Enabled {
+		texts = search.NewMemoryStore()
+		highlighter = search.NewHighlighter(config.Highlight, texts)
+	}
+
 	ds := DataServer{
 		self: Node{
-			ID:   rand.Intn(10000), //todo: support uuid
+			ID:   id,
 			Type: DataNode,
 			Host: config.Server.Address(),
 		},
-		server:   &Server{name: "Data", network: "tcp", address: config.Server.Address()},
-		sharding: make(map[int]*search.Searcher, 0),
+		config:      config,
+		manager:     NewManagerClient(managerAddresses(config.Cluster)),
+		server:      newServer("Data", config),
+		sharding:    make(map[int]*search.Searcher, 0),
+		pipeline:    pipeline,
+		expander:    expander,
+		highlighter: highlighter,
+		texts:       texts,
+		postings:    index.NewPostingCache(config.Cache.PostingMB),
+		oplogs:      make(map[int]*OpLog, 0),
+		applied:     make(map[int]int64, 0),
+		epochs:      make(map[int]string, 0),
+		shardLocks:  make(map[int]*sync.Mutex, 0),
+		handoffs:    make(map[int]time.Time, 0),
+		migrations:  make(map[string]migration, 0),
 	}
 
 	n := Node{}
-	err := RpcCall(config.Cluster.ManageServer.Address(), "ManagerServer.AddServer", ds.self, &n)
+	err = ds.manager.Call("ManagerServer.AddServer", ds.self, &n)
 	if err != nil {
 		panic(err)
 	}
 	ds.self = n
 
 	c := Cluster{}
-	err = RpcCall(config.Cluster.ManageServer.Address(), "ManagerServer.GetCluster", ds.self.Host, &c)
+	err = ds.manager.Call("ManagerServer.GetCluster", ds.self.Host, &c)
 	if err != nil {
 		panic(err)
 	}
 	ds.cluster = c
 	//fmt.Printf("DataServer:%+v\n", ds)
+	if err = ds.loadTexts(ds.openShards()); err != nil {
+		panic(err)
+	}
+	if config.Metrics.Enabled {
+		ds.registerMetrics()
+	}
+	return &ds
+}
 
-	if len(config.Store.IndexFile) == 0 {
-		panic("index file is empty.")
+// openShards 为新分配到本节点的分片创建Searcher, 返回新打开的分片, unsafe
+func (s *DataServer) openShards() []int {
+	var opened []int
+	open := func(shard int) {
+		if _, ok := s.sharding[shard]; ok {
+			return
+		}
+		opened = append(opened, shard)
+		s.sharding[shard] = s.newSearcher(shard)
+		s.shardLocks[shard] = &sync.Mutex{}
 	}
 
-	for _, shard := range ds.self.LeaderSharding {
-		searcher := search.NewSearcher(fmt.Sprintf("%s.%d", config.Store.IndexFile, shard))
-		if config.Store.ModelFile != "" {
-			searcher.InitParaphrase(config.Store.ModelFile)
+	for _, shard := range s.self.LeaderSharding {
+		open(shard)
+		if s.oplogs[shard] == nil {
+			s.oplogs[shard] = NewOpLog(DefaultOpLogSize)
 		}
-		ds.sharding[shard] = searcher
 	}
 
-	for _, shard := range ds.self.FollowerSharding {
-		searcher := search.NewSearcher(fmt.Sprintf("%s.%d", config.Store.IndexFile, shard))
-		if config.Store.ModelFile != "" {
-			searcher.InitParaphrase(config.Store.ModelFile)
+	for _, shard := range s.self.FollowerSharding {
+		open(shard)
+	}
+
+	//不再是主分片的分片停止接收写入
+	for shard := range s.oplogs {
+		if !containsInt(s.self.LeaderSharding, shard) {
+			delete(s.oplogs, shard)
+			delete(s.handoffs, shard)
 		}
-		ds.sharding[shard] = searcher
 	}
-	return &ds
+	return opened
+}
+
+// newSearcher 使用本节点共用的配置打开分片索引
+func (s *DataServer) newSearcher(shard int) *search.Searcher {
+	return search.NewSearcher(fmt.Sprintf("%s.%d", s.config.Store.IndexFile, shard)).
+		WithSimilarity(index.SimilarityFromConfig(s.config)).
+		WithPipeline(s.pipeline).
+		WithParaphrase(s.expander).
+		WithHighlighter(s.highlighter).
+		WithResultCache(s.config.Cache.Results).
+		WithPostingCache(s.postings)
+}
+
+// loadTexts 从文档来源加载shards中的文档原文, 未开启高亮时不加载
+func (s *DataServer) loadTexts(shards []int) error {
+	if s.texts == nil || len(shards) == 0 {
+		return nil
+	}
+	s.lock.RLock()
+	num := s.cluster.ShardingNum
+	s.lock.RUnlock()
+	if num <= 0 {
+		return errors.New("invalid sharding num")
+	}
+	n, err := s.texts.Load(s.config.Store.DocumentSource(), func(id int) bool {
+		return containsInt(shards, id%num)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("loaded %d documents of shards %v for highlighting", n, shards)
+	return nil
+}
+
+// refreshCluster 从ManagerServer拉取最新的分片路由
+func (s *DataServer) refreshCluster() error {
+	c := Cluster{}
+	if err := s.manager.Call("ManagerServer.GetCluster", s.self.Host, &c); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.cluster = c
+	if n, ok := c.DataNodeCorpus[s.self.ID]; ok {
+		s.self = n
+	}
+	opened := s.openShards()
+	s.lock.Unlock()
+	return s.loadTexts(opened)
 }
 
 func (s *DataServer) Run() {
 	if err := s.server.RegisterName("DataServer", s); err != nil {
 		panic(err)
 	}
+	go s.catchUp()
+	go s.heartbeat()
 	if err := s.server.Run(); err != nil {
 		panic(err)
 	}
@@ -78,35 +211,526 @@ func (s *DataServer) Run() {
 type SearchRequest struct {
 	Query    string
 	Sharding []int
+	Model    index.SearchModel //打分模型, 为空时使用配置的默认模型
 }
 
 //Search 搜索
 func (s *DataServer) Search(request SearchRequest, response *[]index.Doc) error {
+	model, err := index.ParseSearchModel(string(request.Model))
+	if err != nil {
+		return err
+	}
+	request.Model = model //转发及检索使用规范化的模型名
 	result := make([]index.Doc, 0)
 	for _, shard := range request.Sharding {
-		srh := s.sharding[shard]
+		srh := s.searcher(shard)
 		if srh == nil {
 			continue
 		}
-		x := srh.Search(request.Query)
+		start := time.Now()
+		x := srh.SearchWithModel(request.Query, request.Model)
+		shardSearchDuration.Since(start, strconv.Itoa(shard), "search")
 		result = append(result, x...)
 	}
 	*response = result
 	return nil
 }
 
+// HybridRequest 混合检索请求, Sharding为检索的分片
+type HybridRequest struct {
+	Query    search.HybridQuery
+	Sharding []int
+}
+
+// Hybrid 在各分片中混合检索, 返回合并后的文本检索及向量检索结果, 由SearchServer统一融合
+func (s *DataServer) Hybrid(request HybridRequest, response *search.HybridResult) error {
+	model, err := index.ParseSearchModel(string(request.Query.Model))
+	if err != nil {
+		return err
+	}
+	request.Query.Model = model
+	result := search.HybridResult{}
+	for _, shard := range request.Sharding {
+		srh := s.searcher(shard)
+		if srh == nil {
+			continue
+		}
+		start := time.Now()
+		r, err := srh.HybridSearch(request.Query)
+		shardSearchDuration.Since(start, strconv.Itoa(shard), "hybrid")
+		if err != nil {
+			return err
+		}
+		result.Merge(r)
+	}
+	*response = result
+	return nil
+}
+
+// ExplainResult 搜索结果及其得分明细
+type ExplainResult struct {
+	Docs     []index.Doc
+	Explains []index.Explanation //与Docs一一对应
+}
+
+func (r *ExplainResult) Len() int           { return len(r.Docs) }
+func (r *ExplainResult) Less(i, j int) bool { return r.Docs[i].Score > r.Docs[j].Score } //降序
+func (r *ExplainResult) Swap(i, j int) {
+	r.Docs[i], r.Docs[j] = r.Docs[j], r.Docs[i]
+	r.Explains[i], r.Explains[j] = r.Explains[j], r.Explains[i]
+}
+
+// Explain 搜索并返回每个结果的得分明细及命中的分片
+func (s *DataServer) Explain(request SearchRequest, response *ExplainResult) error {
+	model, err := index.ParseSearchModel(string(request.Model))
+	if err != nil {
+		return err
+	}
+	request.Model = model //转发及检索使用规范化的模型名
+	result := ExplainResult{}
+	for _, shard := range request.Sharding {
+		srh := s.searcher(shard)
+		if srh == nil {
+			continue
+		}
+		start := time.Now()
+		docs, explains := srh.ExplainWithModel(request.Query, request.Model)
+		shardSearchDuration.Since(start, strconv.Itoa(shard), "explain")
+		for i := range explains {
+			explains[i].Shard = shard
+		}
+		result.Docs = append(result.Docs, docs...)
+		result.Explains = append(result.Explains, explains...)
+	}
+	*response = result
+	return nil
+}
+
+// HighlightResult 搜索结果及其高亮
+type HighlightResult struct {
+	Docs       []index.Doc
+	Highlights []search.Highlight //与Docs一一对应
+}
+
+func (r *HighlightResult) Len() int           { return len(r.Docs) }
+func (r *HighlightResult) Less(i, j int) bool { return r.Docs[i].Score > r.Docs[j].Score } //降序
+func (r *HighlightResult) Swap(i, j int) {
+	r.Docs[i], r.Docs[j] = r.Docs[j], r.Docs[i]
+	r.Highlights[i], r.Highlights[j] = r.Highlights[j], r.Highlights[i]
+}
+
+// Highlight 搜索并返回每个结果的标题及正文片段高亮, 未开启Highlight.Enabled时只有DocID
+func (s *DataServer) Highlight(request SearchRequest, response *HighlightResult) error {
+	model, err := index.ParseSearchModel(string(request.Model))
+	if err != nil {
+		return err
+	}
+	request.Model = model //转发及检索使用规范化的模型名
+	result := HighlightResult{}
+	for _, shard := range request.Sharding {
+		srh := s.searcher(shard)
+		if srh == nil {
+			continue
+		}
+		start := time.Now()
+		docs, highlights := srh.SearchWithHighlight(request.Query, request.Model)
+		shardSearchDuration.Since(start, strconv.Itoa(shard), "highlight")
+		if highlights == nil {
+			highlights = make([]search.Highlight, len(docs))
+			for i, doc := range docs {
+				highlights[i].DocID = doc.ID
+			}
+		}
+		result.Docs = append(result.Docs, docs...)
+		result.Highlights = append(result.Highlights, highlights...)
+	}
+	*response = result
+	return nil
+}
+
+// Reload 加载重新构建并发布的分片索引, response为重新加载的分片数
+func (s *DataServer) Reload(request string, response *int) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	n := 0
+	for shard, srh := range s.sharding {
+		if err := srh.Reload(); err != nil {
+			return fmt.Errorf("reload shard %d: %v", shard, err)
+		}
+		n++
+	}
+	*response = n
+	return nil
+}
+
+// CacheStats 本节点各分片的查询结果缓存及倒排表缓存(所有分片共享)的命中统计
+func (s *DataServer) CacheStats(request string, response *map[int]search.CacheStats) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stats := make(map[int]search.CacheStats, len(s.sharding))
+	for shard, srh := range s.sharding {
+		stats[shard] = srh.CacheStats()
+	}
+	*response = stats
+	return nil
+}
+
+type SnapshotRequest struct {
+	Dir      string //本节点上的快照目录, 每个分片保存到Dir/shard_N
+	Sharding []int  //为空时快照本节点所有分片
+}
+
+// Snapshot 保存分片快照, response为各分片的快照目录
+func (s *DataServer) Snapshot(request SnapshotRequest, response *[]string) error {
+	shards := request.Sharding
+	if len(shards) == 0 {
+		s.lock.RLock()
+		for shard := range s.sharding {
+			shards = append(shards, shard)
+		}
+		s.lock.RUnlock()
+		sort.Ints(shards)
+	}
+
+	dirs := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		srh := s.searcher(shard)
+		if srh == nil {
+			return fmt.Errorf("shard %d is not on this node", shard)
+		}
+		dir := filepath.Join(request.Dir, fmt.Sprintf("shard_%d", shard))
+		if _, err := srh.Snapshot(dir); err != nil {
+			return fmt.Errorf("snapshot shard %d: %v", shard, err)
+		}
+		dirs = append(dirs, dir)
+	}
+	*response = dirs
+	return nil
+}
+
+func (s *DataServer) searcher(shard int) *search.Searcher {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sharding[shard]
+}
+
 // Add 实时更新
-func (s *DataServer) Add(doc index.Document) {
-	shard := doc.ID % s.cluster.ShardingNum
-	srh := s.sharding[shard]
-	srh.Add(doc)
+func (s *DataServer) Add(doc index.Document) error {
+	_, err := s.write(OpAdd, doc)
+	return err
 }
 
 // Del 实时删除
-func (s *DataServer) Del(doc index.Document) {
+func (s *DataServer) Del(doc index.Document) error {
+	_, err := s.write(OpDel, doc)
+	return err
+}
+
+// Write called by SearchServer. 逐个写入文档并返回每个文档的结果
+func (s *DataServer) Write(request WriteRequest, response *[]WriteResult) error {
+	result := make([]WriteResult, 0, len(request.Docs))
+	for _, doc := range request.Docs {
+		r := WriteResult{ID: doc.ID}
+		seq, err := s.write(request.Type, doc)
+		if err != nil {
+			r.Error = err.Error()
+			_, r.NotLeader = err.(*notLeaderError)
+		}
+		r.Seq = seq
+		result = append(result, r)
+	}
+	*response = result
+	return nil
+}
+
+// write 主分片写入: 分配序列号并写入本地, 复制到备份分片, 收到AckReplicaNum个备份分片确认后返回
+// 确认数不足时返回错误, 但本地已写入的数据不会回滚, 落后的备份分片会通过catchUp追赶
+func (s *DataServer) write(typ OpType, doc index.Document) (int64, error) {
+	s.lock.RLock()
 	shard := doc.ID % s.cluster.ShardingNum
 	srh := s.sharding[shard]
-	srh.Del(doc)
+	oplog := s.oplogs[shard]
+	shardLock := s.shardLocks[shard]
+	followers := s.followers(shard)
+	s.lock.RUnlock()
+
+	if oplog == nil {
+		return 0, &notLeaderError{shard: shard, host: s.self.Host}
+	}
+	if typ != OpAdd && typ != OpDel && typ != OpUpdate {
+		return 0, fmt.Errorf("invalid op type %d", typ)
+	}
+
+	shardLock.Lock()
+	if s.handingOff(shard) {
+		shardLock.Unlock()
+		return 0, &notLeaderError{shard: shard, host: s.self.Host}
+	}
+	op := oplog.Append(shard, typ, doc)
+	apply(srh, op)
+	shardLock.Unlock()
+
+	required := util.IfElseInt(s.config.Cluster.AckReplicaNum < len(followers), s.config.Cluster.AckReplicaNum, len(followers))
+	if required <= 0 {
+		go s.replicate(op, followers, nil)
+		return op.Seq, nil
+	}
+
+	acks := make(chan error, len(followers))
+	go s.replicate(op, followers, acks)
+
+	acked, failed := 0, 0
+	for i := 0; i < len(followers); i++ {
+		if err := <-acks; err != nil {
+			log.Printf("replicate shard %d seq %d err: %s", shard, op.Seq, err.Error())
+			failed++
+		} else {
+			acked++
+		}
+		if acked >= required {
+			return op.Seq, nil
+		}
+		if len(followers)-failed < required {
+			break
+		}
+	}
+	return op.Seq, fmt.Errorf("shard %d seq %d acknowledged by %d replicas, required %d", shard, op.Seq, acked, required)
+}
+
+// notLeaderError 本节点不是分片的主分片, 写入未执行
+type notLeaderError struct {
+	shard int
+	host  string
+}
+
+func (e *notLeaderError) Error() string {
+	return fmt.Sprintf("shard %d is not led by %s", e.shard, e.host)
+}
+
+// followers returns hosts of all follower shard replicas, unsafe
+func (s *DataServer) followers(shard int) []string {
+	var hosts []string
+	for id, node := range s.cluster.DataNodeCorpus {
+		if id == s.self.ID {
+			continue
+		}
+		for _, x := range node.FollowerSharding {
+			if x == shard {
+				hosts = append(hosts, node.Host)
+			}
+		}
+	}
+	return hosts
+}
+
+// leaderOf returns host of the leader shard replica, unsafe
+func (s *DataServer) leaderOf(shard int) string {
+	for _, node := range s.cluster.DataNodeCorpus {
+		if containsInt(node.LeaderSharding, shard) {
+			return node.Host
+		}
+	}
+	return ""
+}
+
+// replicate 并发复制op到所有备份分片, 备份分片落后时从操作日志补齐缺失的操作
+func (s *DataServer) replicate(op Operation, followers []string, acks chan error) {
+	for _, host := range followers {
+		go func(host string) {
+			err := s.replicateTo(host, op)
+			if acks != nil {
+				acks <- err
+			}
+		}(host)
+	}
+}
+
+func (s *DataServer) replicateTo(host string, op Operation) error {
+	s.lock.RLock()
+	oplog := s.oplogs[op.Shard]
+	s.lock.RUnlock()
+	if oplog == nil {
+		return &notLeaderError{shard: op.Shard, host: s.self.Host}
+	}
+
+	ops := []Operation{op}
+	for i := 0; i < 3; i++ {
+		var resp ReplicateResponse
+		request := ReplicateRequest{Leader: s.self.Host, Epoch: oplog.Epoch, Shard: op.Shard, Ops: ops}
+		if err := RpcCall(host, "DataServer.Replicate", request, &resp); err != nil {
+			return err
+		}
+		if resp.Applied >= op.Seq {
+			return nil
+		}
+
+		//备份分片落后, 从其已应用的位置开始补齐
+		var err error
+		if ops, err = oplog.Since(resp.Applied); err != nil {
+			return err
+		}
+	}
+	return errors.New("follower can not catch up")
+}
+
+// Replicate called by leader shard. 按序列号顺序应用操作, 忽略已应用的操作, 遇到空洞时停止并返回已应用的序列号
+// 只接受路由中该分片主分片所在节点的复制请求, 避免过期的主分片覆盖数据
+func (s *DataServer) Replicate(request ReplicateRequest, response *ReplicateResponse) error {
+	s.lock.RLock()
+	srh := s.sharding[request.Shard]
+	shardLock := s.shardLocks[request.Shard]
+	follower := containsInt(s.self.FollowerSharding, request.Shard)
+	leader := s.leaderOf(request.Shard)
+	s.lock.RUnlock()
+	if srh == nil || !follower {
+		return fmt.Errorf("shard %d is not followed by %s", request.Shard, s.self.Host)
+	}
+	if leader != request.Leader {
+		return fmt.Errorf("reject replication of shard %d from %s, leader is %q", request.Shard, request.Leader, leader)
+	}
+
+	shardLock.Lock()
+	defer shardLock.Unlock()
+
+	s.lock.Lock()
+	if s.epochs[request.Shard] != request.Epoch {
+		s.epochs[request.Shard] = request.Epoch
+		s.applied[request.Shard] = 0
+	}
+	applied := s.applied[request.Shard]
+	s.lock.Unlock()
+	for _, op := range request.Ops {
+		if op.Seq <= applied {
+			continue
+		}
+		if op.Seq != applied+1 {
+			break
+		}
+		apply(srh, op)
+		applied = op.Seq
+	}
+
+	s.lock.Lock()
+	s.applied[request.Shard] = applied
+	s.lock.Unlock()
+
+	response.Applied = applied
+	return nil
+}
+
+// FetchOps called by follower shard to catch up. Epoch与操作日志不同时(如主分片重启)从头返回
+func (s *DataServer) FetchOps(request FetchOpsRequest, response *FetchOpsResponse) error {
+	s.lock.RLock()
+	oplog := s.oplogs[request.Shard]
+	s.lock.RUnlock()
+	if oplog == nil {
+		return &notLeaderError{shard: request.Shard, host: s.self.Host}
+	}
+
+	since := request.Since
+	if request.Epoch != oplog.Epoch {
+		since = 0
+	}
+	ops, err := oplog.Since(since)
+	if err != nil {
+		return err
+	}
+	*response = FetchOpsResponse{Epoch: oplog.Epoch, Ops: ops}
+	return nil
+}
+
+// catchUp 备份分片定时从主分片拉取操作日志, 补齐复制失败期间缺失的操作
+func (s *DataServer) catchUp() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.refreshCluster(); err != nil {
+			log.Printf("refresh cluster err: %s", err.Error())
+			continue
+		}
+
+		s.lock.RLock()
+		leaders, _ := s.cluster.RouteShardingNode(LeaderSharding)
+		shards := append([]int{}, s.self.FollowerSharding...)
+		s.lock.RUnlock()
+
+		for _, shard := range shards {
+			nodes := leaders[shard]
+			if len(nodes) == 0 {
+				continue
+			}
+
+			s.lock.RLock()
+			fetch := FetchOpsRequest{Shard: shard, Since: s.applied[shard], Epoch: s.epochs[shard]}
+			s.lock.RUnlock()
+
+			var ops FetchOpsResponse
+			if err := RpcCall(nodes[0].Host, "DataServer.FetchOps", fetch, &ops); err != nil {
+				log.Printf("fetch ops of shard %d from %s err: %s", shard, nodes[0].Host, err.Error())
+				continue
+			}
+			if len(ops.Ops) == 0 {
+				continue
+			}
+			var resp ReplicateResponse
+			request := ReplicateRequest{Leader: nodes[0].Host, Epoch: ops.Epoch, Shard: shard, Ops: ops.Ops}
+			if err := s.Replicate(request, &resp); err != nil {
+				log.Printf("apply ops of shard %d err: %s", shard, err.Error())
+			}
+		}
+	}
+}
+
+// heartbeat 定时向ManagerServer上报分片文档数, 分片分配变化时刷新路由
+func (s *DataServer) heartbeat() {
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.lock.RLock()
+		request := Heartbeat{ID: s.self.ID, Host: s.self.Host, DocNum: make(map[int]int)}
+		for shard, srh := range s.sharding {
+			request.DocNum[shard] = srh.Count()
+		}
+		self := s.self
+		s.lock.RUnlock()
+
+		var n Node
+		if err := s.manager.Call("ManagerServer.Heartbeat", request, &n); err != nil {
+			log.Printf("heartbeat err: %s", err.Error())
+			continue
+		}
+		if !sameInts(n.LeaderSharding, self.LeaderSharding) || !sameInts(n.FollowerSharding, self.FollowerSharding) {
+			if err := s.refreshCluster(); err != nil {
+				log.Printf("refresh cluster err: %s", err.Error())
+			}
+		}
+	}
+}
+
+func sameInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func apply(srh *search.Searcher, op Operation) {
+	switch op.Type {
+	case OpAdd:
+		srh.Add(op.Doc)
+	case OpDel:
+		srh.Del(op.Doc)
+	case OpUpdate:
+		srh.Update(op.Doc)
+	}
+	documentsApplied.Inc(strconv.Itoa(op.Shard), opNames[op.Type])
 }
 
 //KeepAlive todo: 备份分片与主分片保持心跳，一旦发现主分片宕机发起选举 or 请求ManageServer重新分配Leader
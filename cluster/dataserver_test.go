@@ -2,11 +2,15 @@ package cluster
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/awesomefly/easysearch/config"
 	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/search"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -52,3 +56,63 @@ func TestDataServer(t *testing.T) {
 
 	fmt.Printf("%+v\n", response)
 }
+
+func TestDataServerSearchModel(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "model")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{{ID: 1, Text: "donut on a glass plate"}})
+	full.Close()
+	ds := &DataServer{sharding: map[int]*search.Searcher{0: search.NewSearcher(filepath.Join(dir, "idx"))}}
+
+	//模型名大小写不敏感, 规范化后再检索
+	var docs []index.Doc
+	assert.Nil(t, ds.Search(SearchRequest{Query: "donut", Sharding: []int{0}, Model: "BM25"}, &docs))
+	assert.Equal(t, 1, len(docs))
+	var explains ExplainResult
+	assert.Nil(t, ds.Explain(SearchRequest{Query: "donut", Sharding: []int{0}, Model: " BM25+ "}, &explains))
+	assert.Equal(t, 1, len(explains.Docs))
+	var highlights HighlightResult
+	assert.Nil(t, ds.Highlight(SearchRequest{Query: "donut", Sharding: []int{0}, Model: "VS"}, &highlights))
+	assert.Equal(t, 1, len(highlights.Docs))
+
+	assert.NotNil(t, ds.Search(SearchRequest{Query: "donut", Sharding: []int{0}, Model: "unknown"}, &docs))
+}
+
+func TestDataServerLoadTexts(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "texts")
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "docs.jsonl")
+	ioutil.WriteFile(source, []byte(`{"id": 1, "text": "one"}
+{"id": 2, "text": "two"}
+{"id": 3, "text": "three"}
+{"id": 4, "text": "four"}
+`), 0644)
+	c := NewCluster(3, 1)
+	c.Add(Node{ID: "n1", Host: "127.0.0.1:8801", Type: DataNode, LeaderSharding: []int{1}})
+	ds := newReplicaServer(t, dir, "n1", c)
+	ds.config.Store.Source = config.Source{Type: index.JSONSource, Path: source}
+	ds.texts = search.NewMemoryStore()
+
+	//只加载本节点分片的文档
+	assert.Nil(t, ds.loadTexts([]int{1}))
+	assert.Equal(t, 2, ds.texts.Len())
+	_, ok := ds.texts.Get(4)
+	assert.True(t, ok)
+	_, ok = ds.texts.Get(2)
+	assert.False(t, ok)
+
+	//新分配的分片加载时不覆盖实时写入的文档
+	ds.texts.Put(index.Document{ID: 2, Text: "two v2"})
+	node := c.DataNodeCorpus["n1"]
+	node.FollowerSharding = []int{2}
+	ds.self = node
+	opened := ds.openShards()
+	assert.Equal(t, []int{2}, opened)
+	assert.Nil(t, ds.loadTexts(opened))
+	assert.Equal(t, 3, ds.texts.Len())
+	doc, _ := ds.texts.Get(2)
+	assert.Equal(t, "two v2", doc.Text)
+}
@@ -0,0 +1,69 @@
+package cluster
+
+import (
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/awesomefly/easysearch/config"
+)
+
+// ManagerClient 调用ManagerServer, 请求失败或被拒绝(非leader)时切换到其他ManagerServer
+type ManagerClient struct {
+	lock   sync.Mutex
+	addrs  []string
+	leader string
+}
+
+func NewManagerClient(addrs []string) *ManagerClient {
+	return &ManagerClient{addrs: addrs}
+}
+
+func managerAddresses(c config.Cluster) []string {
+	var addrs []string
+	for _, s := range c.Managers() {
+		addrs = append(addrs, s.Address())
+	}
+	return addrs
+}
+
+func (c *ManagerClient) Call(method string, request interface{}, response interface{}) error {
+	var err error
+	for round := 0; round < 3; round++ {
+		c.lock.Lock()
+		candidates := append([]string{}, c.addrs...)
+		if c.leader != "" {
+			candidates = append([]string{c.leader}, candidates...)
+		}
+		c.lock.Unlock()
+
+		tried := make(map[string]bool)
+		for len(candidates) > 0 {
+			addr := candidates[0]
+			candidates = candidates[1:]
+			if tried[addr] {
+				continue
+			}
+			tried[addr] = true
+
+			if err = RpcCall(addr, method, request, response); err == nil {
+				c.lock.Lock()
+				c.leader = addr
+				c.lock.Unlock()
+				return nil
+			}
+			if leader, ok := ParseNotLeader(err); ok {
+				if leader != "" {
+					candidates = append([]string{leader}, candidates...)
+				}
+				continue
+			}
+			if _, ok := err.(rpc.ServerError); ok {
+				return err //业务错误, 无需重试
+			}
+		}
+		//可能正在选举, 等待新leader产生
+		time.Sleep(electionTimeout)
+	}
+	return err
+}
@@ -1,9 +1,14 @@
 package cluster
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/awesomefly/easysearch/util"
 
@@ -12,19 +17,65 @@ import (
 	"github.com/awesomefly/easysearch/config"
 )
 
+type MetaCommandType int
+
+const (
+	CmdNoop MetaCommandType = iota
+	CmdAddNode
+	CmdDrainNode
+	CmdMoveShard
+	CmdPromoteShard
+	CmdSetReplicateNum
+)
+
+// MetaCommand 修改集群元数据的命令, 通过raft日志复制并持久化
+type MetaCommand struct {
+	Type  MetaCommandType
+	Node  Node
+	Admin AdminRequest
+}
+
+type heartbeatInfo struct {
+	time   time.Time
+	docNum map[int]int
+}
+
+type applyResult struct {
+	Node Node
+	Err  string
+}
+
 type ManagerServer struct {
+	lock    sync.RWMutex
 	cluster *Cluster
 	hash    *hashring.HashRing
 
+	heartbeats map[string]heartbeatInfo //node id -> 最近一次心跳
+
+	raft   *Raft
 	server *Server
 }
 
 func NewManagerServer(config *config.Config) *ManagerServer {
 	srv := &ManagerServer{
-		cluster: NewCluster(config.Cluster.ShardingNum, config.Cluster.ReplicateNum),
-		hash:    hashring.New(make([]string, 0)),
-		server:  &Server{name: "Manage", network: "tcp", address: config.Server.Address()},
+		cluster:    NewCluster(config.Cluster.ShardingNum, config.Cluster.ReplicateNum),
+		hash:       hashring.New(make([]string, 0)),
+		heartbeats: make(map[string]heartbeatInfo),
+		server:     newServer("Manage", config),
+	}
+
+	self := config.Server.Address()
+	peers := []string{self}
+	if len(config.Cluster.ManageServers) > 0 {
+		peers = managerAddresses(config.Cluster)
 	}
+	storage := NewRaftStorage(config.Store.DataDir, "manager_"+strings.NewReplacer(":", "_", "/", "_").Replace(self))
+	r, err := NewRaft(self, peers, storage, &managerFSM{m: srv}, newRpcTransport())
+	if err != nil {
+		panic(err)
+	}
+	srv.raft = r
+	r.Start()
 	return srv
 }
 
@@ -32,6 +83,9 @@ func (m *ManagerServer) Run() {
 	if err := m.server.RegisterName("ManagerServer", m); err != nil {
 		panic(err)
 	}
+	if err := m.server.RegisterName("Raft", m.raft); err != nil {
+		panic(err)
+	}
 	if err := m.server.Run(); err != nil {
 		panic(err)
 	}
@@ -41,29 +95,73 @@ func (m *ManagerServer) Run() {
 func (m *ManagerServer) AddServer(request Node, response *Node) error {
 	log.Print("AddServer from ", request.Host)
 
-	m.cluster.Add(request)
-	if request.Type == DataNode {
-		m.hash = m.hash.AddNode(request.Host)
-		if err := m.ReBalance(); err != nil {
-			return err
-		}
+	result, err := m.raft.Propose(MetaCommand{Type: CmdAddNode, Node: request})
+	if err != nil {
+		return err
+	}
+	r := result.(applyResult)
+	if r.Err != "" {
+		return errors.New(r.Err)
+	}
 
-		go func() {
-			//todo:使用channel通知分片信息有变化的节点
-		}()
+	go func() {
+		//todo:使用channel通知分片信息有变化的节点
+	}()
 
-		*response = m.cluster.DataNodeCorpus[request.Host]
-	}
+	*response = r.Node
 	return nil
 }
 
 // GetCluster called by DataServer
 func (m *ManagerServer) GetCluster(request string, response *Cluster) error {
 	log.Print("GetCluster from ", request)
-	*response = *m.cluster
+	if state, leader := m.raft.State(); state != Leader {
+		return &NotLeaderError{Leader: leader}
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	*response = *m.cluster.Clone()
 	return nil
 }
 
+// addNode 注册节点, unsafe
+// 相同ID的数据节点重新注册时只更新地址, 保留原有分片, 不触发ReBalance
+func (m *ManagerServer) addNode(node Node) (Node, error) {
+	if node.ID == "" {
+		node.ID = node.Host //兼容未携带ID的节点
+	}
+	if node.Type == DataNode {
+		if old, ok := m.cluster.DataNodeCorpus[node.ID]; ok {
+			old.Host = node.Host
+			m.cluster.DataNodeCorpus[node.ID] = old
+			return old, nil
+		}
+	}
+
+	if err := m.cluster.Add(node); err != nil {
+		log.Printf("add node %s err: %s", node.Host, err.Error())
+		return node, nil
+	}
+	if node.Type == DataNode {
+		//地址被新节点占用, 说明旧节点已不存在(如数据目录被清空)
+		for id, n := range m.cluster.DataNodeCorpus {
+			if id != node.ID && n.Host == node.Host {
+				delete(m.cluster.DataNodeCorpus, id)
+				m.hash = m.hash.RemoveNode(id)
+			}
+		}
+
+		m.hash = m.hash.AddNode(node.ID)
+		if err := m.ReBalance(); err != nil {
+			return node, err
+		}
+		node = m.cluster.DataNodeCorpus[node.ID]
+	}
+	return node, nil
+}
+
+// ReBalance unsafe
 func (m *ManagerServer) ReBalance() error {
 	for k, node := range m.cluster.DataNodeCorpus {
 		node.LeaderSharding = make([]int, 0)
@@ -71,7 +169,8 @@ func (m *ManagerServer) ReBalance() error {
 		m.cluster.DataNodeCorpus[k] = node
 	}
 
-	size := util.IfElseInt(len(m.cluster.DataNodeCorpus) < m.cluster.ReplicateNum, len(m.cluster.DataNodeCorpus), m.cluster.ReplicateNum)
+	active := m.activeNodeNum()
+	size := util.IfElseInt(active < m.cluster.ReplicateNum, active, m.cluster.ReplicateNum)
 	for i := 0; i < m.cluster.ShardingNum; i++ {
 		nodes, ok := m.hash.GetNodes(fmt.Sprint(i), size)
 		if !ok {
@@ -80,16 +179,89 @@ func (m *ManagerServer) ReBalance() error {
 		if len(nodes) < size {
 			return errors.New("unexpected nodes size err. ")
 		}
+		if pinned, ok := m.cluster.Pinned[i]; ok {
+			nodes = m.placement(pinned, nodes, size)
+		}
 
 		n := m.cluster.DataNodeCorpus[nodes[0]]
 		n.LeaderSharding = append(n.LeaderSharding, i)
-		m.cluster.DataNodeCorpus[n.Host] = n
+		m.cluster.DataNodeCorpus[n.ID] = n
 		for _, k := range nodes[1:] {
 			n = m.cluster.DataNodeCorpus[k]
 			n.FollowerSharding = append(n.FollowerSharding, i)
-			m.cluster.DataNodeCorpus[n.Host] = n
+			m.cluster.DataNodeCorpus[n.ID] = n
 		}
 
 	}
 	return nil
 }
+
+// managerFSM 将raft已提交的命令应用到ManagerServer的元数据
+type managerFSM struct {
+	m *ManagerServer
+}
+
+func (f *managerFSM) Apply(cmd MetaCommand) interface{} {
+	f.m.lock.Lock()
+	defer f.m.lock.Unlock()
+
+	var result applyResult
+	switch cmd.Type {
+	case CmdNoop:
+	case CmdAddNode:
+		node, err := f.m.addNode(cmd.Node)
+		result.Node = node
+		if err != nil {
+			result.Err = err.Error()
+		}
+	case CmdDrainNode, CmdMoveShard, CmdPromoteShard, CmdSetReplicateNum:
+		if err := f.m.applyAdmin(cmd); err != nil {
+			result.Err = err.Error()
+		}
+	default:
+		result.Err = fmt.Sprintf("unknown command type %d", cmd.Type)
+	}
+	return result
+}
+
+// applyAdmin unsafe
+func (m *ManagerServer) applyAdmin(cmd MetaCommand) error {
+	switch cmd.Type {
+	case CmdDrainNode:
+		return m.drainNode(cmd.Admin.NodeID)
+	case CmdMoveShard:
+		return m.moveShard(cmd.Admin.Shard, cmd.Admin.From, cmd.Admin.To)
+	case CmdPromoteShard:
+		return m.promoteShard(cmd.Admin.Shard, cmd.Admin.NodeID)
+	case CmdSetReplicateNum:
+		return m.setReplicateNum(cmd.Admin.Num)
+	}
+	return nil
+}
+
+func (f *managerFSM) Snapshot() ([]byte, error) {
+	f.m.lock.RLock()
+	defer f.m.lock.RUnlock()
+	return json.Marshal(f.m.cluster)
+}
+
+func (f *managerFSM) Restore(data []byte) error {
+	c := NewCluster(0, 0)
+	if err := json.Unmarshal(data, c); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(c.DataNodeCorpus))
+	for id, node := range c.DataNodeCorpus {
+		if !node.Draining {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	f.m.lock.Lock()
+	defer f.m.lock.Unlock()
+	f.m.cluster = c
+	f.m.hash = hashring.New(ids)
+	return nil
+}
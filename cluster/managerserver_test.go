@@ -2,8 +2,10 @@ package cluster
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/rpc"
+	"os"
 	"runtime"
 	"testing"
 	"time"
@@ -80,3 +82,158 @@ func TestManageServer(t *testing.T) {
 	assert.Equal(t, nil, addServer("127.0.0.1:8804"))
 	assert.Equal(t, nil, getCluster())
 }
+
+func TestManagerServerPersistence(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "manager")
+	defer os.RemoveAll(dir)
+
+	conf := config.Config{
+		Store:  config.Storage{DataDir: dir},
+		Server: config.Server{Host: "127.0.0.1", Port: 1290},
+		Cluster: config.Cluster{
+			ShardingNum:  4,
+			ReplicateNum: 2,
+		},
+	}
+	server := NewManagerServer(&conf)
+	var n1, n2 Node
+	assert.Nil(t, server.AddServer(Node{Host: "127.0.0.1:8801", Type: DataNode}, &n1))
+	assert.Nil(t, server.AddServer(Node{Host: "127.0.0.1:8802", Type: DataNode}, &n2))
+
+	var before Cluster
+	assert.Nil(t, server.GetCluster("test", &before))
+	server.raft.Stop()
+
+	//重启后从日志恢复节点与分片分配
+	server = NewManagerServer(&conf)
+	defer server.raft.Stop()
+	var after Cluster
+	assert.Nil(t, server.GetCluster("test", &after))
+	assert.Equal(t, 2, len(after.DataNodeCorpus))
+	assert.Equal(t, before.DataNodeCorpus, after.DataNodeCorpus)
+}
+
+func TestManagerServerRejoin(t *testing.T) {
+	conf := config.Config{
+		Server: config.Server{Host: "127.0.0.1", Port: 1291},
+		Cluster: config.Cluster{
+			ShardingNum:  6,
+			ReplicateNum: 2,
+		},
+	}
+	server := NewManagerServer(&conf)
+	defer server.raft.Stop()
+
+	var n1, n2, n3 Node
+	assert.Nil(t, server.AddServer(Node{ID: "n1", Host: "127.0.0.1:8801", Type: DataNode}, &n1))
+	assert.Nil(t, server.AddServer(Node{ID: "n2", Host: "127.0.0.1:8802", Type: DataNode}, &n2))
+	assert.Nil(t, server.AddServer(Node{ID: "n3", Host: "127.0.0.1:8803", Type: DataNode}, &n3))
+
+	var before Cluster
+	assert.Nil(t, server.GetCluster("test", &before))
+
+	//相同ID重新加入(地址变化)保留原有分片
+	var rejoin Node
+	assert.Nil(t, server.AddServer(Node{ID: "n2", Host: "127.0.0.1:9802", Type: DataNode}, &rejoin))
+	assert.Equal(t, before.DataNodeCorpus["n2"].LeaderSharding, rejoin.LeaderSharding)
+	assert.Equal(t, before.DataNodeCorpus["n2"].FollowerSharding, rejoin.FollowerSharding)
+	assert.Equal(t, "127.0.0.1:9802", rejoin.Host)
+
+	var after Cluster
+	assert.Nil(t, server.GetCluster("test", &after))
+	assert.Equal(t, 3, len(after.DataNodeCorpus))
+	assert.Equal(t, before.DataNodeCorpus["n1"], after.DataNodeCorpus["n1"])
+	assert.Equal(t, before.DataNodeCorpus["n3"], after.DataNodeCorpus["n3"])
+}
+
+func TestManagerServerAdmin(t *testing.T) {
+	conf := config.Config{
+		Server: config.Server{Host: "127.0.0.1", Port: 1292},
+		Cluster: config.Cluster{
+			ShardingNum:  4,
+			ReplicateNum: 2,
+		},
+	}
+	server := NewManagerServer(&conf)
+	defer server.raft.Stop()
+
+	fakes := make(map[string]*fakeDataServer)
+	for _, id := range []string{"n1", "n2", "n3"} {
+		fakes[id] = &fakeDataServer{}
+		var n Node
+		assert.Nil(t, server.AddServer(Node{ID: id, Host: serveFake(t, "DataServer", fakes[id]), Type: DataNode}, &n))
+	}
+	assert.Nil(t, server.Heartbeat(Heartbeat{ID: "n1", DocNum: map[int]int{0: 10, 1: 11, 2: 12, 3: 13}}, &Node{}))
+
+	var status ClusterStatus
+	assert.Nil(t, server.Status("test", &status))
+	assert.Equal(t, 3, len(status.Nodes))
+	assert.Equal(t, 4, len(status.Shards))
+	for _, sh := range status.Shards {
+		assert.NotEmpty(t, sh.Leader)
+		assert.Equal(t, 1, len(sh.Followers))
+		if sh.Leader == "n1" {
+			assert.Equal(t, 10+sh.Shard, sh.DocNum)
+		}
+	}
+
+	//提升备份分片
+	shard0 := status.Shards[0]
+	var c Cluster
+	assert.Nil(t, server.PromoteShard(AdminRequest{Shard: 0, NodeID: shard0.Followers[0]}, &c))
+	assert.Contains(t, c.DataNodeCorpus[shard0.Followers[0]].LeaderSharding, 0)
+	assert.Contains(t, c.DataNodeCorpus[shard0.Leader].FollowerSharding, 0)
+	assert.NotNil(t, server.PromoteShard(AdminRequest{Shard: 0, NodeID: "unknown"}, &c))
+
+	//迁移分片到没有该分片的节点
+	var target string
+	for id, n := range c.DataNodeCorpus {
+		if !containsInt(n.LeaderSharding, 1) && !containsInt(n.FollowerSharding, 1) {
+			target = id
+		}
+	}
+	assert.Nil(t, server.Status("test", &status))
+	fakes[target].fail = true
+	assert.NotNil(t, server.MoveShard(AdminRequest{Shard: 1, From: status.Shards[1].Leader, To: target}, &c))
+	assert.NotContains(t, c.DataNodeCorpus[target].LeaderSharding, 1)
+	fakes[target].fail = false
+	assert.Nil(t, server.MoveShard(AdminRequest{Shard: 1, From: status.Shards[1].Leader, To: target}, &c))
+	assert.Contains(t, c.DataNodeCorpus[target].LeaderSharding, 1)
+	//切换路由前从主分片拷贝, 主分片在前
+	assert.Equal(t, 1, len(fakes[target].installs))
+	install := fakes[target].installs[0]
+	assert.Equal(t, 1, install.Shard)
+	assert.True(t, install.Leader)
+	assert.Equal(t, c.DataNodeCorpus[status.Shards[1].Leader].Host, install.From[0])
+
+	//手动调整的分片在ReBalance后保留
+	assert.Nil(t, server.SetReplicateNum(AdminRequest{Num: 2}, &c))
+	assert.Contains(t, c.DataNodeCorpus[target].LeaderSharding, 1)
+	assert.Contains(t, c.DataNodeCorpus[shard0.Followers[0]].LeaderSharding, 0)
+	assert.Equal(t, 1, len(fakes[target].installs))
+
+	//下线节点后其分片拷贝到其他节点并重新分配
+	before := c.Clone()
+	installs := map[string]int{"n2": len(fakes["n2"].installs), "n3": len(fakes["n3"].installs)}
+	assert.Nil(t, server.DrainNode(AdminRequest{NodeID: "n1"}, &c))
+	assert.True(t, c.DataNodeCorpus["n1"].Draining)
+	assert.Empty(t, c.DataNodeCorpus["n1"].LeaderSharding)
+	assert.Empty(t, c.DataNodeCorpus["n1"].FollowerSharding)
+	for id := range installs {
+		old, n := before.DataNodeCorpus[id], c.DataNodeCorpus[id]
+		added := 0
+		for _, shard := range append(append([]int{}, n.LeaderSharding...), n.FollowerSharding...) {
+			if !containsInt(old.LeaderSharding, shard) && !containsInt(old.FollowerSharding, shard) {
+				added++
+			}
+		}
+		assert.Equal(t, added, len(fakes[id].installs)-installs[id])
+	}
+	assert.Nil(t, server.DrainNode(AdminRequest{NodeID: "n2"}, &c))
+	assert.NotNil(t, server.DrainNode(AdminRequest{NodeID: "n3"}, &c))
+
+	assert.Nil(t, server.SetReplicateNum(AdminRequest{Num: 1}, &c))
+	assert.Equal(t, 1, c.ReplicateNum)
+	assert.Equal(t, 4, len(c.DataNodeCorpus["n3"].LeaderSharding))
+	assert.NotNil(t, server.SetReplicateNum(AdminRequest{Num: 0}, &c))
+}
@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"strconv"
+
+	"github.com/awesomefly/easysearch/metrics"
+	"github.com/awesomefly/easysearch/search"
+	"github.com/awesomefly/easysearch/util"
+)
+
+var (
+	rpcRequests = metrics.Default.Counter("easysearch_rpc_requests_total",
+		"RPC requests handled by the node.", "server", "method", "status")
+	rpcDuration = metrics.Default.Histogram("easysearch_rpc_duration_seconds",
+		"RPC handling latency in seconds.", nil, "server", "method")
+	shardSearchDuration = metrics.Default.Histogram("easysearch_shard_search_duration_seconds",
+		"Search time of one shard on a data node in seconds.", nil, "shard", "type")
+	documentsApplied = metrics.Default.Counter("easysearch_documents_applied_total",
+		"Document writes applied to local shards.", "shard", "op")
+)
+
+var opNames = map[OpType]string{OpAdd: "add", OpDel: "delete", OpUpdate: "update"}
+
+// registerMetrics 注册抓取时计算的分片状态指标: 增量索引队列长度、各层级索引段数及大小、缓存命中
+func (s *DataServer) registerMetrics() {
+	shards := func(fn func(shard string, st shardState)) {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		for shard, srh := range s.sharding {
+			fn(strconv.Itoa(shard), shardState{queue: srh.QueueDepth(), stats: srh.Stats(), cache: srh.CacheStats()})
+		}
+	}
+
+	metrics.Default.GaugeFunc("easysearch_incr_queue_depth", "Documents waiting in the incremental index double buffer.",
+		[]string{"shard"}, func(emit func(float64, ...string)) {
+			shards(func(shard string, st shardState) {
+				emit(float64(st.queue), shard)
+			})
+		})
+
+	tier := func(name string, help string, value func(search.TierStats) float64) {
+		metrics.Default.GaugeFunc(name, help, []string{"shard", "tier"}, func(emit func(float64, ...string)) {
+			shards(func(shard string, st shardState) {
+				for _, t := range st.stats {
+					emit(value(t), shard, t.Tier)
+				}
+			})
+		})
+	}
+	tier("easysearch_segments", "Index segments per tier.", func(t search.TierStats) float64 { return float64(t.Segments) })
+	tier("easysearch_segment_documents", "Documents indexed per tier.", func(t search.TierStats) float64 { return float64(t.Docs) })
+	tier("easysearch_segment_bytes", "Index size per tier in bytes, estimated memory for the incremental tier.",
+		func(t search.TierStats) float64 { return float64(t.Bytes) })
+
+	//倒排表缓存所有分片共享, shard为all
+	caches := func(fn func(shard string, cache string, stats util.CacheStats)) {
+		shards(func(shard string, st shardState) {
+			fn(shard, "results", st.cache.Results)
+		})
+		if s.postings != nil {
+			fn("all", "postings", s.postings.Stats())
+		}
+	}
+	cache := func(name string, help string, counter bool, value func(util.CacheStats) float64) {
+		fn := func(emit func(float64, ...string)) {
+			caches(func(shard string, cache string, stats util.CacheStats) {
+				emit(value(stats), shard, cache)
+			})
+		}
+		if counter {
+			metrics.Default.CounterFunc(name, help, []string{"shard", "cache"}, fn)
+		} else {
+			metrics.Default.GaugeFunc(name, help, []string{"shard", "cache"}, fn)
+		}
+	}
+	cache("easysearch_cache_hits_total", "Cache hits.", true, func(c util.CacheStats) float64 { return float64(c.Hits) })
+	cache("easysearch_cache_misses_total", "Cache misses.", true, func(c util.CacheStats) float64 { return float64(c.Misses) })
+	cache("easysearch_cache_evictions_total", "Cache evictions.", true, func(c util.CacheStats) float64 { return float64(c.Evictions) })
+	cache("easysearch_cache_entries", "Cached entries.", false, func(c util.CacheStats) float64 { return float64(c.Entries) })
+	cache("easysearch_cache_hit_ratio", "Cache hits / (hits + misses) since start.", false, util.CacheStats.HitRate)
+}
+
+type shardState struct {
+	queue int
+	stats []search.TierStats
+	cache search.CacheStats
+}
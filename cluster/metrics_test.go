@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/metrics"
+	"github.com/awesomefly/easysearch/search"
+)
+
+type echo struct{}
+
+func (e *echo) Say(request string, response *string) error {
+	if request == "" {
+		return errors.New("empty request")
+	}
+	*response = request
+	return nil
+}
+
+func TestMetricsCodec(t *testing.T) {
+	server := rpc.NewServer()
+	assert.Nil(t, server.RegisterName("Echo", &echo{}))
+	c1, c2 := net.Pipe()
+	go server.ServeCodec(newMetricsCodec("test", serviceMethods("Echo", &echo{}), c1))
+	client := rpc.NewClient(c2)
+	defer client.Close()
+
+	var resp string
+	assert.Nil(t, client.Call("Echo.Say", "hi", &resp))
+	assert.Equal(t, "hi", resp)
+	assert.Nil(t, client.Call("Echo.Say", "hi", &resp))
+	assert.NotNil(t, client.Call("Echo.Say", "", &resp))
+	//不存在的方法不作为标签
+	assert.NotNil(t, client.Call("Echo.Bogus1", "hi", &resp))
+	assert.NotNil(t, client.Call("Bogus.Say", "hi", &resp))
+
+	assert.Equal(t, 2.0, rpcRequests.Value("test", "Echo.Say", "ok"))
+	assert.Equal(t, 1.0, rpcRequests.Value("test", "Echo.Say", "error"))
+	assert.Equal(t, uint64(3), rpcDuration.Count("test", "Echo.Say"))
+	assert.Equal(t, 2.0, rpcRequests.Value("test", "unknown", "error"))
+	assert.Equal(t, 0.0, rpcRequests.Value("test", "Echo.Bogus1", "error"))
+}
+
+func TestDataServerMetrics(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "metrics")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{{ID: 1, Text: "donut on a glass plate"}})
+	full.Close()
+
+	postings := index.NewPostingCache(1)
+	srh := search.NewSearcher(filepath.Join(dir, "idx")).WithResultCache(10).WithPostingCache(postings)
+	srh.Search("donut")
+	srh.Search("donut")
+
+	s := &DataServer{sharding: map[int]*search.Searcher{3: srh}, postings: postings}
+	s.registerMetrics()
+
+	var buf bytes.Buffer
+	assert.Nil(t, metrics.Default.Write(&buf))
+	out := buf.String()
+	assert.Contains(t, out, "easysearch_incr_queue_depth{shard=\"3\"} 0\n")
+	assert.Contains(t, out, "easysearch_segments{shard=\"3\",tier=\"full\"} 1\n")
+	assert.Contains(t, out, "easysearch_segment_documents{shard=\"3\",tier=\"full\"} 1\n")
+	assert.Contains(t, out, "easysearch_cache_hits_total{shard=\"3\",cache=\"results\"} 1\n")
+	assert.Contains(t, out, "easysearch_cache_hit_ratio{shard=\"3\",cache=\"results\"} 0.5\n")
+	assert.Contains(t, out, "easysearch_cache_entries{shard=\"all\",cache=\"postings\"}")
+}
@@ -0,0 +1,333 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/awesomefly/easysearch/search"
+)
+
+const (
+	handoffTimeout = time.Minute //迁移主分片时源节点拒绝写入的最长时间, 超时后路由仍未切换则恢复写入
+	snapshotTTL    = time.Hour   //源节点保留未释放的分片快照的最长时间
+	chunkSize      = 4 << 20     //下载快照文件时每次请求的字节数
+	maxChunkSize   = 64 << 20
+)
+
+// ShardFile 分片快照中的一个文件
+type ShardFile struct {
+	Name string
+	Size int64
+}
+
+// ShardChunkRequest 读取分片快照ID中文件Name从Offset开始的Length字节
+type ShardChunkRequest struct {
+	ID     string
+	Name   string
+	Offset int64
+	Length int
+}
+
+// migration 源节点上等待目标节点下载的分片快照
+type migration struct {
+	dir     string
+	created time.Time
+}
+
+type FetchShardRequest struct {
+	Shard   int
+	Handoff bool //迁移主分片: 源节点在快照前停止写入, 直到路由切换或超时
+}
+
+// ShardSnapshot 分片快照及其对应的操作序列号, 目标节点作为备份分片时从Seq开始追赶
+type ShardSnapshot struct {
+	ID    string //源节点上的快照, 用于分块下载和释放
+	Files []ShardFile
+	Seq   int64
+	Epoch string //Seq所属的主分片操作日志
+}
+
+type InstallShardRequest struct {
+	Shard  int
+	From   []string //依次尝试的源节点, 第一个为当前主分片
+	Leader bool     //目标节点将成为主分片
+}
+
+// migrate 在集群元数据的拷贝上预演cmd, 将新分配给节点的分片从现有节点拷贝过去
+func (m *ManagerServer) migrate(cmd MetaCommand) error {
+	if state, leader := m.raft.State(); state != Leader {
+		return &NotLeaderError{Leader: leader}
+	}
+
+	m.lock.RLock()
+	old := m.cluster.Clone()
+	plan := &ManagerServer{cluster: m.cluster.Clone(), hash: m.hash}
+	m.lock.RUnlock()
+	if err := plan.applyAdmin(cmd); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(plan.cluster.DataNodeCorpus))
+	for id := range plan.cluster.DataNodeCorpus {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		node, before := plan.cluster.DataNodeCorpus[id], old.DataNodeCorpus[id]
+		for _, shards := range [][]int{node.LeaderSharding, node.FollowerSharding} {
+			for _, shard := range shards {
+				if containsInt(before.LeaderSharding, shard) || containsInt(before.FollowerSharding, shard) {
+					continue
+				}
+				request := InstallShardRequest{
+					Shard:  shard,
+					From:   shardHosts(old, shard),
+					Leader: containsInt(node.LeaderSharding, shard),
+				}
+				var docs int
+				if err := RpcCall(node.Host, "DataServer.InstallShard", request, &docs); err != nil {
+					return fmt.Errorf("install shard %d on %s: %v", shard, id, err)
+				}
+				log.Printf("installed shard %d on %s, %d docs", shard, id, docs)
+			}
+		}
+	}
+	return nil
+}
+
+// shardHosts 分片所在节点的地址, 主分片在前
+func shardHosts(c *Cluster, shard int) []string {
+	var leader, followers []string
+	for _, node := range c.DataNodeCorpus {
+		if containsInt(node.LeaderSharding, shard) {
+			leader = append(leader, node.Host)
+		} else if containsInt(node.FollowerSharding, shard) {
+			followers = append(followers, node.Host)
+		}
+	}
+	sort.Strings(followers)
+	return append(leader, followers...)
+}
+
+// FetchShard called by DataServer installing the shard. 保存分片快照并返回快照中的文件列表,
+// 文件由FetchShardChunk分块读取, 目标节点下载完成后调用ReleaseShard删除快照
+func (s *DataServer) FetchShard(request FetchShardRequest, response *ShardSnapshot) error {
+	s.expireMigrations()
+
+	s.lock.Lock()
+	srh := s.sharding[request.Shard]
+	shardLock := s.shardLocks[request.Shard]
+	if srh != nil && request.Handoff && s.oplogs[request.Shard] != nil {
+		s.handoffs[request.Shard] = time.Now().Add(handoffTimeout)
+	}
+	s.lock.Unlock()
+	if srh == nil {
+		return fmt.Errorf("shard %d is not on %s", request.Shard, s.self.Host)
+	}
+
+	//持有分片锁保证快照与序列号一致, 获取各层索引后即释放, 保存快照文件时不阻塞写入和复制
+	var once sync.Once
+	unlock := func() { once.Do(shardLock.Unlock) }
+	shardLock.Lock()
+	defer unlock()
+
+	s.lock.RLock()
+	snapshot := ShardSnapshot{Seq: s.applied[request.Shard], Epoch: s.epochs[request.Shard]}
+	if oplog := s.oplogs[request.Shard]; oplog != nil {
+		snapshot.Seq, snapshot.Epoch = oplog.LastSeq(), oplog.Epoch
+	}
+	s.lock.RUnlock()
+
+	tmp, err := ioutil.TempDir(filepath.Dir(s.config.Store.IndexFile), "migrate")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(tmp, fmt.Sprintf("shard_%d", request.Shard))
+	if _, err = srh.SnapshotWith(dir, unlock); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	for _, info := range infos {
+		snapshot.Files = append(snapshot.Files, ShardFile{Name: info.Name(), Size: info.Size()})
+	}
+	snapshot.ID = filepath.Base(tmp)
+
+	s.lock.Lock()
+	s.migrations[snapshot.ID] = migration{dir: dir, created: time.Now()}
+	s.lock.Unlock()
+	*response = snapshot
+	return nil
+}
+
+// FetchShardChunk 读取分片快照中文件从Offset开始的最多Length字节, 到达文件末尾时返回的数据较短
+func (s *DataServer) FetchShardChunk(request ShardChunkRequest, response *[]byte) error {
+	s.lock.RLock()
+	m, ok := s.migrations[request.ID]
+	s.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("shard snapshot %s not found", request.ID)
+	}
+	if request.Name != filepath.Base(request.Name) || request.Offset < 0 || request.Length <= 0 || request.Length > maxChunkSize {
+		return fmt.Errorf("invalid chunk %s[%d:+%d]", request.Name, request.Offset, request.Length)
+	}
+
+	fd, err := os.Open(filepath.Join(m.dir, request.Name))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	buf := make([]byte, request.Length)
+	n, err := fd.ReadAt(buf, request.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	*response = buf[:n]
+	return nil
+}
+
+// ReleaseShard 目标节点下载完成或放弃后删除分片快照, response为快照是否存在
+func (s *DataServer) ReleaseShard(id string, response *bool) error {
+	s.lock.Lock()
+	m, ok := s.migrations[id]
+	delete(s.migrations, id)
+	s.lock.Unlock()
+	if ok {
+		os.RemoveAll(filepath.Dir(m.dir))
+	}
+	*response = ok
+	return nil
+}
+
+// expireMigrations 删除超过snapshotTTL仍未释放的分片快照, 如目标节点下载中宕机
+func (s *DataServer) expireMigrations() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, m := range s.migrations {
+		if time.Since(m.created) > snapshotTTL {
+			os.RemoveAll(filepath.Dir(m.dir))
+			delete(s.migrations, id)
+		}
+	}
+}
+
+// InstallShard called by ManagerServer before routing the shard to this node.
+// 从源节点拉取分片快照并恢复为本地索引, response为恢复后的文档数
+func (s *DataServer) InstallShard(request InstallShardRequest, response *int) error {
+	file := fmt.Sprintf("%s.%d", s.config.Store.IndexFile, request.Shard)
+	dir := file + ".install"
+	defer os.RemoveAll(dir)
+
+	var snapshot ShardSnapshot
+	err := errors.New("no source node")
+	for i, host := range request.From {
+		fetch := FetchShardRequest{Shard: request.Shard, Handoff: request.Leader && i == 0}
+		if err = downloadShard(host, fetch, dir, &snapshot); err == nil {
+			break
+		}
+		log.Printf("fetch shard %d from %s err: %s", request.Shard, host, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if err = search.Restore(dir, file); err != nil {
+		return err
+	}
+
+	//本节点尚未路由到该分片, 直接替换Searcher
+	srh := s.newSearcher(request.Shard)
+	s.lock.Lock()
+	old := s.sharding[request.Shard]
+	s.sharding[request.Shard] = srh
+	if s.shardLocks[request.Shard] == nil {
+		s.shardLocks[request.Shard] = &sync.Mutex{}
+	}
+	if !request.Leader && snapshot.Epoch != "" {
+		s.epochs[request.Shard] = snapshot.Epoch
+		s.applied[request.Shard] = snapshot.Seq
+	}
+	s.lock.Unlock()
+	if old != nil {
+		old.Close() //进行中的查询结束后删除旧索引
+	}
+	*response = srh.Count()
+	return nil
+}
+
+// downloadShard 在host上保存分片快照并分块下载到dir, 完成或失败后释放源节点上的快照
+func downloadShard(host string, request FetchShardRequest, dir string, snapshot *ShardSnapshot) error {
+	*snapshot = ShardSnapshot{}
+	if err := RpcCall(host, "DataServer.FetchShard", request, snapshot); err != nil {
+		return err
+	}
+	defer func() {
+		var released bool
+		if err := RpcCall(host, "DataServer.ReleaseShard", snapshot.ID, &released); err != nil {
+			log.Printf("release shard snapshot %s on %s err: %s", snapshot.ID, host, err.Error())
+		}
+	}()
+
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	client, err := rpc.Dial("tcp", host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	for _, f := range snapshot.Files {
+		if err = downloadFile(client, snapshot.ID, f, filepath.Join(dir, f.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadFile 按chunkSize分块下载快照中的文件, 不逐块打印响应
+func downloadFile(client *rpc.Client, id string, f ShardFile, dst string) error {
+	if f.Name != filepath.Base(f.Name) {
+		return fmt.Errorf("invalid snapshot file %s", f.Name)
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	for offset := int64(0); offset < f.Size; {
+		var chunk []byte
+		request := ShardChunkRequest{ID: id, Name: f.Name, Offset: offset, Length: chunkSize}
+		if err = client.Call("DataServer.FetchShardChunk", request, &chunk); err == nil && len(chunk) == 0 {
+			err = fmt.Errorf("%s truncated at %d of %d bytes", f.Name, offset, f.Size)
+		}
+		if err == nil {
+			_, err = out.Write(chunk)
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+		offset += int64(len(chunk))
+	}
+	return out.Close()
+}
+
+// handingOff 分片正在迁移主分片, 拒绝写入
+func (s *DataServer) handingOff(shard int) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	deadline, ok := s.handoffs[shard]
+	return ok && time.Now().Before(deadline)
+}
@@ -0,0 +1,101 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/search"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstallShard(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migration")
+	defer os.RemoveAll(dir)
+
+	ll := listenData(t)
+	c := NewCluster(1, 1)
+	c.Add(Node{ID: "l1", Host: ll.Addr().String(), Type: DataNode, LeaderSharding: []int{0}})
+	c.Add(Node{ID: "n2", Host: "127.0.0.1:8802", Type: DataNode})
+	c.Add(Node{ID: "n3", Host: "127.0.0.1:8803", Type: DataNode})
+	leader := newReplicaServer(t, dir, "l1", c)
+	serveData(t, ll, leader)
+	for _, doc := range []index.Document{{ID: 1, Text: "donut on a glass plate"}, {ID: 2, Text: "only the donuts"}} {
+		_, err := leader.write(OpAdd, doc)
+		assert.Nil(t, err)
+	}
+
+	//作为备份分片安装, 从快照对应的序列号开始追赶
+	follower := newReplicaServer(t, dir, "n2", c)
+	follower.pipeline, _ = search.NewPipeline(config.Ranking{})
+	var docs int
+	assert.Nil(t, follower.InstallShard(InstallShardRequest{Shard: 0, From: []string{"127.0.0.1:1", ll.Addr().String()}}, &docs))
+	assert.Equal(t, 2, docs)
+	assert.Equal(t, 2, len(follower.searcher(0).Search("donut")))
+	assert.Equal(t, int64(2), follower.applied[0])
+	assert.Equal(t, leader.oplogs[0].Epoch, follower.epochs[0])
+	_, err := leader.write(OpAdd, index.Document{ID: 3, Text: "glass"})
+	assert.Nil(t, err)
+
+	//作为主分片安装, 源节点在路由切换前拒绝写入
+	target := newReplicaServer(t, dir, "n3", c)
+	assert.Nil(t, target.InstallShard(InstallShardRequest{Shard: 0, From: []string{ll.Addr().String()}, Leader: true}, &docs))
+	assert.Equal(t, 3, docs)
+	_, err = leader.write(OpAdd, index.Document{ID: 4, Text: "glass"})
+	_, ok := err.(*notLeaderError)
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), leader.oplogs[0].LastSeq())
+	assert.Equal(t, 0, len(leader.migrations)) //下载完成后释放快照
+
+	assert.NotNil(t, target.InstallShard(InstallShardRequest{Shard: 1, From: []string{ll.Addr().String()}}, &docs))
+	assert.NotNil(t, target.InstallShard(InstallShardRequest{Shard: 0}, &docs))
+}
+
+func TestFetchShardChunk(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "migration")
+	defer os.RemoveAll(dir)
+
+	c := NewCluster(1, 1)
+	c.Add(Node{ID: "l1", Host: "127.0.0.1:8801", Type: DataNode, LeaderSharding: []int{0}})
+	leader := newReplicaServer(t, dir, "l1", c)
+	_, err := leader.write(OpAdd, index.Document{ID: 1, Text: "donut on a glass plate"})
+	assert.Nil(t, err)
+
+	var snapshot ShardSnapshot
+	assert.Nil(t, leader.FetchShard(FetchShardRequest{Shard: 0}, &snapshot))
+	assert.NotEqual(t, "", snapshot.ID)
+	assert.True(t, len(snapshot.Files) > 0)
+	_, err = leader.write(OpAdd, index.Document{ID: 2, Text: "glass"}) //获取快照后不再阻塞写入
+	assert.Nil(t, err)
+
+	//分块读取的内容与快照文件一致
+	src := leader.migrations[snapshot.ID].dir
+	for _, f := range snapshot.Files {
+		var data []byte
+		for offset := int64(0); offset < f.Size; {
+			var chunk []byte
+			assert.Nil(t, leader.FetchShardChunk(ShardChunkRequest{ID: snapshot.ID, Name: f.Name, Offset: offset, Length: 3}, &chunk))
+			assert.True(t, len(chunk) > 0 && len(chunk) <= 3)
+			data = append(data, chunk...)
+			offset += int64(len(chunk))
+		}
+		expect, _ := ioutil.ReadFile(filepath.Join(src, f.Name))
+		assert.Equal(t, string(expect), string(data), f.Name)
+	}
+
+	var chunk []byte
+	assert.NotNil(t, leader.FetchShardChunk(ShardChunkRequest{ID: snapshot.ID, Name: "../shard_0", Length: 3}, &chunk))
+	assert.NotNil(t, leader.FetchShardChunk(ShardChunkRequest{ID: snapshot.ID, Name: snapshot.Files[0].Name, Length: 0}, &chunk))
+
+	var released bool
+	assert.Nil(t, leader.ReleaseShard(snapshot.ID, &released))
+	assert.True(t, released)
+	_, err = os.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+	assert.NotNil(t, leader.FetchShardChunk(ShardChunkRequest{ID: snapshot.ID, Name: snapshot.Files[0].Name, Length: 3}, &chunk))
+	assert.Nil(t, leader.ReleaseShard(snapshot.ID, &released))
+	assert.False(t, released)
+}
@@ -0,0 +1,711 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RaftState int
+
+const (
+	Follower RaftState = iota
+	Candidate
+	Leader
+)
+
+const (
+	heartbeatInterval  = 100 * time.Millisecond
+	electionTimeout    = 500 * time.Millisecond
+	proposeTimeout     = 5 * time.Second
+	snapshotThreshold  = 1024 //日志条数超过阈值时生成快照并压缩日志
+	notLeaderErrPrefix = "raft: not leader, leader="
+)
+
+// NotLeaderError 非leader节点拒绝写入, Leader为已知的leader地址(可能为空)
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	return notLeaderErrPrefix + e.Leader
+}
+
+// ParseNotLeader 从RPC错误中解析leader地址, 非NotLeaderError时ok为false
+func ParseNotLeader(err error) (leader string, ok bool) {
+	if err == nil || !strings.HasPrefix(err.Error(), notLeaderErrPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(err.Error(), notLeaderErrPrefix), true
+}
+
+type LogEntry struct {
+	Index   int64
+	Term    int64
+	Command MetaCommand
+}
+
+// FSM raft状态机, 已提交的日志按顺序Apply
+type FSM interface {
+	Apply(cmd MetaCommand) interface{}
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// RaftTransport 发送raft RPC, 方便测试时替换网络
+type RaftTransport interface {
+	Call(peer string, method string, request interface{}, response interface{}) error
+}
+
+type RequestVoteArgs struct {
+	Term         int64
+	Candidate    string
+	LastLogIndex int64
+	LastLogTerm  int64
+}
+
+type RequestVoteReply struct {
+	Term        int64
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         int64
+	Leader       string
+	PrevLogIndex int64
+	PrevLogTerm  int64
+	Entries      []LogEntry
+	LeaderCommit int64
+}
+
+type AppendEntriesReply struct {
+	Term      int64
+	Success   bool
+	LastIndex int64 //失败时follower的最后一条日志, 用于快速回退nextIndex
+}
+
+type InstallSnapshotArgs struct {
+	Term     int64
+	Leader   string
+	Snapshot RaftSnapshot
+}
+
+type InstallSnapshotReply struct {
+	Term int64
+}
+
+type proposal struct {
+	term int64
+	ch   chan interface{}
+}
+
+// Raft 简化的raft实现, 用于ManagerServer元数据复制. peers包含自身, 只有一个节点时启动即成为leader
+type Raft struct {
+	lock  sync.Mutex
+	self  string
+	peers []string
+
+	state       RaftState
+	leader      string
+	currentTerm int64
+	votedFor    string
+
+	log           []LogEntry //快照之后的日志
+	snapshotIndex int64
+	snapshotTerm  int64
+	commitIndex   int64
+	lastApplied   int64
+
+	nextIndex  map[string]int64
+	matchIndex map[string]int64
+	proposals  map[int64]proposal
+
+	lastContact time.Time
+	timeout     time.Duration
+
+	storage   *RaftStorage
+	fsm       FSM
+	transport RaftTransport
+	stopCh    chan struct{}
+}
+
+func NewRaft(self string, peers []string, storage *RaftStorage, fsm FSM, transport RaftTransport) (*Raft, error) {
+	r := &Raft{
+		self:      self,
+		peers:     peers,
+		state:     Follower,
+		storage:   storage,
+		fsm:       fsm,
+		transport: transport,
+		proposals: make(map[int64]proposal),
+		stopCh:    make(chan struct{}),
+	}
+
+	hs, snapshot, entries, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	r.currentTerm, r.votedFor = hs.Term, hs.VotedFor
+	if snapshot != nil {
+		if err = fsm.Restore(snapshot.Data); err != nil {
+			return nil, err
+		}
+		r.snapshotIndex, r.snapshotTerm = snapshot.Index, snapshot.Term
+		r.commitIndex, r.lastApplied = snapshot.Index, snapshot.Index
+	}
+	r.log = entries
+
+	if len(peers) <= 1 {
+		//单节点: 本地日志都已提交
+		r.commitIndex = r.lastIndex()
+		r.applyCommitted()
+	}
+	return r, nil
+}
+
+func (r *Raft) Start() {
+	r.lock.Lock()
+	r.resetTimeout()
+	if len(r.peers) <= 1 {
+		r.startElection()
+	}
+	r.lock.Unlock()
+
+	go r.run()
+}
+
+func (r *Raft) Stop() {
+	close(r.stopCh)
+	r.storage.Close()
+}
+
+func (r *Raft) run() {
+	ticker := time.NewTicker(heartbeatInterval / 2)
+	defer ticker.Stop()
+
+	lastHeartbeat := time.Now()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		r.lock.Lock()
+		switch r.state {
+		case Leader:
+			if time.Since(lastHeartbeat) >= heartbeatInterval {
+				lastHeartbeat = time.Now()
+				r.broadcast()
+			}
+		default:
+			if time.Since(r.lastContact) >= r.timeout {
+				r.startElection()
+			}
+		}
+		r.lock.Unlock()
+	}
+}
+
+// State returns current state and known leader
+func (r *Raft) State() (RaftState, string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state, r.leader
+}
+
+// Propose 提交命令并等待其被应用到状态机, 返回状态机Apply的结果
+func (r *Raft) Propose(cmd MetaCommand) (interface{}, error) {
+	r.lock.Lock()
+	if r.state != Leader {
+		leader := r.leader
+		r.lock.Unlock()
+		return nil, &NotLeaderError{Leader: leader}
+	}
+
+	entry := LogEntry{Index: r.lastIndex() + 1, Term: r.currentTerm, Command: cmd}
+	if err := r.storage.Append(entry); err != nil {
+		r.lock.Unlock()
+		return nil, err
+	}
+	r.log = append(r.log, entry)
+	r.matchIndex[r.self] = entry.Index
+
+	ch := make(chan interface{}, 1)
+	r.proposals[entry.Index] = proposal{term: entry.Term, ch: ch}
+	r.advanceCommit()
+	r.broadcast()
+	r.lock.Unlock()
+
+	select {
+	case result := <-ch:
+		if err, ok := result.(error); ok {
+			return nil, err
+		}
+		return result, nil
+	case <-time.After(proposeTimeout):
+		return nil, errors.New("raft: propose timeout")
+	}
+}
+
+// unsafe functions below must be called with lock held
+
+func (r *Raft) lastIndex() int64 {
+	if len(r.log) == 0 {
+		return r.snapshotIndex
+	}
+	return r.log[len(r.log)-1].Index
+}
+
+func (r *Raft) lastTerm() int64 {
+	if len(r.log) == 0 {
+		return r.snapshotTerm
+	}
+	return r.log[len(r.log)-1].Term
+}
+
+// termAt returns -1 if the entry has been compacted or not exists
+func (r *Raft) termAt(index int64) int64 {
+	if index == r.snapshotIndex {
+		return r.snapshotTerm
+	}
+	if index < r.snapshotIndex || index > r.lastIndex() {
+		return -1
+	}
+	return r.log[index-r.snapshotIndex-1].Term
+}
+
+func (r *Raft) entriesFrom(index int64) []LogEntry {
+	if index > r.lastIndex() {
+		return nil
+	}
+	return append([]LogEntry{}, r.log[index-r.snapshotIndex-1:]...)
+}
+
+func (r *Raft) hardState() HardState {
+	return HardState{Term: r.currentTerm, VotedFor: r.votedFor}
+}
+
+func (r *Raft) persistHardState() {
+	if err := r.storage.SaveHardState(r.hardState()); err != nil {
+		log.Printf("raft persist hard state err: %s", err.Error())
+	}
+}
+
+func (r *Raft) resetTimeout() {
+	r.lastContact = time.Now()
+	r.timeout = electionTimeout + time.Duration(rand.Int63n(int64(electionTimeout)))
+}
+
+func (r *Raft) becomeFollower(term int64, leader string) {
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+		r.persistHardState()
+	}
+	if r.state == Leader {
+		log.Printf("raft %s step down at term %d", r.self, r.currentTerm)
+	}
+	r.state = Follower
+	r.leader = leader
+}
+
+func (r *Raft) startElection() {
+	r.state = Candidate
+	r.currentTerm++
+	r.votedFor = r.self
+	r.leader = ""
+	r.persistHardState()
+	r.resetTimeout()
+
+	term := r.currentTerm
+	args := RequestVoteArgs{Term: term, Candidate: r.self, LastLogIndex: r.lastIndex(), LastLogTerm: r.lastTerm()}
+	votes := 1
+	if votes > len(r.peers)/2 {
+		r.becomeLeader()
+		return
+	}
+
+	for _, peer := range r.peers {
+		if peer == r.self {
+			continue
+		}
+		go func(peer string) {
+			var reply RequestVoteReply
+			if err := r.transport.Call(peer, "Raft.RequestVote", args, &reply); err != nil {
+				return
+			}
+
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if reply.Term > r.currentTerm {
+				r.becomeFollower(reply.Term, "")
+				return
+			}
+			if r.state != Candidate || r.currentTerm != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes > len(r.peers)/2 {
+				r.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+func (r *Raft) becomeLeader() {
+	log.Printf("raft %s become leader at term %d", r.self, r.currentTerm)
+	r.state = Leader
+	r.leader = r.self
+	r.nextIndex = make(map[string]int64)
+	r.matchIndex = make(map[string]int64)
+	for _, peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+		r.matchIndex[peer] = 0
+	}
+
+	//提交一条当前任期的空日志, 使之前任期的日志得以提交
+	entry := LogEntry{Index: r.lastIndex() + 1, Term: r.currentTerm, Command: MetaCommand{Type: CmdNoop}}
+	if err := r.storage.Append(entry); err != nil {
+		log.Printf("raft append err: %s", err.Error())
+	}
+	r.log = append(r.log, entry)
+	r.matchIndex[r.self] = entry.Index
+	r.advanceCommit()
+	r.broadcast()
+}
+
+func (r *Raft) broadcast() {
+	for _, peer := range r.peers {
+		if peer != r.self {
+			go r.replicate(peer)
+		}
+	}
+}
+
+func (r *Raft) replicate(peer string) {
+	r.lock.Lock()
+	if r.state != Leader {
+		r.lock.Unlock()
+		return
+	}
+	term := r.currentTerm
+	next := r.nextIndex[peer]
+	if next <= r.snapshotIndex {
+		r.lock.Unlock()
+		r.sendSnapshot(peer, term)
+		return
+	}
+	args := AppendEntriesArgs{
+		Term:         term,
+		Leader:       r.self,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.termAt(next - 1),
+		Entries:      r.entriesFrom(next),
+		LeaderCommit: r.commitIndex,
+	}
+	r.lock.Unlock()
+
+	var reply AppendEntriesReply
+	if err := r.transport.Call(peer, "Raft.AppendEntries", args, &reply); err != nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if reply.Term > r.currentTerm {
+		r.becomeFollower(reply.Term, "")
+		return
+	}
+	if r.state != Leader || r.currentTerm != term {
+		return
+	}
+	if reply.Success {
+		match := args.PrevLogIndex + int64(len(args.Entries))
+		if match > r.matchIndex[peer] {
+			r.matchIndex[peer] = match
+			r.nextIndex[peer] = match + 1
+		}
+		r.advanceCommit()
+	} else {
+		next = args.PrevLogIndex
+		if reply.LastIndex+1 < next {
+			next = reply.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		r.nextIndex[peer] = next
+	}
+}
+
+func (r *Raft) sendSnapshot(peer string, term int64) {
+	//状态机只在持有锁时Apply, 加锁保证快照与lastApplied一致
+	r.lock.Lock()
+	data, err := r.fsm.Snapshot()
+	if err != nil {
+		r.lock.Unlock()
+		log.Printf("raft snapshot err: %s", err.Error())
+		return
+	}
+	args := InstallSnapshotArgs{
+		Term:     term,
+		Leader:   r.self,
+		Snapshot: RaftSnapshot{Index: r.lastApplied, Term: r.termAt(r.lastApplied), Data: data},
+	}
+	r.lock.Unlock()
+
+	var reply InstallSnapshotReply
+	if err = r.transport.Call(peer, "Raft.InstallSnapshot", args, &reply); err != nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if reply.Term > r.currentTerm {
+		r.becomeFollower(reply.Term, "")
+		return
+	}
+	if r.state == Leader && r.currentTerm == term {
+		r.matchIndex[peer] = args.Snapshot.Index
+		r.nextIndex[peer] = args.Snapshot.Index + 1
+	}
+}
+
+// advanceCommit 多数节点已复制的当前任期日志可以提交
+func (r *Raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		if r.termAt(n) != r.currentTerm {
+			break
+		}
+		count := 0
+		for _, peer := range r.peers {
+			if r.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count > len(r.peers)/2 {
+			r.commitIndex = n
+			break
+		}
+	}
+	r.applyCommitted()
+}
+
+func (r *Raft) applyCommitted() {
+	for r.lastApplied < r.commitIndex {
+		r.lastApplied++
+		entry := r.log[r.lastApplied-r.snapshotIndex-1]
+		result := r.fsm.Apply(entry.Command)
+
+		if p, ok := r.proposals[entry.Index]; ok {
+			delete(r.proposals, entry.Index)
+			if p.term != entry.Term {
+				result = errors.New("raft: proposal overwritten by new leader")
+			}
+			p.ch <- result
+		}
+	}
+	r.compact()
+}
+
+// compact 日志过多时生成快照并丢弃已应用的日志
+func (r *Raft) compact() {
+	if r.lastApplied-r.snapshotIndex < snapshotThreshold {
+		return
+	}
+	data, err := r.fsm.Snapshot()
+	if err != nil {
+		log.Printf("raft snapshot err: %s", err.Error())
+		return
+	}
+	snapshot := RaftSnapshot{Index: r.lastApplied, Term: r.termAt(r.lastApplied), Data: data}
+	if err = r.storage.SaveSnapshot(snapshot); err != nil {
+		log.Printf("raft save snapshot err: %s", err.Error())
+		return
+	}
+	r.log = r.entriesFrom(r.lastApplied + 1)
+	r.snapshotIndex, r.snapshotTerm = snapshot.Index, snapshot.Term
+	if err = r.storage.Rewrite(r.hardState(), r.log); err != nil {
+		log.Printf("raft rewrite log err: %s", err.Error())
+	}
+}
+
+// RequestVote called by candidate
+func (r *Raft) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if args.Term > r.currentTerm {
+		r.becomeFollower(args.Term, "")
+	}
+	reply.Term = r.currentTerm
+	if args.Term < r.currentTerm {
+		return nil
+	}
+
+	upToDate := args.LastLogTerm > r.lastTerm() ||
+		(args.LastLogTerm == r.lastTerm() && args.LastLogIndex >= r.lastIndex())
+	if (r.votedFor == "" || r.votedFor == args.Candidate) && upToDate {
+		r.votedFor = args.Candidate
+		r.persistHardState()
+		r.resetTimeout()
+		reply.VoteGranted = true
+	}
+	return nil
+}
+
+// AppendEntries called by leader
+func (r *Raft) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	reply.Term = r.currentTerm
+	if args.Term < r.currentTerm {
+		return nil
+	}
+	r.becomeFollower(args.Term, args.Leader)
+	r.resetTimeout()
+	reply.Term = r.currentTerm
+
+	if args.PrevLogIndex > r.lastIndex() {
+		reply.LastIndex = r.lastIndex()
+		return nil
+	}
+	if args.PrevLogIndex >= r.snapshotIndex && r.termAt(args.PrevLogIndex) != args.PrevLogTerm {
+		reply.LastIndex = args.PrevLogIndex - 1
+		return nil
+	}
+
+	truncated := false
+	for i, entry := range args.Entries {
+		if entry.Index <= r.snapshotIndex {
+			continue
+		}
+		if entry.Index <= r.lastIndex() {
+			if r.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			//日志冲突, 删除冲突位置之后的日志
+			r.log = r.log[:entry.Index-r.snapshotIndex-1]
+			truncated = true
+		}
+
+		entries := args.Entries[i:]
+		r.log = append(r.log, entries...)
+		var err error
+		if truncated {
+			err = r.storage.Rewrite(r.hardState(), r.log)
+		} else {
+			err = r.storage.Append(entries...)
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	reply.Success = true
+	if args.LeaderCommit > r.commitIndex {
+		r.commitIndex = args.LeaderCommit
+		if last := r.lastIndex(); last < r.commitIndex {
+			r.commitIndex = last
+		}
+		r.applyCommitted()
+	}
+	return nil
+}
+
+// InstallSnapshot called by leader when follower lags behind compacted log
+func (r *Raft) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	reply.Term = r.currentTerm
+	if args.Term < r.currentTerm {
+		return nil
+	}
+	r.becomeFollower(args.Term, args.Leader)
+	r.resetTimeout()
+	reply.Term = r.currentTerm
+
+	snapshot := args.Snapshot
+	if snapshot.Index <= r.lastApplied {
+		return nil
+	}
+	if err := r.fsm.Restore(snapshot.Data); err != nil {
+		return err
+	}
+	if err := r.storage.SaveSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	if r.termAt(snapshot.Index) == snapshot.Term {
+		r.log = r.entriesFrom(snapshot.Index + 1)
+	} else {
+		r.log = nil
+	}
+	r.snapshotIndex, r.snapshotTerm = snapshot.Index, snapshot.Term
+	r.lastApplied = snapshot.Index
+	if r.commitIndex < snapshot.Index {
+		r.commitIndex = snapshot.Index
+	}
+	return r.storage.Rewrite(r.hardState(), r.log)
+}
+
+// rpcTransport 复用到每个peer的连接, 连接出错时重连
+type rpcTransport struct {
+	lock    sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+func newRpcTransport() *rpcTransport {
+	return &rpcTransport{clients: make(map[string]*rpc.Client)}
+}
+
+func (t *rpcTransport) Call(peer string, method string, request interface{}, response interface{}) error {
+	t.lock.Lock()
+	client := t.clients[peer]
+	t.lock.Unlock()
+
+	if client == nil {
+		var err error
+		if client, err = rpc.Dial("tcp", peer); err != nil {
+			return err
+		}
+		t.lock.Lock()
+		t.clients[peer] = client
+		t.lock.Unlock()
+	}
+
+	call := client.Go(method, request, response, make(chan *rpc.Call, 1))
+	var err error
+	timeout := false
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(heartbeatInterval * 3):
+		err = fmt.Errorf("call %s of %s timeout", method, peer)
+		timeout = true
+	}
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); !ok {
+			t.lock.Lock()
+			if t.clients[peer] == client {
+				delete(t.clients, peer)
+			}
+			t.lock.Unlock()
+			client.Close()
+		}
+	}
+	if timeout {
+		//关闭连接后未完成的调用会结束, 等待net/rpc不再写入response后再返回
+		<-call.Done
+	}
+	return err
+}
@@ -0,0 +1,209 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memTransport struct {
+	lock  sync.Mutex
+	nodes map[string]*Raft
+	down  map[string]bool
+}
+
+// nodeTransport 模拟节点宕机: 宕机节点既收不到也发不出请求
+type nodeTransport struct {
+	*memTransport
+	from string
+}
+
+func (t *nodeTransport) Call(peer string, method string, request interface{}, response interface{}) error {
+	t.lock.Lock()
+	r := t.nodes[peer]
+	down := t.down[peer] || t.down[t.from]
+	t.lock.Unlock()
+	if r == nil || down {
+		return errors.New("unreachable")
+	}
+
+	switch method {
+	case "Raft.RequestVote":
+		return r.RequestVote(request.(RequestVoteArgs), response.(*RequestVoteReply))
+	case "Raft.AppendEntries":
+		return r.AppendEntries(request.(AppendEntriesArgs), response.(*AppendEntriesReply))
+	case "Raft.InstallSnapshot":
+		return r.InstallSnapshot(request.(InstallSnapshotArgs), response.(*InstallSnapshotReply))
+	}
+	return errors.New("unknown method")
+}
+
+type listFSM struct {
+	lock  sync.Mutex
+	hosts []string
+}
+
+func (f *listFSM) Apply(cmd MetaCommand) interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if cmd.Type == CmdAddNode {
+		f.hosts = append(f.hosts, cmd.Node.Host)
+	}
+	return len(f.hosts)
+}
+
+func (f *listFSM) Snapshot() ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return json.Marshal(f.hosts)
+}
+
+func (f *listFSM) Restore(data []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return json.Unmarshal(data, &f.hosts)
+}
+
+func (f *listFSM) Hosts() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.hosts...)
+}
+
+func waitLeader(t *testing.T, nodes map[string]*Raft, down map[string]bool) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for peer, r := range nodes {
+			if state, _ := r.State(); state == Leader && !down[peer] {
+				return peer
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return ""
+}
+
+func TestRaftStorage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raft")
+	defer os.RemoveAll(dir)
+
+	s := NewRaftStorage(dir, "test")
+	_, _, _, err := s.Load()
+	assert.Nil(t, err)
+	assert.Nil(t, s.SaveHardState(HardState{Term: 2, VotedFor: "a"}))
+	assert.Nil(t, s.Append(LogEntry{Index: 1, Term: 1}, LogEntry{Index: 2, Term: 2}))
+	assert.Nil(t, s.Append(LogEntry{Index: 2, Term: 3})) //覆盖冲突日志
+	s.Close()
+
+	//模拟写入一半时进程崩溃
+	fd, _ := os.OpenFile(s.logFile(), os.O_APPEND|os.O_WRONLY, 0660)
+	fd.Write([]byte{100, 0, 0, 0, 1})
+	fd.Close()
+
+	s = NewRaftStorage(dir, "test")
+	hs, snapshot, entries, err := s.Load()
+	assert.Nil(t, err)
+	assert.Nil(t, snapshot)
+	assert.Equal(t, HardState{Term: 2, VotedFor: "a"}, hs)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, int64(3), entries[1].Term)
+
+	assert.Nil(t, s.SaveSnapshot(RaftSnapshot{Index: 1, Term: 1, Data: []byte("{}")}))
+	assert.Nil(t, s.Rewrite(hs, entries[1:]))
+	s.Close()
+
+	s = NewRaftStorage(dir, "test")
+	_, snapshot, entries, err = s.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), snapshot.Index)
+	assert.Equal(t, 1, len(entries))
+	s.Close()
+}
+
+func TestRaftElectionAndReplication(t *testing.T) {
+	peers := []string{"m1", "m2", "m3"}
+	transport := &memTransport{nodes: make(map[string]*Raft), down: make(map[string]bool)}
+	fsms := make(map[string]*listFSM)
+	for _, peer := range peers {
+		fsms[peer] = &listFSM{}
+		r, err := NewRaft(peer, peers, NewRaftStorage("", peer), fsms[peer], &nodeTransport{transport, peer})
+		assert.Nil(t, err)
+		transport.nodes[peer] = r
+	}
+	for _, r := range transport.nodes {
+		r.Start()
+		defer r.Stop()
+	}
+
+	leader := waitLeader(t, transport.nodes, transport.down)
+	result, err := transport.nodes[leader].Propose(MetaCommand{Type: CmdAddNode, Node: Node{Host: "h1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result)
+
+	for _, peer := range peers {
+		if peer == leader {
+			continue
+		}
+		_, err = transport.nodes[peer].Propose(MetaCommand{Type: CmdAddNode, Node: Node{Host: "x"}})
+		_, ok := ParseNotLeader(err)
+		assert.True(t, ok)
+	}
+
+	//leader宕机后重新选举, 已提交的日志不丢失
+	transport.lock.Lock()
+	transport.down[leader] = true
+	transport.lock.Unlock()
+	time.Sleep(2 * electionTimeout)
+
+	newLeader := waitLeader(t, transport.nodes, transport.down)
+	assert.NotEqual(t, leader, newLeader)
+	result, err = transport.nodes[newLeader].Propose(MetaCommand{Type: CmdAddNode, Node: Node{Host: "h2"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, result)
+
+	//旧leader恢复后追上新日志
+	transport.lock.Lock()
+	transport.down[leader] = false
+	transport.lock.Unlock()
+	time.Sleep(4 * heartbeatInterval)
+	for _, peer := range peers {
+		assert.Equal(t, []string{"h1", "h2"}, fsms[peer].Hosts())
+	}
+}
+
+type slowPeer struct{}
+
+func (p *slowPeer) Vote(request int, response *int) error {
+	time.Sleep(heartbeatInterval * 5)
+	*response = request
+	return nil
+}
+
+func TestRpcTransportTimeout(t *testing.T) {
+	server := rpc.NewServer()
+	assert.Nil(t, server.RegisterName("Raft", &slowPeer{}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	go server.Accept(l)
+
+	transport := newRpcTransport()
+	response := 0
+	err = transport.Call(l.Addr().String(), "Raft.Vote", 1, &response)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "timeout")
+	//超时返回后response不再被写入
+	response = 2
+	time.Sleep(heartbeatInterval * 3)
+	assert.Equal(t, 2, response)
+	assert.Equal(t, 0, len(transport.clients))
+}
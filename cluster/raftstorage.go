@@ -0,0 +1,233 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// raftRecord 日志文件中的一条记录, HardState与Entry二选一
+type raftRecord struct {
+	HardState *HardState `json:",omitempty"`
+	Entry     *LogEntry  `json:",omitempty"`
+}
+
+type HardState struct {
+	Term     int64
+	VotedFor string
+}
+
+type RaftSnapshot struct {
+	Index int64
+	Term  int64
+	Data  []byte
+}
+
+// RaftStorage 持久化raft状态: name.log追加写入HardState与日志, name.snapshot保存状态机快照
+// 每条记录格式为 |length(4B)|crc32(4B)|json|, 进程崩溃导致的不完整记录在加载时被截断
+// dir为空时只保存在内存中
+type RaftStorage struct {
+	dir  string
+	name string
+	fd   *os.File
+}
+
+func NewRaftStorage(dir, name string) *RaftStorage {
+	return &RaftStorage{dir: dir, name: name}
+}
+
+func (s *RaftStorage) logFile() string {
+	return filepath.Join(s.dir, s.name+".log")
+}
+
+func (s *RaftStorage) snapshotFile() string {
+	return filepath.Join(s.dir, s.name+".snapshot")
+}
+
+// Load returns persisted hard state, snapshot and log entries after snapshot
+func (s *RaftStorage) Load() (HardState, *RaftSnapshot, []LogEntry, error) {
+	var hs HardState
+	var entries []LogEntry
+	if s.dir == "" {
+		return hs, nil, entries, nil
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return hs, nil, nil, err
+	}
+
+	var snapshot *RaftSnapshot
+	if data, err := ioutil.ReadFile(s.snapshotFile()); err == nil {
+		snapshot = &RaftSnapshot{}
+		if err = json.Unmarshal(data, snapshot); err != nil {
+			return hs, nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return hs, nil, nil, err
+	}
+
+	fd, err := os.OpenFile(s.logFile(), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return hs, nil, nil, err
+	}
+
+	var offset int64
+	reader := bufio.NewReader(fd)
+	for {
+		rec, n, err := readRecord(reader)
+		if err != nil {
+			break //EOF or torn write
+		}
+		offset += n
+		if rec.HardState != nil {
+			hs = *rec.HardState
+		}
+		if e := rec.Entry; e != nil {
+			if snapshot != nil && e.Index <= snapshot.Index {
+				continue
+			}
+			//日志冲突时后写入的记录覆盖之前的记录
+			for len(entries) > 0 && entries[len(entries)-1].Index >= e.Index {
+				entries = entries[:len(entries)-1]
+			}
+			entries = append(entries, *e)
+		}
+	}
+	if err = fd.Truncate(offset); err != nil {
+		fd.Close()
+		return hs, nil, nil, err
+	}
+	if _, err = fd.Seek(offset, io.SeekStart); err != nil {
+		fd.Close()
+		return hs, nil, nil, err
+	}
+	s.fd = fd
+	return hs, snapshot, entries, nil
+}
+
+func (s *RaftStorage) SaveHardState(hs HardState) error {
+	return s.append(raftRecord{HardState: &hs})
+}
+
+func (s *RaftStorage) Append(entries ...LogEntry) error {
+	for i := range entries {
+		if err := s.append(raftRecord{Entry: &entries[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrite 日志冲突截断或快照压缩后, 用当前状态重写日志文件
+func (s *RaftStorage) Rewrite(hs HardState, entries []LogEntry) error {
+	if s.dir == "" {
+		return nil
+	}
+	tmp := s.logFile() + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(fd)
+	if err = writeRecord(writer, raftRecord{HardState: &hs}); err != nil {
+		fd.Close()
+		return err
+	}
+	for i := range entries {
+		if err = writeRecord(writer, raftRecord{Entry: &entries[i]}); err != nil {
+			fd.Close()
+			return err
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		fd.Close()
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	if err = os.Rename(tmp, s.logFile()); err != nil {
+		fd.Close()
+		return err
+	}
+	if s.fd != nil {
+		s.fd.Close()
+	}
+	s.fd = fd
+	return nil
+}
+
+func (s *RaftStorage) SaveSnapshot(snapshot RaftSnapshot) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp := s.snapshotFile() + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.snapshotFile())
+}
+
+func (s *RaftStorage) Close() error {
+	if s.fd != nil {
+		return s.fd.Close()
+	}
+	return nil
+}
+
+func (s *RaftStorage) append(rec raftRecord) error {
+	if s.dir == "" {
+		return nil
+	}
+	if s.fd == nil {
+		return errors.New("raft storage not loaded")
+	}
+	if err := writeRecord(s.fd, rec); err != nil {
+		return err
+	}
+	return s.fd.Sync()
+}
+
+func writeRecord(w io.Writer, rec raftRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(data))
+	if _, err = w.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readRecord(r io.Reader) (*raftRecord, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.New("raft record checksum mismatch")
+	}
+
+	rec := &raftRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, 0, err
+	}
+	return rec, int64(len(header) + len(data)), nil
+}
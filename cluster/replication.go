@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/util"
+)
+
+type OpType int
+
+const (
+	OpAdd OpType = iota + 1
+	OpDel
+	OpUpdate
+)
+
+// DefaultOpLogSize 每个主分片在内存中保留的最大操作数，落后更多的备份分片无法追赶
+const DefaultOpLogSize = 100000
+
+var ErrOpLogTruncated = errors.New("oplog truncated, follower lags too far behind")
+
+// Operation 主分片分配了序列号的一次写操作
+type Operation struct {
+	Seq   int64
+	Shard int
+	Type  OpType
+	Doc   index.Document
+}
+
+// OpLog 主分片的操作日志, 序列号从1开始连续递增.
+// 主分片重启或重新成为主分片时新建日志, 序列号重新开始, 备份分片按Epoch区分
+type OpLog struct {
+	Epoch string
+
+	lock     sync.RWMutex
+	ops      []Operation //环形缓冲, 写满前按序追加
+	head     int         //最旧的操作在ops中的下标
+	capacity int
+	lastSeq  int64
+}
+
+func NewOpLog(capacity int) *OpLog {
+	if capacity <= 0 {
+		capacity = DefaultOpLogSize
+	}
+	return &OpLog{
+		Epoch:    util.NewUUID(),
+		ops:      make([]Operation, 0),
+		capacity: capacity,
+	}
+}
+
+// Append 分配序列号并追加到日志, 超出容量时淘汰最旧的操作
+func (l *OpLog) Append(shard int, typ OpType, doc index.Document) Operation {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lastSeq++
+	op := Operation{Seq: l.lastSeq, Shard: shard, Type: typ, Doc: doc}
+	if len(l.ops) < l.capacity {
+		l.ops = append(l.ops, op)
+	} else {
+		l.ops[l.head] = op
+		l.head = (l.head + 1) % l.capacity
+	}
+	return op
+}
+
+func (l *OpLog) LastSeq() int64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.lastSeq
+}
+
+// Since returns all operations whose seq is greater than seq
+func (l *OpLog) Since(seq int64) ([]Operation, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	if seq >= l.lastSeq {
+		return nil, nil
+	}
+	first := l.lastSeq - int64(len(l.ops)) + 1
+	if seq+1 < first {
+		return nil, ErrOpLogTruncated
+	}
+	result := make([]Operation, l.lastSeq-seq)
+	start := l.head + int(seq+1-first)
+	for i := range result {
+		result[i] = l.ops[(start+i)%len(l.ops)]
+	}
+	return result, nil
+}
+
+type ReplicateRequest struct {
+	Leader string //主分片所在节点
+	Epoch  string //主分片操作日志的Epoch
+	Shard  int
+	Ops    []Operation
+}
+
+type ReplicateResponse struct {
+	Applied int64 //备份分片已应用的最大序列号
+}
+
+type FetchOpsRequest struct {
+	Shard int
+	Since int64
+	Epoch string //备份分片已应用的操作所属的Epoch, 与主分片不同时从头返回
+}
+
+type FetchOpsResponse struct {
+	Epoch string
+	Ops   []Operation
+}
+
+// WriteRequest 实时写入请求, Docs中的文档执行相同的操作
+type WriteRequest struct {
+	Type OpType
+	Docs []index.Document
+}
+
+// WriteResult 单个文档的写入结果, Error为空表示成功
+// NotLeader表示目标节点不是文档所在分片的主分片(路由过期), 文档未写入, 刷新路由后可安全重试
+type WriteResult struct {
+	ID        int
+	Seq       int64
+	Error     string
+	NotLeader bool
+}
@@ -0,0 +1,233 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/search"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpLog(t *testing.T) {
+	l := NewOpLog(3)
+	for i := 1; i <= 5; i++ {
+		op := l.Append(1, OpAdd, index.Document{ID: i})
+		assert.Equal(t, int64(i), op.Seq)
+	}
+	assert.Equal(t, int64(5), l.LastSeq())
+
+	ops, err := l.Since(3)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ops))
+	assert.Equal(t, int64(4), ops[0].Seq)
+	assert.Equal(t, 4, ops[0].Doc.ID)
+
+	ops, err = l.Since(5)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ops))
+
+	_, err = l.Since(1)
+	assert.Equal(t, ErrOpLogTruncated, err)
+
+	//环形缓冲多次绕回后仍按序列号顺序返回
+	for i := 6; i <= 11; i++ {
+		l.Append(1, OpAdd, index.Document{ID: i})
+	}
+	ops, err = l.Since(8)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(ops))
+	for i, op := range ops {
+		assert.Equal(t, int64(9+i), op.Seq)
+		assert.Equal(t, 9+i, op.Doc.ID)
+	}
+	_, err = l.Since(7)
+	assert.Equal(t, ErrOpLogTruncated, err)
+}
+
+// newReplicaServer 创建不连接ManagerServer的DataServer, 分片路由取自c
+func newReplicaServer(t *testing.T, dir string, id string, c *Cluster) *DataServer {
+	conf := &config.Config{Store: config.Storage{IndexFile: filepath.Join(dir, id)}}
+	self := c.DataNodeCorpus[id]
+	for _, shard := range append(append([]int{}, self.LeaderSharding...), self.FollowerSharding...) {
+		idx := index.NewBTreeIndex(fmt.Sprintf("%s.%d", conf.Store.IndexFile, shard))
+		idx.Close()
+	}
+	s := &DataServer{
+		self:       self,
+		cluster:    *c.Clone(),
+		config:     conf,
+		sharding:   make(map[int]*search.Searcher),
+		oplogs:     make(map[int]*OpLog),
+		applied:    make(map[int]int64),
+		epochs:     make(map[int]string),
+		shardLocks: make(map[int]*sync.Mutex),
+		handoffs:   make(map[int]time.Time),
+		migrations: make(map[string]migration),
+	}
+	s.openShards()
+	return s
+}
+
+// listenData 监听随机端口, 测试结束时关闭
+func listenData(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// serveData 在l上提供DataServer RPC服务
+func serveData(t *testing.T, l net.Listener, s *DataServer) {
+	server := rpc.NewServer()
+	assert.Nil(t, server.RegisterName("DataServer", s))
+	go server.Accept(l)
+}
+
+func TestReplicate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replicate")
+	defer os.RemoveAll(dir)
+
+	c := NewCluster(1, 1)
+	c.Add(Node{ID: "l1", Host: "127.0.0.1:8801", Type: DataNode, LeaderSharding: []int{0}})
+	c.Add(Node{ID: "f1", Host: "127.0.0.1:8802", Type: DataNode, FollowerSharding: []int{0}})
+	f := newReplicaServer(t, dir, "f1", c)
+
+	op := func(seq int64, typ OpType, id int, text string) Operation {
+		return Operation{Seq: seq, Shard: 0, Type: typ, Doc: index.Document{ID: id, Text: text}}
+	}
+	replicate := func(leader, epoch string, ops ...Operation) (int64, error) {
+		var resp ReplicateResponse
+		err := f.Replicate(ReplicateRequest{Leader: leader, Epoch: epoch, Shard: 0, Ops: ops}, &resp)
+		return resp.Applied, err
+	}
+
+	//只接受路由中主分片所在节点的复制
+	_, err := replicate("127.0.0.1:8803", "e1", op(1, OpAdd, 1, "donut"))
+	assert.NotNil(t, err)
+	var resp ReplicateResponse
+	assert.NotNil(t, f.Replicate(ReplicateRequest{Leader: "127.0.0.1:8801", Shard: 1}, &resp))
+
+	//遇到空洞时停止, 已应用的操作被忽略
+	adds, dels := documentsApplied.Value("0", opNames[OpAdd]), documentsApplied.Value("0", opNames[OpDel])
+	applied, err := replicate("127.0.0.1:8801", "e1", op(1, OpAdd, 1, "donut"), op(3, OpAdd, 3, "donut"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), applied)
+	applied, _ = replicate("127.0.0.1:8801", "e1", op(1, OpAdd, 1, "donut"), op(2, OpAdd, 2, "donut"), op(3, OpDel, 1, ""))
+	assert.Equal(t, int64(3), applied)
+	assert.Equal(t, adds+2, documentsApplied.Value("0", opNames[OpAdd]))
+	assert.Equal(t, dels+1, documentsApplied.Value("0", opNames[OpDel]))
+
+	//主分片在同一地址重启, 操作日志的序列号重新开始, 新的操作不能被当作已应用而忽略
+	applied, err = replicate("127.0.0.1:8801", "e2", op(1, OpAdd, 6, "plate"), op(2, OpAdd, 7, "plate"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), applied)
+	assert.Equal(t, adds+4, documentsApplied.Value("0", opNames[OpAdd]))
+	applied, _ = replicate("127.0.0.1:8801", "e2", op(2, OpAdd, 7, "plate"))
+	assert.Equal(t, int64(2), applied)
+	assert.Equal(t, adds+4, documentsApplied.Value("0", opNames[OpAdd]))
+
+	//主分片变化后序列号重新开始, 原主分片的复制被拒绝
+	moved := c.Clone()
+	moved.Add(Node{ID: "l2", Host: "127.0.0.1:8803", Type: DataNode, LeaderSharding: []int{0}})
+	l1 := moved.DataNodeCorpus["l1"]
+	l1.LeaderSharding = nil
+	moved.DataNodeCorpus["l1"] = l1
+	f.lock.Lock()
+	f.cluster = *moved
+	f.lock.Unlock()
+	_, err = replicate("127.0.0.1:8801", "e2", op(3, OpAdd, 4, "donut"))
+	assert.NotNil(t, err)
+	applied, err = replicate("127.0.0.1:8803", "e3", op(1, OpAdd, 5, "glass"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), applied)
+}
+
+func TestReplicateCatchUp(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replicate")
+	defer os.RemoveAll(dir)
+
+	ll, fl := listenData(t), listenData(t)
+	c := NewCluster(1, 1)
+	c.Add(Node{ID: "l1", Host: ll.Addr().String(), Type: DataNode, LeaderSharding: []int{0}})
+	c.Add(Node{ID: "f1", Host: fl.Addr().String(), Type: DataNode, FollowerSharding: []int{0}})
+	leader := newReplicaServer(t, dir, "l1", c)
+	follower := newReplicaServer(t, dir, "f1", c)
+	serveData(t, fl, follower)
+
+	//备份分片落后时从操作日志补齐
+	oplog := leader.oplogs[0]
+	oplog.Append(0, OpAdd, index.Document{ID: 1, Text: "donut"})
+	oplog.Append(0, OpAdd, index.Document{ID: 2, Text: "donut"})
+	op := oplog.Append(0, OpAdd, index.Document{ID: 3, Text: "donut"})
+	assert.Nil(t, leader.replicateTo(fl.Addr().String(), op))
+	assert.Equal(t, int64(3), follower.applied[0])
+
+	//主分片重启后备份分片从新的操作日志开头追赶
+	restarted := NewOpLog(10)
+	restarted.Append(0, OpAdd, index.Document{ID: 4, Text: "plate"})
+	leader.oplogs[0] = restarted
+	var fetched FetchOpsResponse
+	assert.Nil(t, leader.FetchOps(FetchOpsRequest{Shard: 0, Since: follower.applied[0], Epoch: follower.epochs[0]}, &fetched))
+	assert.Equal(t, restarted.Epoch, fetched.Epoch)
+	assert.Equal(t, 1, len(fetched.Ops))
+	var resp ReplicateResponse
+	assert.Nil(t, follower.Replicate(ReplicateRequest{Leader: ll.Addr().String(), Epoch: fetched.Epoch, Shard: 0, Ops: fetched.Ops}, &resp))
+	assert.Equal(t, int64(1), resp.Applied)
+	assert.Nil(t, leader.FetchOps(FetchOpsRequest{Shard: 0, Since: 1, Epoch: restarted.Epoch}, &fetched))
+	assert.Empty(t, fetched.Ops)
+
+	//落后的操作已被淘汰时返回ErrOpLogTruncated
+	leader.oplogs[0] = NewOpLog(2)
+	for i := 1; i <= 5; i++ {
+		op = leader.oplogs[0].Append(0, OpAdd, index.Document{ID: i, Text: "glass"})
+	}
+	follower.applied[0] = 1
+	assert.Equal(t, ErrOpLogTruncated, leader.replicateTo(fl.Addr().String(), op))
+}
+
+func TestWriteAcks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replicate")
+	defer os.RemoveAll(dir)
+
+	ll, fl, down := listenData(t), listenData(t), listenData(t)
+	c := NewCluster(1, 2)
+	c.Add(Node{ID: "l1", Host: ll.Addr().String(), Type: DataNode, LeaderSharding: []int{0}})
+	c.Add(Node{ID: "f1", Host: fl.Addr().String(), Type: DataNode, FollowerSharding: []int{0}})
+	c.Add(Node{ID: "f2", Host: down.Addr().String(), Type: DataNode, FollowerSharding: []int{0}})
+	down.Close() //f2不可用
+	leader := newReplicaServer(t, dir, "l1", c)
+	follower := newReplicaServer(t, dir, "f1", c)
+	serveData(t, fl, follower)
+
+	//一个备份分片确认即返回
+	leader.config.Cluster.AckReplicaNum = 1
+	seq, err := leader.write(OpAdd, index.Document{ID: 1, Text: "donut"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), seq)
+
+	//确认数不足时返回错误, 本地已写入
+	leader.config.Cluster.AckReplicaNum = 2
+	seq, err = leader.write(OpAdd, index.Document{ID: 2, Text: "donut"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "required 2")
+	assert.Equal(t, int64(2), leader.oplogs[0].LastSeq())
+	assert.Eventually(t, func() bool { //可用的备份分片仍会收到复制
+		follower.lock.RLock()
+		defer follower.lock.RUnlock()
+		return follower.applied[0] == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	//非主分片拒绝写入
+	_, err = follower.write(OpAdd, index.Document{ID: 3})
+	_, ok := err.(*notLeaderError)
+	assert.True(t, ok)
+}
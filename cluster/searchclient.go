@@ -8,46 +8,44 @@ import (
 
 	"github.com/awesomefly/easysearch/config"
 	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/search"
 )
 
 //RpcCall RPC方法必须满足Go语言的RPC规则：方法只能有两个可序列化的参数，其中第二个参数是指针类型，并且返回一个error类型，同时必须是公开的方法
 func RpcCall(host string, method string, request interface{}, response interface{}) error {
 	client, err := rpc.Dial("tcp", host)
 	if err != nil {
-		log.Fatal("dialing:", err)
+		log.Print("dialing:", err)
 		return err
 	}
+	defer client.Close()
 
-	switch v := response.(type) {
-	case *Node:
-		err = client.Call(method, request, v)
-	case *Cluster:
-		err = client.Call(method, request, v)
-	case *[]index.Doc:
-		err = client.Call(method, request, v)
-	}
-	if err != nil {
-		log.Fatal(err)
+	if err = client.Call(method, request, response); err != nil {
+		log.Print(err)
 		return err
 	}
-	client.Close()
 
 	log.Printf("RPC Response:%+v", response)
 	return nil
 }
 
 type SearchClient struct {
-	ServerConfig *config.Server //manager server config
-	cluster      *Cluster       //todo: cached and refresh cluster info
+	manager *ManagerClient
+	cluster *Cluster //todo: cached and refresh cluster info
 }
 
-func NewSearchClient(config *config.Server) *SearchClient {
+// NewSearchClient 传入多个ManagerServer时, 请求失败会切换到其他ManagerServer
+func NewSearchClient(managers ...config.Server) *SearchClient {
+	var addrs []string
+	for _, s := range managers {
+		addrs = append(addrs, s.Address())
+	}
 	client := SearchClient{
-		ServerConfig: config,
-		cluster:      &Cluster{},
+		manager: NewManagerClient(addrs),
+		cluster: &Cluster{},
 	}
 
-	err := RpcCall(client.ServerConfig.Address(), "ManagerServer.GetCluster", util.GetLocalIP(), client.cluster)
+	err := client.manager.Call("ManagerServer.GetCluster", util.GetLocalIP(), client.cluster)
 	if err != nil {
 		panic(err)
 	}
@@ -55,8 +53,77 @@ func NewSearchClient(config *config.Server) *SearchClient {
 }
 
 func (c *SearchClient) Search(query string) ([]index.Doc, error) {
+	return c.SearchWithModel(query, "")
+}
+
+// SearchWithModel 使用指定的打分模型搜索, 为空时使用服务端配置的默认模型
+func (c *SearchClient) SearchWithModel(query string, model index.SearchModel) ([]index.Doc, error) {
+	response := make([]index.Doc, 0)
+	request := SearchRequest{Query: query, Model: model}
+	if err := RpcCall(c.cluster.RouteSearchNode().Host, "SearchServer.SearchAll", request, &response); err != nil {
+		return response, err
+	}
+	return response, nil
+}
+
+// Explain 搜索并返回每个结果的得分明细
+func (c *SearchClient) Explain(query string) (*ExplainResult, error) {
+	return c.ExplainWithModel(query, "")
+}
+
+// ExplainWithModel 使用指定的打分模型搜索并返回每个结果的得分明细
+func (c *SearchClient) ExplainWithModel(query string, model index.SearchModel) (*ExplainResult, error) {
+	response := &ExplainResult{}
+	request := SearchRequest{Query: query, Model: model}
+	if err := RpcCall(c.cluster.RouteSearchNode().Host, "SearchServer.ExplainAll", request, response); err != nil {
+		return response, err
+	}
+	return response, nil
+}
+
+// SearchWithHighlight 使用指定的打分模型搜索并返回每个结果的高亮
+func (c *SearchClient) SearchWithHighlight(query string, model index.SearchModel) (*HighlightResult, error) {
+	response := &HighlightResult{}
+	request := SearchRequest{Query: query, Model: model}
+	if err := RpcCall(c.cluster.RouteSearchNode().Host, "SearchServer.HighlightAll", request, response); err != nil {
+		return response, err
+	}
+	return response, nil
+}
+
+// Hybrid 混合检索, 文本检索与向量检索的结果在SearchServer融合
+func (c *SearchClient) Hybrid(q search.HybridQuery) ([]index.Doc, error) {
 	response := make([]index.Doc, 0)
-	if err := RpcCall(c.cluster.RouteSearchNode().Host, "SearchServer.SearchAll", query, &response); err != nil {
+	request := HybridRequest{Query: q}
+	if err := RpcCall(c.cluster.RouteSearchNode().Host, "SearchServer.HybridAll", request, &response); err != nil {
+		return response, err
+	}
+	return response, nil
+}
+
+// Add 实时新增文档
+func (c *SearchClient) Add(doc index.Document) error {
+	var response WriteResult
+	return RpcCall(c.cluster.RouteSearchNode().Host, "SearchServer.Add", doc, &response)
+}
+
+// Update 实时更新文档
+func (c *SearchClient) Update(doc index.Document) error {
+	var response WriteResult
+	return RpcCall(c.cluster.RouteSearchNode().Host, "SearchServer.Update", doc, &response)
+}
+
+// Delete 实时删除文档
+func (c *SearchClient) Delete(id int) error {
+	var response WriteResult
+	return RpcCall(c.cluster.RouteSearchNode().Host, "SearchServer.Delete", index.Document{ID: id}, &response)
+}
+
+// Bulk 批量写入, 返回每个文档的写入结果
+func (c *SearchClient) Bulk(typ OpType, docs []index.Document) ([]WriteResult, error) {
+	response := make([]WriteResult, 0)
+	request := WriteRequest{Type: typ, Docs: docs}
+	if err := RpcCall(c.cluster.RouteSearchNode().Host, "SearchServer.Bulk", request, &response); err != nil {
 		return response, err
 	}
 	return response, nil
@@ -13,7 +13,7 @@ func TestSearchClient(t *testing.T) {
 		Host: "127.0.0.1",
 		Port: 1234,
 	}
-	cli := NewSearchClient(config)
+	cli := NewSearchClient(*config)
 	result, err := cli.Search("Album Jordan")
 	assert.Nil(t, err)
 	assert.NotNil(t, result)
@@ -1,42 +1,52 @@
 package cluster
 
 import (
+	"errors"
+	"fmt"
 	"math/rand"
 	"sort"
+	"sync"
 
 	"github.com/awesomefly/easysearch/config"
 
 	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/search"
 )
 
 type SearchServer struct {
+	lock    sync.RWMutex
 	cluster Cluster
+	manager *ManagerClient
 	server  *Server
 }
 
 func NewSearchServer(config *config.Config) *SearchServer {
+	id, err := LoadNodeID(config.Store.DataDir)
+	if err != nil {
+		panic(err)
+	}
 	self := Node{
-		ID:   rand.Intn(10000), //todo: support uuid
+		ID:   id,
 		Type: SearchNode,
 		Host: config.Server.Address(),
 	}
-	err := RpcCall(config.Cluster.ManageServer.Address(), "ManagerServer.AddServer", self, &Node{})
+	manager := NewManagerClient(managerAddresses(config.Cluster))
+	err = manager.Call("ManagerServer.AddServer", self, &Node{})
 	if err != nil {
 		panic(err)
 	}
 
 	c := Cluster{}
-	err = RpcCall(config.Cluster.ManageServer.Address(), "ManagerServer.GetCluster", "", &c)
+	err = manager.Call("ManagerServer.GetCluster", "", &c)
 	if err != nil {
 		panic(err)
 	}
 
 	return &SearchServer{
 		cluster: c,
-		server:  &Server{name: "Search", network: "tcp", address: config.Server.Address()},
+		manager: manager,
+		server:  newServer("Search", config),
 	}
-
-	return nil
 }
 
 func (s *SearchServer) Run() {
@@ -48,30 +58,51 @@ func (s *SearchServer) Run() {
 	}
 }
 
-//SearchAll 分布式搜索
-//todo: 实现实时更新&删除接口
-func (s *SearchServer) SearchAll(query string, response *[]index.Doc) error {
+func (s *SearchServer) refreshCluster() error {
+	c := Cluster{}
+	if err := s.manager.Call("ManagerServer.GetCluster", "", &c); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cluster = c
+	return nil
+}
+
+// route 每个分片随机选择一个节点, 优先从副本读取
+func (s *SearchServer) route() (Sharding2Node, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	r, err := s.cluster.RouteShardingNode(FollowerSharding) //todo: cache router info
+	if err == nil && len(r) == 0 {
+		r, err = s.cluster.RouteShardingNode(LeaderSharding)
+	}
+	return r, err
+}
+
+//SearchAll 分布式搜索, request.Sharding被忽略, 搜索所有分片
+func (s *SearchServer) SearchAll(request SearchRequest, response *[]index.Doc) error {
+	model, err := index.ParseSearchModel(string(request.Model))
 	if err != nil {
 		return err
 	}
-
-	if r == nil || len(r) == 0 {
-		if r, err = s.cluster.RouteShardingNode(LeaderSharding); err != nil {
-			return err
-		}
+	request.Model = model //转发及检索使用规范化的模型名
+	r, err := s.route()
+	if err != nil {
+		return err
 	}
 
 	result := make([]index.Doc, 0)
 	for sharding, nodes := range r {
 		n := rand.Intn(len(nodes))
 
-		request := SearchRequest{
-			Query:    query,
+		shardRequest := SearchRequest{
+			Query:    request.Query,
 			Sharding: []int{sharding},
+			Model:    request.Model,
 		}
 		var reply []index.Doc
-		if err = RpcCall(nodes[n].Host, "DataServer.Search", request, &reply); err != nil {
+		if err = RpcCall(nodes[n].Host, "DataServer.Search", shardRequest, &reply); err != nil {
 			return err
 		}
 		result = append(result, reply...)
@@ -84,3 +115,234 @@ func (s *SearchServer) SearchAll(query string, response *[]index.Doc) error {
 	*response = result
 	return nil
 }
+
+// ExplainAll 分布式搜索, 返回每个结果的得分明细及命中的分片
+func (s *SearchServer) ExplainAll(request SearchRequest, response *ExplainResult) error {
+	model, err := index.ParseSearchModel(string(request.Model))
+	if err != nil {
+		return err
+	}
+	request.Model = model //转发及检索使用规范化的模型名
+	r, err := s.route()
+	if err != nil {
+		return err
+	}
+
+	result := ExplainResult{}
+	for sharding, nodes := range r {
+		n := rand.Intn(len(nodes))
+
+		shardRequest := SearchRequest{
+			Query:    request.Query,
+			Sharding: []int{sharding},
+			Model:    request.Model,
+		}
+		var reply ExplainResult
+		if err = RpcCall(nodes[n].Host, "DataServer.Explain", shardRequest, &reply); err != nil {
+			return err
+		}
+		result.Docs = append(result.Docs, reply.Docs...)
+		result.Explains = append(result.Explains, reply.Explains...)
+	}
+	sort.Stable(&result)
+	*response = result
+	return nil
+}
+
+// HighlightAll 分布式搜索, 返回每个结果的高亮
+func (s *SearchServer) HighlightAll(request SearchRequest, response *HighlightResult) error {
+	model, err := index.ParseSearchModel(string(request.Model))
+	if err != nil {
+		return err
+	}
+	request.Model = model //转发及检索使用规范化的模型名
+	r, err := s.route()
+	if err != nil {
+		return err
+	}
+
+	result := HighlightResult{}
+	for sharding, nodes := range r {
+		n := rand.Intn(len(nodes))
+
+		shardRequest := SearchRequest{
+			Query:    request.Query,
+			Sharding: []int{sharding},
+			Model:    request.Model,
+		}
+		var reply HighlightResult
+		if err = RpcCall(nodes[n].Host, "DataServer.Highlight", shardRequest, &reply); err != nil {
+			return err
+		}
+		result.Docs = append(result.Docs, reply.Docs...)
+		result.Highlights = append(result.Highlights, reply.Highlights...)
+	}
+	sort.Stable(&result)
+	*response = result
+	return nil
+}
+
+// HybridAll 分布式混合检索, 每一路结果跨分片按得分合并后再融合, 返回前Query.K个, 为0时返回全部. request.Sharding被忽略
+func (s *SearchServer) HybridAll(request HybridRequest, response *[]index.Doc) error {
+	q := request.Query
+	model, err := index.ParseSearchModel(string(q.Model))
+	if err != nil {
+		return err
+	}
+	q.Model = model //转发规范化的模型名
+	if err := q.Fusion.Validate(); err != nil {
+		return err
+	}
+	r, err := s.route()
+	if err != nil {
+		return err
+	}
+
+	result := search.HybridResult{}
+	for sharding, nodes := range r {
+		n := rand.Intn(len(nodes))
+
+		var reply search.HybridResult
+		shardRequest := HybridRequest{Query: q, Sharding: []int{sharding}}
+		if err = RpcCall(nodes[n].Host, "DataServer.Hybrid", shardRequest, &reply); err != nil {
+			return err
+		}
+		result.Merge(reply)
+	}
+	*response = q.Fusion.Fuse(result.Lexical, result.Vector, q.K)
+	return nil
+}
+
+// Add 实时新增文档, 写入文档所在分片的主分片
+func (s *SearchServer) Add(doc index.Document, response *WriteResult) error {
+	return s.writeOne(OpAdd, doc, response)
+}
+
+// Update 实时更新文档
+func (s *SearchServer) Update(doc index.Document, response *WriteResult) error {
+	return s.writeOne(OpUpdate, doc, response)
+}
+
+// Delete 实时删除文档, 只需要文档ID
+func (s *SearchServer) Delete(doc index.Document, response *WriteResult) error {
+	return s.writeOne(OpDel, doc, response)
+}
+
+// Bulk 批量写入, 按主分片分组并发写入, 返回与request.Docs顺序一致的结果
+func (s *SearchServer) Bulk(request WriteRequest, response *[]WriteResult) error {
+	*response = s.write(request.Type, request.Docs)
+	return nil
+}
+
+func (s *SearchServer) writeOne(typ OpType, doc index.Document, response *WriteResult) error {
+	results := s.write(typ, []index.Document{doc})
+	*response = results[0]
+	if results[0].Error != "" {
+		return errors.New(results[0].Error)
+	}
+	return nil
+}
+
+func (s *SearchServer) write(typ OpType, docs []index.Document) []WriteResult {
+	results := make([]WriteResult, len(docs))
+	pending := make([]int, 0, len(docs))
+	for i, doc := range docs {
+		results[i].ID = doc.ID
+		if doc.ID < 0 {
+			results[i].Error = fmt.Sprintf("invalid doc id %d", doc.ID)
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	//路由信息过期时(如主分片迁移), 数据节点返回NotLeader且未写入, 刷新路由后重试一次.
+	//RPC失败时请求可能已部分写入, 重试会重复写入, 直接返回错误由调用方处理
+	for retry := 0; retry < 2 && len(pending) > 0; retry++ {
+		if retry > 0 {
+			if err := s.refreshCluster(); err != nil {
+				break
+			}
+		}
+
+		s.lock.RLock()
+		groups, failed, err := GroupByLeader(&s.cluster, docs, pending)
+		s.lock.RUnlock()
+		if err != nil {
+			for _, i := range pending {
+				results[i].Error = err.Error()
+			}
+			continue
+		}
+		//分片没有主分片的文档单独失败, 刷新路由后重试, 不影响同一批的其他文档
+		noLeader := make([]int, 0, len(failed))
+		for _, i := range pending {
+			if err, ok := failed[i]; ok {
+				results[i].Error = err.Error()
+				noLeader = append(noLeader, i)
+			}
+		}
+
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		notLeader := make([]int, 0)
+		for host, idxes := range groups {
+			wg.Add(1)
+			go func(host string, idxes []int) {
+				defer wg.Done()
+
+				request := WriteRequest{Type: typ, Docs: make([]index.Document, 0, len(idxes))}
+				for _, i := range idxes {
+					request.Docs = append(request.Docs, docs[i])
+				}
+				var reply []WriteResult
+				err := RpcCall(host, "DataServer.Write", request, &reply)
+
+				lock.Lock()
+				defer lock.Unlock()
+				if err != nil || len(reply) != len(idxes) {
+					for _, i := range idxes {
+						results[i].Error = fmt.Sprintf("write to %s failed: %v", host, err)
+					}
+					return
+				}
+				for j, i := range idxes {
+					results[i] = reply[j]
+					if reply[j].NotLeader {
+						notLeader = append(notLeader, i)
+					}
+				}
+			}(host, idxes)
+		}
+		wg.Wait()
+		pending = append(notLeader, noLeader...)
+	}
+	return results
+}
+
+// GroupByLeader 按文档所在分片的主分片节点分组, 返回host->文档下标.
+// 文档ID为负或所在分片没有主分片时, 该文档的错误记录在failed中, 不影响其他文档
+func GroupByLeader(c *Cluster, docs []index.Document, idxes []int) (groups map[string][]int, failed map[int]error, err error) {
+	if c.ShardingNum <= 0 {
+		return nil, nil, errors.New("invalid sharding num")
+	}
+	leaders, err := c.RouteShardingNode(LeaderSharding)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groups, failed = make(map[string][]int), make(map[int]error)
+	for _, i := range idxes {
+		if docs[i].ID < 0 {
+			failed[i] = fmt.Errorf("invalid doc id %d", docs[i].ID)
+			continue
+		}
+		shard := docs[i].ID % c.ShardingNum
+		nodes := leaders[shard]
+		if len(nodes) == 0 {
+			failed[i] = fmt.Errorf("no leader for shard %d", shard)
+			continue
+		}
+		groups[nodes[0].Host] = append(groups[nodes[0].Host], i)
+	}
+	return groups, failed, nil
+}
@@ -1,7 +1,11 @@
 package cluster
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
 	"testing"
 	"time"
 
@@ -71,8 +75,138 @@ func TestSearchServer(t *testing.T) {
 
 	srh := NewSearchServer(&srhSvrConfig)
 	var response []index.Doc
-	err := srh.SearchAll("Jordan", &response)
+	err := srh.SearchAll(SearchRequest{Query: "Jordan"}, &response)
 	assert.Nil(t, err)
 
 	fmt.Printf("%+v\n", response)
 }
+
+func TestGroupByLeader(t *testing.T) {
+	c := NewCluster(2, 1)
+	c.Add(Node{ID: "n0", Host: "127.0.0.1:1240", Type: DataNode, LeaderSharding: []int{0}})
+	c.Add(Node{ID: "n1", Host: "127.0.0.1:1241", Type: DataNode, LeaderSharding: []int{1}})
+
+	docs := []index.Document{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+	groups, failed, err := GroupByLeader(c, docs, []int{0, 1, 2, 3})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(failed))
+	assert.Equal(t, []int{1, 3}, groups["127.0.0.1:1240"])
+	assert.Equal(t, []int{0, 2}, groups["127.0.0.1:1241"])
+
+	//只有没有主分片的文档及ID为负的文档失败
+	c = NewCluster(3, 1)
+	c.Add(Node{ID: "n0", Host: "127.0.0.1:1240", Type: DataNode, LeaderSharding: []int{0}})
+	docs = append(docs, index.Document{ID: -3})
+	groups, failed, err = GroupByLeader(c, docs, []int{0, 2, 4})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]int{"127.0.0.1:1240": {2}}, groups)
+	assert.Equal(t, 2, len(failed))
+	assert.Contains(t, failed[0].Error(), "no leader for shard 1")
+	assert.Contains(t, failed[4].Error(), "invalid doc id")
+
+	_, _, err = GroupByLeader(NewCluster(0, 1), docs, []int{0})
+	assert.NotNil(t, err)
+}
+
+type fakeDataServer struct {
+	lock      sync.Mutex
+	calls     int
+	notLeader bool
+	fail      bool
+	installs  []InstallShardRequest
+}
+
+func (f *fakeDataServer) InstallShard(request InstallShardRequest, response *int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.fail {
+		return errors.New("disk full")
+	}
+	f.installs = append(f.installs, request)
+	return nil
+}
+
+func (f *fakeDataServer) Write(request WriteRequest, response *[]WriteResult) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls++
+	if f.fail {
+		return errors.New("disk full")
+	}
+	for _, doc := range request.Docs {
+		*response = append(*response, WriteResult{ID: doc.ID, Seq: 1, NotLeader: f.notLeader})
+	}
+	return nil
+}
+
+type fakeManager struct {
+	cluster *Cluster
+}
+
+func (f *fakeManager) AddServer(request Node, response *Node) error {
+	*response = request
+	return nil
+}
+
+func (f *fakeManager) GetCluster(request string, response *Cluster) error {
+	*response = *f.cluster
+	return nil
+}
+
+func serveFake(t *testing.T, name string, rcvr interface{}) string {
+	server := rpc.NewServer()
+	assert.Nil(t, server.RegisterName(name, rcvr))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go server.Accept(l)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func TestSearchServerWriteRetry(t *testing.T) {
+	old := &fakeDataServer{notLeader: true}
+	leader := &fakeDataServer{}
+	broken := &fakeDataServer{fail: true}
+	oldHost := serveFake(t, "DataServer", old)
+	leaderHost := serveFake(t, "DataServer", leader)
+	brokenHost := serveFake(t, "DataServer", broken)
+
+	//本地路由过期: 分片0的主分片已迁移到leaderHost
+	stale := NewCluster(2, 1)
+	stale.Add(Node{ID: "n0", Host: oldHost, Type: DataNode, LeaderSharding: []int{0}})
+	stale.Add(Node{ID: "n1", Host: brokenHost, Type: DataNode, LeaderSharding: []int{1}})
+	fresh := NewCluster(2, 1)
+	fresh.Add(Node{ID: "n0", Host: leaderHost, Type: DataNode, LeaderSharding: []int{0}})
+	fresh.Add(Node{ID: "n1", Host: brokenHost, Type: DataNode, LeaderSharding: []int{1}})
+	manager := serveFake(t, "ManagerServer", &fakeManager{cluster: fresh})
+
+	s := &SearchServer{cluster: *stale, manager: NewManagerClient([]string{manager})}
+	results := s.write(OpAdd, []index.Document{{ID: 2}, {ID: 1}})
+
+	//NotLeader的文档刷新路由后重试
+	assert.Equal(t, WriteResult{ID: 2, Seq: 1}, results[0])
+	assert.Equal(t, 1, old.calls)
+	assert.Equal(t, 1, leader.calls)
+	//RPC失败时不重试, 避免重复写入
+	assert.Equal(t, 1, results[1].ID)
+	assert.Contains(t, results[1].Error, "disk full")
+	assert.Equal(t, 1, broken.calls)
+}
+
+func TestSearchServerWritePartial(t *testing.T) {
+	leader := &fakeDataServer{}
+	leaderHost := serveFake(t, "DataServer", leader)
+	c := NewCluster(3, 1)
+	c.Add(Node{ID: "n0", Host: leaderHost, Type: DataNode, LeaderSharding: []int{0}})
+	manager := serveFake(t, "ManagerServer", &fakeManager{cluster: c})
+
+	//分片1没有主分片及ID为负的文档失败, 同一批的其他文档正常写入
+	s := &SearchServer{cluster: *c.Clone(), manager: NewManagerClient([]string{manager})}
+	results := s.write(OpAdd, []index.Document{{ID: 3}, {ID: 1}, {ID: -3}})
+	assert.Equal(t, WriteResult{ID: 3, Seq: 1}, results[0])
+	assert.Equal(t, 1, results[1].ID)
+	assert.Contains(t, results[1].Error, "no leader for shard 1")
+	assert.Equal(t, -3, results[2].ID)
+	assert.Contains(t, results[2].Error, "invalid doc id")
+	assert.Equal(t, 1, leader.calls)
+}
@@ -1,13 +1,22 @@
 package cluster
 
 import (
+	"bufio"
+	"encoding/gob"
 	"io"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/metrics"
 )
 
 type Server struct {
@@ -16,21 +25,52 @@ type Server struct {
 	address string
 
 	listener net.Listener
+	stopped  int32 //Stop后Accept返回的错误不再视为异常
 	handler  func(conn io.ReadWriteCloser)
+	rpc      *rpc.Server     //每个Server独立注册服务, 同一进程可以启动多个同名服务
+	methods  map[string]bool //已注册的"服务.方法", 用于指标的标签
+
+	metrics     config.Metrics
+	metricsAddr string //为空时不开启指标服务
+}
+
+func newServer(name string, c *config.Config) *Server {
+	s := &Server{name: name, network: "tcp", address: c.Server.Address()}
+	if c.Metrics.Enabled {
+		s.metrics = c.Metrics.WithDefault()
+		s.metricsAddr = c.Metrics.Address(c.Server)
+	}
+	return s
 }
 
 func (s *Server) RegisterName(name string, rcvr interface{}) error {
-	if err := rpc.RegisterName(name, rcvr); err != nil {
+	if s.rpc == nil {
+		s.rpc = rpc.NewServer()
+	}
+	if err := s.rpc.RegisterName(name, rcvr); err != nil {
 		return err
 	}
+	if s.methods == nil {
+		s.methods = make(map[string]bool)
+	}
+	for method := range serviceMethods(name, rcvr) {
+		s.methods[method] = true
+	}
 
 	s.handler = func(conn io.ReadWriteCloser) {
-		rpc.ServeConn(conn)
+		s.rpc.ServeCodec(newMetricsCodec(s.name, s.methods, conn))
 	}
 	return nil
 }
 
 func (s *Server) Run() error {
+	if s.metricsAddr != "" {
+		if _, err := metrics.Serve(s.metricsAddr, s.metrics.Path, s.metrics.Pprof); err != nil {
+			log.Fatal("metrics server error: ", err.Error())
+			return err
+		}
+	}
+
 	errChan := make(chan error, 1)
 	go func() { errChan <- s.Start() }()
 
@@ -59,10 +99,13 @@ func (s *Server) Start() error {
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if atomic.LoadInt32(&s.stopped) == 1 {
+				return nil //Stop关闭了listener
+			}
 			log.Fatal("Accept error:", err)
 			return err
 		}
-		s.handler(conn)
+		go s.handler(conn)
 	}
 }
 
@@ -84,8 +127,104 @@ func (s *Server) waitSignal(errCh chan error) error {
 }
 
 func (s *Server) Stop() error {
+	atomic.StoreInt32(&s.stopped, 1)
 	if s.listener != nil {
 		return s.listener.Close()
 	}
 	return nil
 }
+
+// serviceMethods rcvr的导出方法, 包含net/rpc不能调用的方法, 只用于限定指标的标签
+func serviceMethods(name string, rcvr interface{}) map[string]bool {
+	typ := reflect.TypeOf(rcvr)
+	methods := make(map[string]bool, typ.NumMethod())
+	for i := 0; i < typ.NumMethod(); i++ {
+		methods[name+"."+typ.Method(i).Name] = true
+	}
+	return methods
+}
+
+// metricsCodec 同net/rpc默认的gob编码, 同时记录每个RPC的请求数及耗时.
+// 未注册的方法记为unknown, 避免客户端传入任意方法名使标签无限增长
+type metricsCodec struct {
+	server  string
+	methods map[string]bool
+	rwc     io.ReadWriteCloser
+	dec     *gob.Decoder
+	enc     *gob.Encoder
+	encBuf  *bufio.Writer
+	closed  bool
+
+	lock  sync.Mutex
+	start map[uint64]time.Time //请求序号对应的开始时间
+}
+
+func newMetricsCodec(server string, methods map[string]bool, conn io.ReadWriteCloser) *metricsCodec {
+	buf := bufio.NewWriter(conn)
+	return &metricsCodec{
+		server:  server,
+		methods: methods,
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		start:   make(map[uint64]time.Time),
+	}
+}
+
+func (c *metricsCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.start[r.Seq] = time.Now()
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *metricsCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *metricsCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.lock.Lock()
+	start, ok := c.start[r.Seq]
+	delete(c.start, r.Seq)
+	c.lock.Unlock()
+	if ok {
+		status := "ok"
+		if r.Error != "" {
+			status = "error"
+		}
+		method := r.ServiceMethod
+		if !c.methods[method] {
+			method = "unknown"
+		}
+		rpcRequests.Inc(c.server, method, status)
+		rpcDuration.Since(start, c.server, method)
+	}
+
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("rpc: gob error encoding response:", err)
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("rpc: gob error encoding body:", err)
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *metricsCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
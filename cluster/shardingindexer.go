@@ -4,32 +4,45 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/awesomefly/easysearch/config"
 
 	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/search"
 )
 
 func Index(conf *config.Config) {
 	log.Println("Starting sharding index...")
 
-	start := time.Now()
-	docs, err := index.LoadDocuments(conf.Store.DumpFile)
+	src, err := index.OpenSource(conf.Store.DocumentSource())
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Loaded %d documents in %v", len(docs), time.Since(start))
+	report := &index.ErrorReport{}
+	ch := index.StreamDocuments(src, report)
 
 	shards := conf.Cluster.ShardingNum
+	sim := index.SimilarityFromConfig(conf)
+	priors, err := search.LoadStaticScores(*conf)
+	if err != nil {
+		log.Fatal(err)
+	}
 	idxes := make([]*index.BTreeIndex, 0, shards)
 	for i := 0; i < shards; i++ {
+		//在临时目录中构建, 完成后再发布
 		IndexFile := fmt.Sprintf("%s.%d", conf.Store.IndexFile, i)
-		os.Remove(IndexFile + ".idx")
-		os.Remove(IndexFile + ".kv")
-		os.Remove(IndexFile + ".sum")
+		if err = index.CleanupSegments(IndexFile); err != nil {
+			log.Fatal(err)
+		}
+		file, err := index.NewBuildDir(IndexFile)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-		idx := index.NewBTreeIndex(IndexFile)
+		idx := index.NewBTreeIndex(file)
+		idx.SetSimilarity(sim)
 		idxes = append(idxes, idx)
 	}
 
@@ -38,11 +51,14 @@ func Index(conf *config.Config) {
 		buf[i] = make([]index.Document, 0)
 	}
 
-	start = time.Now()
-	for i := 0; i < len(docs); i++ {
-		id := docs[i].ID % shards
-		buf[id] = append(buf[id], docs[i])
-		//log.Printf("keys:%s", docs[i].Text)
+	start := time.Now()
+	total := 0
+	for doc := <-ch; doc != nil; doc = <-ch {
+		total++
+		id := doc.ID % shards
+		doc.Prior = priors.Get(int32(doc.ID))
+		buf[id] = append(buf[id], *doc)
+		//log.Printf("keys:%s", doc.Text)
 
 		if len(buf[id]) > 20 {
 			idxes[id].Add(buf[id])
@@ -61,5 +77,28 @@ func Index(conf *config.Config) {
 		log.Printf("sharding index_%d has %d keys", i, idxes[i].BT.Count())
 		idxes[i].Close()
 	}
-	log.Printf("build index %d documents in %v", len(docs), time.Since(start))
+
+	//文档来源读取失败(I/O错误或被截断)时不发布任何分片, 当前索引保持不变
+	if report.Fatal != nil {
+		for i := 0; i < shards; i++ {
+			os.RemoveAll(filepath.Dir(idxes[i].IndexFile))
+		}
+		log.Fatal(report.String())
+	}
+
+	//所有分片构建完成后再发布, 避免新旧分片混用
+	for i := 0; i < shards; i++ {
+		IndexFile := fmt.Sprintf("%s.%d", conf.Store.IndexFile, i)
+		if _, err = index.Publish(IndexFile, idxes[i].IndexFile); err != nil {
+			log.Fatal(err)
+		}
+		//上一个段保留到下一次发布, 等待DataServer Reload
+		if err = index.CleanupSegments(IndexFile); err != nil {
+			log.Print(err)
+		}
+	}
+	if report.Skipped > 0 {
+		log.Println(report.String())
+	}
+	log.Printf("build index %d documents in %v", total, time.Since(start))
 }
@@ -4,27 +4,300 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"runtime"
 
 	"gopkg.in/yaml.v2"
 )
 
+// BM25Parameters K1为0时使用默认值2, B未配置时使用默认值0.75, 可以显式配置为0(不做长度归一化)
 type BM25Parameters struct {
-	K1 float32 `yaml:"K1"`
-	B  float32 `yaml:"B"`
+	K1 float32  `yaml:"K1"`
+	B  *float32 `yaml:"B"`
+
+	//BM25F字段参数, key为title|url, 配置后这些字段也会被索引
+	Fields map[string]BM25Field `yaml:"Fields"`
+}
+
+// BM25Field BM25F单个字段的参数, B未配置时使用全局B
+type BM25Field struct {
+	Weight float32  `yaml:"Weight"`
+	B      *float32 `yaml:"B"`
+}
+
+// SimilarityParameters 默认打分模型及非BM25模型的参数, 为0时使用默认值
+type SimilarityParameters struct {
+	Model  string  `yaml:"Model"`  //boolean|vs|bm25|bm25+|lm_dirichlet|lm_jm|dfr|ib, 默认bm25
+	Delta  float32 `yaml:"Delta"`  //bm25+的下界, 默认1
+	Mu     float32 `yaml:"Mu"`     //lm_dirichlet的平滑参数, 默认2000
+	Lambda float32 `yaml:"Lambda"` //lm_jm的平滑参数, 默认0.7
+
+	PriorWeight float32 `yaml:"PriorWeight"` //文档静态分(Storage.PriorFile)的权重, 默认0不参与打分
+}
+
+// PageRank 离线计算文档静态分的参数, 为0时使用默认值
+type PageRank struct {
+	Damping    float32 `yaml:"Damping"`    //阻尼系数, 默认0.85
+	Iterations int     `yaml:"Iterations"` //最大迭代次数, 默认50
+	Tolerance  float32 `yaml:"Tolerance"`  //两次迭代的L1距离小于该值时停止, 默认1e-6
+}
+
+// WithDefault 未配置的参数使用默认值
+func (p PageRank) WithDefault() PageRank {
+	if p.Damping <= 0 || p.Damping >= 1 {
+		p.Damping = 0.85
+	}
+	if p.Iterations <= 0 {
+		p.Iterations = 50
+	}
+	if p.Tolerance <= 0 {
+		p.Tolerance = 1e-6
+	}
+	return p
+}
+
+// Vector 向量字段的HNSW参数, 为0时使用默认值
+type Vector struct {
+	Dim            int    `yaml:"Dim"`            //向量维度, 0时取第一个向量的维度
+	Metric         string `yaml:"Metric"`         //cosine|dot, 默认cosine
+	M              int    `yaml:"M"`              //每个节点的邻居数, 默认16
+	EfConstruction int    `yaml:"EfConstruction"` //构建时的候选集大小, 默认200
+	EfSearch       int    `yaml:"EfSearch"`       //查询时的候选集大小, 默认64
+}
+
+// Ranking 多阶段排序: 召回 -> 粗排截断 -> 特征提取及重排 -> topN, 每个阶段的截断数为0时使用默认值
+type Ranking struct {
+	RetrievalK int    `yaml:"RetrievalK"` //每个索引召回的文档数, 默认100
+	ChampionR  int    `yaml:"ChampionR"`  //召回时每个词的胜者表长度, 默认1000
+	RerankK    int    `yaml:"RerankK"`    //按召回得分截断后进入重排的文档数, 默认100
+	TopN       int    `yaml:"TopN"`       //最终返回的文档数, 默认10
+	Model      string `yaml:"Model"`      //重排模型文件(linear或gbdt), 为空时不重排
+	HalfLife   int    `yaml:"HalfLife"`   //时效性特征的半衰期(秒), 默认7天
+}
+
+// WithDefault 未配置的参数使用默认值
+func (r Ranking) WithDefault() Ranking {
+	if r.RetrievalK <= 0 {
+		r.RetrievalK = 100
+	}
+	if r.ChampionR <= 0 {
+		r.ChampionR = 1000
+	}
+	if r.RerankK <= 0 {
+		r.RerankK = 100
+	}
+	if r.TopN <= 0 {
+		r.TopN = 10
+	}
+	if r.HalfLife <= 0 {
+		r.HalfLife = 7 * 24 * 3600
+	}
+	return r
+}
+
+// Paraphrase 查询扩展: 每个查询词分别取词向量近义词及同义词表中的同义词, 扩展词按相似度降权
+type Paraphrase struct {
+	TopN          int     `yaml:"TopN"`          //每个查询词最多取的近义词数, 默认3
+	Threshold     float32 `yaml:"Threshold"`     //近义词的最低cosine相似度, 默认0.6
+	SynonymWeight float32 `yaml:"SynonymWeight"` //同义词表中的词的权重, 默认0.9
+	MaxTerms      int     `yaml:"MaxTerms"`      //一个查询的扩展词总数上限, 默认10
+}
+
+// WithDefault 未配置的参数使用默认值
+func (p Paraphrase) WithDefault() Paraphrase {
+	if p.TopN <= 0 {
+		p.TopN = 3
+	}
+	if p.Threshold <= 0 {
+		p.Threshold = 0.6
+	}
+	if p.SynonymWeight <= 0 {
+		p.SynonymWeight = 0.9
+	}
+	if p.MaxTerms <= 0 {
+		p.MaxTerms = 10
+	}
+	return p
+}
+
+// Word2Vec 训练查询扩展词向量(-m train-paraphrase)的参数, skip-gram及负采样, 为0时使用默认值
+type Word2Vec struct {
+	Dim      int     `yaml:"Dim"`      //向量维度, 默认100
+	Window   int     `yaml:"Window"`   //上下文窗口, 默认5
+	MinCount int     `yaml:"MinCount"` //词频低于MinCount的词不训练, 默认5
+	Negative int     `yaml:"Negative"` //负采样数, 默认5
+	Epochs   int     `yaml:"Epochs"`   //默认5
+	Alpha    float32 `yaml:"Alpha"`    //初始学习率, 线性衰减, 默认0.025
+	Sample   float32 `yaml:"Sample"`   //高频词下采样阈值, 默认0.001, 小于0时不下采样
+	Workers  int     `yaml:"Workers"`  //并发训练数, 默认CPU核数, 多于1个时每个worker只拷贝更新的行, 每轮合并增量
+	Seed     int64   `yaml:"Seed"`     //随机数种子, 默认1
+}
+
+// WithDefault 未配置的参数使用默认值
+func (w Word2Vec) WithDefault() Word2Vec {
+	if w.Dim <= 0 {
+		w.Dim = 100
+	}
+	if w.Window <= 0 {
+		w.Window = 5
+	}
+	if w.MinCount <= 0 {
+		w.MinCount = 5
+	}
+	if w.Negative <= 0 {
+		w.Negative = 5
+	}
+	if w.Epochs <= 0 {
+		w.Epochs = 5
+	}
+	if w.Alpha <= 0 {
+		w.Alpha = 0.025
+	}
+	if w.Sample == 0 {
+		w.Sample = 0.001
+	}
+	if w.Workers <= 0 {
+		w.Workers = runtime.NumCPU()
+	}
+	if w.Seed == 0 {
+		w.Seed = 1
+	}
+	return w
+}
+
+// Hybrid 文本检索与向量检索的融合参数
+type Hybrid struct {
+	Fusion        string  `yaml:"Fusion"`        //rrf(倒数排名融合)|weighted(得分归一化后加权), 默认rrf
+	RRFK          int     `yaml:"RRFK"`          //rrf的排名平滑常数, 默认60
+	LexicalWeight float32 `yaml:"LexicalWeight"` //文本检索的权重, 默认1
+	VectorWeight  float32 `yaml:"VectorWeight"`  //向量检索的权重, 默认1
+}
+
+// Highlight 搜索结果高亮及摘要片段参数, 为0时使用默认值
+type Highlight struct {
+	Enabled      bool   `yaml:"Enabled"`      //DataServer是否从文档来源加载原文用于高亮, 默认false
+	PreTag       string `yaml:"PreTag"`       //命中词前的标签, 默认<em>
+	PostTag      string `yaml:"PostTag"`      //命中词后的标签, 默认</em>
+	FragmentSize int    `yaml:"FragmentSize"` //片段的最大字节数, 默认100
+	Fragments    int    `yaml:"Fragments"`    //每个文档最多返回的片段数, 默认3
+	Escape       bool   `yaml:"Escape"`       //是否对原文做HTML转义, 标签不转义
+}
+
+// WithDefault 未配置的参数使用默认值
+func (h Highlight) WithDefault() Highlight {
+	if h.PreTag == "" {
+		h.PreTag = "<em>"
+	}
+	if h.PostTag == "" {
+		h.PostTag = "</em>"
+	}
+	if h.FragmentSize <= 0 {
+		h.FragmentSize = 100
+	}
+	if h.Fragments <= 0 {
+		h.Fragments = 3
+	}
+	return h
+}
+
+// Cache 查询结果缓存及倒排表缓存, 为0时不缓存
+type Cache struct {
+	Results   int `yaml:"Results"`   //每个分片缓存的查询结果数, 按查询词及索引版本缓存
+	PostingMB int `yaml:"PostingMB"` //btree索引倒排表缓存的内存上限, 节点上所有分片共享
+}
+
+// Metrics 集群节点的Prometheus指标HTTP服务, 默认不开启
+type Metrics struct {
+	Enabled    bool   `yaml:"Enabled"`
+	PortOffset int    `yaml:"PortOffset"` //指标服务的端口为Server.Port+PortOffset, 默认1000
+	Path       string `yaml:"Path"`       //默认/metrics
+	Pprof      bool   `yaml:"Pprof"`      //同时提供/debug/pprof/
+}
+
+// WithDefault 未配置的参数使用默认值
+func (m Metrics) WithDefault() Metrics {
+	if m.PortOffset == 0 {
+		m.PortOffset = 1000
+	}
+	if m.Path == "" {
+		m.Path = "/metrics"
+	}
+	return m
+}
+
+// Address 节点s的指标服务地址
+func (m Metrics) Address(s Server) string {
+	return fmt.Sprint(s.Host, ":", s.Port+m.WithDefault().PortOffset)
+}
+
+type SourceFields struct {
+	ID        string `yaml:"ID"`
+	Title     string `yaml:"Title"`
+	URL       string `yaml:"URL"`
+	Text      string `yaml:"Text"`
+	Timestamp string `yaml:"Timestamp"`
+	Links     string `yaml:"Links"`  //出链, jsonl为字符串数组, csv以|分隔
+	Vector    string `yaml:"Vector"` //向量, jsonl为数字数组, csv以|、逗号或空格分隔
+}
+
+// WithDefault 未配置的字段使用默认字段名
+func (f SourceFields) WithDefault() SourceFields {
+	if f.ID == "" {
+		f.ID = "id"
+	}
+	if f.Title == "" {
+		f.Title = "title"
+	}
+	if f.URL == "" {
+		f.URL = "url"
+	}
+	if f.Text == "" {
+		f.Text = "text"
+	}
+	if f.Timestamp == "" {
+		f.Timestamp = "timestamp"
+	}
+	if f.Links == "" {
+		f.Links = "links"
+	}
+	if f.Vector == "" {
+		f.Vector = "vector"
+	}
+	return f
+}
+
+// Source 文档数据源, Type: wiki|jsonl|csv|textdir
+type Source struct {
+	Type   string       `yaml:"Type"`
+	Path   string       `yaml:"Path"`
+	Fields SourceFields `yaml:"Fields"` //jsonl与csv的字段名
 }
 
 type Storage struct {
-	DumpFile  string `yaml:"DumpFile"`
-	IndexFile string `yaml:"IndexFile"`
-	ModelFile string `yaml:"ModelFile"`
+	DumpFile    string `yaml:"DumpFile"`
+	IndexFile   string `yaml:"IndexFile"`
+	ModelFile   string `yaml:"ModelFile"`
+	SynonymFile string `yaml:"SynonymFile"` //同义词表, 格式同Solr, 与ModelFile一起用于查询扩展
+	DataDir     string `yaml:"DataDir"`     //节点本地数据目录, 如ManagerServer元数据日志与快照
+	PriorFile   string `yaml:"PriorFile"`   //文档静态分文件, 每行"docID score", 由-m pagerank生成或外部提供
+	Source      Source `yaml:"Source"`
+}
+
+// DocumentSource 未配置Source时使用DumpFile指定的wiki dump
+func (s *Storage) DocumentSource() Source {
+	if s.Source.Type != "" {
+		return s.Source
+	}
+	return Source{Type: "wiki", Path: s.DumpFile}
 }
 
 type Cluster struct {
-	ShardingNum  int      `yaml:"ShardingNum"`
-	ReplicateNum int      `yaml:"ReplicateNum"`
-	ManageServer Server   `yaml:"ManageServer"`
-	SearchServer []Server `yaml:"SearchServer"`
-	DataServer   []Server `yaml:"DataServer"`
+	ShardingNum   int      `yaml:"ShardingNum"`
+	ReplicateNum  int      `yaml:"ReplicateNum"`
+	AckReplicaNum int      `yaml:"AckReplicaNum"` //写入时需要确认的备份分片数
+	ManageServer  Server   `yaml:"ManageServer"`
+	ManageServers []Server `yaml:"ManageServers"` //多个ManagerServer通过raft复制元数据
+	SearchServer  []Server `yaml:"SearchServer"`
+	DataServer    []Server `yaml:"DataServer"`
 }
 
 type Server struct {
@@ -36,11 +309,59 @@ func (s *Server) Address() string {
 	return fmt.Sprint(s.Host, ":", s.Port)
 }
 
+// Managers returns all manager servers, ManageServers takes precedence over ManageServer
+func (c *Cluster) Managers() []Server {
+	if len(c.ManageServers) > 0 {
+		return c.ManageServers
+	}
+	return []Server{c.ManageServer}
+}
+
+// Build 离线构建索引参数
+type Build struct {
+	Workers    int    `yaml:"Workers"`    //分词并发数, 默认CPU核数
+	Builders   int    `yaml:"Builders"`   //并发构建的内存段数
+	MemoryMB   int    `yaml:"MemoryMB"`   //所有内存段的内存上限(估算), 超过后落盘为run文件
+	MergeFanIn int    `yaml:"MergeFanIn"` //单轮归并最多打开的run文件数
+	Format     string `yaml:"Format"`     //全量索引格式 btree|mmap, 默认btree
+}
+
+// WithDefault 未配置的参数使用默认值
+func (b Build) WithDefault() Build {
+	if b.Workers <= 0 {
+		b.Workers = runtime.NumCPU()
+	}
+	if b.Builders <= 0 {
+		b.Builders = 2
+	}
+	if b.MemoryMB <= 0 {
+		b.MemoryMB = 512
+	}
+	if b.MergeFanIn < 2 {
+		b.MergeFanIn = 64
+	}
+	if b.Format == "" {
+		b.Format = "btree"
+	}
+	return b
+}
+
 type Config struct {
-	Store   Storage        `yaml:"Storage"`
-	BM25    BM25Parameters `yaml:"BM25"`
-	Server  Server         `yaml:"Server"`
-	Cluster Cluster        `yaml:"Cluster"`
+	Store      Storage              `yaml:"Storage"`
+	BM25       BM25Parameters       `yaml:"BM25"`
+	Similarity SimilarityParameters `yaml:"Similarity"`
+	Server     Server               `yaml:"Server"`
+	Cluster    Cluster              `yaml:"Cluster"`
+	Build      Build                `yaml:"Build"`
+	PageRank   PageRank             `yaml:"PageRank"`
+	Ranking    Ranking              `yaml:"Ranking"`
+	Vector     Vector               `yaml:"Vector"`
+	Hybrid     Hybrid               `yaml:"Hybrid"`
+	Paraphrase Paraphrase           `yaml:"Paraphrase"`
+	Word2Vec   Word2Vec             `yaml:"Word2Vec"`
+	Highlight  Highlight            `yaml:"Highlight"`
+	Cache      Cache                `yaml:"Cache"`
+	Metrics    Metrics              `yaml:"Metrics"`
 }
 
 func InitClusterConfig(path string) *Cluster {
@@ -69,6 +390,9 @@ func InitConfig(path string) *Config {
 	if err = yaml.Unmarshal(buffer, &config); err != nil {
 		panic(err.Error())
 	}
+	if config.Store.DataDir == "" {
+		config.Store.DataDir = "./data"
+	}
 	fmt.Printf("config: %+v\n", config)
 	return &config
 }
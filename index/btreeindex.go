@@ -25,14 +25,11 @@
 package index
 
 import (
-	"bytes"
-	"encoding/binary"
-	"io"
+	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
-	"unsafe"
 
-	"github.com/awesomefly/easysearch/util"
 	btree "github.com/awesomefly/gobtree"
 )
 
@@ -57,13 +54,47 @@ type BTreeIndex struct {
 	BT        *btree.BTree
 	IndexFile string
 
-	property Property
+	property   Property
+	similarity SimilarityConfig
+	priors     StaticScores
+	times      Timestamps
+	vectors    *HNSW
+	sorted     bool //倒排表按文档ID排序, 记录在清单中
+	refs       refCount
+	cache      *PostingCache //为nil时不缓存
 }
 
 func NewBTreeIndex(file string) *BTreeIndex {
+	bt := newBTreeIndex(file)
+	if err := bt.Load(); err != nil {
+		panic(err.Error())
+	}
+	return bt
+}
+
+// OpenBTreeIndex opens an existing index and verifies its manifest.
+// 清单缺失、文件损坏或格式不兼容时返回错误
+func OpenBTreeIndex(file string) (*BTreeIndex, error) {
+	m, err := ReadManifest(file)
+	if err != nil {
+		return nil, fmt.Errorf("open index %s: %w", file, err)
+	}
+	if err = m.Verify(filepath.Dir(file)); err != nil {
+		return nil, fmt.Errorf("open index %s: %v", file, err)
+	}
+
+	bt := newBTreeIndex(file)
+	if err = bt.Load(); err != nil {
+		bt.BT.Close()
+		return nil, fmt.Errorf("open index %s: %v", file, err)
+	}
+	return bt, nil
+}
+
+func newBTreeIndex(file string) *BTreeIndex {
 	conf := DefaultConfig
 	conf.Idxfile, conf.Kvfile = file+".idx", file+".kv"
-	bt := BTreeIndex{
+	return &BTreeIndex{
 		IndexFile: file,
 		BT:        btree.NewBTree(btree.NewStore(conf)), // todo: 索引文件太大，索引压缩、posting list压缩
 		property: Property{
@@ -71,93 +102,121 @@ func NewBTreeIndex(file string) *BTreeIndex {
 			tokenCount: 0,
 			dataRange: DataRange{Start: 0, End: 0},
 		},
+		similarity: DefaultSimilarity(),
+		refs:       newRefCount(),
 	}
-
-	bt.Load()
-	return &bt
 }
 
+// Save property to .sum file
 func (bt *BTreeIndex) Save() {
-	file := bt.IndexFile + ".sum"
-	os.Create(file)
-
-	// Index store
-	fd, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0660)
-	if err != nil {
+	if err := writeSummary(bt.IndexFile+".sum", &bt.property); err != nil {
 		panic(err.Error())
 	}
+}
 
-	buffer := bytes.NewBuffer([]byte{})
-	if err := binary.Write(buffer, binary.LittleEndian, int32(bt.property.docNum)); err != nil {
-		panic(err)
-	}
-
-	if err := binary.Write(buffer, binary.LittleEndian, int32(bt.property.tokenCount)); err != nil {
-		panic(err)
+// Load property from .sum file, static scores from .prior file, timestamps from .time file and vectors from .hnsw file
+func (bt *BTreeIndex) Load() error {
+	if err := readSummary(bt.IndexFile+".sum", &bt.property); err != nil {
+		return err
 	}
-
-	if err := binary.Write(buffer, binary.LittleEndian, int32(bt.property.dataRange.Start)); err != nil {
-		panic(err)
+	priors, err := LoadPriors(bt.IndexFile)
+	if err != nil {
+		return err
 	}
-	if err := binary.Write(buffer, binary.LittleEndian, int32(bt.property.dataRange.End)); err != nil {
-		panic(err)
+	bt.priors = priors
+	if bt.times, err = LoadTimestamps(bt.IndexFile); err != nil {
+		return err
 	}
-
-	if _, err := fd.Write(buffer.Bytes()); err != nil {
-		panic(err)
+	if bt.vectors, err = LoadVectors(bt.IndexFile); err != nil {
+		return err
 	}
-	fd.Close()
+	return nil
 }
 
-func (bt *BTreeIndex) Load() {
-	// Index store
-	file := bt.IndexFile + ".sum"
-	fd, err := os.OpenFile(file, os.O_RDONLY|os.O_CREATE, 0660)
-	if err != nil {
+// Close drains btree to disk and writes summary, static scores, timestamps, vectors and manifest
+func (bt *BTreeIndex) Close() {
+	bt.BT.Drain()
+	bt.BT.Close()
+	bt.Save()
+	if err := SavePriors(bt.IndexFile, bt.priors); err != nil {
 		panic(err.Error())
 	}
-
-	data := make([]byte, unsafe.Sizeof(bt.property.docNum)+unsafe.Sizeof(bt.property.tokenCount))
-	if n, err := fd.Read(data); err != nil {
-		if n == 0 && err == io.EOF {
-			return
-		}
+	if err := SaveTimestamps(bt.IndexFile, bt.times); err != nil {
 		panic(err.Error())
 	}
-
-	buffer := bytes.NewBuffer(data)
-	if err := binary.Read(buffer, binary.LittleEndian, (*int32)(unsafe.Pointer(&bt.property.docNum))); err != nil {
+	if err := SaveVectors(bt.IndexFile, bt.vectors); err != nil {
 		panic(err.Error())
 	}
 
-	if err := binary.Read(buffer, binary.LittleEndian, (*int32)(unsafe.Pointer(&bt.property.tokenCount))); err != nil {
-		panic(err.Error())
-	}
-	if err := binary.Read(buffer, binary.LittleEndian, (*int32)(unsafe.Pointer(&bt.property.dataRange.Start))); err != nil {
+	exts := timestampExts(bt.times, priorExts(bt.priors, ".idx", ".kv", ".sum")...)
+	m, err := NewManifest(bt.IndexFile, &bt.property, vectorExts(bt.vectors, exts...)...)
+	if err != nil {
 		panic(err.Error())
 	}
-	if err := binary.Read(buffer, binary.LittleEndian, (*int32)(unsafe.Pointer(&bt.property.dataRange.End))); err != nil {
+	m.Format = FormatBTree
+	m.Sorted = bt.sorted
+	if err = m.Write(bt.IndexFile); err != nil {
 		panic(err.Error())
 	}
-
-	fd.Close()
-}
-
-func (bt *BTreeIndex) Close() {
-	bt.BT.Drain()
-	bt.BT.Close()
-	bt.Save()
 }
 
 func (bt *BTreeIndex) Clear() {
-	bt.Close()
+	bt.BT.Close()
+	bt.cache.Invalidate(bt.IndexFile)
 
 	// delete deprecated index
+	os.Remove(bt.IndexFile + ManifestSuffix)
 	os.Remove(bt.IndexFile + ".sum")
+	os.Remove(bt.IndexFile + PriorSuffix)
+	os.Remove(bt.IndexFile + TimestampSuffix)
+	os.Remove(bt.IndexFile + VectorSuffix)
 	os.Remove(bt.IndexFile + ".idx")
 	os.Remove(bt.IndexFile + ".kv")
 }
 
+// Acquire 查询前增加引用计数, 索引已被删除时返回false
+func (bt *BTreeIndex) Acquire() bool {
+	return bt.refs.acquire()
+}
+
+// Release 查询结束后释放引用, 最后一个引用释放时删除已退役的索引
+func (bt *BTreeIndex) Release() {
+	if bt.refs.release() {
+		bt.Clear()
+		removeSegmentDir(bt.IndexFile)
+	}
+}
+
+// Retire 索引被替换后释放创建者的引用, 进行中的查询释放后再删除
+func (bt *BTreeIndex) Retire() {
+	if bt.refs.retire() {
+		bt.Release()
+	}
+}
+
+func (bt *BTreeIndex) File() string {
+	return bt.IndexFile
+}
+
+// Range 按key顺序遍历所有倒排表, fn返回错误时停止遍历
+func (bt *BTreeIndex) Range(fn func(key string, pl PostingList) error) error {
+	var err error
+	ch := bt.BT.FullSet()
+	for {
+		k, d, v := <-ch, <-ch, <-ch
+		if k == nil || d == nil || v == nil {
+			break
+		}
+		if err != nil {
+			continue //读完channel, 避免阻塞btree
+		}
+		var pl PostingList
+		pl.FromBytes(v)
+		err = fn(string(k), pl)
+	}
+	return err
+}
+
 func (bt *BTreeIndex) Keys() []string {
 	keys := make(sort.StringSlice, bt.Property().tokenCount)
 
@@ -203,50 +262,75 @@ func (bt *BTreeIndex) Lookup(token string, dirty bool) PostingList {
 // 因此需要移动到新的空间，导致文件数据拷贝
 func (bt *BTreeIndex) Add(docs []Document) {
 	for _, doc := range docs {
-		tokens := util.Analyze(doc.Text)
-		for _, token := range tokens {
-			//log.Printf("token:%s", token)
-			key := &btree.TestKey{K: token}
-			postingList := bt.Lookup(token, true)
-			if postingList != nil {
-				if last := postingList.Find(doc.ID); last != nil {
-					// Don't add same ID twice. But should update frequency
-					last.TF++
-					last.QualityScore = CalDocScore(last.TF, 0)
-					bt.BT.Insert(key, postingList)
-					continue
-				}
-			}
-			item := Doc{
-				ID:           int32(doc.ID),
-				DocLen:       int32(len(tokens)),
-				TF:           1,
-				QualityScore: CalDocScore(1, 0),
+		for _, field := range AnalyzeDocument(doc, &bt.similarity) {
+			bt.addField(doc, field.Tokens)
+			bt.property.AddFieldTokens(field.Field, len(field.Tokens))
+		}
+		if doc.Prior != 0 {
+			if bt.priors == nil {
+				bt.priors = make(StaticScores)
 			}
-			//add to posting list & sort by score
-			postingList = append(postingList, item)
-			sort.Slice(postingList, func(i, j int) bool {
-				return postingList[i].QualityScore > postingList[j].QualityScore
-			})
-			bt.BT.Insert(key, postingList)
+			bt.priors[int32(doc.ID)] = doc.Prior
 		}
+		bt.times = addTimestamp(bt.times, doc)
+		bt.vectors = addVector(bt.vectors, doc, bt.similarity.Vector)
 		bt.property.docNum++
-		bt.property.tokenCount += len(tokens)
 	}
 	bt.BT.Drain()
 }
 
+// addField DocLen为字段的长度, Pos为词第一次出现的位置
+func (bt *BTreeIndex) addField(doc Document, tokens []string) {
+	for i, token := range tokens {
+		//log.Printf("token:%s", token)
+		key := &btree.TestKey{K: token}
+		bt.cache.remove(bt.IndexFile, token)
+		postingList := bt.Lookup(token, true)
+		if postingList != nil {
+			if last := postingList.Find(doc.ID); last != nil {
+				// Don't add same ID twice. But should update frequency
+				last.TF++
+				last.QualityScore = CalDocScore(last.TF, doc.Prior)
+				bt.BT.Insert(key, postingList)
+				continue
+			}
+		}
+		item := Doc{
+			ID:           int32(doc.ID),
+			DocLen:       int32(len(tokens)),
+			TF:           1,
+			Pos:          int32(i + 1),
+			QualityScore: CalDocScore(1, doc.Prior),
+		}
+		//add to posting list & sort by score
+		postingList = append(postingList, item)
+		sort.Slice(postingList, func(i, j int) bool {
+			return postingList[i].QualityScore > postingList[j].QualityScore
+		})
+		bt.BT.Insert(key, postingList)
+	}
+}
+
 func (bt *BTreeIndex) Insert(key string, pl PostingList) {
+	bt.cache.remove(bt.IndexFile, key)
 	bt.BT.Insert(&btree.TestKey{K: key}, pl)
 	bt.property.docNum += pl.Len()
 	bt.property.tokenCount++
 }
 
+// Get 返回的倒排表只读, 设置了PostingCache时优先从缓存读取
 func (bt *BTreeIndex) Get(term string) []Doc {
-	if postingList := bt.Lookup(term, false); postingList != nil {
+	if postingList, ok := bt.cache.get(bt.IndexFile, term); ok {
 		return postingList
 	}
-	return nil
+	postingList := bt.Lookup(term, false)
+	bt.cache.put(bt.IndexFile, term, postingList)
+	return postingList
+}
+
+// SetPostingCache 设置倒排表缓存, 需要在查询前调用
+func (bt *BTreeIndex) SetPostingCache(c *PostingCache) {
+	bt.cache = c
 }
 
 func (bt *BTreeIndex) Property() *Property {
@@ -257,6 +341,47 @@ func (bt *BTreeIndex) SetProperty(p Property) {
 	bt.property = p
 }
 
+func (bt *BTreeIndex) StaticScores() StaticScores {
+	return bt.priors
+}
+
+// SetStaticScores 设置索引中文档的静态分, Close时保存
+func (bt *BTreeIndex) SetStaticScores(s StaticScores) {
+	bt.priors = s
+}
+
+func (bt *BTreeIndex) Timestamps() Timestamps {
+	return bt.times
+}
+
+// MarkSorted 标记倒排表按文档ID排序(归并生成), Close时记录在清单中
+func (bt *BTreeIndex) MarkSorted() {
+	bt.sorted = true
+}
+
+// SetTimestamps 设置索引中文档的时间, Close时保存
+func (bt *BTreeIndex) SetTimestamps(t Timestamps) {
+	bt.times = t
+}
+
+func (bt *BTreeIndex) Vectors() *HNSW {
+	return bt.vectors
+}
+
+// SetVectors 设置索引中文档的向量, Close时保存
+func (bt *BTreeIndex) SetVectors(h *HNSW) {
+	bt.vectors = h
+}
+
+func (bt *BTreeIndex) Similarity() *SimilarityConfig {
+	return &bt.similarity
+}
+
+// SetSimilarity 设置打分参数, 需要在添加文档前设置, 以索引配置的字段
+func (bt *BTreeIndex) SetSimilarity(sim SimilarityConfig) {
+	bt.similarity = sim
+}
+
 func (bt *BTreeIndex) Retrieval(must []string, should []string, not []string, k int, r int, m SearchModel) []Doc {
-	return DoRetrieval(bt, must, should, not, k, r, m)
+	return retrieval(bt, must, should, not, k, r, m)
 }
\ No newline at end of file
@@ -0,0 +1,72 @@
+package index
+
+import (
+	"strings"
+	"unsafe"
+
+	"github.com/awesomefly/easysearch/util"
+)
+
+// PostingCache 查询频繁的词的倒排表缓存, 避免每次查询都从.kv文件读取, 按内存上限LRU淘汰.
+// key为索引文件及词, 可以在多个索引间共享. 不存在的词也会缓存
+type PostingCache struct {
+	lru *util.LRU
+}
+
+// NewPostingCache mb为内存上限, 小于等于0时返回nil, 即不缓存
+func NewPostingCache(mb int) *PostingCache {
+	if mb <= 0 {
+		return nil
+	}
+	return &PostingCache{lru: util.NewLRU(int64(mb) << 20)}
+}
+
+func postingKey(file string, term string) string {
+	return file + "\x00" + term
+}
+
+func (c *PostingCache) get(file string, term string) (PostingList, bool) {
+	if c == nil {
+		return nil, false
+	}
+	v, ok := c.lru.Get(postingKey(file, term))
+	if !ok {
+		return nil, false
+	}
+	return v.(PostingList), true
+}
+
+// put 缓存的倒排表只读, 截断容量避免调用方append时修改缓存
+func (c *PostingCache) put(file string, term string, pl PostingList) {
+	if c == nil {
+		return
+	}
+	key := postingKey(file, term)
+	size := int64(len(key)) + int64(len(pl))*int64(unsafe.Sizeof(Doc{}))
+	c.lru.Add(key, pl[:len(pl):len(pl)], size)
+}
+
+func (c *PostingCache) remove(file string, term string) {
+	if c == nil {
+		return
+	}
+	c.lru.Remove(postingKey(file, term))
+}
+
+// Invalidate 删除索引文件file的所有缓存, 索引被替换或删除时调用
+func (c *PostingCache) Invalidate(file string) {
+	if c == nil {
+		return
+	}
+	prefix := file + "\x00"
+	c.lru.RemoveIf(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+func (c *PostingCache) Stats() util.CacheStats {
+	if c == nil {
+		return util.CacheStats{}
+	}
+	return c.lru.Stats()
+}
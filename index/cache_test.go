@@ -0,0 +1,46 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostingCache(t *testing.T) {
+	assert.Nil(t, NewPostingCache(0))
+
+	dir, _ := ioutil.TempDir("", "posting_cache")
+	defer os.RemoveAll(dir)
+	idx := NewBTreeIndex(filepath.Join(dir, "idx"))
+	idx.Add([]Document{{ID: 1, Text: "donut plate"}, {ID: 2, Text: "donut"}})
+
+	c := NewPostingCache(1)
+	idx.SetPostingCache(c)
+	assert.Equal(t, []int{1, 2}, GetIDs(idx.Get("donut")))
+	assert.Equal(t, []int{1, 2}, GetIDs(idx.Get("donut")))
+	assert.Nil(t, idx.Get("glass"))
+	assert.Nil(t, idx.Get("glass")) //不存在的词也缓存
+	s := c.Stats()
+	assert.Equal(t, int64(2), s.Hits)
+	assert.Equal(t, int64(2), s.Misses)
+	assert.Equal(t, int64(2), s.Entries)
+
+	//写入后重新读取
+	idx.Add([]Document{{ID: 3, Text: "glass"}})
+	assert.Equal(t, []int{3}, GetIDs(idx.Get("glass")))
+	idx.Insert("glass", PostingList{{ID: 4, TF: 1}})
+	idx.BT.Drain()
+	assert.Equal(t, []int{4}, GetIDs(idx.Get("glass")))
+
+	//缓存的倒排表append时不修改缓存
+	pl := idx.Get("donut")
+	_ = append(pl, Doc{ID: 9})
+	assert.Equal(t, []int{1, 2}, GetIDs(idx.Get("donut")))
+
+	c.Invalidate(filepath.Join(dir, "idx"))
+	assert.Equal(t, int64(0), c.Stats().Entries)
+	idx.Clear()
+}
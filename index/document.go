@@ -1,12 +1,7 @@
 package index
 
 import (
-	"compress/gzip"
-	"encoding/xml"
-	"fmt"
-	"io"
 	"log"
-	"os"
 	"path/filepath"
 )
 
@@ -17,6 +12,11 @@ type Document struct {
 	Text  string `xml:"abstract"`
 	Timestamp int
 	ID    int
+
+	Links []string `xml:"links>sublink>link"` //出链, URL或标题, 用于计算PageRank
+	Prior float64  `xml:"-"`                  //静态分, 构建索引时由Storage.PriorFile设置
+
+	Vector []float32 `xml:"-"` //向量字段, 用于近似最近邻检索
 }
 
 // LoadDocuments loads a Wikipedia abstract dump and returns a slice of documents.
@@ -26,88 +26,35 @@ func LoadDocuments(path string) ([]Document, error) {
 	if err != nil {
 		return nil, err
 	}
-	f, err := os.Open(abspath)
+	src, err := NewWikiSource(abspath)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	gz, err := gzip.NewReader(f)
-	if err != nil {
-		return nil, err
+	docs, report := ReadAll(src)
+	if report.Fatal != nil {
+		return nil, report.Fatal
 	}
-	defer gz.Close()
-
-
-	dump := struct {
-		Documents []Document `xml:"doc"`
-	}{}
-	dec := xml.NewDecoder(gz)
-	dec.Token()
-	if err := dec.Decode(&dump); err != nil {
-		return nil, err
+	if report.Skipped > 0 {
+		log.Println(report.String())
 	}
-	docs := dump.Documents
 	for i := range docs {
 		docs[i].ID = i
 	}
 	return docs, nil
 }
 
-func LoadDocumentStream(path string) (chan *Document, error) {
+// LoadDocumentStream loads a Wikipedia abstract dump as stream, a nil document means the end of stream.
+// 跳过的错误记录及致命错误写入返回的report, 读到nil后有效
+func LoadDocumentStream(path string) (chan *Document, *ErrorReport, error) {
 	abspath, err := filepath.Abs(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	f, err := os.Open(abspath)
+	src, err := NewWikiSource(abspath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	gz, err := gzip.NewReader(f)
-	if err != nil {
-		return nil, err
-	}
-
-	ch := make(chan *Document, 10)
-
-	dec := xml.NewDecoder(gz)
-	go func() {
-		defer f.Close()
-		defer gz.Close()
-		id := 0
-		for {
-			tok, err := dec.Token()
-			if tok == nil && err == io.EOF {
-				ch <- nil
-				// EOF means we're done.
-				log.Println("EOF means we're done.")
-				break
-			} else if err != nil {
-				//log.Fatalf("Error decoding token: %s", err.Error())
-				panic(err)
-			}
-
-			switch ty := tok.(type) {
-			case xml.StartElement:
-				if ty.Name.Local == "doc" {
-					// If this is a start element named "location", parse this element
-					// fully.
-					doc := Document{}
-					if err = dec.DecodeElement(&doc, &ty); err != nil {
-						//log.Fatalf("Error decoding item: %s", err.Error())
-						panic(err)
-					}
-					id++
-					doc.ID = id
-					ch <- &doc
-					if id % 5000 == 0 {
-						fmt.Printf("load %d docs\n", id)
-					}
-				}
-			default:
-			}
-		}
-	}()
-	return ch, nil
-}
\ No newline at end of file
+	report := &ErrorReport{}
+	return StreamDocuments(src, report), report, nil
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func TestLoadDocumentStream(t *testing.T) {
-	ch, err := LoadDocumentStream("../data/tem.xml")
+	ch, report, err := LoadDocumentStream("../data/tem.xml")
 	if err != nil {
 		log.Fatal(err)
 		return
@@ -20,6 +20,7 @@ func TestLoadDocumentStream(t *testing.T) {
 		case doc := <-ch:
 			if doc == nil {
 				fmt.Println("doc is nil")
+				fmt.Println(report.String())
 				return
 			}
 			fmt.Println(doc)
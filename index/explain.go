@@ -0,0 +1,90 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func (m SearchModel) String() string {
+	return string(m)
+}
+
+// 索引层级
+const (
+	TierFull = "full"
+	TierAux  = "aux"
+	TierIncr = "incr"
+)
+
+// TermExplain 单个词的得分明细
+type TermExplain struct {
+	Term    string
+	TF      int32   //词在文档中的词频
+	QueryTF int32   //词在查询中的词频
+	IDF     float64 //CalIDF(docNum, df)
+	Boost   float64 //查询扩展词的权重, 原查询词为0
+	Score   float64 //该词的部分得分, 未取整
+
+	Fields []FieldFreq //词在各字段中的词频及字段长度, boolean及vs模型为空
+}
+
+// Explanation 命中文档的得分明细
+type Explanation struct {
+	DocID int32
+	Model string
+	Score float64 //召回阶段的得分, 保留4位小数; 重排后结果的得分为Rerank
+
+	DocLen float64 //正文长度, boolean及vs模型为0
+	AvgDL  float64 //正文平均长度
+	K1     float64
+	B      float64
+	Terms  []TermExplain //按词排序
+
+	Prior       float64 //文档静态分
+	PriorWeight float64 //静态分权重, 为0时不参与打分
+
+	Features Features //重排特征, 按FeatureNames排列, 未重排时为空
+	Rerank   float64  //重排模型的得分, 即结果的最终得分
+
+	Tier  string //命中的索引层级 full|aux|incr
+	Index string //命中的索引文件
+	Shard int    //命中的分片, 单机搜索为-1
+}
+
+func (e *Explanation) sortTerms() {
+	sort.Slice(e.Terms, func(i, j int) bool { return e.Terms[i].Term < e.Terms[j].Term })
+}
+
+func (e Explanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "doc %d score %.4f (%s, tier %s, shard %d, index %s)\n", e.DocID, e.Score, e.Model, e.Tier, e.Shard, e.Index)
+	if e.K1 > 0 {
+		fmt.Fprintf(&b, "  docLen %.0f avgdl %.4f k1 %g b %g\n", e.DocLen, e.AvgDL, e.K1, e.B)
+	} else if e.AvgDL > 0 {
+		fmt.Fprintf(&b, "  docLen %.0f avgdl %.4f\n", e.DocLen, e.AvgDL)
+	}
+	if e.PriorWeight > 0 {
+		fmt.Fprintf(&b, "  prior %.4f weight %g\n", e.Prior, e.PriorWeight)
+	}
+	if len(e.Features) > 0 {
+		fmt.Fprintf(&b, "  rerank %.4f:", e.Rerank)
+		for i, f := range e.Features {
+			fmt.Fprintf(&b, " %s %.4f", FeatureNames[i], f)
+		}
+		b.WriteByte('\n')
+	}
+	for _, t := range e.Terms {
+		if t.Boost > 0 {
+			fmt.Fprintf(&b, "  %s: tf %d qtf %d idf %.4f boost %.4f score %.4f\n", t.Term, t.TF, t.QueryTF, t.IDF, t.Boost, t.Score)
+		} else {
+			fmt.Fprintf(&b, "  %s: tf %d qtf %d idf %.4f score %.4f\n", t.Term, t.TF, t.QueryTF, t.IDF, t.Score)
+		}
+		for _, f := range t.Fields {
+			if f.Field != TextField {
+				fmt.Fprintf(&b, "    %s: tf %d len %d\n", f.Field, f.TF, f.DocLen)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,48 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoRetrievalExplain(t *testing.T) {
+	idx := NewHashMapIndex()
+	idx.Add([]Document{
+		{ID: 1, Text: "A donut on a glass plate. Only the donut"},
+		{ID: 2, Text: "donut is a donut"},
+		{ID: 3, Text: "glass"},
+	})
+
+	for _, model := range []SearchModel{BM25, VectorSpace, Boolean} {
+		docs, explains, err := DoRetrievalExplain(idx, []string{"donut"}, []string{"glass"}, nil, 10, 100, model)
+		assert.Nil(t, err)
+		plain, _ := DoRetrieval(idx, []string{"donut"}, []string{"glass"}, nil, 10, 100, model)
+		assert.Equal(t, plain, docs)
+		assert.Equal(t, len(docs), len(explains))
+
+		for _, doc := range docs {
+			e := explains[doc.ID]
+			assert.Equal(t, model.String(), e.Model)
+			assert.Equal(t, doc.Score, e.Score)
+
+			var sum float64
+			for _, term := range e.Terms {
+				assert.True(t, term.TF > 0)
+				assert.Equal(t, int32(1), term.QueryTF)
+				sum += term.Score
+			}
+			assert.InDelta(t, e.Score, sum, 0.0001)
+		}
+	}
+
+	_, explains, _ := DoRetrievalExplain(idx, []string{"donut"}, []string{"glass"}, nil, 10, 100, BM25)
+	e := explains[1]
+	assert.Equal(t, 2, len(e.Terms))
+	assert.Equal(t, "donut", e.Terms[0].Term)
+	assert.Equal(t, int32(2), e.Terms[0].TF)
+	assert.Equal(t, CalIDF(idx.Property().DocNum(), 2), e.Terms[0].IDF)
+	assert.Equal(t, float64(2), e.K1)
+	assert.Equal(t, 0.75, e.B)
+	assert.Contains(t, e.String(), "donut: tf 2")
+}
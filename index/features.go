@@ -0,0 +1,169 @@
+package index
+
+import (
+	"math"
+)
+
+// 排序特征: 召回后为候选文档提取特征, 供重排模型打分. 特征值按FeatureNames排列
+
+const (
+	FeatureScore     = "score"      //召回阶段的得分
+	FeatureBM25Text  = "bm25_text"  //正文单独计算的BM25
+	FeatureBM25Title = "bm25_title" //标题单独计算的BM25, 未索引标题时为0
+	FeatureBM25URL   = "bm25_url"   //URL单独计算的BM25, 未索引URL时为0
+	FeatureCoverage  = "coverage"   //命中的查询词占比
+	FeatureProximity = "proximity"  //查询词的紧密度
+	FeatureStatic    = "static"     //文档静态分
+	FeatureFreshness = "freshness"  //时效性
+)
+
+var FeatureNames = []string{
+	FeatureScore, FeatureBM25Text, FeatureBM25Title, FeatureBM25URL,
+	FeatureCoverage, FeatureProximity, FeatureStatic, FeatureFreshness,
+}
+
+// 特征在FeatureNames中的位置
+const (
+	featScore = iota
+	featBM25Text
+	featBM25Title
+	featBM25URL
+	featCoverage
+	featProximity
+	featStatic
+	featFreshness
+)
+
+// FeatureIndex 特征在FeatureNames中的位置, 不存在时为-1
+func FeatureIndex(name string) int {
+	for i, f := range FeatureNames {
+		if f == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Features 一个文档的特征值
+type Features []float64
+
+// Get 按名称取特征值
+func (f Features) Get(name string) float64 {
+	if i := FeatureIndex(name); i >= 0 && i < len(f) {
+		return f[i]
+	}
+	return 0
+}
+
+// FeatureContext 提取特征的参数
+type FeatureContext struct {
+	Terms    []string //查询词, 已分词
+	Now      int64    //当前时间(unix秒)
+	HalfLife float64  //时效性半衰期(秒), 为0时不计算时效性
+}
+
+// ExtractFeatures 提取docs在idx中的特征, 与docs一一对应:
+//   - 各字段的BM25: 每个字段单独按字段长度归一化, 使用完整的倒排表, 不受胜者表截断影响
+//   - 紧密度: 倒排表记录了词在字段中第一次出现的位置, 取 命中词数/命中词位置的跨度 在各字段中的最大值,
+//     相邻时为1, 只命中一个词或旧版本索引没有位置时为0
+//   - 时效性: 0.5^(距文档时间/半衰期), 没有文档时间时为0
+func ExtractFeatures(idx Index, docs []Doc, ctx *FeatureContext) []Features {
+	result := make([]Features, len(docs))
+	pos := make(map[int32]int, len(docs))
+	for i, doc := range docs {
+		result[i] = make(Features, len(FeatureNames))
+		result[i][featScore] = doc.Score
+		pos[doc.ID] = i
+	}
+	if len(docs) == 0 {
+		return result
+	}
+
+	terms := uniqTerms(ctx.Terms)
+	p := idx.Property()
+	sim := idx.Similarity()
+	fields := []string{TextField, TitleField, URLField} //与featBM25Text, featBM25Title, featBM25URL对应
+
+	matched := make([]map[string]bool, len(docs))      //doc -> 命中的词
+	positions := make([]map[string][]int32, len(docs)) //doc -> 字段 -> 命中词第一次出现的位置
+	for fi, field := range fields {
+		fs := sim.Field(field)
+		avg := p.AvgFieldLen(field)
+		for _, term := range terms {
+			pl := idx.Get(FieldTerm(field, term))
+			if len(pl) == 0 {
+				continue
+			}
+			idf := CalIDF(p.DocNum(), len(pl))
+			for _, d := range pl {
+				i, ok := pos[d.ID]
+				if !ok {
+					continue
+				}
+				norm := float64(1)
+				if avg > 0 {
+					norm = 1 - fs.B + fs.B*float64(d.DocLen)/avg
+				}
+				tfn := float64(d.TF) / norm
+				result[i][featBM25Text+fi] += idf * tfn * (sim.K1 + 1) / (tfn + sim.K1)
+
+				if matched[i] == nil {
+					matched[i] = make(map[string]bool)
+					positions[i] = make(map[string][]int32)
+				}
+				matched[i][term] = true
+				if d.Pos > 0 {
+					positions[i][field] = append(positions[i][field], d.Pos)
+				}
+			}
+		}
+	}
+
+	priors := idx.StaticScores()
+	times := idx.Timestamps()
+	for i, doc := range docs {
+		f := result[i]
+		if len(terms) > 0 {
+			f[featCoverage] = float64(len(matched[i])) / float64(len(terms))
+		}
+		for _, pos := range positions[i] {
+			f[featProximity] = math.Max(f[featProximity], proximity(pos))
+		}
+		f[featStatic] = priors.Get(doc.ID)
+		if ts := times.Get(doc.ID); ts > 0 && ctx.HalfLife > 0 {
+			age := math.Max(0, float64(ctx.Now-ts))
+			f[featFreshness] = math.Pow(0.5, age/ctx.HalfLife)
+		}
+	}
+	return result
+}
+
+// proximity 一个字段中命中词的紧密度, pos为各词第一次出现的位置
+func proximity(pos []int32) float64 {
+	if len(pos) < 2 {
+		return 0
+	}
+	min, max := pos[0], pos[0]
+	for _, p := range pos[1:] {
+		if p < min {
+			min = p
+		}
+		if p > max {
+			max = p
+		}
+	}
+	return float64(len(pos)) / float64(max-min+1)
+}
+
+// uniqTerms 去重, 保持顺序
+func uniqTerms(terms []string) []string {
+	seen := make(map[string]bool, len(terms))
+	var result []string
+	for _, t := range terms {
+		if !seen[t] {
+			seen[t] = true
+			result = append(result, t)
+		}
+	}
+	return result
+}
@@ -0,0 +1,60 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/awesomefly/easysearch/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractFeatures(t *testing.T) {
+	sim := DefaultSimilarity()
+	sim.Fields = map[string]FieldSimilarity{TitleField: {Weight: 3, B: 0.75}}
+	idx := NewHashMapIndex()
+	idx.SetSimilarity(sim)
+	idx.Add([]Document{
+		{ID: 1, Title: "Chocolate donut", Text: "a sweet treat with glaze", Prior: 0.5, Timestamp: 900},
+		{ID: 2, Title: "Breakfast", Text: "chocolate milk and donut"},
+		{ID: 3, Title: "Glass", Text: "a glass plate with chocolate"},
+	})
+	terms := util.Analyze("chocolate donut")
+	docs, _ := DoRetrieval(idx, nil, terms, nil, 10, 100, BM25)
+	assert.Equal(t, 3, len(docs))
+
+	ctx := &FeatureContext{Terms: append(terms, terms[0]), Now: 1000, HalfLife: 100}
+	features := ExtractFeatures(idx, docs, ctx)
+	assert.Equal(t, len(docs), len(features))
+	byID := make(map[int32]Features)
+	for i, doc := range docs {
+		assert.Equal(t, len(FeatureNames), len(features[i]))
+		assert.Equal(t, doc.Score, features[i].Get(FeatureScore))
+		byID[doc.ID] = features[i]
+	}
+
+	//doc2只有正文命中, 正文的BM25即召回得分
+	assert.InDelta(t, PostingList(docs).Find(2).Score, byID[2].Get(FeatureBM25Text), 0.0001)
+	assert.Equal(t, float64(0), byID[2].Get(FeatureBM25Title))
+	assert.True(t, byID[1].Get(FeatureBM25Title) > 0)
+	assert.Equal(t, float64(0), byID[1].Get(FeatureBM25Text))
+	assert.Equal(t, float64(0), byID[1].Get(FeatureBM25URL))
+
+	assert.Equal(t, float64(1), byID[1].Get(FeatureCoverage))
+	assert.Equal(t, 0.5, byID[3].Get(FeatureCoverage))
+
+	//标题中两个查询词相邻, 紧密度为1; 正文中两词之间隔了一个词; 只命中一个词时为0
+	assert.Equal(t, float64(1), byID[1].Get(FeatureProximity))
+	assert.InDelta(t, 2.0/3, byID[2].Get(FeatureProximity), 1e-9)
+	assert.Equal(t, float64(0), byID[3].Get(FeatureProximity))
+
+	assert.Equal(t, 0.5, byID[1].Get(FeatureStatic))
+	assert.Equal(t, float64(0), byID[2].Get(FeatureStatic))
+
+	//距文档时间一个半衰期为0.5, 没有文档时间时为0
+	assert.InDelta(t, 0.5, byID[1].Get(FeatureFreshness), 1e-9)
+	assert.Equal(t, float64(0), byID[2].Get(FeatureFreshness))
+	features = ExtractFeatures(idx, docs, &FeatureContext{Terms: terms, Now: 1000})
+	assert.Equal(t, float64(0), features[0].Get(FeatureFreshness))
+
+	assert.Equal(t, -1, FeatureIndex("unknown"))
+	assert.Equal(t, 0, len(ExtractFeatures(idx, nil, ctx)))
+}
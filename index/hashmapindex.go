@@ -1,8 +1,8 @@
 package index
 
 import (
-	"github.com/awesomefly/easysearch/util"
 	"sort"
+	"unsafe"
 )
 
 func IfElseInt(condition bool, o1 int, o2 int) int {
@@ -12,19 +12,34 @@ func IfElseInt(condition bool, o1 int, o2 int) int {
 	return o2
 }
 
-// CalDocScore
-// todo: calculate doc static score by PageRank + frequency
-func CalDocScore(frequency int32, pagerank int) float64 {
-	return float64(frequency * 1.0)
+// CalDocScore 胜者表排序使用的质量分, 静态分prior(如PageRank, 归一化到[0,1])按比例放大词频
+func CalDocScore(frequency int32, prior float64) float64 {
+	return float64(frequency) * (1 + prior)
 }
 
 // HashMapIndex is an inverted index. It maps tokens to document IDs.
 type HashMapIndex struct {
 	tbl map[string]PostingList
 
-	property Property
+	property   Property
+	similarity SimilarityConfig
+	priors     StaticScores
+	times      Timestamps
+	vectors    *HNSW
+	memSize    int //估算的内存占用
+
+	docs map[int32]indexedDoc //Add添加的文档, 再次添加同一文档时替换旧版本
+}
+
+// indexedDoc 文档的key及各字段的长度, 用于删除文档
+type indexedDoc struct {
+	keys   []string
+	fields map[string]int
 }
 
+// keyOverhead 估算每个key在map中的额外开销(map bucket + slice header)
+const keyOverhead = 64
+
 func NewHashMapIndex() *HashMapIndex {
 	return &HashMapIndex{
 		tbl: make(map[string]PostingList),
@@ -33,6 +48,7 @@ func NewHashMapIndex() *HashMapIndex {
 			tokenCount: 0,
 			dataRange:  DataRange{Start: 0, End: 0},
 		},
+		similarity: DefaultSimilarity(),
 	}
 }
 
@@ -40,6 +56,27 @@ func (idx *HashMapIndex) Property() *Property {
 	return &idx.property
 }
 
+func (idx *HashMapIndex) Similarity() *SimilarityConfig {
+	return &idx.similarity
+}
+
+// SetSimilarity 设置打分参数, 需要在添加文档前设置, 以索引配置的字段
+func (idx *HashMapIndex) SetSimilarity(sim SimilarityConfig) {
+	idx.similarity = sim
+}
+
+func (idx *HashMapIndex) StaticScores() StaticScores {
+	return idx.priors
+}
+
+func (idx *HashMapIndex) Timestamps() Timestamps {
+	return idx.times
+}
+
+func (idx *HashMapIndex) Vectors() *HNSW {
+	return idx.vectors
+}
+
 func (idx *HashMapIndex) Map() map[string]PostingList {
 	return idx.tbl
 }
@@ -52,35 +89,13 @@ func (idx *HashMapIndex) Keys() []string {
 	}
 	return keys
 }
-// Add adds documents to the index.
-// todo: Support indexing multiple document fields.
+// Add adds documents to the index, 索引正文及打分参数中配置的字段. 已添加的文档被新版本替换
 func (idx *HashMapIndex) Add(docs []Document) {
 	for _, doc := range docs {
-		tokens := util.Analyze(doc.Text)
-		for _, token := range tokens {
-			postingList := idx.tbl[token]
-			if postingList != nil {
-				if last := postingList.Find(doc.ID); last != nil {
-					// Don't add same ID twice. But should update frequency
-					//last := &postingList[tokenCount(postingList)-1]
-					last.TF++
-					last.QualityScore = CalDocScore(last.TF, 0)
-					//idx.tbl[token] = postingList
-					continue
-				}
-			}
-			item := Doc{
-				ID:           int32(doc.ID),
-				DocLen:       int32(len(tokens)),
-				TF:           1,
-				QualityScore: CalDocScore(1, 0),
-			}
-			//add to posting list
-			idx.tbl[token] = append(postingList, item)
-		}
-
-		idx.property.docNum++
-		idx.property.tokenCount += len(tokens)
+		idx.Remove(int32(doc.ID))
+		fields := AnalyzeDocument(doc, &idx.similarity)
+		idx.add(doc, fields, true)
+		idx.track(doc, fields)
 	}
 
 	//sort by score
@@ -92,12 +107,165 @@ func (idx *HashMapIndex) Add(docs []Document) {
 	}
 }
 
+// track 记录Add添加的文档, 批量构建时不记录
+func (idx *HashMapIndex) track(doc Document, fields []FieldTokens) {
+	if idx.docs == nil {
+		idx.docs = make(map[int32]indexedDoc)
+	}
+	d := indexedDoc{fields: make(map[string]int, len(fields))}
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		d.fields[field.Field] += len(field.Tokens)
+		for _, token := range field.Tokens {
+			if !seen[token] {
+				seen[token] = true
+				d.keys = append(d.keys, token)
+			}
+		}
+	}
+	idx.docs[int32(doc.ID)] = d
+}
+
+// Remove 删除Add添加的文档, 文档不存在时返回false.
+// 倒排表拷贝后修改, 不影响正在读取的查询
+func (idx *HashMapIndex) Remove(id int32) bool {
+	d, ok := idx.docs[id]
+	if !ok {
+		return false
+	}
+	for _, key := range d.keys {
+		pl := idx.tbl[key]
+		for i := range pl {
+			if pl[i].ID != id {
+				continue
+			}
+			if len(pl) == 1 {
+				delete(idx.tbl, key)
+				idx.memSize -= len(key) + keyOverhead
+			} else {
+				idx.tbl[key] = append(append(make(PostingList, 0, len(pl)-1), pl[:i]...), pl[i+1:]...)
+			}
+			idx.memSize -= int(unsafe.Sizeof(pl[i]))
+			break
+		}
+	}
+	for field, n := range d.fields {
+		idx.property.AddFieldTokens(field, -n)
+	}
+	idx.property.docNum--
+	delete(idx.priors, id)
+	delete(idx.times, id)
+	idx.vectors.Delete(id)
+	delete(idx.docs, id)
+	return true
+}
+
+// AddTokens adds an analyzed document, posting lists are not sorted.
+// 用于批量构建, 调用方需保证同一文档只添加一次
+func (idx *HashMapIndex) AddTokens(doc Document, tokens []string) {
+	idx.add(doc, []FieldTokens{{Field: TextField, Tokens: tokens}}, false)
+}
+
+// AddFields adds a document analyzed by AnalyzeDocument, posting lists are not sorted.
+func (idx *HashMapIndex) AddFields(doc Document, fields []FieldTokens) {
+	idx.add(doc, fields, false)
+}
+
+func (idx *HashMapIndex) add(doc Document, fields []FieldTokens, dedup bool) {
+	for _, field := range fields {
+		idx.addField(doc, field.Tokens, dedup)
+		idx.property.AddFieldTokens(field.Field, len(field.Tokens))
+	}
+	if doc.Prior != 0 {
+		if idx.priors == nil {
+			idx.priors = make(StaticScores)
+		}
+		idx.priors[int32(doc.ID)] = doc.Prior
+	}
+	idx.times = addTimestamp(idx.times, doc)
+	if len(doc.Vector) > 0 {
+		idx.vectors = addVector(idx.vectors, doc, idx.similarity.Vector)
+		idx.memSize += 4*len(doc.Vector) + 8*2*idx.similarity.Vector.M
+	}
+	idx.property.docNum++
+}
+
+// addField DocLen为字段的长度, Pos为词第一次出现的位置
+func (idx *HashMapIndex) addField(doc Document, tokens []string, dedup bool) {
+	tf := make(map[string]int32, len(tokens))
+	pos := make(map[string]int32, len(tokens))
+	for i, token := range tokens {
+		if tf[token] == 0 {
+			pos[token] = int32(i + 1)
+		}
+		tf[token]++
+	}
+
+	for token, n := range tf {
+		postingList, ok := idx.tbl[token]
+		if dedup && postingList != nil {
+			if last := postingList.Find(doc.ID); last != nil {
+				// Don't add same ID twice. But should update frequency
+				last.TF += n
+				last.QualityScore = CalDocScore(last.TF, doc.Prior)
+				continue
+			}
+		}
+		item := Doc{
+			ID:           int32(doc.ID),
+			DocLen:       int32(len(tokens)),
+			TF:           n,
+			Pos:          pos[token],
+			QualityScore: CalDocScore(n, doc.Prior),
+		}
+		//add to posting list
+		idx.tbl[token] = append(postingList, item)
+
+		idx.memSize += int(unsafe.Sizeof(item))
+		if !ok {
+			idx.memSize += len(token) + keyOverhead
+		}
+	}
+}
+
+// MemSize returns the estimated memory used by posting lists
+// Clone 拷贝索引, 之后对idx的写入不影响拷贝. 只拷贝内存, 用于短暂加锁时获取增量索引的一致视图
+func (idx *HashMapIndex) Clone() *HashMapIndex {
+	c := NewHashMapIndex()
+	c.similarity = idx.similarity
+	c.property.Add(idx.property)
+	for k, pl := range idx.tbl {
+		c.tbl[k] = append(PostingList(nil), pl...)
+	}
+	c.priors = StaticScores(nil).Merge(idx.priors)
+	c.times = Timestamps(nil).Merge(idx.times)
+	c.vectors = idx.vectors.Clone()
+	c.memSize = idx.memSize
+	if idx.docs != nil {
+		c.docs = make(map[int32]indexedDoc, len(idx.docs))
+		for id, d := range idx.docs {
+			c.docs[id] = d
+		}
+	}
+	return c
+}
+
+func (idx *HashMapIndex) MemSize() int {
+	return idx.memSize
+}
+
 // Clear unsafe function
 func (idx *HashMapIndex) Clear() {
 	idx.property.docNum = 0
 	idx.property.tokenCount = 0
 	idx.property.dataRange = DataRange{Start: 0, End: 0}
+	idx.property.fieldTokens = nil
+	idx.priors = nil
+	idx.times = nil
+	idx.vectors = nil
 	idx.tbl = make(map[string]PostingList)
+	idx.memSize = 0
+	idx.docs = nil
 }
 
 func (idx *HashMapIndex) Get(term string) []Doc {
@@ -108,5 +276,5 @@ func (idx *HashMapIndex) Get(term string) []Doc {
 }
 
 func (idx *HashMapIndex) Retrieval(must []string, should []string, not []string, k int, r int, m SearchModel) []Doc {
-	return DoRetrieval(idx, must, should, not, k, r, m)
+	return retrieval(idx, must, should, not, k, r, m)
 }
\ No newline at end of file
@@ -45,3 +45,41 @@ func TestIndex(t *testing.T) {
 		fmt.Printf("%s:%v\n", s, list)
 	}
 }
+
+func TestHashMapIndexReplace(t *testing.T) {
+	idx := NewHashMapIndex()
+	idx.Add([]Document{{ID: 1, Text: "donut on a glass plate", Vector: []float32{1, 0}}})
+	idx.Add([]Document{{ID: 2, Text: "donut"}})
+
+	//再次添加同一文档时替换旧版本
+	idx.Add([]Document{{ID: 1, Text: "fork", Vector: []float32{0, 1}}})
+	assert.Equal(t, 2, idx.Property().DocNum())
+	assert.Equal(t, []int{2}, (PostingList)(idx.Retrieval([]string{"donut"}, nil, nil, 100, 10, Boolean)).IDs())
+	assert.Nil(t, idx.Retrieval([]string{"glass"}, nil, nil, 100, 10, Boolean))
+	assert.Equal(t, []int{1}, (PostingList)(idx.Retrieval([]string{"fork"}, nil, nil, 100, 10, Boolean)).IDs())
+	assert.Equal(t, 1, idx.Vectors().Len())
+
+	assert.True(t, idx.Remove(2))
+	assert.False(t, idx.Remove(2))
+	assert.False(t, idx.Remove(3))
+	assert.Equal(t, 1, idx.Property().DocNum())
+	assert.Nil(t, idx.Retrieval([]string{"donut"}, nil, nil, 100, 10, Boolean))
+}
+
+func TestHashMapIndexClone(t *testing.T) {
+	idx := NewHashMapIndex()
+	idx.Add([]Document{{ID: 1, Text: "donut on a glass plate", Vector: []float32{1, 0}}})
+	c := idx.Clone()
+
+	//拷贝后的写入不影响拷贝
+	idx.Add([]Document{{ID: 2, Text: "donut", Vector: []float32{0, 1}}})
+	idx.Add([]Document{{ID: 1, Text: "fork"}})
+	assert.Equal(t, 1, c.Property().DocNum())
+	assert.Equal(t, []int{1}, (PostingList)(c.Retrieval([]string{"donut"}, nil, nil, 100, 10, Boolean)).IDs())
+	assert.Nil(t, c.Retrieval([]string{"fork"}, nil, nil, 100, 10, Boolean))
+	assert.Equal(t, []int32{1}, c.Vectors().IDs())
+	assert.Equal(t, []int32{2}, idx.Vectors().IDs())
+
+	assert.True(t, c.Remove(1))
+	assert.Equal(t, []int{2}, (PostingList)(idx.Retrieval([]string{"donut"}, nil, nil, 100, 10, Boolean)).IDs())
+}
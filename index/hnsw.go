@@ -0,0 +1,647 @@
+package index
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+)
+
+// 向量字段的近似最近邻检索: 每个索引段一个HNSW图(Hierarchical Navigable Small World),
+// 向量及图保存在同名的.hnsw文件中, 打开索引时读入内存.
+// 参考: https://arxiv.org/abs/1603.09320
+
+const VectorSuffix = ".hnsw"
+
+// VectorMetric 向量相似度
+type VectorMetric string
+
+const (
+	Cosine     VectorMetric = "cosine" //余弦, 向量写入时归一化
+	DotProduct VectorMetric = "dot"    //内积
+)
+
+// HNSWConfig HNSW参数, 0时使用默认值
+type HNSWConfig struct {
+	Dim            int          //向量维度, 0时取第一个向量的维度
+	Metric         VectorMetric //相似度, 默认cosine
+	M              int          //每个节点的邻居数, 第0层为2M, 默认16
+	EfConstruction int          //构建时的候选集大小, 默认200
+	EfSearch       int          //查询时的候选集大小, 小于k时取k, 默认64
+}
+
+func DefaultHNSWConfig() HNSWConfig {
+	return HNSWConfig{Metric: Cosine, M: 16, EfConstruction: 200, EfSearch: 64}
+}
+
+// WithDefault 未配置的参数使用默认值
+func (c HNSWConfig) WithDefault() HNSWConfig {
+	d := DefaultHNSWConfig()
+	if c.Metric == "" {
+		c.Metric = d.Metric
+	}
+	if c.M <= 1 {
+		c.M = d.M
+	}
+	if c.EfConstruction <= 0 {
+		c.EfConstruction = d.EfConstruction
+	}
+	if c.EfSearch <= 0 {
+		c.EfSearch = d.EfSearch
+	}
+	return c
+}
+
+// ParseVectorMetric 校验向量相似度, 为空时为cosine
+func ParseVectorMetric(name string) (VectorMetric, error) {
+	switch VectorMetric(name) {
+	case "", Cosine:
+		return Cosine, nil
+	case DotProduct:
+		return DotProduct, nil
+	}
+	return "", fmt.Errorf("unsupported vector metric %q, expect %s or %s", name, Cosine, DotProduct)
+}
+
+type hnswNode struct {
+	id      int32
+	vec     []float32
+	links   [][]int32 //每层的邻居节点
+	deleted bool      //同一文档重新写入后, 旧节点只用于导航
+}
+
+// HNSW 多层近邻图, 节点按写入顺序编号, 并发安全
+type HNSW struct {
+	conf  HNSWConfig
+	nodes []hnswNode
+	ids   map[int32]int32 //docID -> 节点
+
+	entry    int32 //入口节点, 空图为-1
+	maxLevel int
+	rng      *rand.Rand
+
+	lock sync.RWMutex
+}
+
+func NewHNSW(conf HNSWConfig) *HNSW {
+	return &HNSW{
+		conf:  conf.WithDefault(),
+		ids:   make(map[int32]int32),
+		entry: -1,
+		rng:   rand.New(rand.NewSource(1)),
+	}
+}
+
+func (h *HNSW) Config() HNSWConfig {
+	return h.conf
+}
+
+// Len 文档数
+func (h *HNSW) Len() int {
+	if h == nil {
+		return 0
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.ids)
+}
+
+// Get 文档的向量, cosine为归一化后的向量
+func (h *HNSW) Get(id int32) []float32 {
+	if h == nil {
+		return nil
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if n, ok := h.ids[id]; ok {
+		return h.nodes[n].vec
+	}
+	return nil
+}
+
+// Delete 删除文档, 节点只用于导航. 文档不存在时返回false
+func (h *HNSW) Delete(id int32) bool {
+	if h == nil {
+		return false
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	n, ok := h.ids[id]
+	if ok {
+		h.nodes[n].deleted = true
+		delete(h.ids, id)
+	}
+	return ok
+}
+
+// IDs 所有文档ID, 升序
+func (h *HNSW) IDs() []int32 {
+	if h == nil {
+		return nil
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	ids := make([]int32, 0, len(h.ids))
+	for id := range h.ids {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (h *HNSW) similarity(a, b []float32) float64 {
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return dot
+}
+
+// prepare 校验维度, cosine时返回归一化的拷贝
+func (h *HNSW) prepare(vec []float32) ([]float32, error) {
+	if len(vec) == 0 || (h.conf.Dim > 0 && len(vec) != h.conf.Dim) {
+		return nil, fmt.Errorf("vector dimension %d, expect %d", len(vec), h.conf.Dim)
+	}
+	v := append([]float32(nil), vec...)
+	if h.conf.Metric == Cosine {
+		var norm float64
+		for _, x := range v {
+			norm += float64(x) * float64(x)
+		}
+		if norm == 0 {
+			return nil, fmt.Errorf("zero vector for cosine similarity")
+		}
+		norm = math.Sqrt(norm)
+		for i := range v {
+			v[i] = float32(float64(v[i]) / norm)
+		}
+	}
+	return v, nil
+}
+
+func (h *HNSW) maxLinks(level int) int {
+	if level == 0 {
+		return 2 * h.conf.M
+	}
+	return h.conf.M
+}
+
+// Add 写入文档的向量, 同一文档再次写入时替换旧向量
+func (h *HNSW) Add(id int32, vec []float32) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	v, err := h.prepare(vec)
+	if err != nil {
+		return fmt.Errorf("doc %d: %s", id, err.Error())
+	}
+	if h.conf.Dim == 0 {
+		h.conf.Dim = len(v)
+	}
+	if old, ok := h.ids[id]; ok {
+		h.nodes[old].deleted = true
+	}
+
+	level := int(-math.Log(1-h.rng.Float64()) / math.Log(float64(h.conf.M)))
+	node := int32(len(h.nodes))
+	h.nodes = append(h.nodes, hnswNode{id: id, vec: v, links: make([][]int32, level+1)})
+	h.ids[id] = node
+	if h.entry < 0 {
+		h.entry, h.maxLevel = node, level
+		return nil
+	}
+
+	ep := []candidate{{node: h.entry, sim: h.similarity(v, h.nodes[h.entry].vec)}}
+	for l := h.maxLevel; l > level; l-- {
+		ep = h.searchLayer(v, ep, 1, l, nil)
+	}
+	for l := imin(level, h.maxLevel); l >= 0; l-- {
+		found := h.searchLayer(v, ep, h.conf.EfConstruction, l, nil)
+		neighbors := h.selectNeighbors(found, h.conf.M)
+		h.nodes[node].links[l] = neighbors
+		for _, n := range neighbors {
+			h.connect(n, node, l)
+		}
+		ep = found
+	}
+	if level > h.maxLevel {
+		h.entry, h.maxLevel = node, level
+	}
+	return nil
+}
+
+// connect 添加from -> to的边, 超过邻居数上限时重新选择邻居
+func (h *HNSW) connect(from, to int32, level int) {
+	links := append(h.nodes[from].links[level], to)
+	if len(links) > h.maxLinks(level) {
+		cands := make([]candidate, len(links))
+		for i, n := range links {
+			cands[i] = candidate{node: n, sim: h.similarity(h.nodes[from].vec, h.nodes[n].vec)}
+		}
+		sort.Slice(cands, func(i, j int) bool { return cands[i].sim > cands[j].sim })
+		links = h.selectNeighbors(cands, h.maxLinks(level))
+	}
+	h.nodes[from].links[level] = links
+}
+
+// selectNeighbors 启发式选择邻居: 候选按相似度降序, 与已选邻居的相似度高于与查询点的相似度时跳过,
+// 使邻居分布在不同方向; 不足m个时用跳过的候选补足
+func (h *HNSW) selectNeighbors(cands []candidate, m int) []int32 {
+	selected := make([]int32, 0, m)
+	var skipped []int32
+	for _, c := range cands {
+		if len(selected) >= m {
+			break
+		}
+		good := true
+		for _, s := range selected {
+			if h.similarity(h.nodes[c.node].vec, h.nodes[s].vec) > c.sim {
+				good = false
+				break
+			}
+		}
+		if good {
+			selected = append(selected, c.node)
+		} else {
+			skipped = append(skipped, c.node)
+		}
+	}
+	for _, n := range skipped {
+		if len(selected) >= m {
+			break
+		}
+		selected = append(selected, n)
+	}
+	return selected
+}
+
+type candidate struct {
+	node int32
+	sim  float64
+}
+
+// candidateHeap max为true时为最大堆(待扩展的候选), 否则为最小堆(结果)
+type candidateHeap struct {
+	items []candidate
+	max   bool
+}
+
+func (h candidateHeap) Len() int { return len(h.items) }
+func (h candidateHeap) Less(i, j int) bool {
+	if h.max {
+		return h.items[i].sim > h.items[j].sim
+	}
+	return h.items[i].sim < h.items[j].sim
+}
+func (h candidateHeap) Swap(i, j int)       { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *candidateHeap) Push(x interface{}) { h.items = append(h.items, x.(candidate)) }
+func (h *candidateHeap) Pop() interface{} {
+	x := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return x
+}
+
+// searchLayer 在第level层从ep开始贪心扩展, 返回最相似的ef个节点(相似度降序).
+// accept非nil时只有accept的节点进入结果, 其他节点仍用于导航
+func (h *HNSW) searchLayer(q []float32, ep []candidate, ef int, level int, accept func(n int32) bool) []candidate {
+	visited := make(map[int32]bool, ef*4)
+	cands := &candidateHeap{max: true}
+	results := &candidateHeap{}
+	for _, c := range ep {
+		visited[c.node] = true
+		heap.Push(cands, c)
+		if accept == nil || accept(c.node) {
+			heap.Push(results, c)
+		}
+	}
+	for cands.Len() > 0 {
+		c := heap.Pop(cands).(candidate)
+		if results.Len() >= ef && c.sim < results.items[0].sim {
+			break
+		}
+		node := &h.nodes[c.node]
+		if level >= len(node.links) {
+			continue
+		}
+		for _, n := range node.links[level] {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+			sim := h.similarity(q, h.nodes[n].vec)
+			if results.Len() < ef || sim > results.items[0].sim {
+				heap.Push(cands, candidate{node: n, sim: sim})
+				if accept == nil || accept(n) {
+					heap.Push(results, candidate{node: n, sim: sim})
+					if results.Len() > ef {
+						heap.Pop(results)
+					}
+				}
+			}
+		}
+	}
+	found := results.items
+	sort.Slice(found, func(i, j int) bool { return found[i].sim > found[j].sim })
+	return found
+}
+
+// exactFilterRatio 过滤后的文档数少于总数的该比例时精确计算, 避免在图中扩展大量被过滤的节点
+const exactFilterRatio = 0.1
+
+// Search 返回与q最相似的k个文档, Score为相似度. ef为候选集大小, 0时使用配置的EfSearch.
+// filter非nil时只返回filter中的文档(前置过滤)
+func (h *HNSW) Search(q []float32, k int, ef int, filter map[int32]bool) ([]Doc, error) {
+	if h == nil || k <= 0 {
+		return nil, nil
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if h.entry < 0 {
+		return nil, nil
+	}
+	v, err := h.prepare(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []candidate
+	if filter != nil && float64(len(filter)) < exactFilterRatio*float64(len(h.ids)) {
+		for id := range filter {
+			if n, ok := h.ids[id]; ok {
+				found = append(found, candidate{node: n, sim: h.similarity(v, h.nodes[n].vec)})
+			}
+		}
+		sort.Slice(found, func(i, j int) bool { return found[i].sim > found[j].sim })
+	} else {
+		if ef <= 0 {
+			ef = h.conf.EfSearch
+		}
+		ef = imax(ef, k)
+		ep := []candidate{{node: h.entry, sim: h.similarity(v, h.nodes[h.entry].vec)}}
+		for l := h.maxLevel; l > 0; l-- {
+			ep = h.searchLayer(v, ep, 1, l, nil)
+		}
+		found = h.searchLayer(v, ep, ef, 0, func(n int32) bool {
+			node := &h.nodes[n]
+			return !node.deleted && (filter == nil || filter[node.id])
+		})
+	}
+
+	if len(found) > k {
+		found = found[:k]
+	}
+	docs := make([]Doc, len(found))
+	for i, c := range found {
+		docs[i] = Doc{ID: h.nodes[c.node].id, Score: c.sim}
+	}
+	return docs, nil
+}
+
+// Merge 写入o中的所有向量, 相同文档以o为准. 返回h, h为nil时按o的配置新建
+func (h *HNSW) Merge(o *HNSW) *HNSW {
+	return h.merge(o, nil)
+}
+
+// Clone 拷贝图的节点及邻居, 不重新构建
+func (h *HNSW) Clone() *HNSW {
+	if h == nil {
+		return nil
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	c := NewHNSW(h.conf)
+	c.entry, c.maxLevel = h.entry, h.maxLevel
+	c.nodes = make([]hnswNode, len(h.nodes))
+	for i, n := range h.nodes {
+		links := make([][]int32, len(n.links))
+		for l := range n.links {
+			links[l] = append([]int32(nil), n.links[l]...)
+		}
+		c.nodes[i] = hnswNode{id: n.id, vec: n.vec, links: links, deleted: n.deleted} //写入后向量不变, 共用
+	}
+	for id, node := range h.ids {
+		c.ids[id] = node
+	}
+	return c
+}
+
+// Filter 重建只包含keep的文档的图, 去掉已删除的节点
+func (h *HNSW) Filter(keep func(id int32) bool) *HNSW {
+	if h == nil {
+		return nil
+	}
+	return NewHNSW(h.Config()).merge(h, keep)
+}
+
+func (h *HNSW) merge(o *HNSW, keep func(id int32) bool) *HNSW {
+	if o.Len() == 0 {
+		return h
+	}
+	if h == nil {
+		h = NewHNSW(o.Config())
+	}
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	for i := range o.nodes {
+		n := &o.nodes[i]
+		if n.deleted || (keep != nil && !keep(n.id)) {
+			continue
+		}
+		if err := h.Add(n.id, n.vec); err != nil {
+			panic(err.Error()) //同一配置下的向量维度一致
+		}
+	}
+	return h
+}
+
+const (
+	hnswMagic   uint32 = 0x57534e48 //"HNSW"
+	hnswVersion uint32 = 1
+)
+
+// WriteHNSW 保存向量及图, 先写临时文件再rename. 格式:
+//
+//	magic|version|metric|dim|M|efConstruction|efSearch|nodes|entry|maxLevel
+//	每个节点: id|deleted|levels|vector|每层的邻居数及邻居
+func WriteHNSW(file string, h *HNSW) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	tmp := file + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(fd, 1<<20)
+	metric := uint32(0)
+	if h.conf.Metric == DotProduct {
+		metric = 1
+	}
+	header := []uint32{hnswMagic, hnswVersion, metric, uint32(h.conf.Dim), uint32(h.conf.M),
+		uint32(h.conf.EfConstruction), uint32(h.conf.EfSearch), uint32(len(h.nodes)), uint32(h.entry), uint32(h.maxLevel)}
+	err = binary.Write(w, binary.LittleEndian, header)
+	for i := 0; i < len(h.nodes) && err == nil; i++ {
+		n := &h.nodes[i]
+		deleted := uint32(0)
+		if n.deleted {
+			deleted = 1
+		}
+		if err = binary.Write(w, binary.LittleEndian, []uint32{uint32(n.id), deleted, uint32(len(n.links))}); err != nil {
+			break
+		}
+		if err = binary.Write(w, binary.LittleEndian, n.vec); err != nil {
+			break
+		}
+		for _, links := range n.links {
+			if err = binary.Write(w, binary.LittleEndian, uint32(len(links))); err != nil {
+				break
+			}
+			if err = binary.Write(w, binary.LittleEndian, links); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// ReadHNSW 读取WriteHNSW保存的文件
+func ReadHNSW(file string) (*HNSW, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	r := bufio.NewReaderSize(fd, 1<<20)
+
+	header := make([]uint32, 10)
+	if err = binary.Read(r, binary.LittleEndian, header); err != nil {
+		return nil, fmt.Errorf("%s: read header: %w", file, err)
+	}
+	if header[0] != hnswMagic {
+		return nil, fmt.Errorf("%s: bad magic %x", file, header[0])
+	}
+	if header[1] != hnswVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", file, header[1])
+	}
+	conf := HNSWConfig{Metric: Cosine, Dim: int(header[3]), M: int(header[4]),
+		EfConstruction: int(header[5]), EfSearch: int(header[6])}
+	if header[2] == 1 {
+		conf.Metric = DotProduct
+	}
+	h := NewHNSW(conf)
+	count := int(header[7])
+	h.entry, h.maxLevel = int32(header[8]), int(header[9])
+	if (count == 0) != (h.entry < 0) || int(h.entry) >= count {
+		return nil, fmt.Errorf("%s: bad entry %d of %d nodes", file, h.entry, count)
+	}
+
+	h.nodes = make([]hnswNode, count)
+	head := make([]uint32, 3)
+	for i := range h.nodes {
+		if err = binary.Read(r, binary.LittleEndian, head); err != nil {
+			return nil, fmt.Errorf("%s: read node %d: %w", file, i, err)
+		}
+		n := hnswNode{id: int32(head[0]), deleted: head[1] == 1, vec: make([]float32, conf.Dim), links: make([][]int32, head[2])}
+		if err = binary.Read(r, binary.LittleEndian, n.vec); err != nil {
+			return nil, fmt.Errorf("%s: read node %d: %w", file, i, err)
+		}
+		for l := range n.links {
+			var size uint32
+			if err = binary.Read(r, binary.LittleEndian, &size); err != nil {
+				return nil, fmt.Errorf("%s: read node %d: %w", file, i, err)
+			}
+			if int(size) > count {
+				return nil, fmt.Errorf("%s: node %d has %d links", file, i, size)
+			}
+			n.links[l] = make([]int32, size)
+			if err = binary.Read(r, binary.LittleEndian, n.links[l]); err != nil {
+				return nil, fmt.Errorf("%s: read node %d: %w", file, i, err)
+			}
+			for _, link := range n.links[l] {
+				if link < 0 || int(link) >= count {
+					return nil, fmt.Errorf("%s: node %d links to %d", file, i, link)
+				}
+			}
+		}
+		h.nodes[i] = n
+		if !n.deleted {
+			h.ids[n.id] = int32(i)
+		}
+	}
+	if _, err = r.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("%s: trailing data", file)
+	}
+	return h, nil
+}
+
+// addVector 写入文档的向量, 写入第一个向量时按conf新建图, 维度不一致的向量跳过
+func addVector(h *HNSW, doc Document, conf HNSWConfig) *HNSW {
+	if len(doc.Vector) == 0 {
+		return h
+	}
+	if h == nil {
+		h = NewHNSW(conf)
+	}
+	if err := h.Add(int32(doc.ID), doc.Vector); err != nil {
+		log.Printf("skip vector: %s", err.Error())
+	}
+	return h
+}
+
+// LoadVectors 读取索引段或run文件prefix的向量, 不存在时返回nil
+func LoadVectors(prefix string) (*HNSW, error) {
+	h, err := ReadHNSW(prefix + VectorSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return h, err
+}
+
+// SaveVectors 保存索引段或run文件prefix的向量, 没有向量时删除旧文件
+func SaveVectors(prefix string, h *HNSW) error {
+	if h.Len() == 0 {
+		if err := os.Remove(prefix + VectorSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return WriteHNSW(prefix+VectorSuffix, h)
+}
+
+// vectorExts 有向量时, 清单中加入.hnsw文件
+func vectorExts(h *HNSW, exts ...string) []string {
+	if h.Len() > 0 {
+		exts = append(exts, VectorSuffix)
+	}
+	return exts
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,154 @@
+package index
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func randomVectors(n, dim int) [][]float32 {
+	rng := rand.New(rand.NewSource(7))
+	vecs := make([][]float32, n)
+	for i := range vecs {
+		vecs[i] = make([]float32, dim)
+		for j := range vecs[i] {
+			vecs[i][j] = float32(rng.NormFloat64())
+		}
+	}
+	return vecs
+}
+
+// bruteForce 精确计算的前k个文档
+func bruteForce(h *HNSW, q []float32, k int, filter map[int32]bool) []int32 {
+	v, _ := h.prepare(q)
+	var docs []Doc
+	for _, id := range h.IDs() {
+		if filter == nil || filter[id] {
+			docs = append(docs, Doc{ID: id, Score: h.similarity(v, h.Get(id))})
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Score > docs[j].Score })
+	var ids []int32
+	for i := 0; i < k && i < len(docs); i++ {
+		ids = append(ids, docs[i].ID)
+	}
+	return ids
+}
+
+func recall(docs []Doc, expect []int32) float64 {
+	hit := 0
+	for _, doc := range docs {
+		for _, id := range expect {
+			if doc.ID == id {
+				hit++
+			}
+		}
+	}
+	return float64(hit) / float64(len(expect))
+}
+
+func TestHNSW(t *testing.T) {
+	vecs := randomVectors(1000, 16)
+	h := NewHNSW(HNSWConfig{M: 8, EfConstruction: 100})
+	for i, v := range vecs {
+		assert.Nil(t, h.Add(int32(i), v))
+	}
+	assert.Equal(t, 1000, h.Len())
+	assert.Equal(t, 16, h.Config().Dim)
+	assert.NotNil(t, h.Add(1000, []float32{1, 2}))
+
+	queries := randomVectors(20, 16)
+	var total float64
+	for _, q := range queries {
+		docs, err := h.Search(q, 10, 100, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 10, len(docs))
+		assert.True(t, sort.SliceIsSorted(docs, func(i, j int) bool { return docs[i].Score > docs[j].Score }))
+		total += recall(docs, bruteForce(h, q, 10, nil))
+	}
+	assert.True(t, total/20 > 0.9, "recall %f", total/20)
+
+	//自身是最相似的文档, cosine为1
+	docs, _ := h.Search(vecs[42], 1, 0, nil)
+	assert.Equal(t, int32(42), docs[0].ID)
+	assert.InDelta(t, 1, docs[0].Score, 1e-5)
+
+	//前置过滤: 过滤后文档较多时在图中检索, 较少时精确计算
+	even := make(map[int32]bool)
+	for i := 0; i < 1000; i += 2 {
+		even[int32(i)] = true
+	}
+	docs, _ = h.Search(queries[0], 10, 100, even)
+	for _, doc := range docs {
+		assert.True(t, even[doc.ID])
+	}
+	assert.True(t, recall(docs, bruteForce(h, queries[0], 10, even)) > 0.8)
+	few := map[int32]bool{3: true, 5: true, 2000: true}
+	docs, _ = h.Search(queries[0], 10, 100, few)
+	assert.Equal(t, 2, len(docs))
+	assert.Equal(t, bruteForce(h, queries[0], 10, few), []int32{docs[0].ID, docs[1].ID})
+
+	//重新写入替换旧向量
+	assert.Nil(t, h.Add(42, queries[1]))
+	assert.Equal(t, 1000, h.Len())
+	docs, _ = h.Search(queries[1], 1, 0, nil)
+	assert.Equal(t, int32(42), docs[0].ID)
+	docs, _ = h.Search(vecs[42], 3, 0, nil)
+	for _, doc := range docs {
+		assert.NotEqual(t, int32(42), doc.ID)
+	}
+
+	//保存及读取
+	dir, _ := ioutil.TempDir("", "hnsw")
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "idx")
+	assert.Nil(t, SaveVectors(prefix, h))
+	loaded, err := LoadVectors(prefix)
+	assert.Nil(t, err)
+	assert.Equal(t, h.Config(), loaded.Config())
+	assert.Equal(t, h.IDs(), loaded.IDs())
+	expect, _ := h.Search(queries[2], 10, 0, nil)
+	docs, _ = loaded.Search(queries[2], 10, 0, nil)
+	assert.Equal(t, expect, docs)
+
+	ioutil.WriteFile(prefix+VectorSuffix, []byte("HNSW"), 0644)
+	_, err = LoadVectors(prefix)
+	assert.NotNil(t, err)
+	assert.Nil(t, SaveVectors(prefix, nil))
+	loaded, err = LoadVectors(prefix)
+	assert.Nil(t, err)
+	assert.Nil(t, loaded)
+
+	//重建时去掉已删除的文档
+	rebuilt := h.Filter(func(id int32) bool { return id%10 != 0 })
+	assert.Equal(t, 900, rebuilt.Len())
+	docs, _ = rebuilt.Search(vecs[10], 5, 0, nil)
+	for _, doc := range docs {
+		assert.NotEqual(t, int32(0), doc.ID%10)
+	}
+	merged := (*HNSW)(nil).Merge(rebuilt).Merge(NewHNSW(HNSWConfig{}))
+	assert.Equal(t, 900, merged.Len())
+}
+
+func TestHNSWDotProduct(t *testing.T) {
+	h := NewHNSW(HNSWConfig{Metric: DotProduct})
+	h.Add(1, []float32{1, 0})
+	h.Add(2, []float32{3, 0})
+	h.Add(3, []float32{0, 1})
+	docs, err := h.Search([]float32{1, 0}, 2, 0, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), docs[0].ID) //内积与长度有关
+	assert.Equal(t, float64(3), docs[0].Score)
+	assert.Equal(t, int32(1), docs[1].ID)
+
+	_, err = NewHNSW(HNSWConfig{}).Search([]float32{1}, 1, 0, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, NewHNSW(HNSWConfig{}).Add(1, []float32{0, 0}))
+	_, err = ParseVectorMetric("l2")
+	assert.NotNil(t, err)
+}
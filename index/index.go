@@ -1,20 +1,25 @@
 package index
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/binary"
+	"fmt"
+	"io"
 	"log"
-	"os"
 	"sort"
+	"strconv"
 )
 
-type SearchModel int
+// SearchModel 打分模型的名字, 对应RegisterSimilarity注册的模型, 为空时使用索引配置的默认模型
+type SearchModel string
 
 const (
-	Boolean SearchModel = iota
-	VectorSpace
-	BM25
+	Boolean         SearchModel = "boolean"
+	VectorSpace     SearchModel = "vs"
+	BM25            SearchModel = "bm25"
+	BM25Plus        SearchModel = "bm25+"
+	LMDirichlet     SearchModel = "lm_dirichlet"
+	LMJelinekMercer SearchModel = "lm_jm"
+	DFR             SearchModel = "dfr"
+	IB              SearchModel = "ib"
 )
 
 type KVPair struct {
@@ -24,6 +29,10 @@ type KVPair struct {
 
 type Index interface {
 	Property() *Property
+	Similarity() *SimilarityConfig
+	StaticScores() StaticScores
+	Timestamps() Timestamps
+	Vectors() *HNSW
 	Keys() []string
 	Clear()
 
@@ -33,89 +42,198 @@ type Index interface {
 	Retrieval(must []string, should []string, not []string, k int, r int, m SearchModel) []Doc
 }
 
-// DoRetrieval returns top k docs sorted by boolean model
+// DoRetrieval returns top k docs sorted by the similarity registered as model, model未注册时返回error
 // todo: compress posting list and opt intersection/union rt
 // https://blog.csdn.net/weixin_39890629/article/details/111268898
-func DoRetrieval(idx Index, must []string, should []string, not []string, k int, r int, model SearchModel) []Doc {
+func DoRetrieval(idx Index, must []string, should []string, not []string, k int, r int, model SearchModel) ([]Doc, error) {
+	result, _, err := doRetrieval(idx, must, should, not, nil, k, r, model, false)
+	return result, err
+}
+
+// DoRetrievalExplain 同DoRetrieval, 同时返回结果文档的得分明细
+func DoRetrievalExplain(idx Index, must []string, should []string, not []string, k int, r int, model SearchModel) ([]Doc, map[int32]*Explanation, error) {
+	return doRetrieval(idx, must, should, not, nil, k, r, model, true)
+}
+
+// DoBoostedRetrieval 同DoRetrieval, 词的得分乘以boost中的权重
+func DoBoostedRetrieval(idx Index, must []string, should []string, not []string, boost Boost, k int, r int, model SearchModel) ([]Doc, error) {
+	result, _, err := doRetrieval(idx, must, should, not, boost, k, r, model, false)
+	return result, err
+}
+
+// DoBoostedRetrievalExplain 同DoBoostedRetrieval, 同时返回结果文档的得分明细
+func DoBoostedRetrievalExplain(idx Index, must []string, should []string, not []string, boost Boost, k int, r int, model SearchModel) ([]Doc, map[int32]*Explanation, error) {
+	return doRetrieval(idx, must, should, not, boost, k, r, model, true)
+}
+
+// retrieval Index.Retrieval的实现, model未注册时记录日志并返回nil
+func retrieval(idx Index, must []string, should []string, not []string, k int, r int, model SearchModel) []Doc {
+	result, err := DoRetrieval(idx, must, should, not, k, r, model)
+	if err != nil {
+		log.Printf("retrieval err: %s", err.Error())
+		return nil
+	}
+	return result
+}
+
+func doRetrieval(idx Index, must []string, should []string, not []string, boost Boost, k int, r int, model SearchModel, explain bool) ([]Doc, map[int32]*Explanation, error) {
 	tfidf := NewTFIDF()
+	tfidf.Boost = boost
+	if explain {
+		tfidf.Explain = make(map[int32]*Explanation)
+	}
 
 	//query's term frequency
 	tfidf.DOC2TF[VirtualQueryDocId] = make(TF, 0)
 
-	calTFIDF := func(term string, dn, df int, plr PostingList) {
-		tfidf.IDF[term] = CalIDF(dn, df)
-		for _, doc := range plr {
-			var tf TF
-			if tf = tfidf.DOC2TF[doc.ID]; tf == nil {
-				tf = make(TF, 0)
+	properties := idx.Property()
+	sim := idx.Similarity()
+	if model == "" {
+		model = sim.Model
+	}
+	similarity, err := LookupSimilarity(model)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := append([]string{TextField}, sim.FieldNames()...)
+
+	// postings 词在正文及各字段中的倒排表, 按docID合并. BM25F的df取各字段中最大的df
+	postings := func(term string) PostingList {
+		var merged PostingList
+		df := 0
+		for _, field := range fields {
+			pl := (PostingList)(idx.Get(FieldTerm(field, term)))
+			if pl == nil {
+				// Token doesn't exist.
+				continue
+			}
+			//胜者表按QualityScore(词频及静态分)取前r个,加速归并. 拷贝后再按docID排序, 不修改索引中(可能为只读mmap)的倒排表
+			plr := championList(pl, r)
+			sort.Sort(plr)
+			tfidf.addField(term, field, plr)
+			tfidf.addStats(FieldTerm(field, term), pl)
+			df = IfElseInt(len(pl) > df, len(pl), df)
+			if merged == nil {
+				merged = plr
+			} else {
+				merged.Union(plr)
 			}
-			tf[term] = doc.TF
-			tfidf.DOC2TF[doc.ID] = tf
 		}
+		if merged != nil {
+			tfidf.IDF[term] = CalIDF(properties.DocNum(), df)
+		}
+		return merged
 	}
-	properties := idx.Property()
 
 	var result PostingList
 	for _, term := range must {
 		tfidf.DOC2TF[VirtualQueryDocId][term]++
-		if pl := (PostingList)(idx.Get(term)); pl != nil {
-			plr := pl[:IfElseInt(len(pl) > r, r, len(pl))] //胜者表按TF排序,截断前r个,加速归并
-			sort.Sort(plr)                                 //按docID排序
+		if plr := postings(term); plr != nil {
 			if result == nil {
 				result = plr
 			} else {
 				result.Inter(plr)
 			}
-			calTFIDF(term, properties.DocNum(), len(pl), plr)
-		} else {
-			// Token doesn't exist.
-			continue
 		}
 	}
 
 	for _, term := range should {
 		tfidf.DOC2TF[VirtualQueryDocId][term]++
-		if pl := (PostingList)(idx.Get(term)); pl != nil {
-			plr := pl[:IfElseInt(len(pl) > r, r, len(pl))]
-			sort.Sort(plr)
+		if plr := postings(term); plr != nil {
 			if result == nil {
 				result = plr //胜者表，截断r
 			} else {
 				result.Union(plr)
 			}
-			calTFIDF(term, properties.DocNum(), len(pl), plr)
-		} else {
-			// Token doesn't exist.
-			continue
 		}
 	}
 
 	for _, term := range not {
-		if pl := (PostingList)(idx.Get(term)); pl != nil {
-			sort.Sort(pl)
-			result.Filter(pl)
-		} else {
-			// Token doesn't exist.
-			continue
+		for _, field := range fields {
+			if pl := (PostingList)(idx.Get(FieldTerm(field, term))); pl != nil {
+				pl = append(PostingList(nil), pl...)
+				sort.Sort(pl)
+				result.Filter(pl)
+			}
 		}
 	}
 
-	if model == BM25 {
-		result = CalBM25(result, tfidf, properties.TokenCount(), properties.DocNum())
-	} else if model == VectorSpace {
-		result = CalCosine(result, tfidf)
+	result = similarity.Score(result, &ScoreContext{TFIDF: tfidf, Property: properties, Config: sim})
+	if sim.PriorWeight > 0 {
+		blendPriors(result, idx.StaticScores(), sim.PriorWeight, tfidf.Explain)
 	}
 
 	//排序
 	sort.Slice(result, func(i, j int) bool {
 		return result[i].Score > result[j].Score //降序
 	})
-	log.Printf("result sorted:%+v", result)
 
 	if len(result) > k {
-		return result[:k]
+		result = result[:k]
+	}
+	if !explain {
+		return result, nil, nil
+	}
+	explains := make(map[int32]*Explanation, len(result))
+	for _, hit := range result {
+		explains[hit.ID] = tfidf.Explain[hit.ID]
+	}
+	return result, explains, nil
+}
+
+// championList 胜者表: 按QualityScore取前r个文档, 不修改pl
+func championList(pl PostingList, r int) PostingList {
+	if len(pl) <= r {
+		return append(PostingList(nil), pl...)
+	}
+	if r <= 0 {
+		return nil
+	}
+	//大小为r的最小堆
+	h := append(PostingList(nil), pl[:r]...)
+	less := func(a, b Doc) bool {
+		if a.QualityScore != b.QualityScore {
+			return a.QualityScore < b.QualityScore
+		}
+		return a.ID < b.ID
+	}
+	down := func(i int) {
+		for {
+			min, l, r := i, 2*i+1, 2*i+2
+			if l < len(h) && less(h[l], h[min]) {
+				min = l
+			}
+			if r < len(h) && less(h[r], h[min]) {
+				min = r
+			}
+			if min == i {
+				return
+			}
+			h[i], h[min] = h[min], h[i]
+			i = min
+		}
+	}
+	for i := len(h)/2 - 1; i >= 0; i-- {
+		down(i)
+	}
+	for _, doc := range pl[r:] {
+		if less(h[0], doc) {
+			h[0] = doc
+			down(0)
+		}
+	}
+	return h
+}
+
+// blendPriors 相关性得分加上weight*静态分
+func blendPriors(hits []Doc, priors StaticScores, weight float64, explain map[int32]*Explanation) {
+	for i := range hits {
+		prior := priors.Get(hits[i].ID)
+		hits[i].Score, _ = strconv.ParseFloat(fmt.Sprintf("%.4f", hits[i].Score+weight*prior), 64)
+		if e := explain[hits[i].ID]; e != nil {
+			e.Prior, e.PriorWeight, e.Score = prior, weight, hits[i].Score
+		}
 	}
-	return result
 }
 
 // Drain data to file. sort by key
@@ -124,109 +242,53 @@ func Drain(idx Index, file string) {
 		return
 	}
 
-	fd, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0660)
+	writer, err := NewRunWriter(file)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	writer := bufio.NewWriter(fd)
-	defer func() {
-		writer.Flush()
-		fd.Close()
-	}()
-
+	writer.SetProperty(*idx.Property())
+	if err = SaveVectors(file, idx.Vectors()); err != nil {
+		panic(err.Error())
+	}
+	if err = SavePriors(file, idx.StaticScores()); err != nil {
+		panic(err)
+	}
+	if err = SaveTimestamps(file, idx.Timestamps()); err != nil {
+		panic(err)
+	}
 	keys := idx.Keys()
 	sort.Strings(keys)
-
-	buffer := bytes.NewBuffer([]byte{})
 	for i := 0; i < len(keys); i++ {
-		k := keys[i]
-		pl := (PostingList)(idx.Get(k)).Bytes()
-
-		buffer.Reset()
-		l := int32(len(k))
-		if err := binary.Write(buffer, binary.LittleEndian, l); err != nil {
-			panic(err)
-		}
-
-		if err := binary.Write(buffer, binary.LittleEndian, []byte(k)); err != nil {
-			panic(err)
-		}
-
-		l = int32(len(pl))
-		if err := binary.Write(buffer, binary.LittleEndian, l); err != nil {
-			panic(err)
-		}
-
-		if err := binary.Write(buffer, binary.LittleEndian, pl); err != nil {
-			panic(err)
-		}
-
-		if _, err := writer.Write(buffer.Bytes()); err != nil {
+		if err := writer.Write(keys[i], idx.Get(keys[i])); err != nil {
 			panic(err)
 		}
 	}
+	if err := writer.Close(); err != nil {
+		panic(err)
+	}
 }
 
-// Load file.
+// Load file. a nil pair means the end of file or read error
 func Load(file string) (chan *KVPair, error) {
-	ch := make(chan *KVPair, 10)
-
-	fd, err := os.OpenFile(file, os.O_RDONLY|os.O_CREATE, 0660)
+	reader, err := OpenRunReader(file)
 	if err != nil {
 		return nil, err
 	}
 
-	ReadInt := func() (int, error) {
-		buf := make([]byte, 4)
-		if n, err := fd.Read(buf); err != nil {
-			return 0, err
-		} else {
-			var leng int32
-			if err = binary.Read(bytes.NewBuffer(buf[:n]), binary.LittleEndian, &leng); err != nil {
-				panic(err)
-			}
-			return int(leng), nil
-		}
-
-	}
-
-	ReadString := func(n int) (string, error) {
-		buf := make([]byte, n)
-		if n, err := fd.Read(buf); err != nil {
-			return "", err
-		} else {
-			return string(buf[:n]), nil
-		}
-
-	}
-
+	ch := make(chan *KVPair, 10)
 	go func() {
-		defer fd.Close()
-
+		defer reader.Close()
 		for {
-			pair := KVPair{}
-			n, err := ReadInt()
+			key, pl, err := reader.Next()
 			if err != nil {
+				if err != io.EOF {
+					log.Printf("load %s err: %s", file, err.Error())
+				}
 				ch <- nil
 				break
 			}
-			if pair.Key, err = ReadString(n); err != nil {
-				ch <- nil
-				break
-			}
-			if n, err = ReadInt(); err != nil {
-				ch <- nil
-				break
-			}
-
-			var v string
-			if v, err = ReadString(n); err != nil {
-				ch <- nil
-				break
-			}
-			pair.Value.FromBytes([]byte(v))
-			ch <- &pair
+			ch <- &KVPair{Key: key, Value: pl}
 		}
 	}()
 	return ch, nil
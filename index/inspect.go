@@ -0,0 +1,229 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 索引检查: 打开btree/mmap索引或run文件, 查看词典、倒排表及属性, 校验倒排表无重复文档, 归并生成的全量索引还校验倒排表有序
+
+const FormatRun = "run"
+
+// FileSize 索引文件大小
+type FileSize struct {
+	Name string
+	Size int64
+}
+
+// InspectReport 索引检查结果
+type InspectReport struct {
+	Terms        int    //词数
+	Postings     int    //倒排表总长度
+	MaxDF        int    //最大文档频率
+	MaxDFTerm    string //最大文档频率的词
+	KeyBytes     int64  //词典中key的总字节数
+	PostingBytes int64  //倒排表序列化后的总字节数
+
+	Problems     []string //最多保留MaxReportErrors条
+	ProblemCount int
+}
+
+func (r *InspectReport) addProblem(format string, args ...interface{}) {
+	r.ProblemCount++
+	if len(r.Problems) < MaxReportErrors {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// Inspector 只读地打开一个索引或run文件
+type Inspector struct {
+	File   string
+	Format string //btree|mmap|run
+	Sorted bool   //倒排表按文档ID排序(清单中记录的MergeAll归并结果), run文件及辅助索引按写入顺序或质量分排列
+
+	seg Segment //run文件为nil
+}
+
+// OpenInspector file可以是run文件、索引文件前缀或发布的逻辑路径(存在file.current)
+func OpenInspector(file string) (*Inspector, error) {
+	if isRunFile(file) {
+		return &Inspector{File: file, Format: FormatRun}, nil
+	}
+
+	current, err := ResolveIndex(file)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := OpenSegment(current)
+	if err == nil {
+		format := FormatBTree
+		if _, ok := seg.(*MmapIndex); ok {
+			format = FormatMmap
+		}
+		m, _ := ReadManifest(current)
+		return &Inspector{File: current, Format: format, Sorted: m != nil && m.Sorted, seg: seg}, nil
+	}
+	if _, e := os.Stat(current + ".idx"); !errors.Is(err, ErrNoManifest) || e != nil {
+		return nil, err
+	}
+	//没有清单的旧btree索引
+	bt := newBTreeIndex(current)
+	if err = bt.Load(); err != nil {
+		bt.BT.Close()
+		return nil, err
+	}
+	return &Inspector{File: current, Format: FormatBTree, seg: bt}, nil
+}
+
+func isRunFile(file string) bool {
+	fd, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	var magic uint32
+	return binary.Read(fd, binary.LittleEndian, &magic) == nil && magic == runMagic
+}
+
+// Close 关闭索引, 不修改索引文件
+func (in *Inspector) Close() {
+	switch idx := in.seg.(type) {
+	case *BTreeIndex:
+		idx.BT.Close()
+	case *MmapIndex:
+		idx.Close()
+	}
+}
+
+// Property 索引属性, run文件没有属性返回nil
+func (in *Inspector) Property() *Property {
+	if in.seg == nil {
+		return nil
+	}
+	return in.seg.Property()
+}
+
+// Range 按key顺序遍历所有倒排表
+func (in *Inspector) Range(fn func(key string, pl PostingList) error) error {
+	if in.seg != nil {
+		return in.seg.Range(fn)
+	}
+
+	reader, err := OpenRunReader(in.File)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	for {
+		key, pl, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(key, pl); err != nil {
+			return err
+		}
+	}
+}
+
+// Postings 返回term的倒排表, run文件需要顺序扫描
+func (in *Inspector) Postings(term string) (PostingList, error) {
+	if in.seg != nil {
+		return in.seg.Get(term), nil
+	}
+
+	var result PostingList
+	err := in.Range(func(key string, pl PostingList) error {
+		if key == term {
+			result = pl
+		}
+		if key >= term {
+			return io.EOF
+		}
+		return nil
+	})
+	if err == io.EOF {
+		err = nil
+	}
+	return result, err
+}
+
+// Files 索引包含的文件及大小
+func (in *Inspector) Files() []FileSize {
+	return SegmentFiles(in.File, in.Format)
+}
+
+// SegmentFiles 格式为format的索引file包含的文件及大小, 不存在的文件跳过
+func SegmentFiles(file string, format string) []FileSize {
+	var exts []string
+	switch format {
+	case FormatRun:
+		exts = []string{"", PriorSuffix, TimestampSuffix, VectorSuffix}
+	case FormatMmap:
+		exts = []string{".dict", ".post", ".sum", PriorSuffix, TimestampSuffix, VectorSuffix, ManifestSuffix}
+	default:
+		exts = []string{".idx", ".kv", ".sum", PriorSuffix, TimestampSuffix, VectorSuffix, ManifestSuffix}
+	}
+
+	var files []FileSize
+	for _, ext := range exts {
+		if info, err := os.Stat(file + ext); err == nil {
+			files = append(files, FileSize{Name: filepath.Base(file + ext), Size: info.Size()})
+		}
+	}
+	return files
+}
+
+// Check 遍历所有倒排表统计词典信息, 校验key升序、倒排表无重复文档.
+// 只有Sorted的索引校验倒排表按PostingList顺序(docID降序)排列
+func (in *Inspector) Check() (*InspectReport, error) {
+	report := &InspectReport{}
+	encoded := int64(binary.Size(Doc{}))
+
+	var lastKey string
+	err := in.Range(func(key string, pl PostingList) error {
+		if report.Terms > 0 && key <= lastKey {
+			report.addProblem("term %q after %q: terms not sorted", key, lastKey)
+		}
+		lastKey = key
+
+		report.Terms++
+		report.Postings += len(pl)
+		report.KeyBytes += int64(len(key))
+		report.PostingBytes += int64(len(pl)) * encoded
+		if len(pl) > report.MaxDF {
+			report.MaxDF, report.MaxDFTerm = len(pl), key
+		}
+		if len(pl) == 0 {
+			report.addProblem("term %q: empty posting list", key)
+		}
+
+		if !sort.IsSorted(pl) {
+			if in.Sorted {
+				report.addProblem("term %q: postings not sorted by doc id", key)
+			}
+			pl = append(PostingList(nil), pl...)
+			sort.Sort(pl)
+		}
+		var dups []string
+		for i := 1; i < len(pl); i++ {
+			if pl[i].ID == pl[i-1].ID && (i == 1 || pl[i-1].ID != pl[i-2].ID) {
+				dups = append(dups, strconv.Itoa(int(pl[i].ID)))
+			}
+		}
+		if len(dups) > 0 {
+			report.addProblem("term %q: duplicate doc id %s", key, strings.Join(dups, ","))
+		}
+		return nil
+	})
+	return report, err
+}
@@ -0,0 +1,85 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspector(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "inspect")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "idx")
+	bt := NewBTreeIndex(file)
+	bt.Insert("donut", PostingList{{ID: 2, TF: 1}, {ID: 1, TF: 3}})
+	bt.Insert("glass", PostingList{{ID: 1, TF: 1}})
+	bt.MarkSorted()
+	bt.Close()
+
+	in, err := OpenInspector(file)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatBTree, in.Format)
+	assert.True(t, in.Sorted)
+	assert.Equal(t, 2, in.Property().TokenCount())
+	pl, err := in.Postings("donut")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2}, pl.IDs())
+
+	report, err := in.Check()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Terms)
+	assert.Equal(t, 3, report.Postings)
+	assert.Equal(t, "donut", report.MaxDFTerm)
+	assert.Equal(t, 0, report.ProblemCount)
+	assert.Equal(t, 4, len(in.Files()))
+	in.Close()
+
+	//归并生成的全量索引校验倒排表顺序
+	bt = NewBTreeIndex(file)
+	bt.Insert("donut", PostingList{{ID: 1, TF: 3}, {ID: 2, TF: 1}})
+	bt.MarkSorted()
+	bt.Close()
+	in, _ = OpenInspector(file)
+	report, _ = in.Check()
+	assert.Equal(t, []string{`term "donut": postings not sorted by doc id`}, report.Problems)
+	in.Close()
+
+	//辅助索引按质量分排列, 只校验重复文档
+	aux := filepath.Join(dir, "aux")
+	bt = NewBTreeIndex(aux)
+	bt.Add([]Document{{ID: 1, Text: "donut donut"}, {ID: 2, Text: "donut"}})
+	bt.Close()
+	in, _ = OpenInspector(aux)
+	assert.False(t, in.Sorted)
+	report, _ = in.Check()
+	assert.Equal(t, 0, report.ProblemCount)
+	in.Close()
+
+	//run文件: 倒排表按写入顺序排列, 只校验重复文档
+	run := filepath.Join(dir, "idx.run")
+	writer, _ := NewRunWriter(run)
+	writer.Write("donut", PostingList{{ID: 1}, {ID: 2}})
+	writer.Write("glass", PostingList{{ID: 3}, {ID: 3}, {ID: 3}, {ID: 1}})
+	assert.Nil(t, writer.Close())
+
+	in, err = OpenInspector(run)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatRun, in.Format)
+	assert.Nil(t, in.Property())
+	pl, _ = in.Postings("glass")
+	assert.Equal(t, 4, len(pl))
+	pl, _ = in.Postings("apple")
+	assert.Nil(t, pl)
+
+	report, err = in.Check()
+	assert.Nil(t, err)
+	assert.False(t, in.Sorted)
+	assert.Equal(t, []string{`term "glass": duplicate doc id 3`}, report.Problems)
+
+	_, err = OpenInspector(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,91 @@
+package index
+
+import (
+	"strings"
+
+	"github.com/awesomefly/easysearch/util"
+)
+
+// BooleanQuery 布尔查询: Must中的词必须出现, Not中的词不能出现, 没有Must时至少出现一个Should中的词
+type BooleanQuery struct {
+	Must   []string
+	Should []string
+	Not    []string
+}
+
+// ParseBooleanQuery 解析查询, +词为必须, -词为排除, 其他为可选, 词经过分词及词干提取
+func ParseBooleanQuery(q string) BooleanQuery {
+	var query BooleanQuery
+	for _, word := range strings.Fields(q) {
+		switch {
+		case strings.HasPrefix(word, "+"):
+			query.Must = append(query.Must, util.Analyze(word[1:])...)
+		case strings.HasPrefix(word, "-"):
+			query.Not = append(query.Not, util.Analyze(word[1:])...)
+		default:
+			query.Should = append(query.Should, util.Analyze(word)...)
+		}
+	}
+	return query
+}
+
+func (q BooleanQuery) Empty() bool {
+	return len(q.Must) == 0 && len(q.Should) == 0 && len(q.Not) == 0
+}
+
+// BooleanFilter 索引中满足布尔查询的文档, 词在正文及打分参数配置的字段中查找.
+// 只有Not时为索引中除Not以外有向量的文档
+func BooleanFilter(idx Index, q BooleanQuery) map[int32]bool {
+	fields := append([]string{TextField}, idx.Similarity().FieldNames()...)
+	docs := func(term string) map[int32]bool {
+		set := make(map[int32]bool)
+		for _, field := range fields {
+			for _, doc := range idx.Get(FieldTerm(field, term)) {
+				set[doc.ID] = true
+			}
+		}
+		return set
+	}
+
+	var result map[int32]bool
+	switch {
+	case len(q.Must) > 0:
+		for _, term := range q.Must {
+			set := docs(term)
+			if result == nil {
+				result = set
+				continue
+			}
+			for id := range result {
+				if !set[id] {
+					delete(result, id)
+				}
+			}
+		}
+	case len(q.Should) > 0:
+		result = make(map[int32]bool)
+		for _, term := range q.Should {
+			for id := range docs(term) {
+				result[id] = true
+			}
+		}
+	default:
+		result = make(map[int32]bool)
+		for _, id := range idx.Vectors().IDs() {
+			result[id] = true
+		}
+	}
+
+	for _, term := range q.Not {
+		for id := range docs(term) {
+			delete(result, id)
+		}
+	}
+	return result
+}
+
+// KNN 在idx的向量中检索与vec最相似的k个文档, Score为相似度.
+// filter非nil时只返回filter中的文档, 候选集大小使用打分参数中的EfSearch
+func KNN(idx Index, vec []float32, k int, filter map[int32]bool) ([]Doc, error) {
+	return idx.Vectors().Search(vec, k, idx.Similarity().Vector.EfSearch, filter)
+}
@@ -0,0 +1,47 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKNN(t *testing.T) {
+	idx := NewHashMapIndex()
+	idx.Add([]Document{
+		{ID: 1, Title: "Jordan", Text: "Michael Jordan basketball", Vector: []float32{1, 0, 0}},
+		{ID: 2, Title: "Album", Text: "Jordan album music", Vector: []float32{0.9, 0.1, 0}},
+		{ID: 3, Text: "basketball music", Vector: []float32{0, 1, 0}},
+		{ID: 4, Text: "music without vector"},
+	})
+	assert.Equal(t, 3, idx.Vectors().Len())
+
+	docs, err := KNN(idx, []float32{1, 0, 0}, 2, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []int32{1, 2}, []int32{docs[0].ID, docs[1].ID})
+	assert.InDelta(t, 1, docs[0].Score, 1e-5)
+
+	q := ParseBooleanQuery("+music -albums basketball")
+	assert.Equal(t, []string{"music"}, q.Must)
+	assert.Equal(t, []string{"album"}, q.Not)
+	assert.Equal(t, []string{"basketbal"}, q.Should)
+	assert.True(t, ParseBooleanQuery("").Empty())
+
+	//有Must时取交集, 否则为Should的并集, 最后去掉Not
+	assert.Equal(t, map[int32]bool{3: true, 4: true}, BooleanFilter(idx, q))
+	assert.Equal(t, map[int32]bool{1: true, 3: true}, BooleanFilter(idx, ParseBooleanQuery("basketball")))
+	assert.Equal(t, map[int32]bool{1: true, 3: true}, BooleanFilter(idx, ParseBooleanQuery("-album")))
+	//标题在打分参数的字段中时也参与过滤
+	sim := DefaultSimilarity()
+	sim.Fields = map[string]FieldSimilarity{TitleField: {Weight: 2, B: 0.75}}
+	idx.SetSimilarity(sim)
+	assert.Equal(t, map[int32]bool{1: true}, BooleanFilter(idx, ParseBooleanQuery("-album -music")))
+
+	docs, err = KNN(idx, []float32{1, 0, 0}, 2, BooleanFilter(idx, q))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(docs))
+	assert.Equal(t, int32(3), docs[0].ID)
+
+	_, err = KNN(idx, []float32{1, 0}, 2, nil)
+	assert.NotNil(t, err)
+}
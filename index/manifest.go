@@ -0,0 +1,135 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/awesomefly/easysearch/util"
+)
+
+const (
+	// FormatVersion 索引文件格式版本, 不兼容的格式变更时递增
+	FormatVersion = 1
+
+	ManifestSuffix = ".manifest"
+
+	// 段格式, 旧清单没有该字段时为btree
+	FormatBTree = "btree"
+	FormatMmap  = "mmap"
+)
+
+var ErrNoManifest = errors.New("segment manifest not found")
+
+// SegmentFile 段内文件, Name为相对段所在目录的文件名
+type SegmentFile struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+}
+
+// Manifest 段清单, 记录段的所有文件及校验和
+type Manifest struct {
+	Version    int           `json:"version"`
+	Format     string        `json:"format,omitempty"`
+	Sorted     bool          `json:"sorted,omitempty"` //倒排表按文档ID排序, 由MergeAll归并生成的全量索引
+	Created    time.Time     `json:"created"`
+	Analyzer   string        `json:"analyzer"`
+	DocNum     int           `json:"doc_num"`
+	TokenCount int           `json:"token_count"`
+	DataRange  DataRange     `json:"data_range"`
+	Files      []SegmentFile `json:"files"`
+}
+
+// NewManifest 计算段文件prefix+ext的大小及crc32
+func NewManifest(prefix string, p *Property, exts ...string) (*Manifest, error) {
+	m := &Manifest{
+		Version:    FormatVersion,
+		Created:    time.Now(),
+		Analyzer:   util.AnalyzerName,
+		DocNum:     p.DocNum(),
+		TokenCount: p.TokenCount(),
+		DataRange:  p.DataRange(),
+	}
+	for _, ext := range exts {
+		size, sum, err := checksum(prefix + ext)
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, SegmentFile{Name: filepath.Base(prefix + ext), Size: size, CRC32: sum})
+	}
+	return m, nil
+}
+
+// Write manifest to prefix.manifest, 先写临时文件再rename保证原子性
+func (m *Manifest) Write(prefix string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := prefix + ManifestSuffix + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmp, prefix+ManifestSuffix)
+}
+
+// ReadManifest reads prefix.manifest, returns ErrNoManifest if it does not exist
+func ReadManifest(prefix string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(prefix + ManifestSuffix)
+	if os.IsNotExist(err) {
+		return nil, ErrNoManifest
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("corrupt manifest %s: %v", prefix+ManifestSuffix, err)
+	}
+	return m, nil
+}
+
+// Verify checks format version, analyzer and all files listed in manifest
+func (m *Manifest) Verify(dir string) error {
+	if m.Version != FormatVersion {
+		return fmt.Errorf("incompatible index format version %d, expect %d", m.Version, FormatVersion)
+	}
+	if m.Analyzer != util.AnalyzerName {
+		return fmt.Errorf("index built with analyzer %q, current analyzer is %q", m.Analyzer, util.AnalyzerName)
+	}
+	for _, f := range m.Files {
+		size, sum, err := checksum(filepath.Join(dir, f.Name))
+		if err != nil {
+			return err
+		}
+		if size != f.Size {
+			return fmt.Errorf("corrupt index file %s: size %d, expect %d", f.Name, size, f.Size)
+		}
+		if sum != f.CRC32 {
+			return fmt.Errorf("corrupt index file %s: crc32 %08x, expect %08x", f.Name, sum, f.CRC32)
+		}
+	}
+	return nil
+}
+
+func checksum(file string) (int64, uint32, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fd.Close()
+
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, fd)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, h.Sum32(), nil
+}
@@ -0,0 +1,108 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifest(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "manifest")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idx")
+
+	idx := NewBTreeIndex(file)
+	idx.Add([]Document{{ID: 1, Text: "A donut on a glass plate. Only the."}})
+	idx.Add([]Document{{ID: 2, Text: "donut is a donut"}})
+	idx.Property().SetDataRange(DataRange{Start: 100, End: 200})
+	idx.Close()
+
+	m, err := ReadManifest(file)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatVersion, m.Version)
+	assert.Equal(t, 2, m.DocNum)
+	assert.Equal(t, 3, len(m.Files))
+
+	idx, err = OpenBTreeIndex(file)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, idx.Property().DocNum())
+	assert.Equal(t, m.TokenCount, idx.Property().TokenCount())
+	assert.Equal(t, DataRange{Start: 100, End: 200}, idx.Property().DataRange())
+	assert.Equal(t, 2, len(idx.Get("donut")))
+	idx.BT.Close()
+
+	//损坏的文件
+	data, _ := ioutil.ReadFile(file + ".kv")
+	data[len(data)/2] ^= 0xff
+	ioutil.WriteFile(file+".kv", data, 0660)
+	_, err = OpenBTreeIndex(file)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "crc32")
+
+	//不兼容的版本
+	m.Version = FormatVersion + 1
+	assert.Nil(t, m.Write(file))
+	_, err = OpenBTreeIndex(file)
+	assert.Contains(t, err.Error(), "incompatible")
+
+	os.Remove(file + ManifestSuffix)
+	_, err = OpenBTreeIndex(file)
+	assert.True(t, errors.Is(err, ErrNoManifest))
+}
+
+func TestLoadLegacySummary(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "manifest")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idx")
+
+	fd, _ := os.Create(file + ".sum")
+	binary.Write(fd, binary.LittleEndian, []int32{3, 30, 1, 2})
+	fd.Close()
+
+	idx := NewBTreeIndex(file)
+	assert.Equal(t, 3, idx.Property().DocNum())
+	assert.Equal(t, 30, idx.Property().TokenCount())
+	assert.Equal(t, DataRange{Start: 1, End: 2}, idx.Property().DataRange())
+	idx.BT.Close()
+
+	ioutil.WriteFile(file+".sum", []byte("garbage"), 0660)
+	idx = newBTreeIndex(file)
+	assert.NotNil(t, idx.Load())
+	idx.BT.Close()
+}
+
+func TestRunFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "run")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "run")
+
+	w, err := NewRunWriter(file)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write("a", PostingList{{ID: 1, TF: 1}}))
+	assert.Nil(t, w.Write("b", PostingList{{ID: 2, TF: 1}, {ID: 1, TF: 3}}))
+	assert.NotNil(t, w.Write("a", nil)) //乱序
+	assert.Nil(t, w.Close())
+
+	r, err := OpenRunReader(file)
+	assert.Nil(t, err)
+	key, pl, err := r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", key)
+	assert.Equal(t, 1, pl.Len())
+	key, pl, _ = r.Next()
+	assert.Equal(t, "b", key)
+	assert.Equal(t, int32(3), pl[1].TF)
+	_, _, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	r.Close()
+
+	ioutil.WriteFile(file, []byte("not a run file"), 0660)
+	_, err = OpenRunReader(file)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,25 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package index
+
+import (
+	"io/ioutil"
+	"unsafe"
+)
+
+// mmapFile 不支持mmap的平台读取整个文件, 按8字节对齐分配内存
+func mmapFile(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	words := make([]uint64, (len(data)+7)/8)
+	b := (*[1 << 30]byte)(unsafe.Pointer(&words[0]))[:len(data):len(data)]
+	copy(b, data)
+	return b, nil
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,430 @@
+//
+// mmap read-only segment, 用于不可变的全量索引
+//
+// .dict  词典, 按key升序: magic|version|{len(key) uint16|key|offset uint64|count uint32}...
+// .post  倒排表, 按词典顺序连续存放: magic|version|sizeof(Doc)|byteOrder|{[]Doc 8字节对齐}...
+//
+// 每隔sparseInterval个词在内存中保存一个稀疏索引项, 查询时二分查找稀疏索引,
+// 再在mmap的词典中顺序扫描至多sparseInterval个词. 倒排表直接引用mmap内存, 查询无需分配和拷贝
+//
+
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"unsafe"
+)
+
+const (
+	dictMagic   uint32 = 0x54434445 //"EDCT"
+	postMagic   uint32 = 0x54535045 //"EPST"
+	mmapVersion uint32 = 1
+
+	dictHeaderSize = 8
+	postHeaderSize = 16
+	dictEntryFixed = 2 + 8 + 4
+
+	sparseInterval = 32
+	maxPostings    = 1 << 25 //单个倒排表的最大文档数
+	byteOrderMark  = 0x01020304
+)
+
+var docSize = int(unsafe.Sizeof(Doc{}))
+
+// sparseEntry 稀疏索引项, pos为词典项在.dict中的偏移
+type sparseEntry struct {
+	key string
+	pos int
+}
+
+// MmapIndex 只读的mmap索引段, 由MmapWriter生成
+type MmapIndex struct {
+	IndexFile string
+
+	dict   []byte
+	post   []byte
+	sparse []sparseEntry
+	keys   int
+
+	property   Property
+	similarity SimilarityConfig
+	priors     StaticScores
+	times      Timestamps
+	vectors    *HNSW
+	refs       refCount
+}
+
+// OpenMmapIndex opens a segment written by MmapWriter and verifies its manifest.
+func OpenMmapIndex(file string) (*MmapIndex, error) {
+	m, err := ReadManifest(file)
+	if err != nil {
+		return nil, fmt.Errorf("open index %s: %w", file, err)
+	}
+	if m.Format != FormatMmap {
+		return nil, fmt.Errorf("open index %s: not a mmap segment, format %q", file, m.Format)
+	}
+	if err = m.Verify(filepath.Dir(file)); err != nil {
+		return nil, fmt.Errorf("open index %s: %v", file, err)
+	}
+
+	idx := &MmapIndex{IndexFile: file, similarity: DefaultSimilarity(), refs: newRefCount()}
+	if err = readSummary(file+".sum", &idx.property); err != nil {
+		return nil, fmt.Errorf("open index %s: %v", file, err)
+	}
+	if idx.priors, err = LoadPriors(file); err != nil {
+		return nil, fmt.Errorf("open index %s: %v", file, err)
+	}
+	if idx.times, err = LoadTimestamps(file); err != nil {
+		return nil, fmt.Errorf("open index %s: %v", file, err)
+	}
+	if idx.vectors, err = LoadVectors(file); err != nil {
+		return nil, fmt.Errorf("open index %s: %v", file, err)
+	}
+	if idx.dict, err = mmapFile(file + ".dict"); err != nil {
+		return nil, fmt.Errorf("open index %s: %v", file, err)
+	}
+	if idx.post, err = mmapFile(file + ".post"); err != nil {
+		munmapFile(idx.dict)
+		return nil, fmt.Errorf("open index %s: %v", file, err)
+	}
+	if err = idx.init(); err != nil {
+		idx.unmap()
+		return nil, fmt.Errorf("open index %s: %v", file, err)
+	}
+	return idx, nil
+}
+
+// init 校验文件头并构建稀疏索引
+func (idx *MmapIndex) init() error {
+	if len(idx.dict) < dictHeaderSize || binary.LittleEndian.Uint32(idx.dict) != dictMagic {
+		return errors.New("invalid dict file")
+	}
+	if v := binary.LittleEndian.Uint32(idx.dict[4:]); v != mmapVersion {
+		return fmt.Errorf("unsupported dict version %d", v)
+	}
+	if len(idx.post) < postHeaderSize || binary.LittleEndian.Uint32(idx.post) != postMagic {
+		return errors.New("invalid postings file")
+	}
+	if v := binary.LittleEndian.Uint32(idx.post[4:]); v != mmapVersion {
+		return fmt.Errorf("unsupported postings version %d", v)
+	}
+	//倒排表按本机内存布局存储, 不同平台生成的段不能直接使用
+	if n := int(binary.LittleEndian.Uint32(idx.post[8:])); n != docSize {
+		return fmt.Errorf("postings written with doc size %d, expect %d", n, docSize)
+	}
+	if *(*uint32)(unsafe.Pointer(&idx.post[12])) != byteOrderMark {
+		return errors.New("postings written with different byte order")
+	}
+
+	for pos := dictHeaderSize; pos < len(idx.dict); idx.keys++ {
+		key, off, n, next, err := idx.entry(pos)
+		if err != nil {
+			return err
+		}
+		if off%8 != 0 || n > maxPostings || off+n*docSize > len(idx.post) {
+			return fmt.Errorf("corrupt dict entry %q", key)
+		}
+		if idx.keys%sparseInterval == 0 {
+			idx.sparse = append(idx.sparse, sparseEntry{key: string(key), pos: pos})
+		}
+		pos = next
+	}
+	return nil
+}
+
+// entry 解析pos处的词典项, 返回的key引用mmap内存
+func (idx *MmapIndex) entry(pos int) (key []byte, off int, n int, next int, err error) {
+	if pos+2 > len(idx.dict) {
+		return nil, 0, 0, 0, errors.New("truncated dict file")
+	}
+	l := int(binary.LittleEndian.Uint16(idx.dict[pos:]))
+	next = pos + l + dictEntryFixed
+	if next > len(idx.dict) {
+		return nil, 0, 0, 0, errors.New("truncated dict file")
+	}
+	key = idx.dict[pos+2 : pos+2+l]
+	off = int(binary.LittleEndian.Uint64(idx.dict[pos+2+l:]))
+	n = int(binary.LittleEndian.Uint32(idx.dict[pos+2+l+8:]))
+	return key, off, n, next, nil
+}
+
+// postings 返回引用mmap内存的倒排表, 只读
+func (idx *MmapIndex) postings(off, n int) PostingList {
+	if n == 0 {
+		return nil
+	}
+	return (*[maxPostings]Doc)(unsafe.Pointer(&idx.post[off]))[:n:n]
+}
+
+// Get 返回的倒排表直接引用mmap内存, 调用方不能修改
+func (idx *MmapIndex) Get(term string) []Doc {
+	//第一个key大于term的稀疏索引项的前一项
+	i := sort.Search(len(idx.sparse), func(i int) bool { return idx.sparse[i].key > term }) - 1
+	if i < 0 {
+		return nil
+	}
+	pos := idx.sparse[i].pos
+	for j := 0; j < sparseInterval && pos < len(idx.dict); j++ {
+		key, off, n, next, _ := idx.entry(pos)
+		if string(key) == term {
+			return idx.postings(off, n)
+		}
+		if string(key) > term {
+			return nil
+		}
+		pos = next
+	}
+	return nil
+}
+
+// Range 按key顺序遍历所有倒排表, fn返回错误时停止遍历. pl引用mmap内存, 只读
+func (idx *MmapIndex) Range(fn func(key string, pl PostingList) error) error {
+	for pos := dictHeaderSize; pos < len(idx.dict); {
+		key, off, n, next, err := idx.entry(pos)
+		if err != nil {
+			return err
+		}
+		if err = fn(string(key), idx.postings(off, n)); err != nil {
+			return err
+		}
+		pos = next
+	}
+	return nil
+}
+
+func (idx *MmapIndex) Keys() []string {
+	keys := make([]string, 0, idx.keys)
+	idx.Range(func(key string, pl PostingList) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys
+}
+
+// Add 只读索引不支持写入
+func (idx *MmapIndex) Add(docs []Document) {
+	panic("mmap index is read-only")
+}
+
+func (idx *MmapIndex) File() string {
+	return idx.IndexFile
+}
+
+func (idx *MmapIndex) Property() *Property {
+	return &idx.property
+}
+
+func (idx *MmapIndex) StaticScores() StaticScores {
+	return idx.priors
+}
+
+func (idx *MmapIndex) Timestamps() Timestamps {
+	return idx.times
+}
+
+func (idx *MmapIndex) Vectors() *HNSW {
+	return idx.vectors
+}
+
+func (idx *MmapIndex) Similarity() *SimilarityConfig {
+	return &idx.similarity
+}
+
+func (idx *MmapIndex) SetSimilarity(sim SimilarityConfig) {
+	idx.similarity = sim
+}
+
+func (idx *MmapIndex) Retrieval(must []string, should []string, not []string, k int, r int, m SearchModel) []Doc {
+	return retrieval(idx, must, should, not, k, r, m)
+}
+
+func (idx *MmapIndex) unmap() {
+	munmapFile(idx.dict)
+	munmapFile(idx.post)
+	idx.dict, idx.post, idx.sparse = nil, nil, nil
+}
+
+// Clear 解除映射并删除索引文件, 调用后不能再访问Get返回的倒排表
+func (idx *MmapIndex) Clear() {
+	idx.unmap()
+	os.Remove(idx.IndexFile + ManifestSuffix)
+	os.Remove(idx.IndexFile + ".sum")
+	os.Remove(idx.IndexFile + PriorSuffix)
+	os.Remove(idx.IndexFile + TimestampSuffix)
+	os.Remove(idx.IndexFile + VectorSuffix)
+	os.Remove(idx.IndexFile + ".dict")
+	os.Remove(idx.IndexFile + ".post")
+}
+
+// Close 解除映射, 不删除文件
+func (idx *MmapIndex) Close() {
+	idx.unmap()
+}
+
+// Acquire 查询前增加引用计数, 索引已被删除时返回false
+func (idx *MmapIndex) Acquire() bool {
+	return idx.refs.acquire()
+}
+
+// Release 查询结束后释放引用, 最后一个引用释放时删除已退役的索引
+func (idx *MmapIndex) Release() {
+	if idx.refs.release() {
+		idx.Clear()
+		removeSegmentDir(idx.IndexFile)
+	}
+}
+
+// Retire 索引被替换后释放创建者的引用, 进行中的查询释放后再删除
+func (idx *MmapIndex) Retire() {
+	if idx.refs.retire() {
+		idx.Release()
+	}
+}
+
+// MmapWriter 顺序写入按key升序排列的posting list, 生成mmap索引段
+type MmapWriter struct {
+	file     string
+	dictFd   *os.File
+	postFd   *os.File
+	dict     *bufio.Writer
+	post     *bufio.Writer
+	offset   int
+	lastKey  string
+	property Property
+	priors   StaticScores
+	times    Timestamps
+	vectors  *HNSW
+	sorted   bool
+}
+
+func NewMmapWriter(file string) (*MmapWriter, error) {
+	dictFd, err := os.OpenFile(file+".dict", os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	postFd, err := os.OpenFile(file+".post", os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		dictFd.Close()
+		return nil, err
+	}
+	w := &MmapWriter{
+		file:   file,
+		dictFd: dictFd,
+		postFd: postFd,
+		dict:   bufio.NewWriterSize(dictFd, 1<<20),
+		post:   bufio.NewWriterSize(postFd, 1<<20),
+		offset: postHeaderSize,
+	}
+	binary.Write(w.dict, binary.LittleEndian, dictMagic)
+	binary.Write(w.dict, binary.LittleEndian, mmapVersion)
+	binary.Write(w.post, binary.LittleEndian, postMagic)
+	binary.Write(w.post, binary.LittleEndian, mmapVersion)
+	binary.Write(w.post, binary.LittleEndian, uint32(docSize))
+	bom := uint32(byteOrderMark)
+	w.post.Write((*[4]byte)(unsafe.Pointer(&bom))[:])
+	return w, nil
+}
+
+// Write appends key and its posting list, keys must be written in ascending order
+func (w *MmapWriter) Write(key string, pl PostingList) error {
+	if w.property.tokenCount > 0 && key <= w.lastKey {
+		return fmt.Errorf("segment %s: key %q written after %q", w.file, key, w.lastKey)
+	}
+	if len(key) > 0xffff {
+		return fmt.Errorf("segment %s: key too long, %d bytes", w.file, len(key))
+	}
+	if len(pl) > maxPostings {
+		return fmt.Errorf("segment %s: posting list of %q too long, %d docs", w.file, key, len(pl))
+	}
+
+	var entry [dictEntryFixed]byte
+	binary.LittleEndian.PutUint16(entry[0:], uint16(len(key)))
+	binary.LittleEndian.PutUint64(entry[2:], uint64(w.offset))
+	binary.LittleEndian.PutUint32(entry[10:], uint32(len(pl)))
+	w.dict.Write(entry[:2])
+	w.dict.WriteString(key)
+	if _, err := w.dict.Write(entry[2:]); err != nil {
+		return err
+	}
+
+	if len(pl) > 0 {
+		//Doc为8字节对齐, 按内存布局直接写入
+		b := (*[maxPostings * 32]byte)(unsafe.Pointer(&pl[0]))[: len(pl)*docSize : len(pl)*docSize]
+		if _, err := w.post.Write(b); err != nil {
+			return err
+		}
+		w.offset += len(b)
+	}
+
+	w.lastKey = key
+	w.property.docNum += pl.Len()
+	w.property.tokenCount++
+	return nil
+}
+
+// SetStaticScores 设置段中文档的静态分, Close时保存
+func (w *MmapWriter) SetStaticScores(s StaticScores) {
+	w.priors = s
+}
+
+// MarkSorted 标记倒排表按文档ID排序(归并生成), Close时记录在清单中
+func (w *MmapWriter) MarkSorted() {
+	w.sorted = true
+}
+
+// SetTimestamps 设置段中文档的时间, Close时保存
+func (w *MmapWriter) SetTimestamps(t Timestamps) {
+	w.times = t
+}
+
+// SetVectors 设置段中文档的向量, Close时保存
+func (w *MmapWriter) SetVectors(h *HNSW) {
+	w.vectors = h
+}
+
+// Close flushes files and writes summary, static scores, timestamps, vectors and manifest, p为nil时使用写入过程中统计的属性
+func (w *MmapWriter) Close(p *Property) error {
+	if p == nil {
+		p = &w.property
+	}
+	err := w.dict.Flush()
+	if e := w.post.Flush(); err == nil {
+		err = e
+	}
+	if e := w.dictFd.Close(); err == nil {
+		err = e
+	}
+	if e := w.postFd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = writeSummary(w.file+".sum", p); err != nil {
+		return err
+	}
+	if err = SavePriors(w.file, w.priors); err != nil {
+		return err
+	}
+	if err = SaveTimestamps(w.file, w.times); err != nil {
+		return err
+	}
+	if err = SaveVectors(w.file, w.vectors); err != nil {
+		return err
+	}
+	exts := timestampExts(w.times, priorExts(w.priors, ".dict", ".post", ".sum")...)
+	m, err := NewManifest(w.file, p, vectorExts(w.vectors, exts...)...)
+	if err != nil {
+		return err
+	}
+	m.Format = FormatMmap
+	m.Sorted = w.sorted
+	return m.Write(w.file)
+}
@@ -0,0 +1,73 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMmapIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mmap")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idx")
+
+	//key数超过稀疏索引间隔, 覆盖多个稀疏索引项
+	writer, err := NewMmapWriter(file)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		pl := PostingList{{ID: int32(i), TF: 1}, {ID: int32(i + 1000), TF: 2}}
+		assert.Nil(t, writer.Write(fmt.Sprintf("key%03d", i), pl))
+	}
+	assert.NotNil(t, writer.Write("key000", nil)) //key必须升序
+	assert.Nil(t, writer.Close(nil))
+
+	seg, err := OpenSegment(file)
+	assert.Nil(t, err)
+	idx, ok := seg.(*MmapIndex)
+	assert.True(t, ok)
+	assert.Equal(t, 100, idx.Property().TokenCount())
+	assert.Equal(t, 100, len(idx.Keys()))
+
+	for _, i := range []int{0, 31, 32, 33, 64, 99} {
+		pl := idx.Get(fmt.Sprintf("key%03d", i))
+		assert.Equal(t, []int{i, i + 1000}, PostingList(pl).IDs())
+		assert.Equal(t, int32(2), pl[1].TF)
+	}
+	assert.Nil(t, idx.Get("a"))
+	assert.Nil(t, idx.Get("key0305"))
+	assert.Nil(t, idx.Get("zzz"))
+
+	//检索不修改只读的倒排表
+	result := idx.Retrieval([]string{"key050"}, nil, nil, 10, 1, BM25)
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, []int{50, 1050}, PostingList(idx.Get("key050")).IDs())
+
+	n := 0
+	assert.Nil(t, idx.Range(func(key string, pl PostingList) error {
+		n += len(pl)
+		return nil
+	}))
+	assert.Equal(t, 200, n)
+
+	idx.Retire()
+	_, err = os.Stat(file + ".post")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMmapIndexCorrupt(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mmap")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idx")
+
+	writer, _ := NewMmapWriter(file)
+	writer.Write("donut", PostingList{{ID: 1, TF: 1}})
+	assert.Nil(t, writer.Close(nil))
+
+	os.Truncate(file+".post", 20)
+	_, err := OpenMmapIndex(file)
+	assert.NotNil(t, err)
+}
@@ -19,6 +19,7 @@ type Doc struct {
 	DocLen       int32   //doc length
 
 	TF     int32   //词频, eg. 在倒排表term->[doc1,doc2,doc3]中，仅表示term在docX中的词频
+	Pos    int32   //词在字段中第一次出现的位置(分词后的下标)+1, 0表示未记录(旧版本索引), 用于紧密度特征
 	QualityScore float64 //静态分、质量分
 
 	Score  float64 //bm25/Cosine score used by sort
@@ -97,8 +98,22 @@ func (pl *PostingList) Append(docs ...Doc) {
 	*pl = append(*pl, docs...)
 }
 
+// 倒排表序列化格式: postingsMagic|Doc...; 没有Pos的旧格式没有文件头, 每个Doc为legacyDoc.
+// 文档ID非负, 旧格式的前4字节不会等于postingsMagic
+const postingsMagic int32 = -1
+
+// legacyDoc 旧格式中的Doc, 没有Pos
+type legacyDoc struct {
+	ID           int32
+	DocLen       int32
+	TF           int32
+	QualityScore float64
+	Score        float64
+}
+
 func (pl PostingList) Bytes() []byte {
 	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.LittleEndian, postingsMagic)
 	for _, v := range pl {
 		err := binary.Write(buffer, binary.LittleEndian, v)
 		if err != nil {
@@ -114,9 +129,18 @@ func (pl *PostingList) FromBytes(buf []byte) {
 	}
 
 	buffer := bytes.NewBuffer(buf)
+	if len(buf) >= 4 && int32(binary.LittleEndian.Uint32(buf)) == postingsMagic {
+		buffer.Next(4)
+		for buffer.Len() > 0 {
+			var item Doc
+			binary.Read(buffer, binary.LittleEndian, &item)
+			*pl = append(*pl, item)
+		}
+		return
+	}
 	for buffer.Len() > 0 {
-		var item Doc
+		var item legacyDoc
 		binary.Read(buffer, binary.LittleEndian, &item)
-		*pl = append(*pl, item)
+		*pl = append(*pl, Doc{ID: item.ID, DocLen: item.DocLen, TF: item.TF, QualityScore: item.QualityScore, Score: item.Score})
 	}
 }
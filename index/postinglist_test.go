@@ -1,6 +1,8 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"testing"
 
@@ -38,3 +40,19 @@ func TestPostingList(t *testing.T) {
 	fmt.Printf("pl2:%+v\n", pl2)
 	assert.Equal(t, len(pl), len(pl2))
 }
+
+func TestPostingListLegacyBytes(t *testing.T) {
+	pl := PostingList{{ID: 3, DocLen: 5, TF: 2, Pos: 4, QualityScore: 2}, {ID: 1, DocLen: 7, TF: 1, Pos: 1, QualityScore: 1}}
+	var decoded PostingList
+	decoded.FromBytes(pl.Bytes())
+	assert.Equal(t, pl, decoded)
+
+	//旧格式没有文件头及Pos, 读出的Pos为0
+	buffer := bytes.NewBuffer(nil)
+	for _, doc := range pl {
+		binary.Write(buffer, binary.LittleEndian, legacyDoc{ID: doc.ID, DocLen: doc.DocLen, TF: doc.TF, QualityScore: doc.QualityScore})
+	}
+	var legacy PostingList
+	legacy.FromBytes(buffer.Bytes())
+	assert.Equal(t, PostingList{{ID: 3, DocLen: 5, TF: 2, QualityScore: 2}, {ID: 1, DocLen: 7, TF: 1, QualityScore: 1}}, legacy)
+}
@@ -0,0 +1,148 @@
+package index
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 文档静态分(如PageRank): 与文档内容无关的质量分, 用于胜者表排序及排序特征.
+// 文件为文本格式, 每行"docID score", #开头为注释. 索引段及run文件的静态分保存在同名的.prior文件中
+
+const PriorSuffix = ".prior"
+
+// StaticScores docID -> 静态分, 建议归一化到[0,1]
+type StaticScores map[int32]float64
+
+// Get 文档的静态分, 没有静态分时为0
+func (s StaticScores) Get(id int32) float64 {
+	return s[id]
+}
+
+// Merge 合并o中的静态分, 相同文档以o为准
+func (s StaticScores) Merge(o StaticScores) StaticScores {
+	if len(o) == 0 {
+		return s
+	}
+	if s == nil {
+		s = make(StaticScores, len(o))
+	}
+	for id, score := range o {
+		s[id] = score
+	}
+	return s
+}
+
+// ReadStaticScores 读取静态分文件
+func ReadStaticScores(file string) (StaticScores, error) {
+	scores := make(StaticScores)
+	err := readDocValues(file, "score", func(id int32, value string) error {
+		score, err := strconv.ParseFloat(value, 64)
+		scores[id] = score
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scores, nil
+}
+
+// WriteStaticScores 按docID升序写入静态分文件, 先写临时文件再rename
+func WriteStaticScores(file string, s StaticScores) error {
+	ids := make([]int32, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	return writeDocValues(file, ids, func(id int32) string {
+		return strconv.FormatFloat(s[id], 'g', -1, 64)
+	})
+}
+
+// readDocValues 读取每行"docID value"的文本文件, #开头为注释, name为value的名称, 用于错误信息
+func readDocValues(file string, name string, parse func(id int32, value string) error) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expect \"docID %s\", got %q", file, line, name, text)
+		}
+		id, err := strconv.ParseInt(fields[0], 10, 32)
+		if err != nil || id < 0 {
+			return fmt.Errorf("%s:%d: invalid doc id %q", file, line, fields[0])
+		}
+		if err = parse(int32(id), fields[1]); err != nil {
+			return fmt.Errorf("%s:%d: invalid %s %q", file, line, name, fields[1])
+		}
+	}
+	return scanner.Err()
+}
+
+// writeDocValues 按docID升序写入每行"docID value"的文本文件, 先写临时文件再rename
+func writeDocValues(file string, ids []int32, format func(id int32) string) error {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	tmp := file + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(fd, 1<<20)
+	for _, id := range ids {
+		w.WriteString(strconv.Itoa(int(id)))
+		w.WriteByte(' ')
+		w.WriteString(format(id))
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// LoadPriors 读取索引段或run文件prefix的静态分, 不存在时返回nil
+func LoadPriors(prefix string) (StaticScores, error) {
+	scores, err := ReadStaticScores(prefix + PriorSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return scores, err
+}
+
+// SavePriors 保存索引段或run文件prefix的静态分, 没有静态分时删除旧文件
+func SavePriors(prefix string, s StaticScores) error {
+	if len(s) == 0 {
+		if err := os.Remove(prefix + PriorSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return WriteStaticScores(prefix+PriorSuffix, s)
+}
+
+// priorExts 有静态分时, 清单中加入.prior文件
+func priorExts(s StaticScores, exts ...string) []string {
+	if len(s) > 0 {
+		exts = append(exts, PriorSuffix)
+	}
+	return exts
+}
@@ -0,0 +1,105 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticScoresFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "prior")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "prior.txt")
+
+	scores := StaticScores{3: 0.5, 1: 1, 20: 0.125}
+	assert.Nil(t, WriteStaticScores(file, scores))
+	data, _ := ioutil.ReadFile(file)
+	assert.Equal(t, "1 1\n3 0.5\n20 0.125\n", string(data))
+
+	loaded, err := ReadStaticScores(file)
+	assert.Nil(t, err)
+	assert.Equal(t, scores, loaded)
+	assert.Equal(t, float64(0), loaded.Get(2))
+
+	ioutil.WriteFile(file, []byte("# comment\n\n7 0.25\n8\n"), 0660)
+	_, err = ReadStaticScores(file)
+	assert.Contains(t, err.Error(), ":4:")
+
+	//索引段的静态分, 不存在时为nil
+	priors, err := LoadPriors(filepath.Join(dir, "none"))
+	assert.Nil(t, err)
+	assert.Nil(t, priors)
+	assert.Nil(t, SavePriors(filepath.Join(dir, "none"), nil))
+	_, err = os.Stat(filepath.Join(dir, "none") + PriorSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestChampionList(t *testing.T) {
+	pl := PostingList{
+		{ID: 5, QualityScore: 1},
+		{ID: 4, QualityScore: 3},
+		{ID: 3, QualityScore: 2},
+		{ID: 2, QualityScore: 5},
+		{ID: 1, QualityScore: 2},
+	}
+	top := championList(pl, 3)
+	ids := make(map[int32]bool)
+	for _, doc := range top {
+		ids[doc.ID] = true
+	}
+	assert.Equal(t, map[int32]bool{2: true, 4: true, 3: true}, ids) //同分时保留ID大的文档
+	assert.Equal(t, 5, len(championList(pl, 10)))
+	assert.Nil(t, championList(pl, 0))
+	assert.Equal(t, int32(5), pl[0].ID) //不修改原倒排表
+}
+
+func TestStaticScoreRanking(t *testing.T) {
+	idx := NewHashMapIndex()
+	idx.Add([]Document{
+		{ID: 1, Text: "donut glass"},
+		{ID: 2, Text: "donut plate", Prior: 1},
+		{ID: 3, Text: "donut cup", Prior: 0.5},
+	})
+	assert.Equal(t, StaticScores{2: 1, 3: 0.5}, idx.StaticScores())
+	donut := PostingList(idx.Get("donut"))
+	assert.Equal(t, CalDocScore(1, 1), donut.Find(2).QualityScore)
+	assert.Equal(t, float64(2), donut.Find(2).QualityScore)
+
+	//胜者表只保留静态分高的文档
+	docs := idx.Retrieval(nil, []string{"donut"}, nil, 10, 2, BM25)
+	assert.ElementsMatch(t, []int32{2, 3}, []int32{docs[0].ID, docs[1].ID})
+
+	//相关性相同时按静态分排序
+	sim := DefaultSimilarity()
+	sim.PriorWeight = 2
+	idx.SetSimilarity(sim)
+	docs, explains, _ := DoRetrievalExplain(idx, nil, []string{"donut"}, nil, 10, 100, BM25)
+	assert.Equal(t, []int32{2, 3, 1}, []int32{docs[0].ID, docs[1].ID, docs[2].ID})
+	assert.InDelta(t, docs[2].Score+2, docs[0].Score, 0.0001)
+	assert.Equal(t, float64(1), explains[2].Prior)
+	assert.Equal(t, docs[0].Score, explains[2].Score)
+	assert.Contains(t, explains[2].String(), "prior 1.0000 weight 2")
+
+	//run文件及btree索引保存静态分
+	dir, _ := ioutil.TempDir("", "prior")
+	defer os.RemoveAll(dir)
+	Drain(idx, filepath.Join(dir, "run"))
+	priors, err := LoadPriors(filepath.Join(dir, "run"))
+	assert.Nil(t, err)
+	assert.Equal(t, idx.StaticScores(), priors)
+
+	bt := NewBTreeIndex(filepath.Join(dir, "idx"))
+	bt.Add([]Document{{ID: 7, Text: "donut", Prior: 0.25}, {ID: 8, Text: "donut"}})
+	bt.Close()
+	m, err := ReadManifest(filepath.Join(dir, "idx"))
+	assert.Nil(t, err)
+	assert.Equal(t, "idx"+PriorSuffix, m.Files[len(m.Files)-1].Name)
+	seg, err := OpenSegment(filepath.Join(dir, "idx"))
+	assert.Nil(t, err)
+	assert.Equal(t, StaticScores{7: 0.25}, seg.StaticScores())
+	assert.Equal(t, CalDocScore(1, 0.25), PostingList(seg.Get("donut")).Find(7).QualityScore)
+	seg.Retire()
+}
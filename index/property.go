@@ -1,5 +1,15 @@
 package index
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
 type DataRange struct {
 	Start int
 	End   int
@@ -14,6 +24,9 @@ type Property struct {
 
 	//dataRange
 	dataRange DataRange
+
+	// fieldTokens is the total length of tokens of each non-text field
+	fieldTokens map[string]int
 }
 
 func (idx *Property) DocNum() int {
@@ -39,3 +52,155 @@ func (idx *Property) DataRange() DataRange {
 func (idx *Property) SetDataRange(d DataRange)  {
 	idx.dataRange = d
 }
+
+// FieldTokenCount 字段的词总数, 正文为TokenCount
+func (idx *Property) FieldTokenCount(field string) int {
+	if field == TextField {
+		return idx.tokenCount
+	}
+	return idx.fieldTokens[field]
+}
+
+func (idx *Property) AddFieldTokens(field string, n int) {
+	if field == TextField {
+		idx.tokenCount += n
+		return
+	}
+	if idx.fieldTokens == nil {
+		idx.fieldTokens = make(map[string]int)
+	}
+	idx.fieldTokens[field] += n
+}
+
+// AvgFieldLen 字段的平均长度
+func (idx *Property) AvgFieldLen(field string) float64 {
+	if idx.docNum == 0 {
+		return 0
+	}
+	return float64(idx.FieldTokenCount(field)) / float64(idx.docNum)
+}
+
+// Add 合并其他索引的属性: 文档数及词数相加, 数据时间段取并集
+func (idx *Property) Add(o Property) {
+	idx.docNum += o.docNum
+	idx.tokenCount += o.tokenCount
+	for field, n := range o.fieldTokens {
+		idx.AddFieldTokens(field, n)
+	}
+	if o.dataRange != (DataRange{}) {
+		if idx.dataRange == (DataRange{}) {
+			idx.dataRange = o.dataRange
+		} else {
+			idx.dataRange.Start = IfElseInt(o.dataRange.Start < idx.dataRange.Start, o.dataRange.Start, idx.dataRange.Start)
+			idx.dataRange.End = IfElseInt(o.dataRange.End > idx.dataRange.End, o.dataRange.End, idx.dataRange.End)
+		}
+	}
+}
+
+const (
+	sumMagic   uint32 = 0x4d555345 //"ESUM"
+	sumVersion uint32 = 2
+)
+
+// writeSummary writes property to .sum file, format: magic|version|property
+func writeSummary(file string, p *Property) error {
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.LittleEndian, sumMagic)
+	binary.Write(buffer, binary.LittleEndian, sumVersion)
+	if err := encodeProperty(buffer, p); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buffer.Bytes(), 0660)
+}
+
+// readSummary reads property from .sum file, 兼容没有magic的旧格式(4个int32)及没有字段词数的版本1
+func readSummary(file string, p *Property) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return nil //新建的索引
+	}
+	if err != nil {
+		return err
+	}
+
+	buffer := bytes.NewBuffer(data)
+	if len(data) == 16 {
+		var v [4]int32
+		if err = binary.Read(buffer, binary.LittleEndian, &v); err != nil {
+			return err
+		}
+		p.docNum, p.tokenCount = int(v[0]), int(v[1])
+		p.dataRange = DataRange{Start: int(v[2]), End: int(v[3])}
+		return nil
+	}
+
+	var header struct {
+		Magic, Version uint32
+	}
+	if err = binary.Read(buffer, binary.LittleEndian, &header); err != nil || header.Magic != sumMagic {
+		return fmt.Errorf("%s is not an index summary file", file)
+	}
+	if header.Version < 1 || header.Version > sumVersion {
+		return fmt.Errorf("%s: unsupported summary version %d", file, header.Version)
+	}
+	if err = decodeProperty(buffer, p, header.Version); err != nil {
+		return fmt.Errorf("%s: truncated summary file", file)
+	}
+	return nil
+}
+
+// encodeProperty format: docNum|tokenCount|start|end|len(fields)|{len(name)|name|tokens}...
+func encodeProperty(w io.Writer, p *Property) error {
+	fields := make([]string, 0, len(p.fieldTokens))
+	for field := range p.fieldTokens {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.LittleEndian, [4]int64{int64(p.docNum), int64(p.tokenCount),
+		int64(p.dataRange.Start), int64(p.dataRange.End)})
+	binary.Write(buffer, binary.LittleEndian, uint32(len(fields)))
+	for _, field := range fields {
+		binary.Write(buffer, binary.LittleEndian, uint16(len(field)))
+		buffer.WriteString(field)
+		binary.Write(buffer, binary.LittleEndian, int64(p.fieldTokens[field]))
+	}
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// decodeProperty 版本1没有字段词数
+func decodeProperty(r io.Reader, p *Property, version uint32) error {
+	var v [4]int64
+	if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+		return err
+	}
+	p.docNum, p.tokenCount = int(v[0]), int(v[1])
+	p.dataRange = DataRange{Start: int(v[2]), End: int(v[3])}
+	p.fieldTokens = nil
+	if version < 2 {
+		return nil
+	}
+
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return err
+	}
+	for i := 0; i < int(n); i++ {
+		var l uint16
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			return err
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return err
+		}
+		var tokens int64
+		if err := binary.Read(r, binary.LittleEndian, &tokens); err != nil {
+			return err
+		}
+		p.AddFieldTokens(string(name), int(tokens))
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	runMagic   uint32 = 0x4e555245 //"ERUN"
+	runVersion uint32 = 2
+)
+
+// RunWriter 顺序写入按key升序排列的posting list, 文件格式: magic|version|property|{len(key)|key|len(pl)|pl}...
+// 不需要像Drain一样把整个索引放在内存中. 版本1没有property
+type RunWriter struct {
+	file     string
+	fd       *os.File
+	writer   *bufio.Writer
+	buffer   *bytes.Buffer
+	lastKey  string
+	keys     int
+	property Property
+	started  bool
+}
+
+func NewRunWriter(file string) (*RunWriter, error) {
+	fd, err := os.OpenFile(file, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	w := &RunWriter{
+		file:   file,
+		fd:     fd,
+		writer: bufio.NewWriterSize(fd, 1<<20),
+		buffer: bytes.NewBuffer([]byte{}),
+	}
+	return w, nil
+}
+
+// SetProperty 设置run中文档的属性(文档数、词数), 必须在Write之前调用
+func (w *RunWriter) SetProperty(p Property) {
+	w.property = p
+}
+
+// header 第一次写入时写文件头
+func (w *RunWriter) header() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	binary.Write(w.writer, binary.LittleEndian, runMagic)
+	binary.Write(w.writer, binary.LittleEndian, runVersion)
+	return encodeProperty(w.writer, &w.property)
+}
+
+// Write appends key and its posting list, keys must be written in ascending order
+func (w *RunWriter) Write(key string, pl PostingList) error {
+	if w.keys > 0 && key <= w.lastKey {
+		return fmt.Errorf("run %s: key %q written after %q", w.file, key, w.lastKey)
+	}
+	if err := w.header(); err != nil {
+		return err
+	}
+
+	b := pl.Bytes()
+	w.buffer.Reset()
+	binary.Write(w.buffer, binary.LittleEndian, int32(len(key)))
+	w.buffer.WriteString(key)
+	binary.Write(w.buffer, binary.LittleEndian, int32(len(b)))
+	w.buffer.Write(b)
+	if _, err := w.writer.Write(w.buffer.Bytes()); err != nil {
+		return err
+	}
+
+	w.lastKey = key
+	w.keys++
+	return nil
+}
+
+// Keys returns the number of keys written
+func (w *RunWriter) Keys() int {
+	return w.keys
+}
+
+func (w *RunWriter) Close() error {
+	err := w.header()
+	if err == nil {
+		err = w.writer.Flush()
+	}
+	if err != nil {
+		w.fd.Close()
+		return err
+	}
+	return w.fd.Close()
+}
+
+// RunReader 顺序读取RunWriter/Drain生成的run文件
+type RunReader struct {
+	file     string
+	fd       *os.File
+	reader   *bufio.Reader
+	property Property
+}
+
+func OpenRunReader(file string) (*RunReader, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	r := &RunReader{file: file, fd: fd, reader: bufio.NewReaderSize(fd, 1<<16)}
+
+	var header struct {
+		Magic, Version uint32
+	}
+	if err = binary.Read(r.reader, binary.LittleEndian, &header); err != nil || header.Magic != runMagic {
+		fd.Close()
+		return nil, fmt.Errorf("%s is not a run file", file)
+	}
+	if header.Version < 1 || header.Version > runVersion {
+		fd.Close()
+		return nil, fmt.Errorf("run %s: unsupported version %d", file, header.Version)
+	}
+	if header.Version >= 2 {
+		if err = decodeProperty(r.reader, &r.property, sumVersion); err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("run %s: truncated header", file)
+		}
+	}
+	return r, nil
+}
+
+// Property run中文档的属性, 版本1的run文件为空
+func (r *RunReader) Property() *Property {
+	return &r.property
+}
+
+// Next returns the next key and its posting list, io.EOF at the end of run.
+// 记录不完整时返回io.ErrUnexpectedEOF
+func (r *RunReader) Next() (string, PostingList, error) {
+	key, err := r.readBytes()
+	if err != nil {
+		return "", nil, err
+	}
+	value, err := r.readBytes()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	var pl PostingList
+	pl.FromBytes(value)
+	return string(key), pl, nil
+}
+
+func (r *RunReader) readBytes() ([]byte, error) {
+	var l int32
+	if err := binary.Read(r.reader, binary.LittleEndian, &l); err != nil {
+		return nil, err
+	}
+	if l < 0 {
+		return nil, fmt.Errorf("run %s: invalid length %d", r.file, l)
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (r *RunReader) Close() error {
+	return r.fd.Close()
+}
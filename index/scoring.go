@@ -0,0 +1,214 @@
+package index
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 相关性打分模型: 每个模型实现Similarity并按名字注册, 查询时按名字选择(-search_model)
+
+// ScoreContext 一次查询的打分上下文
+type ScoreContext struct {
+	TFIDF    *TFIDF            //命中文档的词频及词的统计信息
+	Property *Property         //索引的文档数及各字段的词数
+	Config   *SimilarityConfig //索引的打分参数
+}
+
+// Similarity 相关性打分模型
+type Similarity interface {
+	// Score 计算hits的得分写入Doc.Score, ctx.TFIDF.Explain非nil时记录每个文档的得分明细
+	Score(hits []Doc, ctx *ScoreContext) []Doc
+}
+
+// SimilarityFunc 函数形式的Similarity
+type SimilarityFunc func(hits []Doc, ctx *ScoreContext) []Doc
+
+func (f SimilarityFunc) Score(hits []Doc, ctx *ScoreContext) []Doc {
+	return f(hits, ctx)
+}
+
+var similarities = make(map[SearchModel]Similarity)
+
+// RegisterSimilarity 注册打分模型, 重复注册panic
+func RegisterSimilarity(model SearchModel, s Similarity) {
+	if _, ok := similarities[model]; ok {
+		panic(fmt.Sprintf("similarity %s already registered", model))
+	}
+	similarities[model] = s
+}
+
+func LookupSimilarity(model SearchModel) (Similarity, error) {
+	if s, ok := similarities[model]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown search model %q, supported: %s", model, strings.Join(searchModelNames(), "|"))
+}
+
+// SearchModels 已注册的打分模型, 按名字排序
+func SearchModels() []SearchModel {
+	models := make([]SearchModel, 0, len(similarities))
+	for m := range similarities {
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i] < models[j] })
+	return models
+}
+
+func searchModelNames() []string {
+	var names []string
+	for _, m := range SearchModels() {
+		names = append(names, m.String())
+	}
+	return names
+}
+
+// ParseSearchModel 校验模型名字, 空字符串表示使用索引配置的默认模型
+func ParseSearchModel(name string) (SearchModel, error) {
+	model := SearchModel(strings.ToLower(strings.TrimSpace(name)))
+	if model == "" {
+		return "", nil
+	}
+	if _, err := LookupSimilarity(model); err != nil {
+		return "", err
+	}
+	return model, nil
+}
+
+func init() {
+	RegisterSimilarity(Boolean, SimilarityFunc(scoreBoolean))
+	RegisterSimilarity(VectorSpace, SimilarityFunc(func(hits []Doc, ctx *ScoreContext) []Doc {
+		return CalCosine(hits, ctx.TFIDF)
+	}))
+	RegisterSimilarity(BM25, SimilarityFunc(func(hits []Doc, ctx *ScoreContext) []Doc {
+		return CalBM25(hits, ctx.TFIDF, ctx.Property, ctx.Config)
+	}))
+	RegisterSimilarity(BM25Plus, SimilarityFunc(func(hits []Doc, ctx *ScoreContext) []Doc {
+		return CalBM25Plus(hits, ctx.TFIDF, ctx.Property, ctx.Config)
+	}))
+	RegisterSimilarity(LMDirichlet, &TermSimilarity{Model: LMDirichlet, Scorer: scoreLMDirichlet})
+	RegisterSimilarity(LMJelinekMercer, &TermSimilarity{Model: LMJelinekMercer, Scorer: scoreLMJelinekMercer})
+	RegisterSimilarity(DFR, &TermSimilarity{Model: DFR, Scorer: scoreDFR})
+	RegisterSimilarity(IB, &TermSimilarity{Model: IB, Scorer: scoreIB})
+}
+
+// scoreBoolean 布尔模型只做召回, 得分为0
+func scoreBoolean(hits []Doc, ctx *ScoreContext) []Doc {
+	tfidf := ctx.TFIDF
+	if tfidf.Explain == nil {
+		return hits
+	}
+	for _, hit := range hits {
+		e := &Explanation{DocID: hit.ID, Model: Boolean.String()}
+		for term, tf := range tfidf.DOC2TF[hit.ID] {
+			e.Terms = append(e.Terms, TermExplain{Term: term, TF: tf, QueryTF: tfidf.DOC2TF[VirtualQueryDocId][term], IDF: tfidf.IDF[term], Boost: tfidf.Boost[term]})
+		}
+		e.sortTerms()
+		tfidf.Explain[hit.ID] = e
+	}
+	return hits
+}
+
+// TermStats 词在文档一个字段中的统计信息
+type TermStats struct {
+	TF     float64 //词在文档字段中的词频
+	DocLen float64 //文档字段的长度
+	DF     float64 //字段中包含该词的文档数
+	CTF    float64 //词在字段中出现的总次数
+	DocNum float64 //索引的文档数
+	AvgDL  float64 //字段的平均长度
+	Tokens float64 //字段的总词数
+}
+
+// TermScorer 计算一个词在一个字段中的得分
+type TermScorer func(s TermStats, sim *SimilarityConfig) float64
+
+// TermSimilarity 按词及字段分别打分, 字段得分乘以字段权重后求和
+type TermSimilarity struct {
+	Model  SearchModel
+	Scorer TermScorer
+}
+
+func (t *TermSimilarity) Score(hits []Doc, ctx *ScoreContext) []Doc {
+	tfidf, p, sim := ctx.TFIDF, ctx.Property, ctx.Config
+	for i, hit := range hits {
+		var e *Explanation
+		if tfidf.Explain != nil {
+			e = &Explanation{DocID: hit.ID, Model: t.Model.String(), AvgDL: p.AvgFieldLen(TextField)}
+			tfidf.Explain[hit.ID] = e
+		}
+		for term, fields := range tfidf.DOC2FIELD[hit.ID] {
+			var score float64
+			for _, f := range fields {
+				key := FieldTerm(f.Field, term)
+				s := TermStats{
+					TF:     float64(f.TF),
+					DocLen: float64(f.DocLen),
+					DF:     float64(tfidf.DF[key]),
+					CTF:    float64(tfidf.CTF[key]),
+					DocNum: float64(p.DocNum()),
+					AvgDL:  p.AvgFieldLen(f.Field),
+					Tokens: float64(p.FieldTokenCount(f.Field)),
+				}
+				score += sim.Field(f.Field).Weight * t.Scorer(s, sim)
+				if e != nil && f.Field == TextField {
+					e.DocLen = float64(f.DocLen)
+				}
+			}
+			score *= tfidf.Boost.Get(term)
+			hits[i].Score += score
+			if e != nil {
+				e.Terms = append(e.Terms, TermExplain{Term: term, TF: tfidf.DOC2TF[hit.ID][term],
+					QueryTF: tfidf.DOC2TF[VirtualQueryDocId][term], IDF: tfidf.IDF[term], Boost: tfidf.Boost[term], Score: score, Fields: fields})
+			}
+		}
+		hits[i].Score, _ = strconv.ParseFloat(fmt.Sprintf("%.4f", hits[i].Score), 64)
+		if e != nil {
+			e.Score = hits[i].Score
+			e.sortTerms()
+		}
+	}
+	return hits
+}
+
+// collectionProb 词在字段中的概率p(t|C), 平滑避免为0
+func collectionProb(s TermStats) float64 {
+	return (s.CTF + 1) / (s.Tokens + 1)
+}
+
+//scoreLMDirichlet 语言模型Dirichlet平滑, 同lucene LMDirichletSimilarity, 负分截断为0
+//  score = log(1 + tf / (mu * p(t|C))) + log(mu / (dl + mu))
+func scoreLMDirichlet(s TermStats, sim *SimilarityConfig) float64 {
+	score := math.Log(1+s.TF/(sim.Mu*collectionProb(s))) + math.Log(sim.Mu/(s.DocLen+sim.Mu))
+	return math.Max(score, 0)
+}
+
+//scoreLMJelinekMercer 语言模型Jelinek-Mercer平滑, 同lucene LMJelinekMercerSimilarity
+//  score = log(1 + (1 - λ) * tf / dl / (λ * p(t|C)))
+func scoreLMJelinekMercer(s TermStats, sim *SimilarityConfig) float64 {
+	return math.Log(1 + (1-sim.Lambda)*s.TF/s.DocLen/(sim.Lambda*collectionProb(s)))
+}
+
+//normalizeH2 DFR的长度归一化H2: tfn = tf * log2(1 + avgdl / dl)
+func normalizeH2(s TermStats) float64 {
+	if s.AvgDL <= 0 || s.DocLen <= 0 {
+		return s.TF
+	}
+	return s.TF * math.Log2(1+s.AvgDL/s.DocLen)
+}
+
+//scoreDFR divergence from randomness, 基础模型I(n), 后效L, 归一化H2
+//  score = tfn * log2((N + 1) / (df + 0.5)) / (tfn + 1)
+func scoreDFR(s TermStats, sim *SimilarityConfig) float64 {
+	tfn := normalizeH2(s)
+	return tfn * math.Log2((s.DocNum+1)/(s.DF+0.5)) / (tfn + 1)
+}
+
+//scoreIB information-based模型, log-logistic分布, λ = (df + 1) / (N + 1), 归一化H2
+//  score = log((tfn + λ) / λ)
+func scoreIB(s TermStats, sim *SimilarityConfig) float64 {
+	lambda := (s.DF + 1) / (s.DocNum + 1)
+	return math.Log((normalizeH2(s) + lambda) / lambda)
+}
@@ -0,0 +1,81 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchModels(t *testing.T) {
+	assert.Equal(t, []SearchModel{BM25, BM25Plus, Boolean, DFR, IB, LMDirichlet, LMJelinekMercer, VectorSpace}, SearchModels())
+
+	model, err := ParseSearchModel(" BM25+ ")
+	assert.Nil(t, err)
+	assert.Equal(t, BM25Plus, model)
+	model, err = ParseSearchModel("")
+	assert.Nil(t, err)
+	assert.Equal(t, SearchModel(""), model)
+	_, err = ParseSearchModel("tfidf")
+	assert.NotNil(t, err)
+
+	assert.Panics(t, func() { RegisterSimilarity(BM25, SimilarityFunc(scoreBoolean)) })
+
+	sim := SimilarityFromConfig(&config.Config{Similarity: config.SimilarityParameters{Model: "lm_jm", Lambda: 0.1}})
+	assert.Equal(t, LMJelinekMercer, sim.Model)
+	assert.InDelta(t, 0.1, sim.Lambda, 1e-6)
+	assert.Equal(t, float64(2000), sim.Mu)
+	assert.Panics(t, func() { SimilarityFromConfig(&config.Config{Similarity: config.SimilarityParameters{Model: "x"}}) })
+}
+
+func TestSimilarityModels(t *testing.T) {
+	idx := NewHashMapIndex()
+	idx.Add([]Document{
+		{ID: 1, Text: "donut"},
+		{ID: 2, Text: "donut with chocolate glaze and sprinkles on top of a plate"},
+		{ID: 3, Text: "donut donut glass"},
+		{ID: 4, Text: "glass plate"},
+	})
+	should := util.Analyze("donut glass")
+
+	for _, model := range SearchModels() {
+		docs, explains, _ := DoRetrievalExplain(idx, nil, should, nil, 10, 100, model)
+		assert.Equal(t, 4, len(docs), model)
+		for _, doc := range docs {
+			e := explains[doc.ID]
+			assert.Equal(t, model.String(), e.Model)
+			var sum float64
+			for _, term := range e.Terms {
+				assert.True(t, term.Score >= 0, model)
+				sum += term.Score
+			}
+			assert.InDelta(t, e.Score, sum, 0.0001, model)
+		}
+		if model == Boolean {
+			continue
+		}
+		//包含两个词且词频高的文档排在最前
+		assert.Equal(t, int32(3), docs[0].ID, model)
+		if model != VectorSpace { //余弦只使用查询词的权重, 与文档长度无关
+			assert.Equal(t, int32(2), docs[3].ID, model)
+		}
+	}
+
+	//BM25+每个命中的词加上idf*delta, doc3命中donut(df 3)和glass(df 2)
+	bm25, _ := DoRetrieval(idx, nil, should, nil, 10, 100, BM25)
+	plus, _ := DoRetrieval(idx, nil, should, nil, 10, 100, BM25Plus)
+	assert.InDelta(t, bm25[0].Score+CalIDF(4, 3)+CalIDF(4, 2), plus[0].Score, 0.001)
+
+	//未指定模型时使用索引配置的默认模型
+	sim := DefaultSimilarity()
+	sim.Model = DFR
+	idx.SetSimilarity(sim)
+	_, explains, _ := DoRetrievalExplain(idx, nil, should, nil, 10, 100, "")
+	assert.Equal(t, DFR.String(), explains[1].Model)
+	//未注册的模型返回error, 不panic
+	docs, err := DoRetrieval(idx, nil, should, nil, 10, 100, "unknown")
+	assert.NotNil(t, err)
+	assert.Nil(t, docs)
+	assert.Nil(t, idx.Retrieval(nil, should, nil, 10, 100, "BM25"))
+}
@@ -0,0 +1,256 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 段发布流程: 在临时目录 .build.<name>.<ts> 中构建索引, 完成后rename为 <name>.seg.<ts>,
+// 再原子替换指针文件 <name>.current. 任何时刻崩溃, 指针文件都指向一个完整的段.
+// 替换前的段记录在 <name>.previous, 其他进程(如未Reload的DataServer)可能仍在使用, 下一次发布后才删除
+
+const (
+	CurrentSuffix  = ".current"
+	PreviousSuffix = ".previous"
+	buildPrefix    = ".build."
+	segmentInfix   = ".seg."
+)
+
+// legacyExts 未使用段目录的旧索引(btree及mmap格式)的文件
+var legacyExts = []string{".idx", ".kv", ".dict", ".post", ".sum", PriorSuffix, TimestampSuffix, VectorSuffix, ManifestSuffix}
+
+// Segment 可发布的索引段, 全量索引可以是btree或mmap格式
+type Segment interface {
+	Index
+	SetSimilarity(sim SimilarityConfig)
+	File() string
+	Range(fn func(key string, pl PostingList) error) error
+
+	Acquire() bool
+	Release()
+	Retire()
+}
+
+// OpenSegment 按清单中的格式打开索引段, 没有清单时返回ErrNoManifest
+func OpenSegment(file string) (Segment, error) {
+	m, err := ReadManifest(file)
+	if err != nil {
+		return nil, fmt.Errorf("open index %s: %w", file, err)
+	}
+	switch m.Format {
+	case FormatMmap:
+		return OpenMmapIndex(file)
+	case FormatBTree, "":
+		return OpenBTreeIndex(file)
+	}
+	return nil, fmt.Errorf("open index %s: unknown segment format %q", file, m.Format)
+}
+
+// NewBuildDir 为索引file创建临时构建目录, 返回目录中的索引文件路径
+func NewBuildDir(file string) (string, error) {
+	dir := filepath.Join(filepath.Dir(file), fmt.Sprintf("%s%s.%d", buildPrefix, filepath.Base(file), time.Now().UnixNano()))
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(file)), nil
+}
+
+// Publish 将构建完成的索引发布为file的当前段, built为NewBuildDir返回的路径
+func Publish(file string, built string) (string, error) {
+	m, err := ReadManifest(built)
+	if err != nil {
+		return "", err
+	}
+	if err = m.Verify(filepath.Dir(built)); err != nil {
+		return "", err
+	}
+
+	previous, err := currentName(file)
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s%s%d", filepath.Base(file), segmentInfix, time.Now().UnixNano())
+	seg := filepath.Join(filepath.Dir(file), name)
+	if err = os.Rename(filepath.Dir(built), seg); err != nil {
+		return "", err
+	}
+
+	//先记录旧段再切换, 崩溃时previous最多与current相同
+	if err = writePointer(file+PreviousSuffix, previous); err != nil {
+		return "", err
+	}
+	if err = writePointer(file+CurrentSuffix, name); err != nil {
+		return "", err
+	}
+	syncDir(filepath.Dir(file))
+	return filepath.Join(seg, filepath.Base(file)), nil
+}
+
+// currentName 当前段的目录名, 没有指针文件时为file的文件名(旧索引)
+func currentName(file string) (string, error) {
+	current, err := ResolveIndex(file)
+	if err != nil {
+		return "", err
+	}
+	if current == file {
+		return filepath.Base(file), nil
+	}
+	return filepath.Base(filepath.Dir(current)), nil
+}
+
+// writePointer 原子写入指针文件
+func writePointer(path string, name string) error {
+	tmp := path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err = fd.WriteString(name + "\n"); err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readPointer 读取指针文件中的名字, 不存在时返回空
+func readPointer(path string, file string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(string(data))
+	base := filepath.Base(file)
+	if (name != base && !strings.HasPrefix(name, base+segmentInfix)) || strings.ContainsRune(name, os.PathSeparator) {
+		return "", fmt.Errorf("invalid index pointer %s: %q", path, name)
+	}
+	return name, nil
+}
+
+// ResolveIndex 返回file当前段中的索引文件路径, 没有指针文件时返回file本身(未使用段目录的旧索引)
+func ResolveIndex(file string) (string, error) {
+	name, err := readPointer(file+CurrentSuffix, file)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return file, nil
+	}
+	if name == filepath.Base(file) {
+		return "", fmt.Errorf("invalid index pointer %s: %q", file+CurrentSuffix, name)
+	}
+	return filepath.Join(filepath.Dir(file), name, filepath.Base(file)), nil
+}
+
+// CleanupSegments 删除未完成的构建目录, 以及current和previous都不再引用的段和旧索引文件
+func CleanupSegments(file string) error {
+	current, err := currentName(file)
+	if err != nil {
+		return err
+	}
+	previous, err := readPointer(file+PreviousSuffix, file)
+	if err != nil {
+		return err
+	}
+	inUse := func(name string) bool {
+		return name == current || name == previous
+	}
+	dir, base := filepath.Dir(file), filepath.Base(file)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(file + CurrentSuffix + ".tmp")
+	os.Remove(file + PreviousSuffix + ".tmp")
+	if !inUse(base) {
+		for _, ext := range legacyExts {
+			os.Remove(file + ext)
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() {
+			continue
+		}
+		if isGeneration(name, buildPrefix+base+".") ||
+			(isGeneration(name, base+segmentInfix) && !inUse(name)) {
+			log.Printf("remove stale index segment %s", name)
+			if err = os.RemoveAll(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refCount 段的引用计数, 创建者持有1个引用
+type refCount struct {
+	refs    int32
+	retired int32
+}
+
+func newRefCount() refCount {
+	return refCount{refs: 1}
+}
+
+func (r *refCount) acquire() bool {
+	for {
+		n := atomic.LoadInt32(&r.refs)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&r.refs, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release returns true if it is the last reference
+func (r *refCount) release() bool {
+	return atomic.AddInt32(&r.refs, -1) == 0
+}
+
+// retire returns true only for the first call
+func (r *refCount) retire() bool {
+	return atomic.CompareAndSwapInt32(&r.retired, 0, 1)
+}
+
+// removeSegmentDir 段目录中的索引删除后一并删除段目录
+func removeSegmentDir(file string) {
+	if dir := filepath.Dir(file); strings.Contains(filepath.Base(dir), segmentInfix) {
+		os.Remove(dir)
+	}
+}
+
+// isGeneration name是否为prefix加时间戳, 避免误删 <name>.1 等其他索引的目录
+func isGeneration(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+		return false
+	}
+	for _, c := range name[len(prefix):] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func syncDir(dir string) {
+	if fd, err := os.Open(dir); err == nil {
+		fd.Sync()
+		fd.Close()
+	}
+}
@@ -0,0 +1,123 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func buildSegment(t *testing.T, file string, text string) string {
+	built, err := NewBuildDir(file)
+	assert.Nil(t, err)
+	idx := NewBTreeIndex(built)
+	idx.Add([]Document{{ID: 1, Text: text}})
+	idx.Close()
+	return built
+}
+
+func TestPublish(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idx")
+
+	current, err := ResolveIndex(file)
+	assert.Nil(t, err)
+	assert.Equal(t, file, current)
+
+	seg1, err := Publish(file, buildSegment(t, file, "donut"))
+	assert.Nil(t, err)
+	current, _ = ResolveIndex(file)
+	assert.Equal(t, seg1, current)
+
+	//未发布的构建(模拟崩溃)不影响当前段
+	stale := buildSegment(t, file, "glass")
+	other := buildSegment(t, file+".1", "plate") //其他分片的构建目录
+	current, _ = ResolveIndex(file)
+	assert.Equal(t, seg1, current)
+
+	seg2, err := Publish(file, buildSegment(t, file, "glass"))
+	assert.Nil(t, err)
+	idx, err := OpenBTreeIndex(seg2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(idx.Get("glass")))
+	idx.BT.Close()
+
+	//上一个段可能仍被其他进程使用, 保留到下一次发布
+	assert.Nil(t, CleanupSegments(file))
+	_, err = os.Stat(filepath.Dir(seg1))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Dir(stale))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Dir(seg2))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Dir(other))
+	assert.Nil(t, err)
+
+	seg3, err := Publish(file, buildSegment(t, file, "plate"))
+	assert.Nil(t, err)
+	assert.Nil(t, CleanupSegments(file))
+	_, err = os.Stat(filepath.Dir(seg1))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Dir(seg2))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Dir(seg3))
+	assert.Nil(t, err)
+
+	ioutil.WriteFile(file+CurrentSuffix, []byte("../../etc"), 0660)
+	_, err = ResolveIndex(file)
+	assert.NotNil(t, err)
+}
+
+func TestCleanupLegacy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idx")
+
+	legacy := NewBTreeIndex(file)
+	legacy.Add([]Document{{ID: 1, Text: "donut"}})
+	legacy.Close()
+
+	//第一次发布后旧索引仍可能被使用
+	_, err := Publish(file, buildSegment(t, file, "glass"))
+	assert.Nil(t, err)
+	assert.Nil(t, CleanupSegments(file))
+	_, err = os.Stat(file + ".kv")
+	assert.Nil(t, err)
+
+	_, err = Publish(file, buildSegment(t, file, "plate"))
+	assert.Nil(t, err)
+	assert.Nil(t, CleanupSegments(file))
+	for _, ext := range []string{".kv", ".idx", ManifestSuffix} {
+		_, err = os.Stat(file + ext)
+		assert.True(t, os.IsNotExist(err), ext)
+	}
+
+	ioutil.WriteFile(file+PreviousSuffix, []byte("../idx"), 0660)
+	assert.NotNil(t, CleanupSegments(file))
+}
+
+func TestRetire(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idx")
+
+	seg, err := Publish(file, buildSegment(t, file, "donut"))
+	assert.Nil(t, err)
+	idx, err := OpenBTreeIndex(seg)
+	assert.Nil(t, err)
+
+	assert.True(t, idx.Acquire())
+	idx.Retire()
+	idx.Retire()
+	_, err = os.Stat(seg + ".kv")
+	assert.Nil(t, err) //查询仍在进行
+	assert.Equal(t, 1, len(idx.Get("donut")))
+
+	idx.Release()
+	assert.False(t, idx.Acquire())
+	_, err = os.Stat(filepath.Dir(seg))
+	assert.True(t, os.IsNotExist(err))
+}
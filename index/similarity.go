@@ -0,0 +1,159 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/util"
+)
+
+// 多字段文档: 正文的词直接作为key, 其他字段的词加上字段前缀(eg. title:jordan)写入同一个索引,
+// 倒排表中的DocLen为该字段的长度. 打分时按BM25F合并各字段的词频
+
+const (
+	TextField  = "text"
+	TitleField = "title"
+	URLField   = "url"
+)
+
+// FieldTerm 字段中的词对应的key, 正文的词不加前缀
+func FieldTerm(field string, token string) string {
+	if field == TextField {
+		return token
+	}
+	return field + ":" + token
+}
+
+// FieldSimilarity BM25F中单个字段的参数
+type FieldSimilarity struct {
+	Weight float64 //字段权重
+	B      float64 //字段长度归一化参数
+}
+
+// SimilarityConfig 相关性打分参数, 每个索引单独配置
+type SimilarityConfig struct {
+	Model SearchModel //查询未指定模型时使用
+
+	K1 float64
+	B  float64
+
+	//BM25F非正文字段的参数, 为空时只索引正文, 即BM25
+	Fields map[string]FieldSimilarity
+
+	Delta  float64 //bm25+
+	Mu     float64 //lm_dirichlet
+	Lambda float64 //lm_jm
+
+	PriorWeight float64 //文档静态分的权重, 得分 = 相关性 + PriorWeight * 静态分
+
+	Vector HNSWConfig //向量字段的HNSW参数
+}
+
+func DefaultSimilarity() SimilarityConfig {
+	return SimilarityConfig{Model: BM25, K1: 2, B: 0.75, Delta: 1, Mu: 2000, Lambda: 0.7, Vector: DefaultHNSWConfig()}
+}
+
+// SimilarityFromConfig 由配置文件生成打分参数, 默认模型未注册或向量相似度不支持时panic
+func SimilarityFromConfig(c *config.Config) SimilarityConfig {
+	sim := NewSimilarityConfig(c.BM25)
+	p := c.Similarity
+	if p.Model != "" {
+		model, err := ParseSearchModel(p.Model)
+		if err != nil {
+			panic(err.Error())
+		}
+		sim.Model = model
+	}
+	if p.Delta > 0 {
+		sim.Delta = float64(p.Delta)
+	}
+	if p.Mu > 0 {
+		sim.Mu = float64(p.Mu)
+	}
+	if p.Lambda > 0 && p.Lambda < 1 {
+		sim.Lambda = float64(p.Lambda)
+	}
+	if p.PriorWeight > 0 {
+		sim.PriorWeight = float64(p.PriorWeight)
+	}
+
+	v := c.Vector
+	metric, err := ParseVectorMetric(v.Metric)
+	if err != nil {
+		panic(err.Error())
+	}
+	sim.Vector = HNSWConfig{Dim: v.Dim, Metric: metric, M: v.M, EfConstruction: v.EfConstruction, EfSearch: v.EfSearch}.WithDefault()
+	return sim
+}
+
+// NewSimilarityConfig 由配置文件生成打分参数, 未配置的参数使用默认值, 字段未配置B时使用全局B
+func NewSimilarityConfig(p config.BM25Parameters) SimilarityConfig {
+	sim := DefaultSimilarity()
+	if p.K1 > 0 {
+		sim.K1 = float64(p.K1)
+	}
+	if p.B != nil {
+		sim.B = float64(*p.B)
+	}
+	for name, f := range p.Fields {
+		if name != TitleField && name != URLField && name != TextField {
+			panic(fmt.Sprintf("unsupported BM25F field: %s", name))
+		}
+		fs := FieldSimilarity{Weight: float64(f.Weight), B: sim.B}
+		if fs.Weight <= 0 {
+			fs.Weight = 1
+		}
+		if f.B != nil {
+			fs.B = float64(*f.B)
+		}
+		if sim.Fields == nil {
+			sim.Fields = make(map[string]FieldSimilarity)
+		}
+		sim.Fields[name] = fs
+	}
+	return sim
+}
+
+// Field 字段的参数, 未配置的字段(正文)权重为1
+func (s *SimilarityConfig) Field(name string) FieldSimilarity {
+	if f, ok := s.Fields[name]; ok {
+		return f
+	}
+	return FieldSimilarity{Weight: 1, B: s.B}
+}
+
+// FieldNames 需要索引的非正文字段
+func (s *SimilarityConfig) FieldNames() []string {
+	var names []string
+	for name := range s.Fields {
+		if name != TextField {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FieldTokens 文档中一个字段的分词结果, 非正文字段的词已加上字段前缀
+type FieldTokens struct {
+	Field  string
+	Tokens []string
+}
+
+// AnalyzeDocument 对正文及sim中配置的字段分词, 第一个为正文
+func AnalyzeDocument(doc Document, sim *SimilarityConfig) []FieldTokens {
+	fields := []FieldTokens{{Field: TextField, Tokens: util.Analyze(doc.Text)}}
+	for _, name := range sim.FieldNames() {
+		text := doc.Title
+		if name == URLField {
+			text = doc.URL
+		}
+		tokens := util.Analyze(text)
+		for i := range tokens {
+			tokens[i] = FieldTerm(name, tokens[i])
+		}
+		fields = append(fields, FieldTokens{Field: name, Tokens: tokens})
+	}
+	return fields
+}
@@ -0,0 +1,162 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSimilarityConfig(t *testing.T) {
+	sim := NewSimilarityConfig(config.BM25Parameters{})
+	assert.Equal(t, DefaultSimilarity(), sim)
+
+	b := func(v float32) *float32 { return &v }
+	sim = NewSimilarityConfig(config.BM25Parameters{K1: 1.2, B: b(0.5), Fields: map[string]config.BM25Field{
+		TitleField: {Weight: 3},
+		URLField:   {Weight: 0.5, B: b(0.25)},
+		TextField:  {B: b(0)},
+	}})
+	assert.InDelta(t, 1.2, sim.K1, 1e-6)
+	assert.InDelta(t, 0.5, sim.B, 1e-6)
+	assert.InDelta(t, 0.5, sim.Field(TitleField).B, 1e-6) //继承全局B
+	assert.InDelta(t, 0.25, sim.Field(URLField).B, 1e-6)
+	assert.Equal(t, float64(1), sim.Field(TextField).Weight)
+	assert.Equal(t, float64(0), sim.Field(TextField).B) //显式配置为0
+	assert.Equal(t, []string{TitleField, URLField}, sim.FieldNames())
+
+	//只配置K1时B使用默认值, 显式配置的0生效
+	sim = NewSimilarityConfig(config.BM25Parameters{K1: 1.2})
+	assert.Equal(t, 0.75, sim.B)
+	sim = NewSimilarityConfig(config.BM25Parameters{K1: 1.2, B: b(0)})
+	assert.Equal(t, float64(0), sim.B)
+
+	assert.Panics(t, func() {
+		NewSimilarityConfig(config.BM25Parameters{Fields: map[string]config.BM25Field{"body": {Weight: 1}}})
+	})
+}
+
+func TestBM25Similarity(t *testing.T) {
+	//词频相同时, 短文档得分更高
+	idx := NewHashMapIndex()
+	idx.Add([]Document{
+		{ID: 1, Text: "donut"},
+		{ID: 2, Text: "donut with chocolate glaze and sprinkles on top"},
+		{ID: 3, Text: "glass"},
+	})
+	docs := idx.Retrieval(nil, util.Analyze("donut"), nil, 10, 100, BM25)
+	assert.Equal(t, 2, len(docs))
+	assert.Equal(t, int32(1), docs[0].ID)
+	assert.True(t, docs[0].Score > docs[1].Score)
+
+	//b=0时不做长度归一化
+	idx.SetSimilarity(SimilarityConfig{K1: 1.2, B: 0})
+	idx.Clear()
+	idx.Add([]Document{
+		{ID: 1, Text: "donut"},
+		{ID: 2, Text: "donut with chocolate glaze and sprinkles on top"},
+		{ID: 3, Text: "glass"},
+	})
+	_, explains, _ := DoRetrievalExplain(idx, nil, util.Analyze("donut"), nil, 10, 100, BM25)
+	assert.Equal(t, explains[1].Score, explains[2].Score)
+	assert.Equal(t, 1.2, explains[1].K1)
+	assert.Equal(t, float64(7), explains[2].DocLen)
+}
+
+func TestBM25F(t *testing.T) {
+	docs := []Document{
+		{ID: 1, Title: "Chocolate donut", Text: "a sweet treat with glaze"},
+		{ID: 2, Title: "Breakfast", Text: "chocolate milk and a treat"},
+		{ID: 3, Title: "Glass", Text: "a glass plate"},
+	}
+
+	//只索引正文
+	idx := NewHashMapIndex()
+	idx.Add(docs)
+	result := idx.Retrieval(nil, util.Analyze("chocolate"), nil, 10, 100, BM25)
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, int32(2), result[0].ID)
+
+	//标题权重高于正文
+	sim := DefaultSimilarity()
+	sim.Fields = map[string]FieldSimilarity{TitleField: {Weight: 3, B: 0.75}}
+	idx = NewHashMapIndex()
+	idx.SetSimilarity(sim)
+	idx.Add(docs)
+	assert.Equal(t, 4, idx.Property().FieldTokenCount(TitleField))
+	assert.NotNil(t, idx.Get(FieldTerm(TitleField, util.Analyze("chocolate")[0])))
+
+	result, explains, _ := DoRetrievalExplain(idx, nil, util.Analyze("chocolate"), nil, 10, 100, BM25)
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, int32(1), result[0].ID)
+	assert.Equal(t, TitleField, explains[1].Terms[0].Fields[0].Field)
+	assert.Contains(t, explains[1].String(), "title: tf 1")
+
+	//not过滤所有字段
+	result = idx.Retrieval(nil, util.Analyze("treat"), util.Analyze("donut"), 10, 100, BM25)
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, int32(2), result[0].ID)
+}
+
+func TestBoostedRetrieval(t *testing.T) {
+	idx := NewHashMapIndex()
+	idx.Add([]Document{
+		{ID: 1, Text: "couch in the living room"},
+		{ID: 2, Text: "sofa in the living room"},
+	})
+	//扩展词sofa的得分乘以权重, 每个模型都生效
+	for _, model := range []SearchModel{VectorSpace, BM25, BM25Plus, LMDirichlet, DFR, IB} {
+		plain, _ := DoRetrieval(idx, nil, []string{"couch", "sofa"}, nil, 10, 100, model)
+		assert.Equal(t, plain[0].Score, plain[1].Score, model)
+
+		boost := Boost{"sofa": 0.5}
+		docs, explains, _ := DoBoostedRetrievalExplain(idx, nil, []string{"couch", "sofa"}, nil, boost, 10, 100, model)
+		assert.Equal(t, []int{1, 2}, PostingList(docs).IDs(), model)
+		assert.True(t, docs[1].Score < docs[0].Score, model)
+		assert.Equal(t, 0.5, explains[2].Terms[0].Boost, model)
+		assert.Equal(t, float64(0), explains[1].Terms[0].Boost, model)
+	}
+
+	docs, explains, _ := DoBoostedRetrievalExplain(idx, nil, []string{"couch", "sofa"}, nil, Boost{"sofa": 0.5}, 10, 100, BM25)
+	assert.InDelta(t, docs[0].Score/2, docs[1].Score, 0.001)
+	assert.Contains(t, explains[2].String(), "boost 0.5000")
+	assert.Equal(t, []string{"a", "b"}, Boost{"b": 1, "a": 0.5}.Terms())
+	assert.Equal(t, float64(1), Boost(nil).Get("a"))
+}
+
+func TestSummaryFields(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "summary")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idx")
+
+	var p Property
+	p.SetDocNum(3)
+	p.AddFieldTokens(TextField, 30)
+	p.AddFieldTokens(TitleField, 6)
+	p.SetDataRange(DataRange{Start: 1, End: 2})
+	assert.Nil(t, writeSummary(file, &p))
+
+	var q Property
+	assert.Nil(t, readSummary(file, &q))
+	assert.Equal(t, p, q)
+	assert.Equal(t, float64(2), q.AvgFieldLen(TitleField))
+
+	//run文件头中保存属性
+	w, err := NewRunWriter(file + ".run")
+	assert.Nil(t, err)
+	w.SetProperty(p)
+	assert.Nil(t, w.Write("a", PostingList{{ID: 1, TF: 1}}))
+	assert.Nil(t, w.Close())
+	r, err := OpenRunReader(file + ".run")
+	assert.Nil(t, err)
+	assert.Equal(t, p, *r.Property())
+	r.Close()
+
+	p.Add(q)
+	assert.Equal(t, 6, p.DocNum())
+	assert.Equal(t, 12, p.FieldTokenCount(TitleField))
+}
@@ -0,0 +1,452 @@
+package index
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awesomefly/easysearch/config"
+)
+
+const (
+	WikiSource    = "wiki"
+	JSONSource    = "jsonl"
+	CSVSource     = "csv"
+	TextDirSource = "textdir"
+)
+
+// DocumentSource 文档数据源
+type DocumentSource interface {
+	// Next returns next document, io.EOF if there are no more documents.
+	// 单条记录格式错误时返回*RecordError, 调用方可以跳过该记录继续读取; 其他错误无法继续读取
+	Next() (*Document, error)
+	Close() error
+}
+
+// RecordError 单条记录解析失败
+type RecordError struct {
+	Source string
+	Record int //行号/记录序号, 从1开始
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%s record %d: %s", e.Source, e.Record, e.Err.Error())
+}
+
+// ErrorReport 汇总读取过程中跳过的错误记录
+type ErrorReport struct {
+	Skipped int
+	Errors  []*RecordError //最多保留MaxReportErrors条
+	Fatal   error
+}
+
+const MaxReportErrors = 100
+
+func (r *ErrorReport) Add(err *RecordError) {
+	r.Skipped++
+	if len(r.Errors) < MaxReportErrors {
+		r.Errors = append(r.Errors, err)
+	}
+}
+
+func (r *ErrorReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "skipped %d bad records", r.Skipped)
+	for _, err := range r.Errors {
+		b.WriteString("\n  ")
+		b.WriteString(err.Error())
+	}
+	if r.Skipped > len(r.Errors) {
+		fmt.Fprintf(&b, "\n  ... %d more", r.Skipped-len(r.Errors))
+	}
+	if r.Fatal != nil {
+		fmt.Fprintf(&b, "\nfatal: %s", r.Fatal.Error())
+	}
+	return b.String()
+}
+
+// OpenSource 根据配置打开文档数据源
+func OpenSource(c config.Source) (DocumentSource, error) {
+	switch c.Type {
+	case WikiSource, "":
+		return NewWikiSource(c.Path)
+	case JSONSource:
+		return NewJSONLinesSource(c.Path, c.Fields)
+	case CSVSource:
+		return NewCSVSource(c.Path, c.Fields)
+	case TextDirSource:
+		return NewTextDirSource(c.Path)
+	}
+	return nil, fmt.Errorf("unknown document source type: %s", c.Type)
+}
+
+// StreamDocuments 异步读取数据源中的文档, 跳过的错误记录写入report, 读取结束后发送nil
+func StreamDocuments(src DocumentSource, report *ErrorReport) chan *Document {
+	ch := make(chan *Document, 10)
+	go func() {
+		defer src.Close()
+		n := 0
+		for {
+			doc, err := src.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				var re *RecordError
+				if errors.As(err, &re) {
+					report.Add(re)
+					continue
+				}
+				report.Fatal = err
+				log.Printf("read documents err: %s", err.Error())
+				break
+			}
+			ch <- doc
+			if n++; n%5000 == 0 {
+				fmt.Printf("load %d docs\n", n)
+			}
+		}
+		ch <- nil
+	}()
+	return ch
+}
+
+// ReadAll reads all documents from src, bad records are skipped and reported
+func ReadAll(src DocumentSource) ([]Document, *ErrorReport) {
+	report := &ErrorReport{}
+	docs := make([]Document, 0)
+	ch := StreamDocuments(src, report)
+	for doc := <-ch; doc != nil; doc = <-ch {
+		docs = append(docs, *doc)
+	}
+	return docs, report
+}
+
+// openMaybeGzip 根据文件头判断是否为gzip压缩文件
+func openMaybeGzip(path string) (io.Reader, []io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(f)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return gz, []io.Closer{gz, f}, nil
+	}
+	return br, []io.Closer{f}, nil
+}
+
+func closeAll(closers []io.Closer) error {
+	var err error
+	for _, c := range closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// wikiSource Wikipedia abstract dump, ID按文档在dump中的位置分配(从1开始)
+type wikiSource struct {
+	path    string
+	dec     *xml.Decoder
+	closers []io.Closer
+	id      int
+}
+
+func NewWikiSource(path string) (DocumentSource, error) {
+	r, closers, err := openMaybeGzip(path)
+	if err != nil {
+		return nil, err
+	}
+	return &wikiSource{path: path, dec: xml.NewDecoder(r), closers: closers}, nil
+}
+
+func (s *wikiSource) Next() (*Document, error) {
+	for {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return nil, err //xml语法错误后无法继续解析
+		}
+
+		if ty, ok := tok.(xml.StartElement); ok && ty.Name.Local == "doc" {
+			s.id++
+			doc := Document{}
+			if err = s.dec.DecodeElement(&doc, &ty); err != nil {
+				if _, ok := err.(*xml.SyntaxError); ok {
+					return nil, err
+				}
+				return nil, &RecordError{Source: s.path, Record: s.id, Err: err}
+			}
+			doc.ID = s.id
+			return &doc, nil
+		}
+	}
+}
+
+func (s *wikiSource) Close() error {
+	return closeAll(s.closers)
+}
+
+// fieldsDocument 按配置的字段名构造文档
+func fieldsDocument(fields config.SourceFields, get func(name string) (string, bool)) (*Document, error) {
+	fields = fields.WithDefault()
+
+	idStr, ok := get(fields.ID)
+	if !ok || strings.TrimSpace(idStr) == "" {
+		return nil, fmt.Errorf("missing id field %q", fields.ID)
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(idStr))
+	if err != nil || id < 0 {
+		return nil, fmt.Errorf("invalid id %q", idStr)
+	}
+
+	doc := &Document{ID: id}
+	if doc.Text, ok = get(fields.Text); !ok {
+		return nil, fmt.Errorf("missing text field %q", fields.Text)
+	}
+	doc.Title, _ = get(fields.Title)
+	doc.URL, _ = get(fields.URL)
+	if links, ok := get(fields.Links); ok {
+		for _, link := range strings.Split(links, linkSeparator) {
+			if link = strings.TrimSpace(link); link != "" {
+				doc.Links = append(doc.Links, link)
+			}
+		}
+	}
+	if vec, ok := get(fields.Vector); ok && strings.TrimSpace(vec) != "" {
+		if doc.Vector, err = ParseVector(vec); err != nil {
+			return nil, err
+		}
+	}
+	if ts, ok := get(fields.Timestamp); ok && ts != "" {
+		if doc.Timestamp, err = parseTimestamp(ts); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// linkSeparator csv中多个出链的分隔符
+const linkSeparator = "|"
+
+// ParseVector 解析以|、逗号或空格分隔的向量
+func ParseVector(s string) ([]float32, error) {
+	items := strings.FieldsFunc(s, func(r rune) bool {
+		return r == '|' || r == ',' || r == ' ' || r == '\t' || r == '[' || r == ']'
+	})
+	vec := make([]float32, len(items))
+	for i, item := range items {
+		v, err := strconv.ParseFloat(item, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector %q", s)
+		}
+		vec[i] = float32(v)
+	}
+	return vec, nil
+}
+
+// parseTimestamp 支持unix秒与RFC3339格式
+func parseTimestamp(s string) (int, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return int(n), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return int(t.Unix()), nil
+}
+
+// jsonLinesSource 每行一个json对象
+type jsonLinesSource struct {
+	path    string
+	fields  config.SourceFields
+	scanner *bufio.Scanner
+	closers []io.Closer
+	line    int
+}
+
+func NewJSONLinesSource(path string, fields config.SourceFields) (DocumentSource, error) {
+	r, closers, err := openMaybeGzip(path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	return &jsonLinesSource{path: path, fields: fields, scanner: scanner, closers: closers}, nil
+}
+
+func (s *jsonLinesSource) Next() (*Document, error) {
+	for s.scanner.Scan() {
+		s.line++
+		line := strings.TrimSpace(s.scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		obj := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			return nil, &RecordError{Source: s.path, Record: s.line, Err: err}
+		}
+		doc, err := fieldsDocument(s.fields, func(name string) (string, bool) {
+			v, ok := obj[name]
+			if !ok || v == nil {
+				return "", false
+			}
+			switch x := v.(type) {
+			case string:
+				return x, true
+			case float64:
+				return strconv.FormatFloat(x, 'f', -1, 64), true
+			case []interface{}:
+				items := make([]string, 0, len(x))
+				for _, item := range x {
+					items = append(items, fmt.Sprint(item))
+				}
+				return strings.Join(items, linkSeparator), true
+			default:
+				return fmt.Sprint(x), true
+			}
+		})
+		if err != nil {
+			return nil, &RecordError{Source: s.path, Record: s.line, Err: err}
+		}
+		return doc, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (s *jsonLinesSource) Close() error {
+	return closeAll(s.closers)
+}
+
+// csvSource 首行为列名
+type csvSource struct {
+	path    string
+	fields  config.SourceFields
+	reader  *csv.Reader
+	header  map[string]int
+	closers []io.Closer
+	record  int
+}
+
+func NewCSVSource(path string, fields config.SourceFields) (DocumentSource, error) {
+	r, closers, err := openMaybeGzip(path)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	names, err := reader.Read()
+	if err != nil {
+		closeAll(closers)
+		return nil, fmt.Errorf("read csv header of %s: %v", path, err)
+	}
+	header := make(map[string]int, len(names))
+	for i, name := range names {
+		header[strings.TrimSpace(name)] = i
+	}
+	return &csvSource{path: path, fields: fields, reader: reader, header: header, closers: closers}, nil
+}
+
+func (s *csvSource) Next() (*Document, error) {
+	row, err := s.reader.Read()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	s.record++
+	if err != nil {
+		if _, ok := err.(*csv.ParseError); ok {
+			return nil, &RecordError{Source: s.path, Record: s.record, Err: err}
+		}
+		return nil, err
+	}
+
+	doc, err := fieldsDocument(s.fields, func(name string) (string, bool) {
+		i, ok := s.header[name]
+		if !ok || i >= len(row) {
+			return "", false
+		}
+		return row[i], true
+	})
+	if err != nil {
+		return nil, &RecordError{Source: s.path, Record: s.record, Err: err}
+	}
+	return doc, nil
+}
+
+func (s *csvSource) Close() error {
+	return closeAll(s.closers)
+}
+
+// textDirSource 目录下每个文件为一个文档, 文件名(不含扩展名)为文档ID, 如 1024.txt
+type textDirSource struct {
+	dir   string
+	files []string
+	pos   int
+}
+
+func NewTextDirSource(dir string) (DocumentSource, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			files = append(files, e.Name())
+		}
+	}
+	sort.Strings(files)
+	return &textDirSource{dir: dir, files: files}, nil
+}
+
+func (s *textDirSource) Next() (*Document, error) {
+	if s.pos >= len(s.files) {
+		return nil, io.EOF
+	}
+	name := s.files[s.pos]
+	s.pos++
+
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	id, err := strconv.Atoi(stem)
+	if err != nil || id < 0 {
+		return nil, &RecordError{Source: s.dir, Record: s.pos, Err: fmt.Errorf("file name %q is not a doc id", name)}
+	}
+	path := filepath.Join(s.dir, name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &RecordError{Source: s.dir, Record: s.pos, Err: err}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, &RecordError{Source: s.dir, Record: s.pos, Err: err}
+	}
+	return &Document{ID: id, Title: stem, Text: string(data), Timestamp: int(info.ModTime().Unix())}, nil
+}
+
+func (s *textDirSource) Close() error {
+	return nil
+}
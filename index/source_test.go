@@ -0,0 +1,130 @@
+package index
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func TestJSONLinesSource(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "source")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "docs.jsonl")
+	writeFile(t, path, `{"doc_id": 7, "body": "hello world", "title": "t7", "timestamp": "2021-01-02T03:04:05Z"}
+{"doc_id": "8", "body": "second", "vector": [0.5, -1, 2]}
+
+{"body": "missing id"}
+not a json
+{"doc_id": 9, "body": "third", "timestamp": 1600000000}
+`)
+	src, err := OpenSource(config.Source{Type: JSONSource, Path: path, Fields: config.SourceFields{ID: "doc_id", Text: "body"}})
+	assert.Nil(t, err)
+
+	docs, report := ReadAll(src)
+	assert.Nil(t, report.Fatal)
+	assert.Equal(t, 2, report.Skipped)
+	assert.Equal(t, 4, report.Errors[0].Record)
+	assert.Equal(t, 5, report.Errors[1].Record)
+
+	assert.Equal(t, 3, len(docs))
+	assert.Equal(t, Document{ID: 7, Title: "t7", Text: "hello world", Timestamp: 1609556645}, docs[0])
+	assert.Equal(t, 8, docs[1].ID)
+	assert.Equal(t, []float32{0.5, -1, 2}, docs[1].Vector)
+	assert.Equal(t, 9, docs[2].ID)
+	assert.Equal(t, 1600000000, docs[2].Timestamp)
+}
+
+func TestCSVSource(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "source")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "docs.csv")
+	writeFile(t, path, "id,title,text\n1,a,\"text, with comma\"\nx,b,bad id\n3,c,ok\n")
+	src, err := OpenSource(config.Source{Type: CSVSource, Path: path})
+	assert.Nil(t, err)
+
+	docs, report := ReadAll(src)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, 2, len(docs))
+	assert.Equal(t, "text, with comma", docs[0].Text)
+	assert.Equal(t, 3, docs[1].ID)
+
+	vec, err := ParseVector("[0.1, 0.2 | 3]")
+	assert.Nil(t, err)
+	assert.Equal(t, []float32{0.1, 0.2, 3}, vec)
+	_, err = ParseVector("0.1,x")
+	assert.NotNil(t, err)
+}
+
+func TestTextDirSource(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "source")
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "10.txt"), "ten")
+	writeFile(t, filepath.Join(dir, "2.txt"), "two")
+	writeFile(t, filepath.Join(dir, "readme.txt"), "not a doc")
+	src, err := OpenSource(config.Source{Type: TextDirSource, Path: dir})
+	assert.Nil(t, err)
+
+	docs, report := ReadAll(src)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, 2, len(docs))
+	assert.Equal(t, 10, docs[0].ID)
+	assert.Equal(t, "ten", docs[0].Text)
+	assert.Equal(t, 2, docs[1].ID)
+}
+
+func TestWikiSource(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "source")
+	defer os.RemoveAll(dir)
+
+	dump := `<feed><doc><title>A</title><url>u1</url><abstract>first</abstract></doc>
+<doc><title>B</title><url>u2</url><abstract>second</abstract></doc></feed>`
+	path := filepath.Join(dir, "dump.xml.gz")
+	f, _ := os.Create(path)
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(dump))
+	gz.Close()
+	f.Close()
+
+	docs, err := LoadDocuments(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(docs))
+	assert.Equal(t, 0, docs[0].ID)
+	assert.Equal(t, "second", docs[1].Text)
+
+	//未压缩的dump
+	plain := filepath.Join(dir, "dump.xml")
+	writeFile(t, plain, dump)
+	ch, report, err := LoadDocumentStream(plain)
+	assert.Nil(t, err)
+	doc := <-ch
+	assert.Equal(t, 1, doc.ID)
+	assert.Equal(t, "A", doc.Title)
+	assert.Equal(t, 2, (<-ch).ID)
+	assert.Nil(t, <-ch)
+	assert.Equal(t, 0, report.Skipped)
+	assert.Nil(t, report.Fatal)
+
+	//格式错误的dump返回错误而不是panic
+	writeFile(t, plain, "<feed><doc><title>A</title></doc><doc>")
+	ch, report, err = LoadDocumentStream(plain)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, (<-ch).ID)
+	assert.Nil(t, <-ch)
+	assert.NotNil(t, report.Fatal)
+	src, _ := NewWikiSource(plain)
+	docs, report = ReadAll(src)
+	assert.Equal(t, 1, len(docs))
+	assert.NotNil(t, report.Fatal)
+}
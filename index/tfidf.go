@@ -3,19 +3,92 @@ package index
 import (
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 )
 
 type TF map[string]int32
+
+// Boost 查询词的权重, 各打分模型中词的得分乘以权重, 未设置的词为1. 用于按相似度降低查询扩展词的得分
+type Boost map[string]float64
+
+func (b Boost) Get(term string) float64 {
+	if w, ok := b[term]; ok {
+		return w
+	}
+	return 1
+}
+
+// Terms 设置了权重的词, 按字典序
+func (b Boost) Terms() []string {
+	terms := make([]string, 0, len(b))
+	for term := range b {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	return terms
+}
+
+// FieldFreq 词在文档一个字段中的词频及字段长度
+type FieldFreq struct {
+	Field  string
+	TF     int32
+	DocLen int32
+}
+
 type TFIDF struct {
 	IDF    map[string]float64
-	DOC2TF map[int32]TF
+	DOC2TF map[int32]TF //各字段的词频之和
+
+	DOC2FIELD map[int32]map[string][]FieldFreq //doc -> term -> 各字段的词频
+
+	DF  map[string]int   //key(FieldTerm) -> 字段中的文档频率
+	CTF map[string]int64 //key(FieldTerm) -> 字段中的总词频, 语言模型及DFR使用
+
+	Boost Boost //查询词的权重
+
+	Explain map[int32]*Explanation //非nil时记录每个文档的得分明细
 }
 
 func NewTFIDF() *TFIDF {
 	return &TFIDF{
-		IDF:    make(map[string]float64),
-		DOC2TF: make(map[int32]TF, 0),
+		IDF:       make(map[string]float64),
+		DOC2TF:    make(map[int32]TF, 0),
+		DOC2FIELD: make(map[int32]map[string][]FieldFreq, 0),
+		DF:        make(map[string]int),
+		CTF:       make(map[string]int64),
+	}
+}
+
+// addStats 记录key在整个倒排表(未截断)中的df及总词频
+func (tfidf *TFIDF) addStats(key string, pl PostingList) {
+	if _, ok := tfidf.DF[key]; ok {
+		return
+	}
+	var ctf int64
+	for i := range pl {
+		ctf += int64(pl[i].TF)
+	}
+	tfidf.DF[key] = len(pl)
+	tfidf.CTF[key] = ctf
+}
+
+// addField 记录词在字段中的倒排表
+func (tfidf *TFIDF) addField(term string, field string, plr PostingList) {
+	for _, doc := range plr {
+		tf := tfidf.DOC2TF[doc.ID]
+		if tf == nil {
+			tf = make(TF, 0)
+			tfidf.DOC2TF[doc.ID] = tf
+		}
+		tf[term] += doc.TF
+
+		fields := tfidf.DOC2FIELD[doc.ID]
+		if fields == nil {
+			fields = make(map[string][]FieldFreq)
+			tfidf.DOC2FIELD[doc.ID] = fields
+		}
+		fields[term] = append(fields[term], FieldFreq{Field: field, TF: doc.TF, DocLen: doc.DocLen})
 	}
 }
 
@@ -31,7 +104,7 @@ func CalCosine(hits []Doc, tfidf *TFIDF) []Doc {
 	var querySum float64
 	for term, tf := range tfidf.DOC2TF[queryDocId] {
 		idf := tfidf.IDF[term]
-		weight := float64(tf) * idf
+		weight := float64(tf) * idf * tfidf.Boost.Get(term)
 		querySum += math.Pow(weight, 2)
 	}
 
@@ -40,31 +113,77 @@ func CalCosine(hits []Doc, tfidf *TFIDF) []Doc {
 		for term, tf := range tfidf.DOC2TF[hit.ID] {
 			idf := tfidf.IDF[term]
 			docTermWeight := float64(tf) * idf
-			queryTermWeight := float64(tfidf.DOC2TF[queryDocId][term]) * idf
+			queryTermWeight := float64(tfidf.DOC2TF[queryDocId][term]) * idf * tfidf.Boost.Get(term)
 
 			multiplySum += docTermWeight * queryTermWeight
 			docSum += math.Pow(docTermWeight, 2)
 		}
 		hits[i].Score = multiplySum / math.Sqrt(querySum*docSum)
 		hits[i].Score, _ = strconv.ParseFloat(fmt.Sprintf("%.4f", hits[i].Score), 64)
+
+		if tfidf.Explain != nil {
+			e := &Explanation{DocID: hit.ID, Model: VectorSpace.String(), Score: hits[i].Score}
+			for term, tf := range tfidf.DOC2TF[hit.ID] {
+				idf, qtf := tfidf.IDF[term], tfidf.DOC2TF[queryDocId][term]
+				e.Terms = append(e.Terms, TermExplain{Term: term, TF: tf, QueryTF: qtf, IDF: idf, Boost: tfidf.Boost[term],
+					Score: float64(tf) * idf * float64(qtf) * idf * tfidf.Boost.Get(term) / math.Sqrt(querySum*docSum)})
+			}
+			e.sortTerms()
+			tfidf.Explain[hit.ID] = e
+		}
 	}
 	return hits
 }
 
-//CalBM25 计算bm25得分并排序
-//docsLen 索引文档总长度(词的数量), DocsNum 索取文档总数
-func CalBM25(hits []Doc, tfidf *TFIDF, docLen int, docNum int) []Doc {
+//CalBM25 计算bm25得分, 多字段时为BM25F:
+//  tf' = Σ weight_f * tf_f / (1 - b_f + b_f * len_f / avglen_f)
+//  score = Σ idf * tf' * (k1 + 1) / (tf' + k1)
+//只有正文时即为BM25
+func CalBM25(hits []Doc, tfidf *TFIDF, p *Property, sim *SimilarityConfig) []Doc {
+	return calBM25(hits, tfidf, p, sim, BM25, 0)
+}
+
+//CalBM25Plus BM25+, 每个命中的词的得分加上下界delta, 避免长文档的得分趋近于0
+//  score = Σ idf * (tf' * (k1 + 1) / (tf' + k1) + delta)
+func CalBM25Plus(hits []Doc, tfidf *TFIDF, p *Property, sim *SimilarityConfig) []Doc {
+	return calBM25(hits, tfidf, p, sim, BM25Plus, sim.Delta)
+}
+
+func calBM25(hits []Doc, tfidf *TFIDF, p *Property, sim *SimilarityConfig, model SearchModel, delta float64) []Doc {
 	// 计算bm25 参考:https://www.jianshu.com/p/1e498888f505
+	k1 := sim.K1
 	for i, hit := range hits {
-		for term, tf := range tfidf.DOC2TF[hit.ID] { //hit doc包含多个term
-			d := float64(docLen)
-			avg := float64(docLen) / float64(docNum)
+		var e *Explanation
+		if tfidf.Explain != nil {
+			e = &Explanation{DocID: hit.ID, Model: model.String(), K1: k1, B: sim.B, AvgDL: p.AvgFieldLen(TextField)}
+			tfidf.Explain[hit.ID] = e
+		}
+		for term, fields := range tfidf.DOC2FIELD[hit.ID] { //hit doc包含多个term
 			idf := tfidf.IDF[term]
-			k1 := float64(2)
-			b := 0.75
-			hits[i].Score += idf * float64(tf) * (k1 + 1) / (float64(tf) + k1*(1-b+b*d/avg))
+			var tfn float64
+			for _, f := range fields {
+				fs := sim.Field(f.Field)
+				norm := float64(1)
+				if avg := p.AvgFieldLen(f.Field); avg > 0 {
+					norm = 1 - fs.B + fs.B*float64(f.DocLen)/avg
+				}
+				tfn += fs.Weight * float64(f.TF) / norm
+				if e != nil && f.Field == TextField {
+					e.DocLen = float64(f.DocLen)
+				}
+			}
+			score := tfidf.Boost.Get(term) * idf * (tfn*(k1+1)/(tfn+k1) + delta)
+			hits[i].Score += score
+			if e != nil {
+				e.Terms = append(e.Terms, TermExplain{Term: term, TF: tfidf.DOC2TF[hit.ID][term],
+					QueryTF: tfidf.DOC2TF[VirtualQueryDocId][term], IDF: idf, Boost: tfidf.Boost[term], Score: score, Fields: fields})
+			}
 		}
 		hits[i].Score, _ = strconv.ParseFloat(fmt.Sprintf("%.4f", hits[i].Score), 64)
+		if e != nil {
+			e.Score = hits[i].Score
+			e.sortTerms()
+		}
 	}
 	return hits
 }
@@ -0,0 +1,87 @@
+package index
+
+import (
+	"os"
+	"strconv"
+)
+
+// 文档时间: 文档的发布或修改时间(unix秒), 用于时效性特征.
+// 索引段及run文件的文档时间保存在同名的.time文件中, 格式与静态分文件相同, 每行"docID unix秒"
+
+const TimestampSuffix = ".time"
+
+// Timestamps docID -> 文档时间(unix秒)
+type Timestamps map[int32]int64
+
+// Get 文档的时间, 没有时间时为0
+func (t Timestamps) Get(id int32) int64 {
+	return t[id]
+}
+
+// Merge 合并o中的文档时间, 相同文档以o为准
+func (t Timestamps) Merge(o Timestamps) Timestamps {
+	if len(o) == 0 {
+		return t
+	}
+	if t == nil {
+		t = make(Timestamps, len(o))
+	}
+	for id, ts := range o {
+		t[id] = ts
+	}
+	return t
+}
+
+// LoadTimestamps 读取索引段或run文件prefix的文档时间, 不存在时返回nil
+func LoadTimestamps(prefix string) (Timestamps, error) {
+	times := make(Timestamps)
+	err := readDocValues(prefix+TimestampSuffix, "timestamp", func(id int32, value string) error {
+		ts, err := strconv.ParseInt(value, 10, 64)
+		times[id] = ts
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return times, nil
+}
+
+// SaveTimestamps 保存索引段或run文件prefix的文档时间, 没有文档时间时删除旧文件
+func SaveTimestamps(prefix string, t Timestamps) error {
+	if len(t) == 0 {
+		if err := os.Remove(prefix + TimestampSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	ids := make([]int32, 0, len(t))
+	for id := range t {
+		ids = append(ids, id)
+	}
+	return writeDocValues(prefix+TimestampSuffix, ids, func(id int32) string {
+		return strconv.FormatInt(t[id], 10)
+	})
+}
+
+// timestampExts 有文档时间时, 清单中加入.time文件
+func timestampExts(t Timestamps, exts ...string) []string {
+	if len(t) > 0 {
+		exts = append(exts, TimestampSuffix)
+	}
+	return exts
+}
+
+// addTimestamp 记录文档时间, 没有时间的文档不记录
+func addTimestamp(t Timestamps, doc Document) Timestamps {
+	if doc.Timestamp <= 0 {
+		return t
+	}
+	if t == nil {
+		t = make(Timestamps)
+	}
+	t[int32(doc.ID)] = int64(doc.Timestamp)
+	return t
+}
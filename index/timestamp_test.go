@@ -0,0 +1,45 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimestampsFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "timestamp")
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "idx")
+
+	times := Timestamps{3: 1600000000, 1: 1500000000}
+	assert.Nil(t, SaveTimestamps(prefix, times))
+	data, _ := ioutil.ReadFile(prefix + TimestampSuffix)
+	assert.Equal(t, "1 1500000000\n3 1600000000\n", string(data))
+
+	loaded, err := LoadTimestamps(prefix)
+	assert.Nil(t, err)
+	assert.Equal(t, times, loaded)
+	assert.Equal(t, int64(0), loaded.Get(2))
+
+	ioutil.WriteFile(prefix+TimestampSuffix, []byte("1 1500000000\n2 0.5\n"), 0660)
+	_, err = LoadTimestamps(prefix)
+	assert.Contains(t, err.Error(), ":2: invalid timestamp")
+
+	//没有文档时间时删除旧文件, 不存在时为nil
+	assert.Nil(t, SaveTimestamps(prefix, nil))
+	loaded, err = LoadTimestamps(prefix)
+	assert.Nil(t, err)
+	assert.Nil(t, loaded)
+
+	//btree索引关闭时保存文档时间, 重新打开时加载
+	bt := NewBTreeIndex(prefix)
+	bt.Add([]Document{{ID: 1, Text: "donut", Timestamp: 100}, {ID: 2, Text: "glass"}})
+	bt.Close()
+	bt = NewBTreeIndex(prefix)
+	assert.Equal(t, Timestamps{1: 100}, bt.Timestamps())
+	assert.Equal(t, int32(1), PostingList(bt.Get("donut")).Find(1).Pos)
+	bt.BT.Close()
+}
@@ -3,21 +3,30 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"github.com/awesomefly/easysearch/cluster"
 	"github.com/awesomefly/easysearch/config"
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"text/tabwriter"
 
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/paraphrase/serving"
+	"github.com/awesomefly/easysearch/paraphrase/train"
+	"github.com/awesomefly/easysearch/score"
 	"github.com/awesomefly/easysearch/search"
+	"github.com/awesomefly/easysearch/util"
 )
 
-func startStandaloneCluster() error {
+func startStandaloneCluster(dataDir string) error {
 	conf := config.InitClusterConfig("./cluster.yml")
 	procAttr := &os.ProcAttr{
 		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
@@ -27,21 +36,29 @@ func startStandaloneCluster() error {
 
 	//start manager server
 	baseArgs := os.Args[0] + " -m cluster "
-	argv := strings.Fields(baseArgs + "--servername=managerserver --host=" +
-		conf.ManageServer.Host + " --port=" + fmt.Sprint(conf.ManageServer.Port))
-	proc, err := os.StartProcess(os.Args[0], argv, procAttr)
-	if err != nil {
-		fmt.Println("start manager server process error:", err)
-		return err
+	for _, srv := range conf.Managers() {
+		argv := strings.Fields(baseArgs + "--servername=managerserver --host=" +
+			srv.Host + " --port=" + fmt.Sprint(srv.Port))
+		proc, err := os.StartProcess(os.Args[0], argv, procAttr)
+		if err != nil {
+			fmt.Println("start manager server process error:", err)
+			return err
+		}
+		procs = append(procs, proc)
 	}
-	procs = append(procs, proc)
 	time.Sleep(3 * time.Second)
 
+	var argv []string
+	var proc *os.Process
+	var err error
+
 	//start data server
 	for i := 0; i < len(conf.DataServer); i++ {
 		srv := conf.DataServer[i]
 
-		argv = strings.Fields(baseArgs + "--servername=dataserver --host=" + srv.Host + " --port=" + fmt.Sprint(srv.Port))
+		//每个节点使用单独的数据目录, 节点ID不会相同
+		argv = strings.Fields(baseArgs + "--servername=dataserver --host=" + srv.Host + " --port=" + fmt.Sprint(srv.Port) +
+			" --data_dir=" + cluster.NodeDataDir(dataDir, "dataserver", srv.Address()))
 		proc, err = os.StartProcess(os.Args[0], argv, procAttr)
 		if err != nil {
 			fmt.Println("start data server process error:", err)
@@ -55,7 +72,8 @@ func startStandaloneCluster() error {
 	for i := 0; i < len(conf.SearchServer); i++ {
 		srv := conf.SearchServer[i]
 
-		argv = strings.Fields(baseArgs + "--servername=searchserver --host=" + srv.Host + " --port=" + fmt.Sprint(srv.Port))
+		argv = strings.Fields(baseArgs + "--servername=searchserver --host=" + srv.Host + " --port=" + fmt.Sprint(srv.Port) +
+			" --data_dir=" + cluster.NodeDataDir(dataDir, "searchserver", srv.Address()))
 		proc, err = os.StartProcess(os.Args[0], argv, procAttr)
 		if err != nil {
 			fmt.Println("start search server process error:", err)
@@ -75,41 +93,184 @@ func startStandaloneCluster() error {
 	return nil
 }
 
-func startProfile() {
-	f, err := os.OpenFile("cpu.pprof", os.O_CREATE|os.O_RDWR, 0666)
+func runAdmin(conf *config.Config, op string, node string, shard int, from string, to string, replicas int) error {
+	var addrs []string
+	for _, s := range conf.Cluster.Managers() {
+		addrs = append(addrs, s.Address())
+	}
+	cli := cluster.NewAdminClient(addrs)
+
+	switch op {
+	case "status":
+		status, err := cli.Status()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("manager leader: %s, sharding num: %d, replicate num: %d\n",
+			status.ManagerLeader, status.ShardingNum, status.ReplicateNum)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NODE\tHOST\tHEALTHY\tDRAINING\tLEADER\tFOLLOWER")
+		for _, n := range status.Nodes {
+			fmt.Fprintf(w, "%s\t%s\t%v\t%v\t%v\t%v\n", n.Node.ID, n.Node.Host, n.Healthy, n.Node.Draining,
+				n.Node.LeaderSharding, n.Node.FollowerSharding)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "SHARD\tLEADER\tFOLLOWERS\tDOCS")
+		for _, sh := range status.Shards {
+			fmt.Fprintf(w, "%d\t%s\t%v\t%d\n", sh.Shard, sh.Leader, sh.Followers, sh.DocNum)
+		}
+		return w.Flush()
+	case "drain":
+		return cli.Drain(node)
+	case "move":
+		return cli.Move(shard, from, to)
+	case "promote":
+		return cli.Promote(shard, node)
+	case "replicas":
+		return cli.SetReplicateNum(replicas)
+	}
+	return fmt.Errorf("unknown admin op: %s", op)
+}
+
+func printExplains(explains []index.Explanation) {
+	for _, e := range explains {
+		fmt.Print(e.String())
+	}
+}
+
+func printHighlights(highlights []search.Highlight) {
+	for _, h := range highlights {
+		fmt.Printf("%d\t%s\t%s\n", h.DocID, h.Title, h.URL)
+		for _, f := range h.Fragments {
+			fmt.Printf("\t... %s ...\n", f)
+		}
+	}
+}
+
+// runInspect 输出索引属性、文件大小、词典统计及校验结果, term非空时输出其倒排表, limit个词及其DF
+func runInspect(file string, term string, limit int) error {
+	in, err := index.OpenInspector(file)
 	if err != nil {
-		log.Fatal(err)
-		return
+		return err
+	}
+	defer in.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "index:\t%s\nformat:\t%s\n", in.File, in.Format)
+	if p := in.Property(); p != nil {
+		fmt.Fprintf(w, "doc num:\t%d\ntoken count:\t%d\ndata range:\t[%d, %d]\n",
+			p.DocNum(), p.TokenCount(), p.DataRange().Start, p.DataRange().End)
+	}
+	fmt.Fprintln(w)
+
+	if term != "" {
+		pl, err := in.Postings(term)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "term %q df %d\n", term, len(pl))
+		fmt.Fprintln(w, "ID\tDOCLEN\tTF\tQUALITY")
+		for _, doc := range pl {
+			fmt.Fprintf(w, "%d\t%d\t%d\t%.4f\n", doc.ID, doc.DocLen, doc.TF, doc.QualityScore)
+		}
+		return w.Flush()
+	}
+
+	report, err := in.Check()
+	if err != nil {
+		return err
+	}
+	var total int64
+	fmt.Fprintln(w, "FILE\tSIZE")
+	for _, f := range in.Files() {
+		fmt.Fprintf(w, "%s\t%d\n", f.Name, f.Size)
+		total += f.Size
+	}
+	fmt.Fprintf(w, "total\t%d\n\n", total)
+	fmt.Fprintf(w, "terms:\t%d\npostings:\t%d\nmax df:\t%d (%s)\n", report.Terms, report.Postings, report.MaxDF, report.MaxDFTerm)
+	fmt.Fprintf(w, "key bytes:\t%d\nposting bytes:\t%d\noverhead bytes:\t%d\n\n",
+		report.KeyBytes, report.PostingBytes, total-report.KeyBytes-report.PostingBytes)
+
+	if limit > 0 {
+		n := 0
+		fmt.Fprintln(w, "TERM\tDF")
+		in.Range(func(key string, pl index.PostingList) error {
+			fmt.Fprintf(w, "%s\t%d\n", key, len(pl))
+			if n++; n >= limit {
+				return io.EOF
+			}
+			return nil
+		})
+		fmt.Fprintln(w)
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintln(w, p)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if report.ProblemCount > 0 {
+		return fmt.Errorf("%d problems found", report.ProblemCount)
 	}
-	defer f.Close()
+	return nil
+}
 
+// startProfile 开始CPU profile并写入file, 返回的函数停止profile.
+// 服务模式一直运行到收到信号, 收到SIGINT/SIGTERM时先写入profile再退出
+func startProfile(file string) func() {
+	f, err := os.Create(file)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if err = pprof.StartCPUProfile(f); err != nil {
 		log.Fatal(err)
-		return
 	}
-	defer pprof.StopCPUProfile()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		stop()
+		log.Printf("received %s, cpu profile written to %s", sig, file)
+		os.Exit(1)
+	}()
+	return stop
 }
 
 func main() {
-	f, _ := os.Create("cpu.pprof")
-	defer f.Close()
-	pprof.StartCPUProfile(f)
-	defer pprof.StopCPUProfile()
-
 	log.SetOutput(os.Stdout)
 	//log.Printf("args:%+v\n", os.Args)
 	//runtime.GOMAXPROCS(2)
 	log.Println("GOMAXPROCS:", runtime.GOMAXPROCS(0))
 
 	var module string
-	flag.StringVar(&module, "m", "", "[indexer|searcher|merger|cluster]")
+	flag.StringVar(&module, "m", "", "[indexer|searcher|merger|cluster|admin|snapshot|restore|inspect|pagerank|train-paraphrase]")
 
 	//searcher
 	var query, source, modelFile, searchModel string
 	flag.StringVar(&query, "q", "Album Jordan", "search query")
 	flag.StringVar(&source, "source", "", "[local|remote]")
-	flag.StringVar(&searchModel, "search_model", "", "[boolean|bm25|vs]")
-	flag.StringVar(&modelFile, "paraphrase_file", "", "paraphrase model file")
+	flag.StringVar(&searchModel, "search_model", "", "[boolean|vs|bm25|bm25+|lm_dirichlet|lm_jm|dfr|ib], default Similarity.Model in config")
+	flag.StringVar(&modelFile, "paraphrase_file", "", "paraphrase model file, default Storage.ModelFile in config")
+	var explain bool
+	flag.BoolVar(&explain, "explain", false, "print how each hit was scored")
+	var knn int
+	var vector, filter string
+	flag.IntVar(&knn, "knn", 0, "k nearest neighbours by vector, 0 for text search; number of hybrid results")
+	flag.StringVar(&vector, "vector", "", "query vector, e.g. 0.1,0.2,0.3; embed -q by paraphrase model if empty")
+	flag.StringVar(&filter, "filter", "", "boolean pre-filter of knn, e.g. \"+jordan -album\"")
+	var highlight bool
+	flag.BoolVar(&highlight, "highlight", false, "print highlighted title and text fragments of each hit, see Highlight in config")
+	var hybrid bool
+	flag.BoolVar(&hybrid, "hybrid", false, "fuse text search of -q and knn of -vector, see Hybrid in config")
 
 	//indexer
 	var sharding bool
@@ -124,36 +285,133 @@ func main() {
 	var servername string
 	flag.StringVar(&servername, "servername", "", "[all|managerserver|dataserver|searchserver]")
 
-	var host string
+	var host, dataDir string
 	var port int
 	flag.StringVar(&host, "host", "", "server host")
 	flag.IntVar(&port, "port", 0, "server port")
+	flag.StringVar(&dataDir, "data_dir", "", "data dir of this node, default Storage.DataDir in config")
+
+	//admin
+	var op, node, fromNode, toNode string
+	var shard, replicas int
+	flag.StringVar(&op, "op", "status", "[status|drain|move|promote|replicas]")
+	flag.StringVar(&node, "node", "", "node id")
+	flag.IntVar(&shard, "shard", 0, "shard id")
+	flag.StringVar(&fromNode, "from_node", "", "move shard from node id")
+	flag.StringVar(&toNode, "to_node", "", "move shard to node id")
+	flag.IntVar(&replicas, "replicas", 0, "replicate num")
+
+	//snapshot & restore
+	var dir string
+	flag.StringVar(&dir, "dir", "", "snapshot dir")
+
+	//inspect, -f 指定索引或run文件
+	var term string
+	var limit int
+	flag.StringVar(&term, "term", "", "print postings of term")
+	flag.IntVar(&limit, "limit", 20, "list first n terms with df")
+	var cpuProfile string
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "write cpu profile to file, e.g. cpu.pprof")
 	flag.Parse()
 
+	if cpuProfile != "" {
+		defer startProfile(cpuProfile)()
+	}
+
 	conf := config.InitConfig("./config.yml")
 	if module == "indexer" {
 		log.Println("Starting Index ...")
 		if sharding {
 			cluster.Index(conf)
 		} else {
-			search.Index(*conf) //todo: 构建索引耗时过长，性能分析下具体耗时原因
+			search.Index(*conf)
 		}
 	} else if module == "searcher" {
 		start := time.Now()
 		var matched []index.Doc
-		var err error
+		model, err := index.ParseSearchModel(searchModel)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var vec []float32
+		if vector != "" {
+			if vec, err = index.ParseVector(vector); err != nil {
+				log.Fatal(err)
+			}
+		}
+		fusion, err := search.NewFusion(conf.Hybrid)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hq := search.HybridQuery{Text: query, Model: model, Vector: vec, Filter: filter, K: knn, Fusion: fusion}
 		if source == "local" {
 			log.Println("Starting local search..")
-			searcher := search.NewSearcher(conf.Store.IndexFile)
+			pipeline, err := search.NewPipeline(conf.Ranking)
+			if err != nil {
+				log.Fatal(err)
+			}
 			if modelFile != "" {
-				searcher.InitParaphrase(modelFile)
+				conf.Store.ModelFile = modelFile
+			}
+			expander, err := serving.ExpanderFromConfig(conf) //Storage.ModelFile及SynonymFile
+			if err != nil {
+				log.Fatal(err)
 			}
+			searcher := search.NewSearcher(conf.Store.IndexFile).WithSimilarity(index.SimilarityFromConfig(conf)).WithPipeline(pipeline).WithParaphrase(expander).
+				WithResultCache(conf.Cache.Results).WithPostingCache(index.NewPostingCache(conf.Cache.PostingMB))
 			log.Printf("index loaded %d keys in %v", searcher.Count() , time.Since(start))
-			matched = searcher.Search(query)
+			if highlight {
+				store, err := search.LoadTextStore(conf.Store.DocumentSource())
+				if err != nil {
+					log.Fatal(err)
+				}
+				searcher.WithHighlighter(search.NewHighlighter(conf.Highlight, store))
+			}
+			if hybrid {
+				if matched, err = searcher.Hybrid(hq); err != nil {
+					log.Fatal(err)
+				}
+			} else if knn > 0 {
+				if vec == nil {
+					vec = searcher.Embed(query)
+				}
+				if matched, err = searcher.KNN(vec, knn, filter); err != nil {
+					log.Fatal(err)
+				}
+			} else if explain {
+				var explains []index.Explanation
+				matched, explains = searcher.ExplainWithModel(query, model)
+				printExplains(explains)
+			} else {
+				matched = searcher.SearchWithModel(query, model)
+			}
+			if highlight {
+				printHighlights(searcher.Highlight(query, matched))
+			}
 		} else if source == "remote" {
 			log.Println("Starting remote search..")
-			cli := cluster.NewSearchClient(&conf.Cluster.ManageServer)
-			matched, err = cli.Search(query)
+			cli := cluster.NewSearchClient(conf.Cluster.Managers()...)
+			if hybrid {
+				//数据节点不加载改写模型, 查询向量在本地编码
+				if hq.Vector == nil && modelFile != "" {
+					hq.Vector = serving.NewModel(modelFile).Embed(util.Analyze(query))
+				}
+				matched, err = cli.Hybrid(hq)
+			} else if explain {
+				var result *cluster.ExplainResult
+				if result, err = cli.ExplainWithModel(query, model); err == nil {
+					matched = result.Docs
+					printExplains(result.Explains)
+				}
+			} else if highlight {
+				var result *cluster.HighlightResult
+				if result, err = cli.SearchWithHighlight(query, model); err == nil {
+					matched = result.Docs
+					printHighlights(result.Highlights)
+				}
+			} else {
+				matched, err = cli.SearchWithModel(query, model)
+			}
 			if err != nil {
 				log.Fatal(err)
 				return
@@ -162,14 +420,64 @@ func main() {
 		log.Printf("Search found %d documents in %v", len(matched), time.Since(start))
 	} else if module == "merger" {
 		search.Merge(srcPath, dstPath)
+	} else if module == "snapshot" {
+		//快照保存在--host:--port指定的DataServer本地
+		var dirs []string
+		addr := config.Server{Host: host, Port: port}
+		if err := cluster.RpcCall(addr.Address(), "DataServer.Snapshot", cluster.SnapshotRequest{Dir: dir}, &dirs); err != nil {
+			log.Fatal(err)
+		}
+		for _, d := range dirs {
+			fmt.Println(d)
+		}
+	} else if module == "restore" {
+		file := conf.Store.IndexFile
+		if sharding {
+			file = fmt.Sprintf("%s.%d", file, shard)
+		}
+		if err := search.Restore(dir, file); err != nil {
+			log.Fatal(err)
+		}
+	} else if module == "pagerank" {
+		//-t 指定输出文件, 默认为Storage.PriorFile
+		file := conf.Store.PriorFile
+		if dstPath != "" {
+			file = dstPath
+		}
+		if err := score.BuildPageRank(*conf, file); err != nil {
+			log.Fatal(err)
+		}
+	} else if module == "train-paraphrase" {
+		//-t 指定输出文件, 默认为Storage.ModelFile
+		file := conf.Store.ModelFile
+		if dstPath != "" {
+			file = dstPath
+		}
+		if file == "" {
+			log.Fatal("missing output file, set -t or Storage.ModelFile")
+		}
+		if err := train.TrainFile(*conf, file); err != nil {
+			log.Fatal(err)
+		}
+	} else if module == "inspect" {
+		if err := runInspect(srcPath, term, limit); err != nil {
+			log.Fatal(err)
+		}
+	} else if module == "admin" {
+		if err := runAdmin(conf, op, node, shard, fromNode, toNode, replicas); err != nil {
+			log.Fatal(err)
+		}
 	} else if module == "cluster" {
 		if host != "" && port != 0 {
 			conf.Server.Host = host
 			conf.Server.Port = port
 		}
+		if dataDir != "" {
+			conf.Store.DataDir = dataDir
+		}
 		if servername == "all" {
 			log.Println("Starting Standalone Cluster..")
-			if err := startStandaloneCluster(); err != nil {
+			if err := startStandaloneCluster(conf.Store.DataDir); err != nil {
 				panic(err)
 			}
 		} else if servername == "managerserver" {
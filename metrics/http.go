@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// ContentType Prometheus文本格式
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler 输出r中的所有指标
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		if err := r.Write(w); err != nil {
+			log.Printf("write metrics err: %s", err.Error())
+		}
+	})
+}
+
+// Serve 在addr上启动HTTP服务, path输出Default中的指标. withPprof为true时同时提供/debug/pprof/
+func Serve(addr string, path string, withPprof bool) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.Handle(path, Default.Handler())
+	if withPprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Addr: l.Addr().String(), Handler: mux}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics server err: %s", err.Error())
+		}
+	}()
+	log.Printf("metrics served at http://%s%s", l.Addr().String(), path)
+	return srv, nil
+}
@@ -0,0 +1,369 @@
+// Package metrics 进程内指标, 以Prometheus文本格式输出
+// 格式见 https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets 耗时直方图的默认桶(秒)
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default 默认的指标集合, 各模块的指标都注册在这里
+var Default = NewRegistry()
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: %d label values for labels %v", d.name, len(values), d.labels))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// sample 输出一个样本, extra为额外的标签名及值(如直方图的le)
+func (d *desc) sample(w *bufio.Writer, suffix string, values []string, value float64, extra ...string) {
+	w.WriteString(d.name + suffix)
+	if len(d.labels)+len(extra) > 0 {
+		pairs := make([]string, 0, len(d.labels)+len(extra)/2)
+		for i, name := range d.labels {
+			pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+		}
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type metric interface {
+	describe() *desc
+	write(w *bufio.Writer)
+}
+
+// Registry 指标集合, 并发安全. 同名指标只注册一次
+type Registry struct {
+	lock    sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// register 已注册同名同类型的指标时返回已注册的指标, 类型不同时panic
+func (r *Registry) register(m metric) metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	d := m.describe()
+	if old, ok := r.metrics[d.name]; ok {
+		if old.describe().typ != d.typ {
+			panic(fmt.Sprintf("metric %s registered as %s", d.name, old.describe().typ))
+		}
+		if f, ok := old.(*funcMetric); ok {
+			f.set(m.(*funcMetric).fn) //回调以最后一次注册的为准
+		}
+		return old
+	}
+	r.metrics[d.name] = m
+	return m
+}
+
+// Counter 注册单调递增的计数器, labels为标签名
+func (r *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	return r.register(&CounterVec{series: newSeries(name, help, typeCounter, labels)}).(*CounterVec)
+}
+
+// Gauge 注册可增减的指标
+func (r *Registry) Gauge(name string, help string, labels ...string) *GaugeVec {
+	return r.register(&GaugeVec{series: newSeries(name, help, typeGauge, labels)}).(*GaugeVec)
+}
+
+// Histogram 注册直方图, buckets为升序的桶上界, 为nil时使用DefBuckets
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: typeHistogram, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	return r.register(h).(*HistogramVec)
+}
+
+// Collect 抓取时调用, 对每组标签值调用emit输出当前值
+type Collect func(emit func(value float64, labelValues ...string))
+
+// GaugeFunc 注册抓取时计算的指标, 如队列长度、索引大小. 同名指标重复注册时替换回调
+func (r *Registry) GaugeFunc(name string, help string, labels []string, fn Collect) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, typ: typeGauge, labels: labels}, fn: fn})
+}
+
+// CounterFunc 同GaugeFunc, 值为单调递增的计数, 如缓存命中数
+func (r *Registry) CounterFunc(name string, help string, labels []string, fn Collect) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, typ: typeCounter, labels: labels}, fn: fn})
+}
+
+// Write 按指标名顺序输出所有指标
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// series 每组标签值一个值的指标
+type series struct {
+	desc
+	lock   sync.Mutex
+	values map[string]*seriesValue
+}
+
+type seriesValue struct {
+	labels []string
+	value  float64
+}
+
+func newSeries(name string, help string, typ string, labels []string) series {
+	return series{desc: desc{name: name, help: help, typ: typ, labels: labels}, values: make(map[string]*seriesValue)}
+}
+
+func (s *series) describe() *desc {
+	return &s.desc
+}
+
+func (s *series) update(values []string, fn func(v float64) float64) {
+	key := s.key(values)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		v = &seriesValue{labels: append([]string(nil), values...)}
+		s.values[key] = v
+	}
+	v.value = fn(v.value)
+}
+
+// Value 标签值对应的当前值, 未记录时为0
+func (s *series) Value(labelValues ...string) float64 {
+	key := s.key(labelValues)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if v, ok := s.values[key]; ok {
+		return v.value
+	}
+	return 0
+}
+
+func (s *series) write(w *bufio.Writer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.values) == 0 {
+		return
+	}
+	s.header(w)
+	for _, key := range sortedKeys(s.values) {
+		v := s.values[key]
+		s.sample(w, "", v.labels, v.value)
+	}
+}
+
+func sortedKeys(m map[string]*seriesValue) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type CounterVec struct {
+	series
+}
+
+// Add v不能小于0
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.name))
+	}
+	c.update(labelValues, func(old float64) float64 { return old + v })
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+type GaugeVec struct {
+	series
+}
+
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.update(labelValues, func(float64) float64 { return v })
+}
+
+func (g *GaugeVec) Add(v float64, labelValues ...string) {
+	g.update(labelValues, func(old float64) float64 { return old + v })
+}
+
+type HistogramVec struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 //每个桶(不累计)的样本数, 最后一个为+Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *HistogramVec) describe() *desc {
+	return &h.desc
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hv
+	}
+	hv.counts[sort.SearchFloat64s(h.buckets, v)]++
+	hv.sum += v
+	hv.count++
+}
+
+// Since 记录从start到现在的秒数
+func (h *HistogramVec) Since(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Count 标签值对应的样本数
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if hv, ok := h.values[key]; ok {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.values) == 0 {
+		return
+	}
+	h.header(w)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		var cum uint64
+		for i, upper := range h.buckets {
+			cum += hv.counts[i]
+			h.sample(w, "_bucket", hv.labels, float64(cum), "le", formatFloat(upper))
+		}
+		h.sample(w, "_bucket", hv.labels, float64(hv.count), "le", "+Inf")
+		h.sample(w, "_sum", hv.labels, hv.sum)
+		h.sample(w, "_count", hv.labels, float64(hv.count))
+	}
+}
+
+// funcMetric 抓取时调用回调计算的指标
+type funcMetric struct {
+	desc
+	lock sync.Mutex
+	fn   Collect
+}
+
+func (f *funcMetric) describe() *desc {
+	return &f.desc
+}
+
+func (f *funcMetric) set(fn Collect) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.fn = fn
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	f.lock.Lock()
+	fn := f.fn
+	f.lock.Unlock()
+
+	values := make(map[string]*seriesValue)
+	fn(func(value float64, labelValues ...string) {
+		values[f.key(labelValues)] = &seriesValue{labels: append([]string(nil), labelValues...), value: value}
+	})
+	if len(values) == 0 {
+		return
+	}
+	f.header(w)
+	for _, key := range sortedKeys(values) {
+		f.sample(w, "", values[key].labels, values[key].value)
+	}
+}
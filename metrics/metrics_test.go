@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Requests.", "method", "status")
+	c.Inc("Search", "ok")
+	c.Add(2, "Search", "ok")
+	c.Inc("Add", "error")
+	assert.Equal(t, 3.0, c.Value("Search", "ok"))
+	assert.Same(t, c, r.Counter("requests_total", "Requests.", "method", "status"))
+	assert.Panics(t, func() { c.Add(-1, "Search", "ok") })
+	assert.Panics(t, func() { c.Inc("Search") })
+	assert.Panics(t, func() { r.Gauge("requests_total", "") })
+
+	g := r.Gauge("queue", "Queue \\ depth\nnow.")
+	g.Set(5)
+	g.Add(-2)
+
+	h := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "shard")
+	h.Observe(0.05, `a"b`)
+	h.Observe(0.1, `a"b`)
+	h.Observe(3, `a"b`)
+	assert.Equal(t, uint64(3), h.Count(`a"b`))
+
+	r.GaugeFunc("segments", "Segments.", []string{"tier"}, func(emit func(float64, ...string)) {
+		emit(1, "full")
+		emit(math.Inf(1), "aux")
+	})
+	r.CounterFunc("hits_total", "Hits.", nil, func(emit func(float64, ...string)) {})
+	r.Counter("unused_total", "Unused.")
+
+	var buf bytes.Buffer
+	assert.Nil(t, r.Write(&buf))
+	assert.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{shard="a\"b",le="0.1"} 2
+latency_seconds_bucket{shard="a\"b",le="1"} 2
+latency_seconds_bucket{shard="a\"b",le="+Inf"} 3
+latency_seconds_sum{shard="a\"b"} 3.15
+latency_seconds_count{shard="a\"b"} 3
+# HELP queue Queue \\ depth\nnow.
+# TYPE queue gauge
+queue 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{method="Add",status="error"} 1
+requests_total{method="Search",status="ok"} 3
+# HELP segments Segments.
+# TYPE segments gauge
+segments{tier="aux"} +Inf
+segments{tier="full"} 1
+`, buf.String())
+
+	//重复注册时替换回调
+	r.GaugeFunc("segments", "Segments.", []string{"tier"}, func(emit func(float64, ...string)) {
+		emit(2, "full")
+	})
+	buf.Reset()
+	r.Write(&buf)
+	assert.Contains(t, buf.String(), "segments{tier=\"full\"} 2\n")
+	assert.NotContains(t, buf.String(), "aux")
+}
+
+func TestServe(t *testing.T) {
+	Default.Counter("easysearch_test_total", "Test.").Inc()
+	srv, err := Serve("127.0.0.1:0", "/metrics", true)
+	assert.Nil(t, err)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + srv.Addr + "/metrics")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "easysearch_test_total 1\n")
+
+	resp, err = http.Get("http://" + srv.Addr + "/debug/pprof/")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
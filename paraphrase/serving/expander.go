@@ -0,0 +1,104 @@
+package serving
+
+import (
+	"sort"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/util"
+)
+
+// Expander 查询扩展: 每个查询词分别取词向量中相似度不低于阈值的近义词及同义词表中的同义词,
+// 扩展词的权重为与原词的相似度(同义词为SynonymWeight), 总数不超过MaxTerms
+type Expander struct {
+	conf     config.Paraphrase
+	model    *ParaphraseModel //为nil时只使用同义词表
+	synonyms Synonyms
+}
+
+// NewExpander model及synonyms都可以为nil
+func NewExpander(conf config.Paraphrase, model *ParaphraseModel, synonyms Synonyms) *Expander {
+	return &Expander{conf: conf.WithDefault(), model: model, synonyms: synonyms}
+}
+
+// ExpanderFromConfig 按Storage.ModelFile及Storage.SynonymFile创建, 都未配置时返回nil
+func ExpanderFromConfig(c *config.Config) (*Expander, error) {
+	var (
+		model    *ParaphraseModel
+		synonyms Synonyms
+		err      error
+	)
+	if c.Store.ModelFile != "" {
+		model = NewModel(c.Store.ModelFile)
+	}
+	if c.Store.SynonymFile != "" {
+		if synonyms, err = LoadSynonyms(c.Store.SynonymFile); err != nil {
+			return nil, err
+		}
+	}
+	if model == nil && synonyms == nil {
+		return nil, nil
+	}
+	return NewExpander(c.Paraphrase, model, synonyms), nil
+}
+
+func (e *Expander) Model() *ParaphraseModel {
+	return e.model
+}
+
+// Expand 扩展查询, 返回扩展词(util.Analyze后的形式, 不含查询词)及其权重
+func (e *Expander) Expand(query string) map[string]float64 {
+	words := util.Words(query)
+	origin := make(map[string]bool)
+	for _, term := range util.Analyze(query) {
+		origin[term] = true
+	}
+
+	result := make(map[string]float64)
+	add := func(term string, weight float64) {
+		if !origin[term] && weight > result[term] {
+			result[term] = weight
+		}
+	}
+	for _, word := range words {
+		stem := util.Analyze(word)
+		if len(stem) == 0 {
+			continue
+		}
+		for _, syn := range e.synonyms[stem[0]] {
+			add(syn, float64(e.conf.SynonymWeight))
+		}
+		if e.model == nil {
+			continue
+		}
+		//模型可能由原词或词干训练, 原词不在词表中时使用词干, 都不在时跳过
+		key := word
+		if !e.model.Contains(key) {
+			key = stem[0]
+		}
+		for _, match := range e.model.Similar(key, e.conf.TopN) {
+			if float64(match.Score) < float64(e.conf.Threshold) {
+				break
+			}
+			for _, term := range util.Analyze(match.Word) {
+				add(term, float64(match.Score))
+			}
+		}
+	}
+
+	if len(result) > e.conf.MaxTerms {
+		terms := make([]string, 0, len(result))
+		for term := range result {
+			terms = append(terms, term)
+		}
+		sort.Slice(terms, func(i, j int) bool {
+			if result[terms[i]] != result[terms[j]] {
+				return result[terms[i]] > result[terms[j]]
+			}
+			return terms[i] < terms[j]
+		})
+		for _, term := range terms[e.conf.MaxTerms:] {
+			delete(result, term)
+		}
+	}
+	return result
+}
@@ -0,0 +1,98 @@
+package serving
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeModel 写入word2vec二进制格式的模型
+func writeModel(t *testing.T, file string, words map[string][]float32) {
+	var keys []string
+	for w := range words {
+		keys = append(keys, w)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d %d\n", len(keys), len(words[keys[0]]))
+	for _, w := range keys {
+		buf.WriteString(w + " ")
+		binary.Write(&buf, binary.LittleEndian, words[w])
+		buf.WriteByte('\n')
+	}
+	assert.Nil(t, ioutil.WriteFile(file, buf.Bytes(), 0644))
+}
+
+func TestExpander(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paraphrase")
+	defer os.RemoveAll(dir)
+
+	modelFile := filepath.Join(dir, "model.bin")
+	writeModel(t, modelFile, map[string][]float32{
+		"car":        {1, 0, 0},
+		"automobile": {0.95, 0.31, 0},
+		"vehicle":    {0.8, 0.6, 0},
+		"banana":     {0, 0, 1},
+		"run":        {0, 1, 0}, //词干训练的模型
+		"sprint":     {0.1, 0.99, 0},
+	})
+	model := NewModel(modelFile)
+
+	similar := model.Similar("car", 2)
+	assert.Equal(t, 2, len(similar))
+	assert.Equal(t, "automobile", similar[0].Word)
+	assert.Equal(t, "vehicle", similar[1].Word)
+	assert.Equal(t, 5, len(model.Similar("car", 10))) //词表小于n
+	assert.Nil(t, model.Similar("unknown", 2))
+	assert.Nil(t, model.GetSimilar([]string{"unknown"}, nil, 2)) //不在模型中的词不再退出
+
+	synFile := filepath.Join(dir, "synonyms.txt")
+	assert.Nil(t, ioutil.WriteFile(synFile, []byte(`# 注释
+couch, sofa
+tv => television, big screen
+`), 0644))
+	syn, err := LoadSynonyms(synFile)
+	assert.Nil(t, err)
+	assert.Equal(t, Synonyms{"couch": {"sofa"}, "sofa": {"couch"}, "tv": {"televis", "big", "screen"}}, syn)
+
+	//每个词分别扩展, 相似度低于阈值的词不扩展, 权重为相似度
+	e := NewExpander(config.Paraphrase{TopN: 2, Threshold: 0.9}, model, syn)
+	ext := e.Expand("cars and bananas")
+	assert.Equal(t, 1, len(ext))
+	assert.InDelta(t, 0.95, ext["automobil"], 0.01)
+
+	e = NewExpander(config.Paraphrase{}, model, syn)
+	ext = e.Expand("car running on sofa, unknownword")
+	assert.Equal(t, []string{"automobil", "couch", "sprint", "vehicl"}, keys(ext))
+	assert.InDelta(t, 0.8, ext["vehicl"], 0.01)
+	assert.InDelta(t, 0.9, ext["couch"], 1e-6)
+
+	e = NewExpander(config.Paraphrase{MaxTerms: 2}, model, syn)
+	assert.Equal(t, []string{"automobil", "sprint"}, keys(e.Expand("car running on sofa")))
+	assert.Equal(t, 0, len(NewExpander(config.Paraphrase{}, nil, nil).Expand("car")))
+
+	assert.Nil(t, ioutil.WriteFile(synFile, []byte("a => b => c\n"), 0644))
+	_, err = LoadSynonyms(synFile)
+	assert.NotNil(t, err)
+	e, err = ExpanderFromConfig(&config.Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, e)
+}
+
+func keys(m map[string]float64) []string {
+	var result []string
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -54,7 +54,8 @@ func (m *ParaphraseModel) GetSimilar(positive []string, negative []string, n int
 	// Hit the most similar result by cosine similarity.
 	matches, err := m.mode.CosN(expr, n)
 	if err != nil {
-		log.Fatalf("error evaluating cosine similarity: %v", err)
+		log.Printf("error evaluating cosine similarity: %v", err) //词不在模型中
+		return nil
 	}
 
 	var result []string
@@ -63,3 +64,38 @@ func (m *ParaphraseModel) GetSimilar(positive []string, negative []string, n int
 	}
 	return result
 }
+
+//Similar 与word最相似的n个词(不含word本身)及cosine相似度, 按相似度降序, word不在模型中时返回nil
+func (m *ParaphraseModel) Similar(word string, n int) []word2vec.Match {
+	matches, err := m.mode.CosN(word2vec.Expr{word: 1}, n+1)
+	if err != nil {
+		return nil
+	}
+	result := make([]word2vec.Match, 0, n)
+	for _, match := range matches {
+		if match.Word != "" && match.Word != word && len(result) < n { //词表小于n时有空的结果
+			result = append(result, match)
+		}
+	}
+	return result
+}
+
+// Contains word是否在模型的词表中
+func (m *ParaphraseModel) Contains(word string) bool {
+	return len(m.mode.Map([]string{word})) > 0
+}
+
+//Embed 文本的向量表示, 为词向量的平均值, 没有词在模型中时返回nil
+func (m *ParaphraseModel) Embed(words []string) []float32 {
+	var result []float32
+	vectors := m.mode.Map(words)
+	for _, v := range vectors {
+		if result == nil {
+			result = make([]float32, len(v))
+		}
+		for i := range v {
+			result[i] += v[i] / float32(len(vectors))
+		}
+	}
+	return result
+}
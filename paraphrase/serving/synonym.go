@@ -0,0 +1,83 @@
+package serving
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/awesomefly/easysearch/util"
+)
+
+// Synonyms 同义词表, 词均为util.Analyze后的形式, 与索引中的词一致
+type Synonyms map[string][]string
+
+// LoadSynonyms 读取同义词表, 格式同Solr:
+//   couch, sofa, divan    等价同义词, 互相扩展
+//   tv, telly => television    单向扩展, 左边的词扩展为右边的词
+//   # 注释
+// 分词后为多个词的短语只作为扩展词
+func LoadSynonyms(file string) (Synonyms, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	syn := make(Synonyms)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.Split(text, "=>")
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("%s:%d: more than one =>", file, line)
+		}
+		from := analyzeList(parts[0])
+		to := from
+		if len(parts) == 2 {
+			to = analyzeList(parts[1])
+		}
+		if len(from) == 0 || len(to) == 0 {
+			return nil, fmt.Errorf("%s:%d: empty synonyms", file, line)
+		}
+		for _, words := range from {
+			if len(words) != 1 {
+				continue
+			}
+			for _, target := range to {
+				for _, t := range target {
+					syn.add(words[0], t)
+				}
+			}
+		}
+	}
+	return syn, scanner.Err()
+}
+
+// analyzeList 逗号分隔的词或短语分别分词
+func analyzeList(s string) [][]string {
+	var result [][]string
+	for _, item := range strings.Split(s, ",") {
+		if words := util.Analyze(item); len(words) > 0 {
+			result = append(result, words)
+		}
+	}
+	return result
+}
+
+func (s Synonyms) add(word string, synonym string) {
+	if word == synonym {
+		return
+	}
+	for _, w := range s[word] {
+		if w == synonym {
+			return
+		}
+	}
+	s[word] = append(s[word], synonym)
+}
@@ -0,0 +1,411 @@
+package train
+
+// skip-gram + 负采样训练词向量, 参考word2vec的C实现 https://github.com/tmikolov/word2vec
+// 输出word2vec二进制格式, 可由code.sajari.com/word2vec加载(见paraphrase/serving)
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/util"
+)
+
+// Corpus 可多次遍历的语料, 每次遍历对每个句子(分词后的词序列)调用fn
+type Corpus func(fn func(words []string)) error
+
+// SourceCorpus 文档来源中每个文档的标题及正文经util.Analyze分词后作为句子, 与索引中的词一致
+func SourceCorpus(c config.Source) Corpus {
+	return func(fn func(words []string)) error {
+		src, err := index.OpenSource(c)
+		if err != nil {
+			return err
+		}
+		report := &index.ErrorReport{}
+		ch := index.StreamDocuments(src, report)
+		for doc := <-ch; doc != nil; doc = <-ch {
+			if words := util.Analyze(doc.Title); len(words) > 0 {
+				fn(words)
+			}
+			if words := util.Analyze(doc.Text); len(words) > 0 {
+				fn(words)
+			}
+		}
+		return report.Fatal
+	}
+}
+
+// SliceCorpus 内存中的语料
+func SliceCorpus(sentences [][]string) Corpus {
+	return func(fn func(words []string)) error {
+		for _, words := range sentences {
+			fn(words)
+		}
+		return nil
+	}
+}
+
+// Model 训练得到的词向量, Words按词频降序
+type Model struct {
+	Dim     int
+	Words   []string
+	Vectors []float32 //len(Words)*Dim
+}
+
+func (m *Model) Vector(i int) []float32 {
+	return m.Vectors[i*m.Dim : (i+1)*m.Dim]
+}
+
+type vocabWord struct {
+	word  string
+	count int64
+}
+
+const (
+	unigramPower   = 0.75
+	maxTableSize   = 10000000
+	minAlphaFactor = 0.0001
+	maxExp         = 6
+	sentenceLen    = 1000 //超过的句子拆分训练
+	roundWords     = 2000 //多个worker时每个worker每轮训练的词数, 每轮结束后合并增量
+)
+
+type trainer struct {
+	conf  config.Word2Vec
+	vocab []vocabWord
+	ids   map[string]int32
+	total int64 //语料中词表内的词数
+
+	syn0  []float32 //词向量
+	syn1  []float32 //负采样的输出向量
+	table []int32   //负采样按词频^0.75的分布
+
+	processed int64 //已训练的词数, 用于学习率衰减
+}
+
+// Train 遍历语料建立词表, 再按Epochs遍历语料训练skip-gram词向量. 多个worker并发训练, 每轮结束后将各worker的增量累加到共享向量
+func Train(corpus Corpus, c config.Word2Vec) (*Model, error) {
+	start := time.Now()
+	t := &trainer{conf: c.WithDefault()}
+	if err := t.buildVocab(corpus); err != nil {
+		return nil, err
+	}
+	if len(t.vocab) == 0 {
+		return nil, fmt.Errorf("empty vocabulary, min count %d", t.conf.MinCount)
+	}
+	log.Printf("vocabulary %d words, corpus %d words", len(t.vocab), t.total)
+	t.init()
+
+	for epoch := 0; epoch < t.conf.Epochs; epoch++ {
+		if err := t.epoch(corpus, epoch); err != nil {
+			return nil, err
+		}
+		n := atomic.LoadInt64(&t.processed)
+		log.Printf("epoch %d/%d, %d words, %.0f words/s", epoch+1, t.conf.Epochs, n, float64(n)/time.Since(start).Seconds())
+	}
+
+	m := &Model{Dim: t.conf.Dim, Words: make([]string, len(t.vocab)), Vectors: t.syn0}
+	for i, w := range t.vocab {
+		m.Words[i] = w.word
+	}
+	log.Printf("Trained %d word vectors in %v", len(m.Words), time.Since(start))
+	return m, nil
+}
+
+func (t *trainer) buildVocab(corpus Corpus) error {
+	counts := make(map[string]int64)
+	err := corpus(func(words []string) {
+		for _, w := range words {
+			counts[w]++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for w, n := range counts {
+		if n >= int64(t.conf.MinCount) {
+			t.vocab = append(t.vocab, vocabWord{word: w, count: n})
+			t.total += n
+		}
+	}
+	sort.Slice(t.vocab, func(i, j int) bool {
+		if t.vocab[i].count != t.vocab[j].count {
+			return t.vocab[i].count > t.vocab[j].count
+		}
+		return t.vocab[i].word < t.vocab[j].word
+	})
+	t.ids = make(map[string]int32, len(t.vocab))
+	for i, w := range t.vocab {
+		t.ids[w.word] = int32(i)
+	}
+	return nil
+}
+
+func (t *trainer) init() {
+	dim := t.conf.Dim
+	rng := rand.New(rand.NewSource(t.conf.Seed))
+	t.syn0 = make([]float32, len(t.vocab)*dim)
+	for i := range t.syn0 {
+		t.syn0[i] = (rng.Float32() - 0.5) / float32(dim)
+	}
+	t.syn1 = make([]float32, len(t.vocab)*dim)
+
+	var norm float64
+	for _, w := range t.vocab {
+		norm += math.Pow(float64(w.count), unigramPower)
+	}
+	size := len(t.vocab) * 100
+	if size > maxTableSize {
+		size = maxTableSize
+	}
+	t.table = make([]int32, size)
+	i, cum := 0, math.Pow(float64(t.vocab[0].count), unigramPower)/norm
+	for a := range t.table {
+		t.table[a] = int32(i)
+		if float64(a)/float64(size) > cum && i < len(t.vocab)-1 {
+			i++
+			cum += math.Pow(float64(t.vocab[i].count), unigramPower) / norm
+		}
+	}
+}
+
+// worker 训练使用的临时变量. 多个worker时每轮训练中不修改共享向量, 只拷贝并更新用到的行, 每轮结束后合并增量
+type worker struct {
+	rng   *rand.Rand
+	neu1e []float32
+	rows0 map[int32][]float32 //更新过的syn0行的副本, 为nil时直接更新共享向量
+	rows1 map[int32][]float32
+}
+
+// newWorkers 单个worker直接更新共享向量, 多个worker各自记录更新过的行
+func (t *trainer) newWorkers(epoch int) []*worker {
+	workers := make([]*worker, t.conf.Workers)
+	for i := range workers {
+		w := &worker{
+			rng:   rand.New(rand.NewSource(t.conf.Seed + int64(epoch*t.conf.Workers+i+1))),
+			neu1e: make([]float32, t.conf.Dim),
+		}
+		if len(workers) > 1 {
+			w.rows0 = make(map[int32][]float32)
+			w.rows1 = make(map[int32][]float32)
+		}
+		workers[i] = w
+	}
+	return workers
+}
+
+// row 共享向量shared的第id行, rows不为nil时返回该行的副本, 第一次访问时从共享向量拷贝
+func (t *trainer) row(shared []float32, rows map[int32][]float32, id int32) []float32 {
+	dim := t.conf.Dim
+	vec := shared[int(id)*dim : int(id+1)*dim]
+	if rows == nil {
+		return vec
+	}
+	local, ok := rows[id]
+	if !ok {
+		local = append([]float32(nil), vec...)
+		rows[id] = local
+	}
+	return local
+}
+
+// epoch 语料按轮分发给多个worker并发训练, 每轮结束后合并各worker的向量
+func (t *trainer) epoch(corpus Corpus, epoch int) error {
+	workers := t.newWorkers(epoch)
+	batch := make([][]int32, 0)
+	words := 0
+	round := func() {
+		var wg sync.WaitGroup
+		for i, w := range workers {
+			wg.Add(1)
+			go func(i int, w *worker) {
+				defer wg.Done()
+				for j := i; j < len(batch); j += len(workers) {
+					t.trainSentence(w, batch[j])
+				}
+			}(i, w)
+		}
+		wg.Wait()
+		t.merge(workers)
+		batch, words = batch[:0], 0
+	}
+
+	err := corpus(func(ws []string) {
+		sentence := make([]int32, 0, len(ws))
+		for _, w := range ws {
+			if id, ok := t.ids[w]; ok {
+				sentence = append(sentence, id)
+			}
+		}
+		for len(sentence) > 0 {
+			n := len(sentence)
+			if n > sentenceLen {
+				n = sentenceLen
+			}
+			batch = append(batch, sentence[:n])
+			sentence = sentence[n:]
+			if words += n; words >= roundWords*len(workers) {
+				round()
+			}
+		}
+	})
+	if len(batch) > 0 {
+		round()
+	}
+	return err
+}
+
+// merge 各worker的增量累加到共享向量: shared + Σ(local − shared), 与单个worker顺序训练的更新量一致. 单个worker时无需合并
+func (t *trainer) merge(workers []*worker) {
+	if len(workers) <= 1 {
+		return
+	}
+	rows0 := make([]map[int32][]float32, len(workers))
+	rows1 := make([]map[int32][]float32, len(workers))
+	for i, w := range workers {
+		rows0[i], rows1[i] = w.rows0, w.rows1
+	}
+	t.mergeRows(t.syn0, rows0)
+	t.mergeRows(t.syn1, rows1)
+}
+
+// mergeRows 副本先减去共享向量得到增量, 全部计算完成后再累加, 合并后清空副本
+func (t *trainer) mergeRows(shared []float32, rows []map[int32][]float32) {
+	dim := t.conf.Dim
+	for _, local := range rows {
+		for id, vec := range local {
+			base := shared[int(id)*dim : int(id+1)*dim]
+			for i := range vec {
+				vec[i] -= base[i]
+			}
+		}
+	}
+	for _, local := range rows {
+		for id, delta := range local {
+			base := shared[int(id)*dim : int(id+1)*dim]
+			for i := range base {
+				base[i] += delta[i]
+			}
+			delete(local, id)
+		}
+	}
+}
+
+// trainSentence 下采样高频词后, 用每个词预测随机缩小的窗口内的上下文词
+func (t *trainer) trainSentence(w *worker, sentence []int32) {
+	n := atomic.AddInt64(&t.processed, int64(len(sentence)))
+	alpha := t.conf.Alpha * float32(1-float64(n)/float64(int64(t.conf.Epochs)*t.total+1))
+	if alpha < t.conf.Alpha*minAlphaFactor {
+		alpha = t.conf.Alpha * minAlphaFactor
+	}
+
+	if t.conf.Sample > 0 {
+		kept := make([]int32, 0, len(sentence))
+		threshold := float64(t.conf.Sample) * float64(t.total)
+		for _, id := range sentence {
+			count := float64(t.vocab[id].count)
+			if p := (math.Sqrt(count/threshold) + 1) * threshold / count; p >= w.rng.Float64() {
+				kept = append(kept, id)
+			}
+		}
+		sentence = kept
+	}
+
+	window := t.conf.Window
+	for pos, word := range sentence {
+		b := w.rng.Intn(window)
+		for c := pos - window + b; c <= pos+window-b; c++ {
+			if c < 0 || c >= len(sentence) || c == pos {
+				continue
+			}
+			t.trainPair(w, sentence[c], word, alpha)
+		}
+	}
+}
+
+// trainPair 上下文词context的向量预测中心词word(正样本)及Negative个负样本
+func (t *trainer) trainPair(w *worker, context int32, word int32, alpha float32) {
+	l1 := t.row(t.syn0, w.rows0, context)
+	neu1e := w.neu1e
+	for i := range neu1e {
+		neu1e[i] = 0
+	}
+	for d := 0; d <= t.conf.Negative; d++ {
+		target, label := word, float32(1)
+		if d > 0 {
+			target = t.table[w.rng.Intn(len(t.table))]
+			if target == word {
+				continue
+			}
+			label = 0
+		}
+		l2 := t.row(t.syn1, w.rows1, target)
+		var f float32
+		for i := range l1 {
+			f += l1[i] * l2[i]
+		}
+		var g float32
+		switch {
+		case f > maxExp:
+			g = (label - 1) * alpha
+		case f < -maxExp:
+			g = label * alpha
+		default:
+			g = (label - float32(1/(1+math.Exp(-float64(f))))) * alpha
+		}
+		for i := range l1 {
+			neu1e[i] += g * l2[i]
+			l2[i] += g * l1[i]
+		}
+	}
+	for i := range l1 {
+		l1[i] += neu1e[i]
+	}
+}
+
+// Save 按word2vec二进制格式写入file: 首行"词数 维度", 之后每个词为"词 "+维度个little endian float32+换行
+func (m *Model) Save(file string) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%d %d\n", len(m.Words), m.Dim)
+	for i, word := range m.Words {
+		w.WriteString(word)
+		w.WriteByte(' ')
+		binary.Write(w, binary.LittleEndian, m.Vector(i))
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// TrainFile 从配置的文档来源训练词向量并写入file
+func TrainFile(c config.Config, file string) error {
+	m, err := Train(SourceCorpus(c.Store.DocumentSource()), c.Word2Vec)
+	if err != nil {
+		return err
+	}
+	return m.Save(file)
+}
@@ -0,0 +1,86 @@
+package train
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/paraphrase/serving"
+	"github.com/stretchr/testify/assert"
+)
+
+// topicSentences 两个主题的句子, 同一主题的词出现在相同的上下文中
+func topicSentences(n int) []string {
+	topics := [][]string{
+		{"car", "truck", "vehicle", "engine", "wheel", "driver"},
+		{"apple", "banana", "fruit", "orange", "juice", "sweet"},
+	}
+	rng := rand.New(rand.NewSource(3))
+	var sentences []string
+	for i := 0; i < n; i++ {
+		topic := topics[i%2]
+		words := make([]string, 8)
+		for j := range words {
+			words[j] = topic[rng.Intn(len(topic))]
+		}
+		sentences = append(sentences, strings.Join(words, " "))
+	}
+	return sentences
+}
+
+func TestTrain(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "train")
+	defer os.RemoveAll(dir)
+
+	var lines []string
+	for i, s := range topicSentences(2000) {
+		lines = append(lines, fmt.Sprintf(`{"id": %d, "text": "%s"}`, i+1, s))
+	}
+	lines = append(lines, `{"id": 9999, "text": "rare"}`)
+	source := filepath.Join(dir, "docs.jsonl")
+	assert.Nil(t, ioutil.WriteFile(source, []byte(strings.Join(lines, "\n")), 0644))
+
+	conf := config.Config{
+		Store:    config.Storage{Source: config.Source{Type: index.JSONSource, Path: source}},
+		Word2Vec: config.Word2Vec{Dim: 16, Window: 3, MinCount: 2, Epochs: 3, Sample: -1, Workers: 2},
+	}
+	file := filepath.Join(dir, "word2vec.bin")
+	assert.Nil(t, TrainFile(conf, file))
+
+	//输出可以由serving加载, 词为分词及词干提取后的形式, 低频词不在词表中
+	model := serving.NewModel(file)
+	assert.True(t, model.Contains("vehicl"))
+	assert.False(t, model.Contains("rare"))
+	for _, word := range []string{"car", "appl"} {
+		similar := model.Similar(word, 3)
+		assert.Equal(t, 3, len(similar))
+		for _, match := range similar {
+			assert.Equal(t, word == "car", strings.Contains("truck vehicl engin wheel driver", match.Word), match.Word)
+		}
+	}
+
+	_, err := Train(SliceCorpus([][]string{{"a", "b"}}), config.Word2Vec{MinCount: 2})
+	assert.NotNil(t, err)
+}
+
+func TestMergeDeltas(t *testing.T) {
+	tr := &trainer{conf: config.Word2Vec{Dim: 2, Workers: 2}}
+	tr.syn0 = []float32{1, 1, 2, 2}
+	tr.syn1 = make([]float32, 4)
+	workers := tr.newWorkers(0)
+
+	//两个worker更新同一行, 合并后为两者增量之和; 只有一个worker更新的行取该worker的结果
+	tr.row(tr.syn0, workers[0].rows0, 0)[0] += 0.5
+	tr.row(tr.syn0, workers[1].rows0, 0)[0] += 0.25
+	tr.row(tr.syn0, workers[1].rows0, 1)[1] -= 1
+	assert.Equal(t, []float32{1, 1, 2, 2}, tr.syn0) //训练中不修改共享向量
+	tr.merge(workers)
+	assert.Equal(t, []float32{1.75, 1, 2, 1}, tr.syn0)
+	assert.Equal(t, 0, len(workers[0].rows0)+len(workers[1].rows0))
+}
@@ -1,55 +1,87 @@
 package score
 
 import (
-	"github.com/go-nlp/bm25"
-	"github.com/go-nlp/tfidf"
 	"sort"
+
+	"github.com/awesomefly/easysearch/index"
 )
 
 type BM25Document []int           //token id list
 func (d BM25Document) IDs() []int { return []int(d) }
 
-func newTFIDF(docs []BM25Document) *tfidf.TFIDF {
-	tf := tfidf.New()
-
-	for _, doc := range docs {
-		tf.Add(doc)
-	}
-	tf.CalculateIDF()
-	return tf
-}
-
 // MostSimilar 相关性计算
 // q query words, docs is doc id list, return most similar docs' id list
 func MostSimilar(docCorpus map[int]BM25Document, tokenCorpus map[string]int, q []string, docs []int, k int) []int {
-	// sort by bm25
-	// 相关性评分请先阅读：https://www.jianshu.com/p/1e498888f505
-	// 废弃-词集过大时，docs无法完全放入内存，需要自行统计词频并计算score
-	var corpus []BM25Document
-	for _, ts := range docCorpus {
-		corpus = append(corpus, ts)
+	return MostSimilarWithModel(index.BM25, docCorpus, tokenCorpus, q, docs, k)
+}
+
+// MostSimilarWithModel 使用index中注册的打分模型计算相关性, 与索引检索的得分一致
+// 词集过大时，docs无法完全放入内存，应使用索引检索
+func MostSimilarWithModel(model index.SearchModel, docCorpus map[int]BM25Document, tokenCorpus map[string]int, q []string, docs []int, k int) []int {
+	similarity, err := index.LookupSimilarity(model)
+	if err != nil {
+		panic(err.Error())
 	}
-	tf := newTFIDF(corpus)
 
-	var query BM25Document
+	tfidf := index.NewTFIDF()
+	tfidf.DOC2TF[index.VirtualQueryDocId] = make(index.TF)
+	query := make(map[int]string)
 	for _, term := range q {
-		query = append(query, tokenCorpus[term])
+		if id, ok := tokenCorpus[term]; ok { //不在词典中的词不参与打分
+			query[id] = term
+			tfidf.DOC2TF[index.VirtualQueryDocId][term]++
+		}
+	}
+
+	//语料的文档数、总词数及词的df、总词频
+	var property index.Property
+	for _, doc := range docCorpus {
+		property.SetDocNum(property.DocNum() + 1)
+		property.AddFieldTokens(index.TextField, len(doc))
+		seen := make(map[int]bool)
+		for _, id := range doc {
+			if term, ok := query[id]; ok {
+				tfidf.CTF[term]++
+				if !seen[id] {
+					seen[id] = true
+					tfidf.DF[term]++
+				}
+			}
+		}
+	}
+	for _, term := range query {
+		if df := tfidf.DF[term]; df > 0 {
+			tfidf.IDF[term] = index.CalIDF(property.DocNum(), df)
+		}
 	}
 
-	resultDocs := make([]tfidf.Document, 0, len(docs))
+	hits := make([]index.Doc, 0, len(docs))
 	for _, id := range docs {
-		resultDocs = append(resultDocs, docCorpus[id])
+		doc := docCorpus[id]
+		tf := make(index.TF)
+		for _, token := range doc {
+			if term, ok := query[token]; ok {
+				tf[term]++
+			}
+		}
+		fields := make(map[string][]index.FieldFreq, len(tf))
+		for term, n := range tf {
+			fields[term] = []index.FieldFreq{{Field: index.TextField, TF: n, DocLen: int32(len(doc))}}
+		}
+		tfidf.DOC2TF[int32(id)] = tf
+		tfidf.DOC2FIELD[int32(id)] = fields
+		hits = append(hits, index.Doc{ID: int32(id), DocLen: int32(len(doc))})
 	}
 
-	// FIXME: IDF计算公式不对
-	scores := bm25.BM25(tf, query, resultDocs, 2, 0.75)
-	sort.Sort(scores) //order by asc
-	//sort.Reverse(scores) //order by desc
+	sim := index.DefaultSimilarity()
+	hits = similarity.Score(hits, &index.ScoreContext{TFIDF: tfidf, Property: &property, Config: &sim})
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Score > hits[j].Score //降序
+	})
 
 	var final []int
-	for i := len(scores) - 1; i >= 0 && k > 0; i-- {
-		final = append(final, docs[scores[i].ID])
-		k--
+	for i := 0; i < len(hits) && i < k; i++ {
+		final = append(final, int(hits[i].ID))
 	}
 	return final
 }
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"testing"
 
+	"github.com/awesomefly/easysearch/index"
 	"github.com/go-nlp/bm25"
 	"github.com/go-nlp/tfidf"
+	"github.com/stretchr/testify/assert"
 )
 
 var mobydick = []string{
@@ -115,3 +118,27 @@ func Example_BM25() {
 	//	Doc  : "whenever I find myself involuntarily pausing before coffin warehouses , and bringing up the rear of every funeral I meet ; "
 
 }
+
+func TestMostSimilar(t *testing.T) {
+	corpus, _ := makeCorpus(mobydick)
+	docCorpus := make(map[int]BM25Document)
+	var ids []int
+	for i, d := range makeDocuments(mobydick, corpus) {
+		docCorpus[i] = BM25Document(d.(doc))
+		ids = append(ids, i)
+	}
+
+	//同时包含两个词的短文档在前, 不在词典中的词被忽略
+	top := MostSimilar(docCorpus, corpus, []string{"whenever", "find", "unknown"}, ids, 3)
+	assert.Equal(t, []int{3, 5, 4}, top)
+	assert.Equal(t, []int{0}, MostSimilar(docCorpus, corpus, []string{"ishmael"}, ids, 1))
+
+	for _, model := range index.SearchModels() {
+		if model == index.Boolean {
+			continue
+		}
+		top = MostSimilarWithModel(model, docCorpus, corpus, []string{"ishmael"}, ids, 1)
+		assert.Equal(t, []int{0}, top, model)
+	}
+	assert.Panics(t, func() { MostSimilarWithModel("unknown", docCorpus, corpus, nil, ids, 1) })
+}
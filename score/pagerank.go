@@ -0,0 +1,170 @@
+package score
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+)
+
+// 离线计算文档的PageRank作为静态分: 第一遍读取文档建立URL/标题到节点的映射, 第二遍解析出链建立链接图
+
+// LinkGraph 文档链接图, 节点编号从0开始
+type LinkGraph struct {
+	IDs []int32   //节点 -> 文档ID
+	Out [][]int32 //节点 -> 出链节点, 不含自链接及重复的链接
+
+	keys map[string]int32 //URL/标题 -> 节点
+}
+
+func NewLinkGraph() *LinkGraph {
+	return &LinkGraph{keys: make(map[string]int32)}
+}
+
+// normalizeLink 去掉锚点, 忽略大小写, 下划线视为空格, 使wiki的URL与链接可以匹配
+func normalizeLink(link string) string {
+	if i := strings.IndexByte(link, '#'); i >= 0 {
+		link = link[:i]
+	}
+	link = strings.TrimSuffix(strings.TrimSpace(link), "/")
+	return strings.ToLower(strings.ReplaceAll(link, "_", " "))
+}
+
+// AddNode 添加文档节点, 文档可以通过URL或标题被链接
+func (g *LinkGraph) AddNode(doc *index.Document) {
+	node := int32(len(g.IDs))
+	g.IDs = append(g.IDs, int32(doc.ID))
+	g.Out = append(g.Out, nil)
+	for _, key := range []string{doc.URL, doc.Title} {
+		if key = normalizeLink(key); key != "" {
+			if _, ok := g.keys[key]; !ok {
+				g.keys[key] = node
+			}
+		}
+	}
+}
+
+// AddLinks 添加第node个文档的出链, 返回解析到文档的链接数, 需要在所有节点添加后调用
+func (g *LinkGraph) AddLinks(node int, links []string) int {
+	seen := make(map[int32]bool, len(links))
+	for _, link := range links {
+		to, ok := g.keys[normalizeLink(link)]
+		if !ok || int(to) == node || seen[to] {
+			continue
+		}
+		seen[to] = true
+		g.Out[node] = append(g.Out[node], to)
+	}
+	return len(seen)
+}
+
+// PageRank 幂迭代计算PageRank, 没有出链的节点平均分配给所有节点, 结果之和为1
+func PageRank(out [][]int32, damping float64, iterations int, tolerance float64) ([]float64, int) {
+	n := len(out)
+	if n == 0 {
+		return nil, 0
+	}
+	pr := make([]float64, n)
+	next := make([]float64, n)
+	for i := range pr {
+		pr[i] = 1 / float64(n)
+	}
+
+	iter := 0
+	for iter < iterations {
+		iter++
+		var dangling float64
+		for u, links := range out {
+			if len(links) == 0 {
+				dangling += pr[u]
+			}
+		}
+		base := (1-damping)/float64(n) + damping*dangling/float64(n)
+		for i := range next {
+			next[i] = base
+		}
+		for u, links := range out {
+			if len(links) == 0 {
+				continue
+			}
+			share := damping * pr[u] / float64(len(links))
+			for _, v := range links {
+				next[v] += share
+			}
+		}
+
+		var diff float64
+		for i := range pr {
+			diff += math.Abs(next[i] - pr[i])
+		}
+		pr, next = next, pr
+		if diff < tolerance {
+			break
+		}
+	}
+	return pr, iter
+}
+
+// BuildPageRank 计算数据源中文档的PageRank, 归一化到(0,1]后写入静态分文件file
+func BuildPageRank(c config.Config, file string) error {
+	if file == "" {
+		return fmt.Errorf("static score file not specified, set Storage.PriorFile")
+	}
+	start := time.Now()
+	conf := c.PageRank.WithDefault()
+
+	g := NewLinkGraph()
+	if err := scanDocuments(c, func(doc *index.Document) { g.AddNode(doc) }); err != nil {
+		return err
+	}
+	edges, node := 0, 0
+	if err := scanDocuments(c, func(doc *index.Document) {
+		edges += g.AddLinks(node, doc.Links)
+		node++
+	}); err != nil {
+		return err
+	}
+	if node != len(g.IDs) {
+		return fmt.Errorf("document source changed while computing pagerank: %d docs, expect %d", node, len(g.IDs))
+	}
+	log.Printf("link graph: %d docs, %d links", len(g.IDs), edges)
+
+	pr, iter := PageRank(g.Out, float64(conf.Damping), conf.Iterations, float64(conf.Tolerance))
+	var max float64
+	for _, v := range pr {
+		max = math.Max(max, v)
+	}
+	scores := make(index.StaticScores, len(pr))
+	for i, v := range pr {
+		scores[g.IDs[i]] = v / max
+	}
+	if err := index.WriteStaticScores(file, scores); err != nil {
+		return err
+	}
+	log.Printf("wrote pagerank of %d docs to %s after %d iterations in %v", len(scores), file, iter, time.Since(start))
+	return nil
+}
+
+// scanDocuments 顺序读取数据源中的所有文档
+func scanDocuments(c config.Config, fn func(doc *index.Document)) error {
+	src, err := index.OpenSource(c.Store.DocumentSource())
+	if err != nil {
+		return err
+	}
+	report := &index.ErrorReport{}
+	ch := index.StreamDocuments(src, report)
+	for doc := <-ch; doc != nil; doc = <-ch {
+		fn(doc)
+	}
+	if report.Fatal != nil {
+		return report.Fatal
+	}
+	if report.Skipped > 0 {
+		log.Println(report.String())
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package score
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageRank(t *testing.T) {
+	//0,1,2都链接到3, 3链接到0, 4没有出链
+	out := [][]int32{{3}, {3}, {3, 0}, {0}, nil}
+	pr, iter := PageRank(out, 0.85, 200, 1e-6)
+	assert.True(t, iter < 200)
+
+	var sum float64
+	for _, v := range pr {
+		sum += v
+	}
+	assert.InDelta(t, 1, sum, 1e-6)
+	assert.True(t, pr[3] > pr[0])
+	assert.True(t, pr[0] > pr[1])
+	assert.InDelta(t, pr[1], pr[4], 1e-6) //没有入链的节点得分相同
+
+	pr, _ = PageRank(nil, 0.85, 10, 1e-6)
+	assert.Nil(t, pr)
+}
+
+func TestBuildPageRank(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pagerank")
+	defer os.RemoveAll(dir)
+
+	docs := `{"id": 1, "url": "https://en.wikipedia.org/wiki/Michael_Jordan", "text": "basketball", "links": ["Chicago Bulls", "https://en.wikipedia.org/wiki/Michael_Jordan#Career"]}
+{"id": 2, "title": "Chicago Bulls", "text": "team", "links": ["https://en.wikipedia.org/wiki/Michael_Jordan"]}
+{"id": 3, "title": "Scottie Pippen", "text": "basketball", "links": ["chicago_bulls", "Unknown Page", "Chicago Bulls"]}
+{"id": 4, "title": "Album", "text": "music"}`
+	source := filepath.Join(dir, "docs.jsonl")
+	assert.Nil(t, ioutil.WriteFile(source, []byte(docs), 0644))
+
+	conf := config.Config{Store: config.Storage{Source: config.Source{Type: index.JSONSource, Path: source}}}
+	assert.NotNil(t, BuildPageRank(conf, ""))
+
+	file := filepath.Join(dir, "prior.txt")
+	assert.Nil(t, BuildPageRank(conf, file))
+	scores, err := index.ReadStaticScores(file)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(scores))
+	assert.Equal(t, float64(1), scores[2]) //被链接最多
+	assert.True(t, scores[1] > scores[3])
+	assert.InDelta(t, scores[3], scores[4], 1e-9)
+	assert.True(t, scores[4] > 0)
+}
@@ -0,0 +1,168 @@
+package score
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/awesomefly/easysearch/index"
+)
+
+// 重排模型: 输入index.ExtractFeatures提取的特征, 输出重排得分. 模型文件为json:
+//  线性模型 {"type": "linear", "bias": 0, "weights": {"bm25_text": 1, "static": 0.5}}
+//  树模型   {"type": "gbdt", "trees": [...]}, trees为xgboost训练的LambdaMART等模型
+//           dump_model(dump_format="json")的结果, 分裂特征为特征名或"f<下标>"(下标对应index.FeatureNames).
+//           lightgbm的dump_model格式不同, 需先转换为xgboost的节点格式
+
+const (
+	LinearRanker = "linear"
+	GBDTRanker   = "gbdt"
+)
+
+// Ranker 重排模型
+type Ranker interface {
+	Score(f index.Features) float64
+}
+
+// Linear 线性模型, score = bias + Σ weight_i * feature_i
+type Linear struct {
+	Weights []float64 //按index.FeatureNames排列
+	Bias    float64
+}
+
+func (m *Linear) Score(f index.Features) float64 {
+	score := m.Bias
+	for i, w := range m.Weights {
+		if i < len(f) {
+			score += w * f[i]
+		}
+	}
+	return score
+}
+
+// TreeNode 回归树的节点, 字段与xgboost的json dump一致. 特征值小于阈值时走yes分支
+type TreeNode struct {
+	NodeID    int         `json:"nodeid"`
+	Split     string      `json:"split"`
+	Threshold float64     `json:"split_condition"`
+	Yes       int         `json:"yes"`
+	No        int         `json:"no"`
+	Leaf      *float64    `json:"leaf"`
+	Children  []*TreeNode `json:"children"`
+
+	feature int //Split对应的特征下标
+	yes, no *TreeNode
+}
+
+// GBDT 梯度提升树, score = Σ tree(features)
+type GBDT struct {
+	Trees []*TreeNode
+}
+
+func (m *GBDT) Score(f index.Features) float64 {
+	var score float64
+	for _, node := range m.Trees {
+		for node.Leaf == nil {
+			var v float64
+			if node.feature < len(f) {
+				v = f[node.feature]
+			}
+			if v < node.Threshold {
+				node = node.yes
+			} else {
+				node = node.no
+			}
+		}
+		score += *node.Leaf
+	}
+	return score
+}
+
+// featureIndex 特征名或"f<下标>"对应的特征下标
+func featureIndex(name string) (int, error) {
+	if i := index.FeatureIndex(name); i >= 0 {
+		return i, nil
+	}
+	if strings.HasPrefix(name, "f") {
+		if i, err := strconv.Atoi(name[1:]); err == nil && i >= 0 && i < len(index.FeatureNames) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("unknown feature %q, expect one of %s", name, strings.Join(index.FeatureNames, ","))
+}
+
+// link 解析分裂特征, 按nodeid连接子节点
+func (n *TreeNode) link() error {
+	if n.Leaf != nil {
+		return nil
+	}
+	var err error
+	if n.feature, err = featureIndex(n.Split); err != nil {
+		return fmt.Errorf("node %d: %s", n.NodeID, err.Error())
+	}
+	for _, child := range n.Children {
+		if child == nil {
+			continue
+		}
+		if child.NodeID == n.Yes {
+			n.yes = child
+		}
+		if child.NodeID == n.No {
+			n.no = child
+		}
+		if err = child.link(); err != nil {
+			return err
+		}
+	}
+	if n.yes == nil || n.no == nil {
+		return fmt.Errorf("node %d: missing child %d or %d", n.NodeID, n.Yes, n.No)
+	}
+	return nil
+}
+
+// LoadRanker 读取重排模型文件
+func LoadRanker(file string) (Ranker, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		Type    string             `json:"type"`
+		Bias    float64            `json:"bias"`
+		Weights map[string]float64 `json:"weights"`
+		Trees   []*TreeNode        `json:"trees"`
+	}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+
+	switch m.Type {
+	case LinearRanker:
+		linear := &Linear{Weights: make([]float64, len(index.FeatureNames)), Bias: m.Bias}
+		for name, w := range m.Weights {
+			i, err := featureIndex(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err.Error())
+			}
+			linear.Weights[i] = w
+		}
+		return linear, nil
+	case GBDTRanker:
+		if len(m.Trees) == 0 {
+			return nil, fmt.Errorf("%s: no trees", file)
+		}
+		for i, tree := range m.Trees {
+			if tree == nil {
+				return nil, fmt.Errorf("%s: tree %d is empty", file, i)
+			}
+			if err = tree.link(); err != nil {
+				return nil, fmt.Errorf("%s: tree %d: %s", file, i, err.Error())
+			}
+		}
+		return &GBDT{Trees: m.Trees}, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported ranker type %q, expect %s or %s", file, m.Type, LinearRanker, GBDTRanker)
+	}
+}
@@ -0,0 +1,53 @@
+package score
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awesomefly/easysearch/index"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadRanker(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ranker")
+	defer os.RemoveAll(dir)
+	write := func(content string) string {
+		file := filepath.Join(dir, "model.json")
+		assert.Nil(t, ioutil.WriteFile(file, []byte(content), 0644))
+		return file
+	}
+	features := make(index.Features, len(index.FeatureNames))
+	features[index.FeatureIndex(index.FeatureBM25Text)] = 2
+	features[index.FeatureIndex(index.FeatureStatic)] = 0.5
+
+	ranker, err := LoadRanker(write(`{"type": "linear", "bias": 1, "weights": {"bm25_text": 0.5, "f6": 2}}`))
+	assert.Nil(t, err)
+	assert.InDelta(t, 1+0.5*2+2*0.5, ranker.Score(features), 1e-9)
+
+	//xgboost json dump格式
+	ranker, err = LoadRanker(write(`{"type": "gbdt", "trees": [
+  {"nodeid": 0, "depth": 0, "split": "static", "split_condition": 0.3, "yes": 1, "no": 2, "missing": 1, "children": [
+    {"nodeid": 1, "leaf": -0.2},
+    {"nodeid": 2, "depth": 1, "split": "f1", "split_condition": 1.5, "yes": 3, "no": 4, "missing": 3, "children": [
+      {"nodeid": 3, "leaf": 0.1},
+      {"nodeid": 4, "leaf": 0.4}
+    ]}
+  ]},
+  {"nodeid": 0, "leaf": 0.05}
+]}`))
+	assert.Nil(t, err)
+	assert.InDelta(t, 0.4+0.05, ranker.Score(features), 1e-9)
+	features[index.FeatureIndex(index.FeatureStatic)] = 0
+	assert.InDelta(t, -0.2+0.05, ranker.Score(features), 1e-9)
+
+	_, err = LoadRanker(write(`{"type": "linear", "weights": {"pagerank": 1}}`))
+	assert.Contains(t, err.Error(), "unknown feature")
+	_, err = LoadRanker(write(`{"type": "gbdt", "trees": [{"nodeid": 0, "split": "f0", "split_condition": 1, "yes": 1, "no": 2, "children": [{"nodeid": 1, "leaf": 1}]}]}`))
+	assert.Contains(t, err.Error(), "missing child")
+	_, err = LoadRanker(write(`{"type": "dnn"}`))
+	assert.NotNil(t, err)
+	_, err = LoadRanker(filepath.Join(dir, "none.json"))
+	assert.NotNil(t, err)
+}
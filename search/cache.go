@@ -0,0 +1,58 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/util"
+)
+
+// CacheStats 查询结果缓存及倒排表缓存的命中统计
+type CacheStats struct {
+	Results  util.CacheStats
+	Postings util.CacheStats
+}
+
+// WithResultCache 缓存最近n个查询的结果, n<=0时不缓存. 需要在查询前调用
+func (srh *Searcher) WithResultCache(n int) *Searcher {
+	srh.results = nil
+	if n > 0 {
+		srh.results = util.NewLRU(int64(n))
+	}
+	return srh
+}
+
+// WithPostingCache 设置btree索引(全量及辅助)的倒排表缓存, 可以在多个Searcher间共享. 需要在查询前调用
+func (srh *Searcher) WithPostingCache(c *index.PostingCache) *Searcher {
+	srh.postings = c
+	setPostingCache(srh.full(), c)
+	for _, idx := range (*IndexArray)(atomic.LoadPointer(&srh.auxIndex)).Indices() {
+		idx.SetPostingCache(c)
+	}
+	return srh
+}
+
+// setPostingCache mmap索引直接读取映射的内存, 不需要缓存
+func setPostingCache(seg index.Segment, c *index.PostingCache) {
+	if bt, ok := seg.(*index.BTreeIndex); ok {
+		bt.SetPostingCache(c)
+	}
+}
+
+// CacheStats 查询结果缓存及倒排表缓存的命中统计, 未设置缓存时为0
+func (srh *Searcher) CacheStats() CacheStats {
+	return CacheStats{Results: srh.results.Stats(), Postings: srh.postings.Stats()}
+}
+
+// invalidate 增量索引切换、Drain、Load或删除文档后, 之前缓存的查询结果不再使用
+func (srh *Searcher) invalidate() {
+	atomic.AddUint64(&srh.generation, 1)
+	srh.results.Purge()
+}
+
+// cacheKey 索引版本、打分模型、返回的文档数及归一化的查询(小写、去停用词, 不提取词干, 查询扩展与原词有关)
+func (srh *Searcher) cacheKey(query string, model index.SearchModel, n int) string {
+	return fmt.Sprintf("%d|%s|%d|%s", atomic.LoadUint64(&srh.generation), model, n, strings.Join(util.Words(query), " "))
+}
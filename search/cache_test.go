@@ -0,0 +1,65 @@
+package search
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/awesomefly/easysearch/index"
+)
+
+func TestSearcherCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cache")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{
+		{ID: 1, Text: "donut on a glass plate"},
+		{ID: 2, Text: "only the donuts"},
+	})
+	full.Close()
+
+	srh := NewSearcher(filepath.Join(dir, "idx")).WithResultCache(10).WithPostingCache(index.NewPostingCache(1))
+	docs := srh.Search("donut")
+	assert.ElementsMatch(t, []int32{1, 2}, docIDs(docs))
+	//归一化后相同的查询命中缓存
+	assert.Equal(t, docs, srh.Search("The DONUT"))
+	s := srh.CacheStats()
+	assert.Equal(t, int64(1), s.Results.Hits)
+	assert.Equal(t, int64(1), s.Results.Misses)
+
+	//打分模型不同时重新检索, 倒排表命中缓存
+	srh.SearchWithModel("donut", index.BM25Plus)
+	assert.Equal(t, int64(2), srh.CacheStats().Results.Misses)
+	assert.True(t, srh.CacheStats().Postings.Hits > 0)
+
+	//增量索引写入后缓存失效
+	srh.Add(index.Document{ID: 3, Text: "donut shop", Timestamp: 1})
+	(*DoubleBuffer)(srh.incrIndex).Sync()
+	assert.ElementsMatch(t, []int32{1, 2, 3}, docIDs(srh.Search("donut")))
+
+	//删除文档后缓存失效
+	srh.Del(index.Document{ID: 1})
+	assert.ElementsMatch(t, []int32{2, 3}, docIDs(srh.Search("donut")))
+
+	//Load替换全量索引后缓存失效
+	next := index.NewBTreeIndex(filepath.Join(dir, "idx2"))
+	next.Add([]index.Document{{ID: 4, Text: "donut"}})
+	next.Close()
+	assert.Nil(t, srh.Load(filepath.Join(dir, "idx2"), FullIndex))
+	assert.ElementsMatch(t, []int32{3, 4}, docIDs(srh.Search("donut")))
+	assert.Equal(t, int64(1), srh.CacheStats().Results.Hits)
+
+	//Drain切换增量索引后缓存失效
+	gen := atomic.LoadUint64(&srh.generation)
+	srh.Drain(0)
+	assert.True(t, atomic.LoadUint64(&srh.generation) > gen)
+	srh.draining.Wait()
+
+	//未设置缓存时没有统计
+	assert.Equal(t, CacheStats{}, NewSearcher(filepath.Join(dir, "idx2")).CacheStats())
+}
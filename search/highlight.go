@@ -0,0 +1,268 @@
+package search
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/util"
+)
+
+// TextStore 文档原文存储, 索引中只有词及位置信息, 高亮需要原文
+type TextStore interface {
+	Get(id int32) (index.Document, bool)
+	Put(doc index.Document)
+	Delete(id int32)
+}
+
+// MemoryStore 内存中的文档原文, 并发安全
+type MemoryStore struct {
+	lock sync.RWMutex
+	docs map[int32]index.Document
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{docs: make(map[int32]index.Document)}
+}
+
+// LoadTextStore 从文档来源加载所有文档的原文
+func LoadTextStore(c config.Source) (*MemoryStore, error) {
+	store := NewMemoryStore()
+	_, err := store.Load(c, nil)
+	return store, err
+}
+
+// Load 从文档来源加载keep返回true的文档的原文, keep为nil时加载所有文档, 返回加载的文档数.
+// 已有的文档(如实时写入的新版本)不覆盖
+func (s *MemoryStore) Load(c config.Source, keep func(id int) bool) (int, error) {
+	src, err := index.OpenSource(c)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	report := &index.ErrorReport{}
+	ch := index.StreamDocuments(src, report)
+	for doc := <-ch; doc != nil; doc = <-ch {
+		if keep != nil && !keep(doc.ID) {
+			continue
+		}
+		if _, ok := s.Get(int32(doc.ID)); !ok {
+			s.Put(*doc)
+			n++
+		}
+	}
+	return n, report.Fatal
+}
+
+func (s *MemoryStore) Get(id int32) (index.Document, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	doc, ok := s.docs[id]
+	return doc, ok
+}
+
+// Put 只保存高亮需要的字段
+func (s *MemoryStore) Put(doc index.Document) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.docs[int32(doc.ID)] = index.Document{ID: doc.ID, Title: doc.Title, URL: doc.URL, Text: doc.Text}
+}
+
+func (s *MemoryStore) Delete(id int32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.docs, id)
+}
+
+func (s *MemoryStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.docs)
+}
+
+// Highlight 一个搜索结果的高亮, Title为高亮后的标题, Fragments为正文中得分最高的片段, 按得分降序
+type Highlight struct {
+	DocID     int32
+	Title     string
+	URL       string
+	Fragments []string
+}
+
+// Highlighter 在原文中查找查询词(经util.Analyze处理)的位置, 命中词用标签包围
+type Highlighter struct {
+	conf  config.Highlight
+	store TextStore
+}
+
+// NewHighlighter store为nil时使用空的MemoryStore, 可以在多个Searcher间共享
+func NewHighlighter(conf config.Highlight, store TextStore) *Highlighter {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Highlighter{conf: conf.WithDefault(), store: store}
+}
+
+func (h *Highlighter) Store() TextStore {
+	return h.store
+}
+
+// Highlight 高亮每个文档的标题及正文片段, 与docs一一对应. terms为查询词及其权重, 原文不在store中时只有DocID
+func (h *Highlighter) Highlight(terms index.Boost, docs []index.Doc) []Highlight {
+	result := make([]Highlight, len(docs))
+	for i, d := range docs {
+		result[i].DocID = d.ID
+		doc, ok := h.store.Get(d.ID)
+		if !ok {
+			continue
+		}
+		result[i].Title = h.Text(doc.Title, terms)
+		result[i].URL = doc.URL
+		result[i].Fragments = h.Fragments(doc.Text, terms)
+	}
+	return result
+}
+
+// Text 高亮整段文本
+func (h *Highlighter) Text(text string, terms index.Boost) string {
+	return h.tag(text, util.AnalyzeOffsets(text), terms)
+}
+
+// fragment 原文中的一个片段, 为tokens[lo:hi]所在的范围
+type fragment struct {
+	lo, hi int
+	score  float64
+}
+
+// Fragments 返回text中得分最高且互不重叠的片段, 没有命中词时返回nil.
+// 候选片段以每个命中词为中心向两侧扩展到FragmentSize, 边界为词的边界;
+// 得分为片段中不同命中词的权重之和, 同一个词重复出现时每次加其权重的0.1
+func (h *Highlighter) Fragments(text string, terms index.Boost) []string {
+	tokens := util.AnalyzeOffsets(text)
+	var candidates []fragment
+	for i, token := range tokens {
+		if terms[token.Term] > 0 {
+			candidates = append(candidates, h.expand(tokens, i, terms))
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score //降序, 得分相同时靠前的优先
+	})
+
+	var picked []fragment
+	for _, c := range candidates {
+		if len(picked) == h.conf.Fragments {
+			break
+		}
+		overlap := false
+		for _, p := range picked {
+			if c.lo < p.hi && p.lo < c.hi {
+				overlap = true
+				break
+			}
+		}
+		if !overlap {
+			picked = append(picked, c)
+		}
+	}
+
+	result := make([]string, 0, len(picked))
+	for _, p := range picked {
+		start, end := tokens[p.lo].Start, tokens[p.hi-1].End
+		offset := make([]util.Token, p.hi-p.lo)
+		for i, token := range tokens[p.lo:p.hi] {
+			offset[i] = util.Token{Term: token.Term, Start: token.Start - start, End: token.End - start}
+		}
+		result = append(result, h.tag(text[start:end], offset, terms))
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// expand 以tokens[i]为中心交替向两侧扩展, 直到片段长度超过FragmentSize
+func (h *Highlighter) expand(tokens []util.Token, i int, terms index.Boost) fragment {
+	size := h.conf.FragmentSize
+	lo, hi := i, i+1
+	for grew := true; grew; {
+		grew = false
+		if hi < len(tokens) && tokens[hi].End-tokens[lo].Start <= size {
+			hi++
+			grew = true
+		}
+		if lo > 0 && tokens[hi-1].End-tokens[lo-1].Start <= size {
+			lo--
+			grew = true
+		}
+	}
+
+	f := fragment{lo: lo, hi: hi}
+	seen := make(map[string]bool)
+	for _, token := range tokens[lo:hi] {
+		w := terms[token.Term]
+		if w <= 0 {
+			continue
+		}
+		if seen[token.Term] {
+			f.score += 0.1 * w
+		} else {
+			seen[token.Term] = true
+			f.score += w
+		}
+	}
+	return f
+}
+
+// tag 命中词用PreTag及PostTag包围, tokens为text中的词及位置
+func (h *Highlighter) tag(text string, tokens []util.Token, terms index.Boost) string {
+	escape := func(s string) string {
+		if h.conf.Escape {
+			return html.EscapeString(s)
+		}
+		return s
+	}
+	var sb strings.Builder
+	last := 0
+	for _, token := range tokens {
+		if terms[token.Term] <= 0 {
+			continue
+		}
+		sb.WriteString(escape(text[last:token.Start]))
+		sb.WriteString(h.conf.PreTag)
+		sb.WriteString(escape(text[token.Start:token.End]))
+		sb.WriteString(h.conf.PostTag)
+		last = token.End
+	}
+	sb.WriteString(escape(text[last:]))
+	return sb.String()
+}
+
+// WithHighlighter 设置高亮, 之后新增的文档同时写入其原文存储
+func (srh *Searcher) WithHighlighter(h *Highlighter) *Searcher {
+	srh.highlighter = h
+	return srh
+}
+
+// Highlight 高亮搜索结果, 与docs一一对应, 高亮查询词及扩展词. 未设置高亮时返回nil
+func (srh *Searcher) Highlight(query string, docs []index.Doc) []Highlight {
+	if srh.highlighter == nil {
+		return nil
+	}
+	terms := srh.Paraphrase(query)
+	if terms == nil {
+		terms = make(index.Boost)
+	}
+	for _, term := range util.Analyze(query) {
+		terms[term] = 1
+	}
+	return srh.highlighter.Highlight(terms, docs)
+}
+
+// SearchWithHighlight 同SearchWithModel, 同时返回每个结果的高亮
+func (srh *Searcher) SearchWithHighlight(query string, model index.SearchModel) ([]index.Doc, []Highlight) {
+	docs := srh.SearchWithModel(query, model)
+	return docs, srh.Highlight(query, docs)
+}
@@ -0,0 +1,88 @@
+package search
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+)
+
+func TestHighlighter(t *testing.T) {
+	h := NewHighlighter(config.Highlight{FragmentSize: 30, Fragments: 2}, nil)
+	terms := index.Boost{"cat": 1, "dog": 0.5}
+
+	//词干映射回原文的位置
+	assert.Equal(t, "The <em>Cats</em> & <em>dogs</em>", h.Text("The Cats & dogs", terms))
+	assert.Equal(t, "no match", h.Text("no match", terms))
+	assert.Nil(t, h.Fragments("no match here", terms))
+
+	text := "A dog barked at night. " + strings.Repeat("Nothing happened here. ", 5) +
+		"Later the cats chased a cat and a dog."
+	fragments := h.Fragments(text, terms)
+	assert.Equal(t, 2, len(fragments))
+	//得分最高的片段包含两个查询词
+	assert.Contains(t, fragments[0], "<em>cats</em>")
+	assert.Contains(t, fragments[0], "<em>cat</em>")
+	assert.Equal(t, "<em>dog</em> barked at night. Nothing", fragments[1])
+	for _, f := range fragments {
+		plain := strings.NewReplacer("<em>", "", "</em>", "").Replace(f)
+		assert.LessOrEqual(t, len(plain), 30)
+		assert.Contains(t, text, plain)
+	}
+
+	//自定义标签及HTML转义
+	h = NewHighlighter(config.Highlight{PreTag: "[", PostTag: "]", Escape: true}, nil)
+	assert.Equal(t, "&lt;b&gt;[cat]&lt;/b&gt; &amp; [Dog]", h.Text("<b>cat</b> & Dog", terms))
+	assert.Equal(t, []string{"x [cat] y"}, h.Fragments("x cat y", terms))
+}
+
+func TestSearcherHighlight(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "highlight")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "docs.jsonl")
+	ioutil.WriteFile(file, []byte(`{"id": 1, "title": "Jordan", "url": "u1", "text": "Michael Jordan played basketball."}
+{"id": 2, "title": "Album", "url": "u2", "text": "An album by Jordan Knight."}
+`), 0644)
+	store, err := LoadTextStore(config.Source{Type: "jsonl", Path: file})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, store.Len())
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{
+		{ID: 1, Title: "Jordan", Text: "Michael Jordan played basketball."},
+		{ID: 2, Title: "Album", Text: "An album by Jordan Knight."},
+	})
+	full.Close()
+
+	srh := NewSearcher(filepath.Join(dir, "idx"))
+	assert.Nil(t, srh.Highlight("album", srh.Search("album")))
+	srh.WithHighlighter(NewHighlighter(config.Highlight{}, store))
+
+	docs, highlights := srh.SearchWithHighlight("albums", "")
+	assert.Equal(t, []int32{2}, docIDs(docs))
+	assert.Equal(t, []Highlight{{
+		DocID:     2,
+		Title:     "<em>Album</em>",
+		URL:       "u2",
+		Fragments: []string{"An <em>album</em> by Jordan Knight"},
+	}}, highlights)
+
+	//实时新增的文档写入原文存储
+	srh.Add(index.Document{ID: 3, Title: "Knight", Text: "Knight rider", Timestamp: 1})
+	doc, ok := store.Get(3)
+	assert.True(t, ok)
+	assert.Equal(t, "Knight rider", doc.Text)
+	srh.Del(index.Document{ID: 3})
+	_, ok = store.Get(3)
+	assert.False(t, ok)
+
+	//原文不在存储中时只有DocID
+	assert.Equal(t, []Highlight{{DocID: 9}}, srh.Highlight("album", []index.Doc{{ID: 9}}))
+}
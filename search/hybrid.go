@@ -0,0 +1,210 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+)
+
+type FusionMethod string
+
+const (
+	RRF      FusionMethod = "rrf"      //倒数排名融合: sum(w/(k+rank))
+	Weighted FusionMethod = "weighted" //每路得分min-max归一化后加权求和
+)
+
+// DefaultRRFK rrf的排名平滑常数
+const DefaultRRFK = 60
+
+// Fusion 多路召回结果的融合参数, 零值使用默认值(rrf, k=60, 权重为1)
+type Fusion struct {
+	Method        FusionMethod
+	K             int
+	LexicalWeight float64
+	VectorWeight  float64
+}
+
+// NewFusion 由配置生成融合参数, 融合方式不支持时返回错误
+func NewFusion(c config.Hybrid) (Fusion, error) {
+	f := Fusion{
+		Method:        FusionMethod(c.Fusion),
+		K:             c.RRFK,
+		LexicalWeight: float64(c.LexicalWeight),
+		VectorWeight:  float64(c.VectorWeight),
+	}
+	return f.WithDefault(), f.Validate()
+}
+
+// WithDefault 未配置的参数使用默认值
+func (f Fusion) WithDefault() Fusion {
+	if f.Method == "" {
+		f.Method = RRF
+	}
+	if f.K <= 0 {
+		f.K = DefaultRRFK
+	}
+	if f.LexicalWeight <= 0 {
+		f.LexicalWeight = 1
+	}
+	if f.VectorWeight <= 0 {
+		f.VectorWeight = 1
+	}
+	return f
+}
+
+func (f Fusion) Validate() error {
+	switch f.Method {
+	case "", RRF, Weighted:
+		return nil
+	}
+	return fmt.Errorf("unknown fusion method %q", f.Method)
+}
+
+// Fuse 融合文本检索与向量检索的结果, 每路结果需按得分降序. 返回按融合得分降序的前n个文档, n<=0时返回全部
+func (f Fusion) Fuse(lexical, vector []index.Doc, n int) []index.Doc {
+	f = f.WithDefault()
+	lists := [][]index.Doc{lexical, vector}
+	weights := []float64{f.LexicalWeight, f.VectorWeight}
+
+	var result []index.Doc
+	pos := make(map[int32]int)
+	for l, docs := range lists {
+		min, max := scoreRange(docs)
+		for rank, doc := range docs {
+			var s float64
+			if f.Method == Weighted {
+				s = 1 //同一路得分相同时都视为最高分
+				if max > min {
+					s = (doc.Score - min) / (max - min)
+				}
+			} else {
+				s = 1 / float64(f.K+rank+1)
+			}
+
+			i, ok := pos[doc.ID]
+			if !ok {
+				i = len(result)
+				pos[doc.ID] = i
+				doc.Score = 0
+				result = append(result, doc)
+			}
+			result[i].Score += weights[l] * s
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Score > result[j].Score //降序
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+func scoreRange(docs []index.Doc) (min, max float64) {
+	for i, doc := range docs {
+		if i == 0 || doc.Score < min {
+			min = doc.Score
+		}
+		if i == 0 || doc.Score > max {
+			max = doc.Score
+		}
+	}
+	return
+}
+
+// HybridQuery 文本检索与向量检索并行执行后融合
+type HybridQuery struct {
+	Text   string            //文本查询, 为空时不做文本检索
+	Model  index.SearchModel //文本检索的打分模型, 为空时使用配置的默认模型
+	Vector []float32         //查询向量, 为空时用改写模型对Text编码, 仍为空时不做向量检索
+	Filter string            //向量检索的布尔过滤条件, 见KNN
+	K      int               //返回的文档数, 也是文本检索及向量检索各自的候选数, 默认为Pipeline.TopN
+	Fusion Fusion
+}
+
+// HybridResult 文本检索及向量检索各自的结果, 均按得分降序, 用于跨分片时先合并每一路再融合
+type HybridResult struct {
+	Lexical []index.Doc
+	Vector  []index.Doc
+}
+
+// Merge 合并其他分片的结果, 每一路按得分降序, 同一文档只保留一个
+func (r *HybridResult) Merge(o HybridResult) {
+	r.Lexical = mergeByScore(r.Lexical, o.Lexical)
+	r.Vector = mergeByScore(r.Vector, o.Vector)
+}
+
+func mergeByScore(a, b []index.Doc) []index.Doc {
+	seen := make(map[int32]bool, len(a)+len(b))
+	result := make([]index.Doc, 0, len(a)+len(b))
+	for _, docs := range [][]index.Doc{a, b} {
+		for _, doc := range docs {
+			if !seen[doc.ID] {
+				seen[doc.ID] = true
+				result = append(result, doc)
+			}
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Score > result[j].Score //降序
+	})
+	return result
+}
+
+// HybridSearch 并行执行文本检索和向量检索, 返回两路各自的结果
+func (srh *Searcher) HybridSearch(q HybridQuery) (HybridResult, error) {
+	if err := q.Fusion.Validate(); err != nil {
+		return HybridResult{}, err
+	}
+	model, err := index.ParseSearchModel(string(q.Model))
+	if err != nil {
+		return HybridResult{}, err
+	}
+	q.Model = model
+	k := q.K
+	if k <= 0 {
+		k = srh.pipeline.TopN
+	}
+	vec := q.Vector
+	if len(vec) == 0 && q.Text != "" {
+		vec = srh.Embed(q.Text)
+	}
+
+	var (
+		result HybridResult
+		wg     sync.WaitGroup
+	)
+	if q.Text != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result.Lexical = srh.search(q.Text, q.Model, k, nil) //两路召回同样的深度
+		}()
+	}
+	if len(vec) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result.Vector, err = srh.KNN(vec, k, q.Filter)
+		}()
+	}
+	wg.Wait()
+	return result, err
+}
+
+// Hybrid 混合检索, 文本检索与向量检索的结果按q.Fusion融合后取前K个
+func (srh *Searcher) Hybrid(q HybridQuery) ([]index.Doc, error) {
+	r, err := srh.HybridSearch(q)
+	if err != nil {
+		return nil, err
+	}
+	k := q.K
+	if k <= 0 {
+		k = srh.pipeline.TopN
+	}
+	return q.Fusion.Fuse(r.Lexical, r.Vector, k), nil
+}
@@ -0,0 +1,93 @@
+package search
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFusion(t *testing.T) {
+	lexical := []index.Doc{{ID: 1, Score: 9}, {ID: 2, Score: 5}, {ID: 3, Score: 1}}
+	vector := []index.Doc{{ID: 3, Score: 0.9}, {ID: 4, Score: 0.8}, {ID: 2, Score: 0.7}}
+
+	//rrf只与排名有关: doc2为1/62+1/63, doc3为1/63+1/61
+	docs := Fusion{}.Fuse(lexical, vector, 0)
+	assert.Equal(t, []int32{3, 2, 1, 4}, docIDs(docs))
+	assert.InDelta(t, 1.0/61+1.0/63, docs[0].Score, 1e-9)
+	assert.Equal(t, []int32{3, 2}, docIDs(Fusion{}.Fuse(lexical, vector, 2)))
+	docs = Fusion{VectorWeight: 0.01}.Fuse(lexical, vector, 0)
+	assert.Equal(t, int32(1), docs[0].ID)
+
+	//weighted: 每路min-max归一化, doc2为2*0.5+0, doc3为2*0+1, 得分相同时保持先出现的顺序
+	docs = Fusion{Method: Weighted, LexicalWeight: 2}.Fuse(lexical, vector, 0)
+	assert.Equal(t, []int32{1, 2, 3, 4}, docIDs(docs))
+	assert.InDelta(t, 2, docs[0].Score, 1e-9)
+	assert.InDelta(t, 1, docs[1].Score, 1e-9)
+	assert.InDelta(t, 1, docs[2].Score, 1e-9)
+	assert.InDelta(t, 0.5, docs[3].Score, 1e-9)
+	assert.Equal(t, []int32{4}, docIDs(Fusion{Method: Weighted}.Fuse(nil, vector[1:2], 0)))
+
+	f, err := NewFusion(config.Hybrid{Fusion: "weighted", VectorWeight: 0.5})
+	assert.Nil(t, err)
+	assert.Equal(t, Fusion{Method: Weighted, K: DefaultRRFK, LexicalWeight: 1, VectorWeight: 0.5}, f)
+	_, err = NewFusion(config.Hybrid{Fusion: "max"})
+	assert.NotNil(t, err)
+
+	//跨分片时每一路先按得分合并
+	r := HybridResult{Lexical: lexical[:1], Vector: vector[1:]}
+	r.Merge(HybridResult{Lexical: lexical[1:], Vector: vector[:1]})
+	assert.Equal(t, []int32{1, 2, 3}, docIDs(r.Lexical))
+	assert.Equal(t, []int32{3, 4, 2}, docIDs(r.Vector))
+}
+
+func TestSearcherHybrid(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "hybrid")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{
+		{ID: 1, Text: "donut donut donut", Vector: []float32{0, 1}},
+		{ID: 2, Text: "donut glass", Vector: []float32{1, 0.2}},
+		{ID: 3, Text: "glass plate", Vector: []float32{1, 0}},
+	})
+	full.Close()
+	srh := NewSearcher(filepath.Join(dir, "idx"))
+
+	r, err := srh.HybridSearch(HybridQuery{Text: "donut", Vector: []float32{1, 0}, K: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []int32{1, 2}, docIDs(r.Lexical))
+	assert.Equal(t, []int32{3, 2}, docIDs(r.Vector))
+
+	//两路都命中的doc2排在最前
+	docs, err := srh.Hybrid(HybridQuery{Text: "donut", Vector: []float32{1, 0}, K: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(docs))
+	assert.Equal(t, int32(2), docs[0].ID)
+
+	//没有查询向量及改写模型时只做文本检索
+	docs, err = srh.Hybrid(HybridQuery{Text: "donut"})
+	assert.Nil(t, err)
+	assert.Equal(t, []int32{1, 2}, docIDs(docs))
+	docs, _ = srh.Hybrid(HybridQuery{Vector: []float32{1, 0}, Filter: "donut"})
+	assert.Equal(t, []int32{2, 1}, docIDs(docs))
+
+	_, err = srh.Hybrid(HybridQuery{Text: "donut", Vector: []float32{1}})
+	assert.NotNil(t, err)
+	_, err = srh.Hybrid(HybridQuery{Text: "donut", Fusion: Fusion{Method: "max"}})
+	assert.NotNil(t, err)
+	_, err = srh.Hybrid(HybridQuery{Text: "donut", Model: "unknown"})
+	assert.NotNil(t, err)
+
+	//两路都召回K个, 不受Pipeline.TopN限制; 模型名大小写不敏感
+	srh.pipeline.TopN = 1
+	r, err = srh.HybridSearch(HybridQuery{Text: "donut", Model: "BM25", Vector: []float32{1, 0}, K: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, []int32{1, 2}, docIDs(r.Lexical))
+	assert.Equal(t, 3, len(r.Vector))
+	assert.Equal(t, 1, len(srh.Search("donut")))
+}
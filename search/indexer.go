@@ -1,18 +1,23 @@
 package search
 
 import (
+	"container/heap"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/awesomefly/easysearch/config"
 
 	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/util"
 )
 
 type Indexer interface {
@@ -21,150 +26,479 @@ type Indexer interface {
 	Merge(file string)
 }
 
-const SpiltThresholdDocNum int = 50000
+// ProgressInterval 构建进度输出间隔
+var ProgressInterval = 5 * time.Second
+
+// Index 在临时目录中构建索引, 构建完成后原子发布, 构建过程中或崩溃后旧索引仍然可用
 func Index(c config.Config) {
 	log.Println("Starting index...")
 
-	//remove old index files
-	IndexDir := filepath.Dir(c.Store.IndexFile)
-	IndexPathPrefix := "_tmp." + filepath.Base(c.Store.IndexFile)
-	reg, _ := regexp.Compile(IndexPathPrefix + ".*")
-	if err := Remove(IndexDir, reg); err != nil {
+	//清理上次未完成的构建及过期的段
+	if err := index.CleanupSegments(c.Store.IndexFile); err != nil {
 		log.Fatal(err)
 		return
 	}
-
-	reg1, _ := regexp.Compile("^" + filepath.Base(c.Store.IndexFile) + ".*")
-	if err := Remove(filepath.Dir(c.Store.IndexFile), reg1); err != nil {
+	file, err := index.NewBuildDir(c.Store.IndexFile)
+	if err != nil {
 		log.Fatal(err)
 		return
 	}
+	build := c
+	build.Store.IndexFile = file
 
 	//文件太大，先拆分生成小文件，在内存中构造到排表，最后再归并到一个索引文件
 	//无法直接在文件中构建构建索引，因为posting list在文件中是连续存储的，随着posting list逐渐变长，需要不断的拷贝到新空间
-	Spilt(c, IndexDir+"/"+IndexPathPrefix)
+	IndexDir := filepath.Dir(file)
+	IndexPathPrefix := "_tmp." + filepath.Base(file)
+	files, err := Spilt(build, IndexDir+"/"+IndexPathPrefix)
+	if err != nil {
+		//文档来源读取失败(I/O错误或被截断)时不发布不完整的索引, 当前索引保持不变
+		os.RemoveAll(IndexDir)
+		log.Fatal(err)
+	}
 
 	//归并合并
-	files, err := Walk(IndexDir, reg)
+	if _, err = MergeAll(build, files); err != nil {
+		log.Fatal(err)
+	}
+	reg, _ := regexp.Compile("^" + regexp.QuoteMeta(IndexPathPrefix))
+	if err = Remove(IndexDir, reg); err != nil {
+		log.Fatal(err)
+	}
+
+	seg, err := index.Publish(c.Store.IndexFile, file)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	log.Printf("Published index %s", seg)
+
+	//删除不再被引用的段及旧索引文件, 上一个段保留到下一次发布, 等待DataServer Reload
+	if err = index.CleanupSegments(c.Store.IndexFile); err != nil {
+		log.Print(err)
 	}
-	MergeAll(c, files)
 }
 
-func Spilt(c config.Config, filePrefix string) (files []string) {
+// analyzedDoc 分词后的文档
+type analyzedDoc struct {
+	doc    index.Document
+	fields []index.FieldTokens
+}
+
+// Spilt 并发分词、并发构建多个内存段, 内存段估算大小超过上限后落盘为run文件.
+// 文档来源读取失败时返回错误, 已写入的run文件由调用方删除
+func Spilt(c config.Config, filePrefix string) (files []string, err error) {
 	start := time.Now()
-	//1. spilt to small file.
-	ch, err := index.LoadDocumentStream(c.Store.DumpFile)
+	conf := c.Build.WithDefault()
+	sim := index.SimilarityFromConfig(&c)
+
+	//1. read documents and static scores
+	src, err := index.OpenSource(c.Store.DocumentSource())
 	if err != nil {
-		log.Fatal(err)
-		return
+		return nil, err
 	}
+	priors, err := LoadStaticScores(c)
+	if err != nil {
+		return nil, err
+	}
+	report := &index.ErrorReport{}
+	ch := index.StreamDocuments(src, report)
 
-	//2. index and dump posting list
-	idx := index.NewHashMapIndex()
-
-	WriteToFile := func() string {
-		file := fmt.Sprintf("%s.%d", filePrefix, time.Now().Nanosecond())
-		fmt.Printf("Loaded all docs, Drain to file: %s \n", file)
+	docs := make(chan *index.Document, conf.Workers*16)
+	go func() {
+		for doc := <-ch; doc != nil; doc = <-ch {
+			docs <- doc
+		}
+		close(docs)
+	}()
 
-		index.Drain(idx, file)
-		return file
+	//2. analyze on N workers
+	var (
+		numDocs, numTokens, numRuns int64
+	)
+	analyzed := make(chan analyzedDoc, conf.Workers*16)
+	var workers sync.WaitGroup
+	for i := 0; i < conf.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for doc := range docs {
+				doc.Prior = priors.Get(int32(doc.ID))
+				analyzed <- analyzedDoc{doc: *doc, fields: index.AnalyzeDocument(*doc, &sim)}
+			}
+		}()
 	}
+	go func() {
+		workers.Wait()
+		close(analyzed)
+	}()
+
+	//3. build segments concurrently and dump posting list
+	var (
+		lock     sync.Mutex
+		builders sync.WaitGroup
+	)
+	limit := conf.MemoryMB << 20 / conf.Builders
+	for i := 0; i < conf.Builders; i++ {
+		builders.Add(1)
+		go func(builder int) {
+			defer builders.Done()
+			idx := index.NewHashMapIndex()
+			idx.SetSimilarity(sim) //向量按配置的相似度建图
+			seq := 0
+			flush := func() {
+				if idx.Property().DocNum() == 0 {
+					return
+				}
+				file := fmt.Sprintf("%s.%d.%d", filePrefix, builder, seq)
+				seq++
+				index.Drain(idx, file)
+				atomic.AddInt64(&numRuns, 1)
 
-	for {
-		//timeout := time.NewTimer(1 * time.Second)
-		select {
-		case doc := <-ch:
-			if doc == nil {
-				file := WriteToFile()
+				lock.Lock()
 				files = append(files, file)
-				break
+				lock.Unlock()
+				idx.Clear()
 			}
 
-			idx.Add([]index.Document{*doc}) //内存中操作
-			if idx.Property().DocNum() >= SpiltThresholdDocNum {
-				file := WriteToFile()
-				files = append(files, file)
+			for ad := range analyzed {
+				idx.AddFields(ad.doc, ad.fields) //内存中操作
+				atomic.AddInt64(&numDocs, 1)
+				atomic.AddInt64(&numTokens, int64(len(ad.fields[0].Tokens)))
+				if idx.MemSize() >= limit {
+					flush()
+				}
+			}
+			flush()
+		}(i)
+	}
 
-				idx.Clear()
+	//4. report progress
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n := atomic.LoadInt64(&numDocs)
+				log.Printf("indexed %d docs, %d tokens, %d runs, %.0f docs/s",
+					n, atomic.LoadInt64(&numTokens), atomic.LoadInt64(&numRuns), float64(n)/time.Since(start).Seconds())
+			case <-done:
+				return
 			}
-			continue
-			//case <-timeout.C:
-			//	log.Printf("Read timeout. err: %s", err.Error())
-			//	break
 		}
-		break
+	}()
+
+	builders.Wait()
+	close(done)
+
+	if report.Skipped > 0 || report.Fatal != nil {
+		log.Println(report.String())
+	}
+	sort.Strings(files)
+	if report.Fatal != nil {
+		return files, fmt.Errorf("read documents: %v", report.Fatal)
 	}
-	log.Printf("Dump all documents in %v.", time.Since(start))
-	return files
+	log.Printf("Dump %d documents to %d runs in %v.", numDocs, len(files), time.Since(start))
+	return files, nil
 }
 
-func MergeAll(c config.Config, files []string) {
-	var chs []chan *index.KVPair
-	for i := 0; i < len(files); i++ {
-		chl, err := index.Load(files[i])
-		if err != nil {
-			panic(err)
-		}
-		chs = append(chs, chl)
+// LoadStaticScores 读取Storage.PriorFile配置的文档静态分, 未配置时返回nil
+func LoadStaticScores(c config.Config) (index.StaticScores, error) {
+	if c.Store.PriorFile == "" {
+		return nil, nil
+	}
+	priors, err := index.ReadStaticScores(c.Store.PriorFile)
+	if err != nil {
+		return nil, err
 	}
+	log.Printf("loaded %d static scores from %s", len(priors), c.Store.PriorFile)
+	return priors, nil
+}
 
-	start := time.Now()
-	bt := index.NewBTreeIndex(c.Store.IndexFile)
+// MergeStats 归并统计
+type MergeStats struct {
+	Runs     int //归并的run文件数
+	Rounds   int //归并轮数
+	Keys     int //写入索引的key数
+	Postings int //写入索引的posting数
+}
 
-	//3. merge posting list
-	//频繁往Posting List中追加doc，导致元分配空间不足，需要拷贝PostingList到新的空间，文件读写IO高
-	//必须归并后在写入索引，
-	finished := make(map[int]bool)
-	pairs := make([]*index.KVPair, len(files))
-	for {
-		pivot := -1
-		for i := 0; i < len(pairs); i++ {
-			if pairs[i] == nil && chs[i] != nil {
-				timeout := time.NewTimer(1000 * time.Millisecond)
-				select {
-				case kv := <-chs[i]:
-					if kv == nil {
-						close(chs[i])
-						chs[i] = nil
-					}
-					pairs[i] = kv
-				case <-timeout.C:
-					close(chs[i])
-					chs[i] = nil
-				}
-			}
+// MergeAll 多轮归并run文件, 每轮最多打开MergeFanIn个文件, 最后一轮写入btree索引
+func MergeAll(c config.Config, files []string) (MergeStats, error) {
+	conf := c.Build.WithDefault()
+	start := time.Now()
+	stats := MergeStats{Runs: len(files)}
 
-			if pairs[i] == nil {//已完成一路
-				finished[i] = true
-				continue
-			} else if pivot == -1 {//取第一非空值作为哨兵
-				pivot = i
+	prefix := filepath.Join(filepath.Dir(c.Store.IndexFile), "_tmp."+filepath.Base(c.Store.IndexFile))
+	for ; len(files) > conf.MergeFanIn; stats.Rounds++ {
+		var next []string
+		for i := 0; i < len(files); i += conf.MergeFanIn {
+			group := files[i:util.IfElseInt(i+conf.MergeFanIn < len(files), i+conf.MergeFanIn, len(files))]
+			if len(group) == 1 {
+				next = append(next, group[0])
 				continue
 			}
 
-			if pairs[i].Key < pairs[pivot].Key {
-				pivot = i
-			} else if pairs[i].Key == pairs[pivot].Key {
-				pairs[pivot].Value.Append(pairs[i].Value...)
-				pairs[i] = nil
+			file := fmt.Sprintf("%s.m%d.%d", prefix, stats.Rounds, i/conf.MergeFanIn)
+			p, err := runProperty(group)
+			if err != nil {
+				return stats, err
+			}
+			writer, err := index.NewRunWriter(file)
+			if err != nil {
+				return stats, err
+			}
+			writer.SetProperty(p)
+			if _, _, err = mergeRuns(group, writer.Write); err != nil {
+				writer.Close()
+				return stats, err
+			}
+			if err = writer.Close(); err != nil {
+				return stats, err
 			}
+			sidecars, err := loadSidecars(group)
+			if err == nil {
+				err = sidecars.save(file)
+			}
+			if err != nil {
+				return stats, err
+			}
+			for _, f := range group {
+				os.Remove(f)
+				os.Remove(f + index.PriorSuffix)
+				os.Remove(f + index.TimestampSuffix)
+				os.Remove(f + index.VectorSuffix)
+			}
+			next = append(next, file)
 		}
-		if len(finished) == len(files) { //all finished
-			break
+		log.Printf("merge round %d: %d runs -> %d runs", stats.Rounds, len(files), len(next))
+		files = next
+	}
+
+	p, err := runProperty(files)
+	if err != nil {
+		return stats, err
+	}
+	sidecars, err := loadSidecars(files)
+	if err != nil {
+		return stats, err
+	}
+	if conf.Format == index.FormatMmap {
+		stats.Keys, stats.Postings, err = mergeToMmap(c.Store.IndexFile, files, p, sidecars)
+	} else {
+		stats.Keys, stats.Postings, err = mergeToBTree(c.Store.IndexFile, files, p, sidecars)
+	}
+	stats.Rounds++
+	if err != nil {
+		return stats, err
+	}
+	mergeDuration.Since(start, conf.Format)
+	log.Printf("Merged %d runs in %d rounds, %d keys and %d postings in %v",
+		stats.Runs, stats.Rounds, stats.Keys, stats.Postings, time.Since(start))
+	return stats, nil
+}
+
+// runProperty 合并run文件中记录的文档属性, 旧版本run文件没有属性时为空
+func runProperty(files []string) (index.Property, error) {
+	var p index.Property
+	for _, file := range files {
+		reader, err := index.OpenRunReader(file)
+		if err != nil {
+			return p, err
 		}
+		p.Add(*reader.Property())
+		reader.Close()
+	}
+	return p, nil
+}
 
-		//4. insert "word->posting list"
-		sort.Sort(pairs[pivot].Value)
-		bt.Insert(pairs[pivot].Key, pairs[pivot].Value)
-		pairs[pivot] = nil
+// runSidecars run文件的静态分、文档时间及向量, 与倒排表一起归并
+type runSidecars struct {
+	priors  index.StaticScores
+	times   index.Timestamps
+	vectors *index.HNSW
+}
+
+// loadSidecars 合并run文件的静态分、文档时间及向量, 向量插入到第一个run文件的图中
+func loadSidecars(files []string) (runSidecars, error) {
+	var s runSidecars
+	for _, file := range files {
+		priors, err := index.LoadPriors(file)
+		if err != nil {
+			return s, err
+		}
+		s.priors = s.priors.Merge(priors)
+
+		times, err := index.LoadTimestamps(file)
+		if err != nil {
+			return s, err
+		}
+		s.times = s.times.Merge(times)
+
+		vectors, err := index.LoadVectors(file)
+		if err != nil {
+			return s, err
+		}
+		if s.vectors == nil {
+			s.vectors = vectors
+		} else {
+			s.vectors.Merge(vectors)
+		}
 	}
-	log.Printf("Indexed %d documents and %d keys in %v", bt.Property().DocNum(), bt.BT.Count(), time.Since(start))
+	return s, nil
+}
+
+func (s runSidecars) save(file string) error {
+	if err := index.SavePriors(file, s.priors); err != nil {
+		return err
+	}
+	if err := index.SaveTimestamps(file, s.times); err != nil {
+		return err
+	}
+	return index.SaveVectors(file, s.vectors)
+}
 
-	bt.BT.Stats(true)
+// mergeToBTree 最后一轮归并写入btree索引, p为空时使用Insert统计的属性
+func mergeToBTree(file string, files []string, p index.Property, sidecars runSidecars) (int, int, error) {
+	bt := index.NewBTreeIndex(file)
+	//频繁往Posting List中追加doc，导致元分配空间不足，需要拷贝PostingList到新的空间，文件读写IO高
+	//必须归并后在写入索引，
+	keys, postings, err := mergeRuns(files, func(key string, pl index.PostingList) error {
+		//insert "word->posting list"
+		bt.Insert(key, pl)
+		return nil
+	})
+	if err == nil {
+		bt.BT.Stats(true)
+	}
+	bt.MarkSorted()
+	if p.DocNum() > 0 {
+		bt.SetProperty(p)
+	}
+	bt.SetStaticScores(sidecars.priors)
+	bt.SetTimestamps(sidecars.times)
+	bt.SetVectors(sidecars.vectors)
 	bt.Close()
-	time.Sleep(5*time.Second)
+	return keys, postings, err
+}
+
+// mergeToMmap 最后一轮归并写入只读的mmap索引段, p为空时使用写入过程中统计的属性
+func mergeToMmap(file string, files []string, p index.Property, sidecars runSidecars) (int, int, error) {
+	writer, err := index.NewMmapWriter(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	writer.SetStaticScores(sidecars.priors)
+	writer.SetTimestamps(sidecars.times)
+	writer.MarkSorted()
+	writer.SetVectors(sidecars.vectors)
+	keys, postings, err := mergeRuns(files, writer.Write)
+	var prop *index.Property
+	if p.DocNum() > 0 {
+		prop = &p
+	}
+	if e := writer.Close(prop); err == nil {
+		err = e
+	}
+	return keys, postings, err
+}
+
+// runCursor run文件的当前读取位置
+type runCursor struct {
+	file   string
+	reader *index.RunReader
+	key    string
+	pl     index.PostingList
+}
+
+// runHeap 按key的最小堆
+type runHeap []*runCursor
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].key < h[j].key }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runCursor)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// advance reads the next key of cursor, returns false at the end of run
+func (cur *runCursor) advance() (bool, error) {
+	last := cur.key
+	key, pl, err := cur.reader.Next()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read run %s: %v", cur.file, err)
+	}
+	if last != "" && key <= last {
+		return false, fmt.Errorf("run %s is not sorted: key %q after %q", cur.file, key, last)
+	}
+	cur.key, cur.pl = key, pl
+	return true, nil
+}
+
+// mergeRuns k路归并多个按key排序的run文件, 相同key的posting list合并后按key顺序调用emit
+func mergeRuns(files []string, emit func(key string, pl index.PostingList) error) (keys int, postings int, err error) {
+	h := make(runHeap, 0, len(files))
+	defer func() {
+		for _, cur := range h {
+			cur.reader.Close()
+		}
+	}()
+
+	for _, file := range files {
+		reader, err := index.OpenRunReader(file)
+		if err != nil {
+			return keys, postings, err
+		}
+		cur := &runCursor{file: file, reader: reader}
+		ok, err := cur.advance()
+		if err != nil {
+			reader.Close()
+			return keys, postings, err
+		}
+		if !ok {
+			reader.Close()
+			continue
+		}
+		h = append(h, cur)
+	}
+	heap.Init(&h)
+
+	for h.Len() > 0 {
+		key := h[0].key
+		var pl index.PostingList
+		for h.Len() > 0 && h[0].key == key {
+			cur := h[0]
+			pl = append(pl, cur.pl...)
+
+			ok, err := cur.advance()
+			if err != nil {
+				return keys, postings, err
+			}
+			if ok {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+				cur.reader.Close()
+			}
+		}
+
+		sort.Sort(pl)
+		if err := emit(key, pl); err != nil {
+			return keys, postings, err
+		}
+		keys++
+		postings += len(pl)
+	}
+	return keys, postings, nil
 }
 
 func Remove(dir string, reg *regexp.Regexp) error {
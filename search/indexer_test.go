@@ -1,11 +1,19 @@
 package search
 
 import (
-	"github.com/awesomefly/easysearch/config"
-	"github.com/awesomefly/easysearch/index"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strings"
 	"testing"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestIndexer(t *testing.T) {
@@ -30,4 +38,245 @@ func TestIndex(t *testing.T) {
 
 	bt := index.NewBTreeIndex(conf.Store.IndexFile)
 	bt.BT.Stats(true)
-}
\ No newline at end of file
+}
+func TestIndexPipeline(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "indexer")
+	defer os.RemoveAll(dir)
+
+	var lines []string
+	for i := 1; i <= 200; i++ {
+		lines = append(lines, fmt.Sprintf(`{"id": %d, "text": "donut doc%d %s"}`, i, i%7, strings.Repeat("glass ", i%3+1)))
+	}
+	source := filepath.Join(dir, "docs.jsonl")
+	assert.Nil(t, ioutil.WriteFile(source, []byte(strings.Join(lines, "\n")), 0644))
+
+	conf := config.Config{
+		Store: config.Storage{
+			IndexFile: filepath.Join(dir, "idx"),
+			Source:    config.Source{Type: index.JSONSource, Path: source},
+		},
+		Build: config.Build{Workers: 3, Builders: 2, MergeFanIn: 2},
+	}
+	files, err := Spilt(conf, filepath.Join(dir, "_tmp.idx"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+
+	//拆成更多run文件, 验证多轮归并
+	more := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		idx := index.NewHashMapIndex()
+		idx.Add([]index.Document{{ID: 1000 + i, Text: "donut extra"}})
+		file := fmt.Sprintf("%s/_tmp.idx.x.%d", dir, i)
+		index.Drain(idx, file)
+		more = append(more, file)
+	}
+	stats, err := MergeAll(conf, append(files, more...))
+	assert.Nil(t, err)
+	assert.Equal(t, 7, stats.Runs)
+	assert.Equal(t, 3, stats.Rounds)
+	assert.Equal(t, 10, stats.Keys) //donut glass extra doc0-doc6
+	assert.Equal(t, 205+200+5+200, stats.Postings)
+
+	bt := index.NewBTreeIndex(conf.Store.IndexFile)
+	defer bt.Close()
+	donut := index.PostingList(bt.Get("donut"))
+	assert.Equal(t, 205, donut.Len())
+	assert.True(t, sort.IsSorted(donut))
+	assert.Equal(t, 200, index.PostingList(bt.Get("glass")).Len())
+	assert.Equal(t, 5, index.PostingList(bt.Get("extra")).Len())
+	glass := index.PostingList(bt.Get("glass")).Find(5)
+	assert.Equal(t, int32(3), glass.TF)
+	assert.Equal(t, 205, bt.Property().DocNum())        //文档数而非倒排表长度
+	assert.Equal(t, 801+10, bt.Property().TokenCount()) //正文词数而非key数
+
+	//中间run文件已被删除
+	left, _ := Walk(dir, regexp.MustCompile(`^_tmp\.idx\.m`))
+	assert.LessOrEqual(t, len(left), 2)
+}
+
+func TestMergeRunsError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "indexer")
+	defer os.RemoveAll(dir)
+
+	idx := index.NewHashMapIndex()
+	idx.Add([]index.Document{{ID: 1, Text: "donut glass plate"}})
+	good := filepath.Join(dir, "good")
+	index.Drain(idx, good)
+
+	//截断的run文件返回错误, 而不是当作结束
+	data, _ := ioutil.ReadFile(good)
+	bad := filepath.Join(dir, "bad")
+	assert.Nil(t, ioutil.WriteFile(bad, data[:len(data)-3], 0644))
+
+	var keys []string
+	_, _, err := mergeRuns([]string{good, bad}, func(key string, pl index.PostingList) error {
+		keys = append(keys, key)
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unexpected EOF")
+
+	keys = keys[:0]
+	n, postings, err := mergeRuns([]string{good, good}, func(key string, pl index.PostingList) error {
+		keys = append(keys, key)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 6, postings)
+	assert.True(t, sort.StringsAreSorted(keys))
+
+	_, err = MergeAll(config.Config{Store: config.Storage{IndexFile: filepath.Join(dir, "idx")}}, []string{good, bad})
+	assert.NotNil(t, err)
+}
+
+func TestSpiltTruncatedSource(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "indexer")
+	defer os.RemoveAll(dir)
+
+	//被截断的dump读取失败, 返回错误而不是构建不完整的索引
+	source := filepath.Join(dir, "dump.xml")
+	assert.Nil(t, ioutil.WriteFile(source, []byte("<feed><doc><title>A</title><abstract>donut</abstract></doc><doc>"), 0644))
+	conf := config.Config{Store: config.Storage{IndexFile: filepath.Join(dir, "idx"), DumpFile: source}}
+	_, err := Spilt(conf, filepath.Join(dir, "_tmp.idx"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "read documents")
+}
+
+func TestIndexPublish(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "indexer")
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "docs.jsonl")
+	conf := config.Config{
+		Store: config.Storage{
+			IndexFile: filepath.Join(dir, "idx"),
+			Source:    config.Source{Type: index.JSONSource, Path: source},
+		},
+	}
+	ioutil.WriteFile(source, []byte(`{"id": 1, "text": "donut"}`), 0644)
+	Index(conf)
+
+	srh := NewSearcher(conf.Store.IndexFile)
+	assert.Equal(t, []int{1}, index.PostingList(srh.Search("donut")).IDs())
+
+	//重新构建并发布, 旧索引在重新加载前仍然可用
+	ioutil.WriteFile(source, []byte(`{"id": 2, "text": "donut"}`), 0644)
+	Index(conf)
+	assert.Equal(t, []int{1}, index.PostingList(srh.Search("donut")).IDs())
+
+	assert.Nil(t, srh.Reload())
+	assert.Equal(t, []int{2}, index.PostingList(srh.Search("donut")).IDs())
+
+	//加载正在使用的段时不退役, 文件不会被删除
+	current, _ := index.ResolveIndex(conf.Store.IndexFile)
+	assert.Nil(t, srh.Load(conf.Store.IndexFile, FullIndex))
+	assert.Nil(t, srh.Load(current, FullIndex))
+	_, err := os.Stat(current + index.ManifestSuffix)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2}, index.PostingList(srh.Search("donut")).IDs())
+
+	//searcher重新加载后删除旧段, 只保留当前段
+	entries, _ := ioutil.ReadDir(dir)
+	var segs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			segs = append(segs, filepath.Join(dir, e.Name()))
+		}
+	}
+	assert.Equal(t, []string{filepath.Dir(current)}, segs)
+}
+
+func TestIndexStaticScores(t *testing.T) {
+	for _, format := range []string{index.FormatBTree, index.FormatMmap} {
+		dir, _ := ioutil.TempDir("", "indexer")
+
+		var lines []string
+		for i := 1; i <= 30; i++ {
+			if i%10 == 0 {
+				lines = append(lines, fmt.Sprintf(`{"id": %d, "text": "doc%d donut", "timestamp": %d}`, i, i, 1000+i))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf(`{"id": %d, "text": "donut doc%d"}`, i, i))
+		}
+		source := filepath.Join(dir, "docs.jsonl")
+		assert.Nil(t, ioutil.WriteFile(source, []byte(strings.Join(lines, "\n")), 0644))
+		prior := filepath.Join(dir, "prior.txt")
+		assert.Nil(t, index.WriteStaticScores(prior, index.StaticScores{7: 1, 21: 0.5, 999: 0.1}))
+
+		conf := config.Config{
+			Store: config.Storage{
+				IndexFile: filepath.Join(dir, "idx"),
+				PriorFile: prior,
+				Source:    config.Source{Type: index.JSONSource, Path: source},
+			},
+			Build:      config.Build{Workers: 2, Builders: 2, MemoryMB: 1, MergeFanIn: 2, Format: format},
+			Similarity: config.SimilarityParameters{PriorWeight: 10},
+		}
+		Index(conf)
+
+		srh := NewSearcher(conf.Store.IndexFile).WithSimilarity(index.SimilarityFromConfig(&conf))
+		assert.Equal(t, index.StaticScores{7: 1, 21: 0.5}, srh.full().StaticScores(), format) //只保留索引中的文档
+		assert.Equal(t, index.Timestamps{10: 1010, 20: 1020, 30: 1030}, srh.full().Timestamps(), format)
+		for _, doc := range srh.full().Get("donut") {
+			pos := int32(1) //词第一次出现的位置+1
+			if doc.ID%10 == 0 {
+				pos = 2
+			}
+			assert.Equal(t, pos, doc.Pos, format)
+		}
+		docs := index.PostingList(srh.Search("donut"))
+		assert.Equal(t, 10, docs.Len(), format)
+		sort.Slice(docs, func(i, j int) bool { return docs[i].Score > docs[j].Score })
+		assert.Equal(t, []int{7, 21}, docs[:2].IDs(), format) //相关性相同时静态分高的文档排在前面
+
+		//归并生成的全量索引倒排表按文档ID排序
+		in, err := index.OpenInspector(conf.Store.IndexFile)
+		assert.Nil(t, err, format)
+		report, _ := in.Check()
+		assert.True(t, in.Sorted, format)
+		assert.Equal(t, 0, report.ProblemCount, format)
+		in.Close()
+
+		left, _ := Walk(dir, regexp.MustCompile(`^_tmp\.`))
+		assert.Equal(t, 0, len(left), format)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestIndexVectors(t *testing.T) {
+	for _, format := range []string{index.FormatBTree, index.FormatMmap} {
+		dir, _ := ioutil.TempDir("", "indexer")
+
+		var lines []string
+		for i := 1; i <= 30; i++ {
+			lines = append(lines, fmt.Sprintf(`{"id": %d, "text": "donut doc%d", "emb": [%d, 1]}`, i, i, i%5))
+		}
+		source := filepath.Join(dir, "docs.jsonl")
+		assert.Nil(t, ioutil.WriteFile(source, []byte(strings.Join(lines, "\n")), 0644))
+
+		conf := config.Config{
+			Store: config.Storage{
+				IndexFile: filepath.Join(dir, "idx"),
+				Source:    config.Source{Type: index.JSONSource, Path: source, Fields: config.SourceFields{Vector: "emb"}},
+			},
+			Build:  config.Build{Workers: 2, Builders: 2, MemoryMB: 1, MergeFanIn: 2, Format: format},
+			Vector: config.Vector{Metric: "dot"},
+		}
+		Index(conf)
+
+		srh := NewSearcher(conf.Store.IndexFile).WithSimilarity(index.SimilarityFromConfig(&conf))
+		assert.Equal(t, 30, srh.full().Vectors().Len(), format)
+		assert.Equal(t, index.DotProduct, srh.full().Vectors().Config().Metric, format)
+		docs, err := srh.KNN([]float32{1, 0}, 3, "")
+		assert.Nil(t, err)
+		for _, doc := range docs {
+			assert.Equal(t, float64(4), doc.Score, format) //i%5==4的文档内积最大
+			assert.Equal(t, int32(4), doc.ID%5, format)
+		}
+
+		left, _ := Walk(dir, regexp.MustCompile(`^_tmp\.`))
+		assert.Equal(t, 0, len(left), format)
+		os.RemoveAll(dir)
+	}
+}
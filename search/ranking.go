@@ -0,0 +1,100 @@
+package search
+
+import (
+	"sort"
+	"time"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/score"
+)
+
+// Pipeline 多阶段排序: 召回 -> 粗排截断 -> 特征提取及重排 -> topN, 每个阶段有各自的截断数
+type Pipeline struct {
+	RetrievalK int     //每个索引召回的文档数
+	ChampionR  int     //召回时每个词的胜者表长度
+	RerankK    int     //按召回得分截断后进入重排的文档数
+	TopN       int     //最终返回的文档数
+	HalfLife   float64 //时效性特征的半衰期(秒)
+
+	Ranker score.Ranker //重排模型, 为nil时按召回得分排序
+}
+
+func DefaultPipeline() Pipeline {
+	p, _ := NewPipeline(config.Ranking{})
+	return p
+}
+
+// NewPipeline 由配置生成排序参数, 配置了模型时读取模型文件
+func NewPipeline(c config.Ranking) (Pipeline, error) {
+	c = c.WithDefault()
+	p := Pipeline{
+		RetrievalK: c.RetrievalK,
+		ChampionR:  c.ChampionR,
+		RerankK:    c.RerankK,
+		TopN:       c.TopN,
+		HalfLife:   float64(c.HalfLife),
+	}
+	if c.Model != "" {
+		ranker, err := score.LoadRanker(c.Model)
+		if err != nil {
+			return p, err
+		}
+		p.Ranker = ranker
+	}
+	return p, nil
+}
+
+// WithPipeline 设置多阶段排序参数, 需要在查询前调用
+func (srh *Searcher) WithPipeline(p Pipeline) *Searcher {
+	srh.pipeline = p
+	return srh
+}
+
+// rank 按召回得分截断RerankK个(不少于n), 有重排模型时在命中的索引中提取特征并重新打分, 最后截断n个.
+// explain非nil时记录重排特征及得分
+func (srh *Searcher) rank(docs []index.Doc, origin map[int32]index.Index, terms []string, n int, explain map[int32]*index.Explanation) []index.Doc {
+	p := srh.pipeline
+	byScore := func() {
+		sort.SliceStable(docs, func(i, j int) bool {
+			return docs[i].Score > docs[j].Score //降序
+		})
+	}
+	byScore()
+
+	if p.Ranker != nil {
+		rerankK := p.RerankK
+		if n > rerankK {
+			rerankK = n
+		}
+		if len(docs) > rerankK {
+			docs = docs[:rerankK]
+		}
+		//同一索引中的文档一起提取特征
+		groups := make(map[index.Index][]int)
+		for i, doc := range docs {
+			idx := origin[doc.ID]
+			groups[idx] = append(groups[idx], i)
+		}
+		ctx := &index.FeatureContext{Terms: terms, Now: time.Now().Unix(), HalfLife: p.HalfLife}
+		for idx, pos := range groups {
+			hits := make([]index.Doc, len(pos))
+			for j, i := range pos {
+				hits[j] = docs[i]
+			}
+			features := index.ExtractFeatures(idx, hits, ctx)
+			for j, i := range pos {
+				docs[i].Score = p.Ranker.Score(features[j])
+				if e := explain[docs[i].ID]; e != nil {
+					e.Features, e.Rerank = features[j], docs[i].Score
+				}
+			}
+		}
+		byScore()
+	}
+
+	if len(docs) > n {
+		docs = docs[:n]
+	}
+	return docs
+}
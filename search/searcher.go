@@ -1,7 +1,10 @@
 package search
 
 import (
+	"errors"
 	"log"
+	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"sync"
@@ -13,6 +16,7 @@ import (
 
 	"github.com/RoaringBitmap/roaring"
 
+	"github.com/awesomefly/easysearch/config"
 	"github.com/awesomefly/easysearch/index"
 	"github.com/awesomefly/easysearch/paraphrase/serving"
 	"github.com/awesomefly/easysearch/util"
@@ -35,6 +39,7 @@ const (
 type Message struct {
 	MsgType MsgType
 	Msg     string
+	Done    chan struct{} //处理完成后关闭, 可以为nil
 }
 
 type DoubleBuffer struct {
@@ -43,6 +48,8 @@ type DoubleBuffer struct {
 
 	Indices []*index.HashMapIndex
 	Queues  []chan index.Document
+
+	onChange atomic.Value //func(), 读索引切换或写入时调用
 }
 
 func NewDoubleBuffer() *DoubleBuffer {
@@ -88,6 +95,9 @@ func (b *DoubleBuffer) Start() chan Message {
 				case FLUSH:
 					b.DoFlush()
 				}
+				if msg.Done != nil {
+					close(msg.Done)
+				}
 			default:
 				b.DoAdd()
 			}
@@ -121,6 +131,7 @@ func (b *DoubleBuffer) DoFlush() {
 
 		if len(docs) > 0 {
 			idx.Add(docs)
+			b.changed()
 		}
 	}
 }
@@ -148,7 +159,9 @@ func (b *DoubleBuffer) DoAdd() {
 	}
 
 	if len(b.Queues[1-writeIdx]) > 10 {
-		atomic.CompareAndSwapUint32(&b.CurrentIdx, writeIdx, 1-writeIdx)
+		if atomic.CompareAndSwapUint32(&b.CurrentIdx, writeIdx, 1-writeIdx) {
+			b.changed()
+		}
 		//适当sleep，让历史读写操作执行完，避免读写并发
 		time.Sleep(100 * time.Millisecond)
 	}
@@ -160,6 +173,26 @@ func (b *DoubleBuffer) Add(doc index.Document) {
 	}
 }
 
+// WithSimilarity 设置打分参数及需要索引的字段
+func (b *DoubleBuffer) WithSimilarity(sim index.SimilarityConfig) *DoubleBuffer {
+	for i := 0; i < len(b.Indices); i++ {
+		b.Indices[i].SetSimilarity(sim)
+	}
+	return b
+}
+
+// OnChange 设置读索引变化(切换或Flush写入)时的回调, 如使查询结果缓存失效
+func (b *DoubleBuffer) OnChange(fn func()) *DoubleBuffer {
+	b.onChange.Store(fn)
+	return b
+}
+
+func (b *DoubleBuffer) changed() {
+	if fn, ok := b.onChange.Load().(func()); ok && fn != nil {
+		fn()
+	}
+}
+
 func (b *DoubleBuffer) ReadIndex() *index.HashMapIndex {
 	writeIdx := atomic.LoadUint32(&b.CurrentIdx)
 	return b.Indices[1-writeIdx]
@@ -172,6 +205,17 @@ func (b *DoubleBuffer) Flush() {
 	}
 }
 
+// Sync flushes queued documents and waits until they are indexed
+func (b *DoubleBuffer) Sync() {
+	done := make(chan struct{})
+	b.msgChan <- Message{
+		MsgType: FLUSH,
+		Msg:     "sync",
+		Done:    done,
+	}
+	<-done
+}
+
 func (b *DoubleBuffer) Clear() {
 }
 
@@ -265,7 +309,7 @@ func (b *IndexArray) Evict(dr index.DataRange) []*index.BTreeIndex {
 
 type Searcher struct {
 	//全量索引/主索引，历史全量数据静态构建成本高
-	fullIndex unsafe.Pointer
+	fullIndex unsafe.Pointer //*index.Segment btree或mmap格式
 
 	// 辅助索引（auxiliary index），全量索引较大重建不方便，可以近期新增数据构建成增量索引。
 	// eg.每天只对1天前的数据重建索引，当天数据构建成增量索引
@@ -277,16 +321,67 @@ type Searcher struct {
 
 	//deleteList []index.Doc //delete docs list.  update doc = delete old doc and create new one
 	//BloomFilter  *bloom.Filter //也可使用布谷鸟过滤器效率更高
-	roaringFilter *roaring.Bitmap //todo：如何删除过期数据
+	roaringFilter *roaring.Bitmap                   //todo：如何删除过期数据
+	superseded    map[index.Index]*roaring.Bitmap   //全量及辅助索引中被更新覆盖的文档, 见supersede
+	drainingIncr  map[*DoubleBuffer]*roaring.Bitmap //Drain中的增量索引里被更新覆盖的文档
+	filterLock    sync.RWMutex
+
+	model    *serving.ParaphraseModel //todo: 移到search server更合适
+	expander *serving.Expander
 
-	model *serving.ParaphraseModel //todo: 移到search server更合适
+	highlighter *Highlighter //为nil时不高亮
+
+	results    *util.LRU           //查询结果缓存, 为nil时不缓存
+	postings   *index.PostingCache //btree索引的倒排表缓存, 为nil时不缓存
+	generation uint64              //索引版本, 任一层级的索引或删除列表变化时递增, 是结果缓存key的一部分
+
+	writeLock sync.RWMutex   //写操作之间共享, Snapshot获取各层索引时独占
+	draining  sync.WaitGroup //进行中的Drain
+
+	similarity index.SimilarityConfig //所有索引共用的打分参数
+	pipeline   Pipeline               //多阶段排序参数
 
 	indexFile string
 }
 
+// openIndex 有清单的索引校验后打开, 没有清单的按新建或旧格式索引打开
+func openIndex(file string) (*index.BTreeIndex, error) {
+	idx, err := index.OpenBTreeIndex(file)
+	if errors.Is(err, index.ErrNoManifest) {
+		if _, e := os.Stat(file + ".idx"); e == nil {
+			log.Printf("index %s has no manifest, skip verification", file)
+		}
+		return index.NewBTreeIndex(file), nil
+	}
+	return idx, err
+}
+
+// openSegment 按清单中的格式打开全量索引, 没有清单的按btree索引打开
+func openSegment(file string) (index.Segment, error) {
+	seg, err := index.OpenSegment(file)
+	if errors.Is(err, index.ErrNoManifest) {
+		idx, err := openIndex(file)
+		if err != nil {
+			return nil, err
+		}
+		return idx, nil
+	}
+	return seg, err
+}
+
+// NewSearcher file为索引的逻辑路径, 存在file.current时加载其指向的段.
+// 不清理构建目录, 由Index/Restore等构建方在开始和发布后清理, 避免删除进行中的构建
 func NewSearcher(file string) *Searcher {
+	current, err := index.ResolveIndex(file)
+	if err != nil {
+		panic(err.Error())
+	}
+	fullIndex, err := openSegment(current)
+	if err != nil {
+		panic(err.Error())
+	}
 	srh := &Searcher{
-		fullIndex: unsafe.Pointer(index.NewBTreeIndex(file)),
+		fullIndex: unsafe.Pointer(&fullIndex),
 		auxIndex:  unsafe.Pointer(NewIndexArray().WithFile(file + ".aux." + strconv.Itoa(int(time.Now().Unix())))),
 		incrIndex: unsafe.Pointer(NewDoubleBuffer().WithDataRange(0)),
 		//deleteList: make([]index.Doc, 0),
@@ -294,50 +389,110 @@ func NewSearcher(file string) *Searcher {
 		roaringFilter: roaring.New(),
 		model:         nil,
 		indexFile:     file,
+		similarity:    index.DefaultSimilarity(),
+		pipeline:      DefaultPipeline(),
 	}
+	(*DoubleBuffer)(srh.incrIndex).OnChange(srh.invalidate)
 	return srh
 }
 
+// WithSimilarity 设置所有索引的打分参数, 需要在写入和查询前调用
+func (srh *Searcher) WithSimilarity(sim index.SimilarityConfig) *Searcher {
+	srh.similarity = sim
+	srh.full().SetSimilarity(sim)
+	for _, idx := range (*IndexArray)(atomic.LoadPointer(&srh.auxIndex)).Indices() {
+		idx.SetSimilarity(sim)
+	}
+	(*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).WithSimilarity(sim)
+	return srh
+}
+
+// InitParaphrase 加载词向量模型, 使用默认的扩展参数
 func (srh *Searcher) InitParaphrase(file string) {
-	srh.model = serving.NewModel(file)
+	srh.WithParaphrase(serving.NewExpander(config.Paraphrase{}, serving.NewModel(file), nil))
+}
+
+// WithParaphrase 设置查询扩展, 需要在查询前调用, 可以在多个Searcher间共享
+func (srh *Searcher) WithParaphrase(e *serving.Expander) *Searcher {
+	srh.expander = e
+	srh.model = nil
+	if e != nil {
+		srh.model = e.Model()
+	}
+	return srh
+}
+
+// Paraphrase 查询扩展词及其权重(与查询词的相似度), 未设置扩展时返回nil
+func (srh *Searcher) Paraphrase(query string) index.Boost {
+	if srh.expander == nil {
+		return nil
+	}
+	return srh.expander.Expand(query)
 }
 
-func (srh *Searcher) Paraphrase(texts []string, n int) []string {
+// Embed 使用改写模型把查询文本转换为向量, 用于KNN. 未加载模型或查询词都不在模型中时返回nil
+func (srh *Searcher) Embed(query string) []float32 {
 	if srh.model == nil {
 		return nil
 	}
-	var (
-		positive = texts
-		negative []string
-	)
-	l := len(texts)
-	sim := srh.model.GetSimilar(positive, negative, l+n)
-	return sim[l:]
+	return srh.model.Embed(util.Analyze(query))
 }
 
 // Add doc to index double-buffer async
 // write need lock but read do not
 func (srh *Searcher) Add(doc index.Document) {
+	srh.add(doc, false)
+}
+
+func (srh *Searcher) add(doc index.Document, update bool) {
+	srh.writeLock.RLock()
+	defer srh.writeLock.RUnlock()
+
 	incr := (*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex))
 
 	//跨天，新建个增量索引
 	end := incr.ReadIndex().Property().DataRange().End
 	if doc.Timestamp > end {
-		srh.Drain(end)
+		srh.drain(end)
+	}
+
+	//Drain之后标记, 旧版本可能在刚开始Drain的增量索引中
+	if update {
+		srh.filterLock.Lock()
+		srh.roaringFilter.Remove(uint32(doc.ID))
+		srh.supersede(int32(doc.ID))
+		srh.filterLock.Unlock()
+		srh.invalidate()
 	}
 
 	//可能触发Drain需要重新Load
 	(*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).Add(doc)
+	if srh.highlighter != nil {
+		srh.highlighter.Store().Put(doc)
+	}
 }
 
 // Del doc from index
 func (srh *Searcher) Del(doc index.Document) {
-	//todo: 加锁
+	srh.writeLock.RLock()
+	defer srh.writeLock.RUnlock()
+	srh.filterLock.Lock()
+	defer srh.filterLock.Unlock()
 	srh.roaringFilter.Add(uint32(doc.ID))
+	srh.invalidate()
+	if srh.highlighter != nil {
+		srh.highlighter.Store().Delete(int32(doc.ID))
+	}
+}
+
+// Update 用新版本替换文档: 全量、辅助索引中的旧版本按索引标记为已覆盖, 增量索引中的旧版本直接替换.
+// 已删除的文档更新后重新可见
+func (srh *Searcher) Update(doc index.Document) {
+	srh.add(doc, true)
 }
 
 func (srh *Searcher) Count() int {
-	a := (*index.BTreeIndex)(atomic.LoadPointer(&srh.fullIndex)).Property().DocNum()
+	a := srh.full().Property().DocNum()
 	copyData := (*IndexArray)(atomic.LoadPointer(&srh.auxIndex)).Indices()
 	for i := 0; i < len(copyData); i++ {
 		a += copyData[i].Property().DocNum()
@@ -347,7 +502,7 @@ func (srh *Searcher) Count() int {
 }
 
 func (srh *Searcher) Clear() {
-	(*index.BTreeIndex)(atomic.LoadPointer(&srh.fullIndex)).Clear()
+	srh.full().Clear()
 	copyData := (*IndexArray)(atomic.LoadPointer(&srh.auxIndex)).Indices()
 	for i := 0; i < len(copyData); i++ {
 		copyData[i].Clear()
@@ -358,17 +513,32 @@ func (srh *Searcher) Clear() {
 // 实际的原地更新策略，需要PostingList末尾预留足够空间，否则大量PostingList需要移动效率更低
 // 磁盘空间足够时使用再合并策略，实现简单且不影响并发，但需要足够的内存
 func (srh *Searcher) Drain(timestamp int) {
-	oldIncr := (*DoubleBuffer)(atomic.SwapPointer(&srh.incrIndex, unsafe.Pointer(NewDoubleBuffer().WithDataRange(int64(timestamp)))))
+	srh.writeLock.RLock()
+	defer srh.writeLock.RUnlock()
+	srh.drain(timestamp)
+}
+
+func (srh *Searcher) drain(timestamp int) {
+	oldIncr := (*DoubleBuffer)(atomic.SwapPointer(&srh.incrIndex, unsafe.Pointer(NewDoubleBuffer().WithDataRange(int64(timestamp)).WithSimilarity(srh.similarity).OnChange(srh.invalidate))))
+	srh.beginDrain(oldIncr)
+	srh.invalidate()
+	srh.draining.Add(1)
 	go func() {
+		defer srh.draining.Done()
 		//flush after sleep any second
 		time.Sleep(100 * time.Millisecond)
-		oldIncr.Flush()
+		oldIncr.Sync() //等待队列中的文档写入后再合并
 		oldIncr.Stop()
+		start := time.Now()
+		defer drainDuration.Since(start, filepath.Base(srh.indexFile))
 
 		oldIncrDR := oldIncr.ReadIndex().Property().DataRange()
 		auxIdxArray := (*IndexArray)(atomic.LoadPointer(&srh.auxIndex))
 		oldAux := auxIdxArray.Hit(oldIncrDR)
 		if oldAux != nil {
+			//oldAux中已被覆盖的旧版本不再合并
+			stale := srh.supersededOf(oldAux)
+
 			//合并keys
 			keys := make(sort.StringSlice, len(oldIncr.ReadIndex().Map())+int(oldAux.BT.Count()))
 			for k := range oldIncr.ReadIndex().Map() {
@@ -387,9 +557,10 @@ func (srh *Searcher) Drain(timestamp int) {
 
 			//合并到新索引
 			newAux := index.NewBTreeIndex(srh.indexFile + ".aux." + strconv.Itoa(int(time.Now().Unix())))
+			newAux.SetSimilarity(srh.similarity)
 			for i := 0; i < keys.Len(); i++ {
 				key := keys[i]
-				pl := oldAux.Lookup(key, false)
+				pl := filterDeleted(oldAux.Lookup(key, false), stale)
 				if pl2 := oldIncr.ReadIndex().Get(key); pl2 != nil {
 					pl = append(pl, pl2...)
 				}
@@ -398,43 +569,153 @@ func (srh *Searcher) Drain(timestamp int) {
 				}
 			}
 			newAux.SetProperty(*oldAux.Property())
-			newAux.Property().SetDocNum(oldIncr.ReadIndex().Property().DocNum() + oldAux.Property().DocNum())
-			newAux.Property().SetTokenCount(oldIncr.ReadIndex().Property().TokenCount() + oldAux.Property().TokenCount())
+			newAux.Property().Add(*oldIncr.ReadIndex().Property())
+			newAux.SetStaticScores(index.StaticScores(nil).Merge(filterPriors(oldAux.StaticScores(), stale)).Merge(oldIncr.ReadIndex().StaticScores()))
+			newAux.SetTimestamps(index.Timestamps(nil).Merge(filterTimestamps(oldAux.Timestamps(), stale)).Merge(oldIncr.ReadIndex().Timestamps()))
+			newAux.SetVectors((*index.HNSW)(nil).Merge(filterVectors(oldAux.Vectors(), stale)).Merge(oldIncr.ReadIndex().Vectors()))
 			newAux.BT.Drain()
+			newAux.SetPostingCache(srh.postings)
 
 			//oldAux = (*index.BTreeIndex)(atomic.SwapPointer(&srh.auxIndex, unsafe.Pointer(newAux)))
-			if auxIdxArray.Swap(oldAux, newAux) {
-				oldAux.Clear()
+			srh.filterLock.Lock()
+			swapped := auxIdxArray.Swap(oldAux, newAux)
+			if swapped {
+				srh.endDrain(oldIncr, oldAux, newAux, stale)
+			} else {
+				srh.endDrain(oldIncr, nil, nil, nil)
+			}
+			srh.filterLock.Unlock()
+			if swapped {
+				srh.invalidate()
+				oldAux.Retire()
 				oldIncr.Clear()
 			}
 		} else {
 			idx := index.NewBTreeIndex(srh.indexFile + ".aux." + strconv.Itoa(oldIncrDR.Start))
+			idx.SetSimilarity(srh.similarity)
 			idx.Property().SetDataRange(oldIncrDR)
+			idx.SetPostingCache(srh.postings)
 			auxIdxArray.Add(idx)
+			srh.filterLock.Lock()
+			srh.endDrain(oldIncr, nil, nil, nil)
+			srh.filterLock.Unlock()
+			srh.invalidate()
 		}
 	}()
 }
 
 // Load index, use for rebuild index
-func (srh *Searcher) Load(file string, flag IndexType) {
-	newIndex := index.NewBTreeIndex(file)
+// 索引文件损坏或格式不兼容时返回错误, 不替换当前索引
+func (srh *Searcher) Load(file string, flag IndexType) error {
 	auxIdxArray := (*IndexArray)(atomic.LoadPointer(&srh.auxIndex))
 
-	evicts := auxIdxArray.Evict(newIndex.Property().DataRange())
+	var evicts []index.Segment
 	switch flag {
 	case FullIndex:
-		old := (*index.BTreeIndex)(atomic.SwapPointer(&srh.fullIndex, unsafe.Pointer(newIndex)))
+		//与正在使用的是同一个段时不重新加载, 退役旧段会删除新段的文件
+		resolved, err := index.ResolveIndex(file)
+		if err != nil {
+			return err
+		}
+		if filepath.Clean(resolved) == filepath.Clean(srh.full().File()) {
+			return nil
+		}
+		file = resolved
+		newIndex, err := openSegment(file)
+		if err != nil {
+			return err
+		}
+		newIndex.SetSimilarity(srh.similarity)
+		setPostingCache(newIndex, srh.postings)
+		for _, idx := range auxIdxArray.Evict(newIndex.Property().DataRange()) {
+			evicts = append(evicts, idx)
+		}
+		old := *(*index.Segment)(atomic.SwapPointer(&srh.fullIndex, unsafe.Pointer(&newIndex)))
 		evicts = append(evicts, old)
 	case AuxIndex:
+		newIndex, err := openIndex(file) //辅助索引需要合并增量数据, 只能是btree
+		if err != nil {
+			return err
+		}
+		newIndex.SetSimilarity(srh.similarity)
+		newIndex.SetPostingCache(srh.postings)
+		for _, idx := range auxIdxArray.Evict(newIndex.Property().DataRange()) {
+			evicts = append(evicts, idx)
+		}
 		auxIdxArray.Add(newIndex) //如果先添加后淘汰，需要避免自身也被淘汰
 		//old = (*index.BTreeIndex)(atomic.SwapPointer(&srh.auxIndex, unsafe.Pointer(newIndex)))
 	}
 
+	srh.invalidate()
+	//进行中的查询结束后才删除, 同名文件重新加载时不能读到旧的倒排表
+	srh.postings.Invalidate(file)
 	for i := 0; i < len(evicts); i++ {
-		evicts[i].Clear()
+		srh.postings.Invalidate(evicts[i].File())
+		srh.forget(evicts[i])
+		evicts[i].Retire()
 	}
+	return nil
 }
 
+// Reload 加载file.current指向的新发布的全量索引
+func (srh *Searcher) Reload() error {
+	current, err := index.ResolveIndex(srh.indexFile)
+	if err != nil {
+		return err
+	}
+	if current == srh.full().File() {
+		return nil
+	}
+	log.Printf("reload full index %s", current)
+	return srh.Load(current, FullIndex)
+}
+
+// Close 分片迁移后替换Searcher时关闭: 停止增量索引, 退役全量及辅助索引, 进行中的查询结束后删除其文件.
+// 关闭后查询没有结果, 不能再写入
+func (srh *Searcher) Close() {
+	srh.writeLock.Lock()
+	defer srh.writeLock.Unlock()
+	srh.draining.Wait()
+
+	//替换为空索引, 关闭后到达的查询不会在acquireFull中等待新的全量索引
+	var empty index.Segment = closedSegment{index.NewHashMapIndex()}
+	full := *(*index.Segment)(atomic.SwapPointer(&srh.fullIndex, unsafe.Pointer(&empty)))
+	aux := (*IndexArray)(atomic.SwapPointer(&srh.auxIndex, unsafe.Pointer(NewIndexArray())))
+	(*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).Stop()
+	srh.invalidate()
+
+	evicts := []index.Segment{full}
+	for _, idx := range aux.Indices() {
+		evicts = append(evicts, idx)
+	}
+	for i := 0; i < len(evicts); i++ {
+		srh.postings.Invalidate(evicts[i].File())
+		srh.forget(evicts[i])
+		evicts[i].Retire()
+	}
+}
+
+// closedSegment Close后的全量索引, 没有文档且总能获取
+type closedSegment struct {
+	*index.HashMapIndex
+}
+
+func (closedSegment) File() string {
+	return ""
+}
+
+func (closedSegment) Range(fn func(key string, pl index.PostingList) error) error {
+	return nil
+}
+
+func (closedSegment) Acquire() bool {
+	return true
+}
+
+func (closedSegment) Release() {}
+
+func (closedSegment) Retire() {}
+
 //SearchTips todo: 支持搜索提示
 //Trie 适合英文词典，如果系统中存在大量字符串且这些字符串基本没有公共前缀，则相应的trie树将非常消耗内存（数据结构之trie树）
 //Double Array Trie 适合做中文词典，内存占用小
@@ -443,28 +724,116 @@ func (srh *Searcher) SearchTips() []string {
 	return nil
 }
 
+// full 当前的全量索引, 查询时使用acquireFull
+func (srh *Searcher) full() index.Segment {
+	return *(*index.Segment)(atomic.LoadPointer(&srh.fullIndex))
+}
+
+// acquireFull 获取全量索引并增加引用计数, 使用完需要Release
+func (srh *Searcher) acquireFull() index.Segment {
+	for {
+		idx := srh.full()
+		if idx.Acquire() {
+			return idx
+		}
+		//已被替换并删除, 重新读取
+	}
+}
+
 func (srh *Searcher) Retrieval(terms []string, ext []string, model index.SearchModel) []index.Doc {
-	var result []index.Doc
+	tiers := srh.acquireTiers()
+	defer tiers.release()
+	boost := make(index.Boost, len(ext))
+	for _, term := range ext {
+		boost[term] = 1
+	}
+	docs, _ := srh.retrieval(tiers, terms, boost, model, srh.pipeline.RetrievalK, nil)
+	return docs
+}
 
-	fullIdx := (*index.BTreeIndex)(atomic.LoadPointer(&srh.fullIndex))
-	auxIdxArray := (*IndexArray)(atomic.LoadPointer(&srh.auxIndex))
-	incrIdx := (*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).ReadIndex()
+// tier 查询中使用的一个索引层级
+type tier struct {
+	idx  index.Index
+	name string //TierFull|TierAux|TierIncr
+	file string
+}
 
-	result = fullIdx.Retrieval(terms, ext, nil, 10, 1000, model)
+type tiers struct {
+	list     []tier
+	releases []func()
+}
 
-	copyData := auxIdxArray.Indices()
-	for i := 0; i < len(copyData); i++ {
-		y := copyData[i].Retrieval(terms, ext, nil, 10, 1000, model)
-		(*index.PostingList)(&result).Union(y)
+func (t *tiers) release() {
+	for _, release := range t.releases {
+		release()
 	}
+}
 
-	z := incrIdx.Retrieval(terms, ext, nil, 10, 1000, model)
-	(*index.PostingList)(&result).Union(z)
-	return result
+// acquireTiers 按全量、辅助、增量的顺序获取查询使用的索引, 查询结束前持有引用, 使用完需要release
+func (srh *Searcher) acquireTiers() *tiers {
+	t := &tiers{}
+	fullIdx := srh.acquireFull()
+	t.list = append(t.list, tier{idx: fullIdx, name: index.TierFull, file: fullIdx.File()})
+	t.releases = append(t.releases, fullIdx.Release)
+
+	auxIdxArray := (*IndexArray)(atomic.LoadPointer(&srh.auxIndex))
+	for _, aux := range auxIdxArray.Indices() {
+		if !aux.Acquire() {
+			continue
+		}
+		t.list = append(t.list, tier{idx: aux, name: index.TierAux, file: aux.File()})
+		t.releases = append(t.releases, aux.Release)
+	}
+
+	incrIdx := (*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).ReadIndex()
+	t.list = append(t.list, tier{idx: incrIdx, name: index.TierIncr})
+	return t
+}
+
+// retrieval 在每个索引中召回前k个文档, 返回合并的结果及每个文档命中的索引, 同一文档保留最先命中的索引层级.
+// ext为查询扩展词及其权重, explain非nil时记录每个结果的得分明细及命中的索引
+func (srh *Searcher) retrieval(t *tiers, terms []string, ext index.Boost, model index.SearchModel, k int, explain map[int32]*index.Explanation) ([]index.Doc, map[int32]index.Index) {
+	var result []index.Doc
+	origin := make(map[int32]index.Index)
+	p := srh.pipeline
+	should := ext.Terms()
+	for _, tier := range t.list {
+		var docs []index.Doc
+		var explains map[int32]*index.Explanation
+		var err error
+		if explain == nil {
+			docs, err = index.DoBoostedRetrieval(tier.idx, terms, should, nil, ext, k, p.ChampionR, model)
+		} else {
+			docs, explains, err = index.DoBoostedRetrievalExplain(tier.idx, terms, should, nil, ext, k, p.ChampionR, model)
+		}
+		if err != nil {
+			log.Printf("retrieval %s err: %s", tier.name, err.Error())
+			continue
+		}
+		docs = srh.filterSuperseded(tier.idx, docs)
+		for _, doc := range docs {
+			if _, ok := origin[doc.ID]; !ok {
+				origin[doc.ID] = tier.idx
+			}
+			if e := explains[doc.ID]; e != nil && explain[doc.ID] == nil {
+				e.Tier, e.Index, e.Shard = tier.name, tier.file, -1
+				explain[doc.ID] = e
+			}
+		}
+		if result == nil {
+			result = docs
+		} else {
+			(*index.PostingList)(&result).Union(docs)
+		}
+	}
+	return result, origin
 }
 
 //Filter deleted docs
 func (srh *Searcher) Filter(docs []index.Doc) []index.Doc {
+	srh.filterLock.RLock()
+	defer srh.filterLock.RUnlock()
+
 	var result []index.Doc
 	for _, doc := range docs {
 		hit := srh.roaringFilter.Contains(uint32(doc.ID))
@@ -476,8 +845,80 @@ func (srh *Searcher) Filter(docs []index.Doc) []index.Doc {
 }
 
 // Search queries the index for the given text.
-// todo: 检索召回（多路召回） -> 粗排sort(CTR by LR) -> 精排sort(CVR by DNN) -> topN(堆排序)
+// 检索召回 -> 粗排截断 -> 重排(特征提取+排序模型) -> topN, 见Pipeline
+// 文本与向量的多路召回见Hybrid, todo: 精排sort(CVR by DNN)
 func (srh *Searcher) Search(query string) []index.Doc {
+	return srh.search(query, "", 0, nil)
+}
+
+// SearchWithModel 使用指定的打分模型搜索, model需要用index.ParseSearchModel规范化, 未注册的模型没有结果; 为空时使用配置的默认模型
+func (srh *Searcher) SearchWithModel(query string, model index.SearchModel) []index.Doc {
+	return srh.search(query, model, 0, nil)
+}
+
+// Explain 同Search, 同时返回每个结果的得分明细, 与结果一一对应
+func (srh *Searcher) Explain(query string) ([]index.Doc, []index.Explanation) {
+	return srh.ExplainWithModel(query, "")
+}
+
+// ExplainWithModel 同SearchWithModel, 同时返回每个结果的得分明细
+func (srh *Searcher) ExplainWithModel(query string, model index.SearchModel) ([]index.Doc, []index.Explanation) {
+	explain := make(map[int32]*index.Explanation)
+	docs := srh.search(query, model, 0, explain)
+
+	explains := make([]index.Explanation, len(docs))
+	for i, doc := range docs {
+		if e := explain[doc.ID]; e != nil {
+			explains[i] = *e
+		} else {
+			explains[i] = index.Explanation{DocID: doc.ID, Score: doc.Score, Shard: -1}
+		}
+	}
+	return docs, explains
+}
+
+// KNN 在全量、辅助、增量索引中检索与vector最相似的k个文档, Score为相似度(cosine或内积).
+// filter为布尔查询(+必须 -排除 其他为可选), 先过滤再检索, 为空时不过滤
+func (srh *Searcher) KNN(vector []float32, k int, filter string) ([]index.Doc, error) {
+	q := index.ParseBooleanQuery(filter)
+	t := srh.acquireTiers()
+	defer t.release()
+
+	var result []index.Doc
+	for _, tier := range t.list {
+		var allowed map[int32]bool
+		if !q.Empty() {
+			if allowed = index.BooleanFilter(tier.idx, q); len(allowed) == 0 {
+				continue
+			}
+		}
+		docs, err := index.KNN(tier.idx, vector, k, allowed)
+		if err != nil {
+			return nil, err
+		}
+		docs = srh.filterSuperseded(tier.idx, docs)
+		if result == nil {
+			result = docs
+		} else {
+			(*index.PostingList)(&result).Union(docs)
+		}
+	}
+
+	result = srh.Filter(result)
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Score > result[j].Score //降序
+	})
+	if len(result) > k {
+		result = result[:k]
+	}
+	return result, nil
+}
+
+// search 返回前n个文档, n<=0时为Pipeline.TopN
+func (srh *Searcher) search(query string, model index.SearchModel, n int, explain map[int32]*index.Explanation) []index.Doc {
+	if n <= 0 {
+		n = srh.pipeline.TopN
+	}
 	//todo: 支持前缀查找
 	//参考：Lucene builds an inverted index using Skip-Lists on disk,
 	//and then loads a mapping for the indexed terms into memory using a Finite State Transducer (FST).
@@ -485,13 +926,35 @@ func (srh *Searcher) Search(query string) []index.Doc {
 	//1. Query Rewrite todo:支持查询纠错，意图识别
 	//1.1 文本预处理：分词、去除停用词、词干提取
 	terms := util.Analyze(query)
-	//1.2 语义扩展，即近义词/含义相同等
-	ext := srh.Paraphrase(terms, 3)
 
-	//2. todo:多路召回（传统检索+向量检索）
-	r := srh.Retrieval(terms, ext, index.BM25)
+	//1.2 查询结果缓存, 得分明细不缓存. 缓存键包含查询词, 命中时无需扩展
+	var key string
+	if explain == nil && srh.results != nil {
+		key = srh.cacheKey(query, model, n)
+		if docs, ok := srh.results.Get(key); ok {
+			return append([]index.Doc(nil), docs.([]index.Doc)...)
+		}
+	}
+
+	//1.3 语义扩展，即近义词/含义相同等
+	ext := srh.Paraphrase(query)
+
+	//2. 召回, 与向量检索的多路召回见Hybrid
+	t := srh.acquireTiers()
+	defer t.release()
+	k := srh.pipeline.RetrievalK
+	if n > k {
+		k = n //每个索引至少召回n个
+	}
+	r, origin := srh.retrieval(t, terms, ext, model, k, explain)
 
 	//3. 过滤已删除文档filter
 	r = srh.Filter(r)
+
+	//4. 粗排截断 -> 重排 -> topN
+	r = srh.rank(r, origin, terms, n, explain)
+	if key != "" {
+		srh.results.Add(key, append([]index.Doc(nil), r...), 1)
+	}
 	return r
 }
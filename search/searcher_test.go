@@ -3,13 +3,18 @@ package search
 import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/awesomefly/easysearch/config"
 	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/paraphrase/serving"
 )
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -131,3 +136,259 @@ func TestSearcher(t *testing.T) {
 	//Clear
 	searcher.Clear()
 }
+
+func TestSearcherExplain(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "explain")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{{ID: 1, Text: "A donut on a glass plate."}})
+	full.Close()
+
+	srh := NewSearcher(filepath.Join(dir, "idx"))
+	srh.Add(index.Document{ID: 2, Text: "Only the donuts."})
+	srh.Drain(0) //id 2 写入辅助索引
+	srh.draining.Wait()
+	srh.Add(index.Document{ID: 3, Text: "donut"})
+	(*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).Sync()
+
+	docs, explains := srh.Explain("donut")
+	assert.Equal(t, 3, len(docs))
+	tiers := make(map[int32]string)
+	for i, e := range explains {
+		assert.Equal(t, docs[i].ID, e.DocID)
+		assert.Equal(t, docs[i].Score, e.Score)
+		assert.Equal(t, -1, e.Shard)
+		assert.Equal(t, "donut", e.Terms[0].Term)
+		tiers[e.DocID] = e.Tier
+		if e.Tier == index.TierFull {
+			assert.Equal(t, filepath.Join(dir, "idx"), e.Index)
+		}
+	}
+	assert.Equal(t, map[int32]string{1: index.TierFull, 2: index.TierAux, 3: index.TierIncr}, tiers)
+
+	//查询指定打分模型, 所有索引层级使用同一模型
+	_, explains = srh.ExplainWithModel("donut", index.LMDirichlet)
+	for _, e := range explains {
+		assert.Equal(t, index.LMDirichlet.String(), e.Model)
+	}
+	assert.Equal(t, 3, len(srh.SearchWithModel("donut", index.IB)))
+}
+
+func TestSearcherKeepsBuildDir(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "builddir")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "idx")
+	full := index.NewBTreeIndex(file)
+	full.Add([]index.Document{{ID: 1, Text: "donut"}})
+	full.Close()
+
+	//进行中的构建不能被新打开的Searcher删除
+	built, err := index.NewBuildDir(file)
+	assert.Nil(t, err)
+	srh := NewSearcher(file)
+	assert.Equal(t, 1, len(srh.Search("donut")))
+	_, err = os.Stat(filepath.Dir(built))
+	assert.Nil(t, err)
+}
+
+func TestSearcherClose(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "close")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "idx")
+	full := index.NewBTreeIndex(file)
+	full.Add([]index.Document{{ID: 1, Text: "donut"}})
+	full.Close()
+
+	srh := NewSearcher(file)
+	aux := (*IndexArray)(srh.auxIndex).Indices()[0].File()
+	assert.Equal(t, 1, len(srh.Search("donut")))
+
+	//进行中的查询结束后才删除索引文件
+	tiers := srh.acquireTiers()
+	srh.Close()
+	_, err := os.Stat(file + ".idx")
+	assert.Nil(t, err)
+	_, err = os.Stat(aux + ".idx")
+	assert.Nil(t, err)
+	tiers.release()
+	_, err = os.Stat(file + ".idx")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(aux + ".idx")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, 0, len(srh.Search("donut")))
+	assert.Equal(t, 0, srh.Count())
+}
+
+func TestSearcherRanking(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ranking")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{
+		{ID: 1, Text: "donut donut", Prior: 1},
+		{ID: 2, Text: "donut glass"},
+		{ID: 3, Text: "donut glass plate"},
+		{ID: 4, Text: "donut glass plate cup"},
+		{ID: 5, Text: "donut glass plate cup fork knife", Prior: 100},
+	})
+	full.Close()
+
+	srh := NewSearcher(filepath.Join(dir, "idx"))
+	srh.Add(index.Document{ID: 6, Text: "donut", Timestamp: int(time.Now().Unix())})
+	(*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).Sync()
+
+	//默认按召回得分排序
+	assert.Equal(t, []int32{1, 2, 3, 6, 4, 5}, docIDs(srh.Search("donut")))
+
+	//粗排截断4个, 重排后取前2个: doc6刚写入时效性最高, doc5静态分高但在粗排中被截断
+	model := filepath.Join(dir, "rank.json")
+	ioutil.WriteFile(model, []byte(`{"type": "linear", "weights": {"score": 1, "static": 5, "freshness": 10}}`), 0644)
+	p, err := NewPipeline(config.Ranking{RetrievalK: 10, RerankK: 4, TopN: 2, Model: model})
+	assert.Nil(t, err)
+	srh.WithPipeline(p)
+	docs, explains := srh.Explain("donut")
+	assert.Equal(t, []int32{6, 1}, docIDs(docs))
+	assert.Equal(t, docs[0].Score, explains[0].Rerank)
+	assert.InDelta(t, 1, explains[0].Features.Get(index.FeatureFreshness), 0.001)
+	assert.Equal(t, float64(0), explains[1].Features.Get(index.FeatureFreshness))
+	assert.Equal(t, float64(1), explains[1].Features.Get(index.FeatureStatic))
+	assert.Contains(t, explains[1].String(), "static 1.0000")
+	assert.Equal(t, []int32{6, 1}, docIDs(srh.Search("donut")))
+
+	//查询词在正文中相邻, 紧密度为1
+	_, explains = srh.Explain("glass plate")
+	assert.Equal(t, 2, len(explains))
+	for _, e := range explains {
+		assert.Equal(t, float64(1), e.Features.Get(index.FeatureProximity))
+	}
+
+	_, err = NewPipeline(config.Ranking{Model: filepath.Join(dir, "none.json")})
+	assert.NotNil(t, err)
+}
+
+func TestSearcherKNN(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "knn")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{
+		{ID: 1, Text: "donut on a plate", Vector: []float32{1, 0, 0}},
+		{ID: 2, Text: "glass plate", Vector: []float32{0, 1, 0}},
+		{ID: 3, Text: "no vector donut"},
+	})
+	full.Close()
+
+	srh := NewSearcher(filepath.Join(dir, "idx"))
+	assert.Equal(t, 2, srh.full().Vectors().Len())
+	srh.Add(index.Document{ID: 4, Text: "donut in aux", Vector: []float32{0.9, 0.1, 0}})
+	srh.Drain(0) //id 4 写入辅助索引
+	srh.draining.Wait()
+	srh.Add(index.Document{ID: 5, Text: "donut in incr", Vector: []float32{0.8, 0, 0.2}})
+	(*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).Sync()
+
+	docs, err := srh.KNN([]float32{1, 0, 0}, 3, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []int32{1, 4, 5}, docIDs(docs))
+	assert.InDelta(t, 1, docs[0].Score, 1e-5)
+
+	//先按布尔查询过滤再检索
+	docs, err = srh.KNN([]float32{1, 0, 0}, 3, "+plate")
+	assert.Nil(t, err)
+	assert.Equal(t, []int32{1, 2}, docIDs(docs))
+	docs, _ = srh.KNN([]float32{1, 0, 0}, 3, "+donut -aux -incr")
+	assert.Equal(t, []int32{1}, docIDs(docs))
+	docs, _ = srh.KNN([]float32{1, 0, 0}, 3, "-plate")
+	assert.Equal(t, []int32{4, 5}, docIDs(docs))
+
+	//已删除的文档不返回
+	srh.Del(index.Document{ID: 1})
+	docs, _ = srh.KNN([]float32{1, 0, 0}, 2, "")
+	assert.Equal(t, []int32{4, 5}, docIDs(docs))
+
+	_, err = srh.KNN([]float32{1, 0}, 2, "")
+	assert.NotNil(t, err)
+}
+
+func TestSearcherParaphrase(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paraphrase")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{
+		{ID: 1, Text: "sofa for sale"},
+		{ID: 2, Text: "couch for sale"},
+		{ID: 3, Text: "table for sale"},
+	})
+	full.Close()
+
+	synonyms := filepath.Join(dir, "synonyms.txt")
+	ioutil.WriteFile(synonyms, []byte("couch, sofa\n"), 0644)
+	conf := config.Config{Store: config.Storage{SynonymFile: synonyms}, Paraphrase: config.Paraphrase{SynonymWeight: 0.5}}
+	expander, err := serving.ExpanderFromConfig(&conf)
+	assert.Nil(t, err)
+
+	srh := NewSearcher(filepath.Join(dir, "idx"))
+	assert.Equal(t, []int32{2}, docIDs(srh.Search("couch")))
+	srh.WithParaphrase(expander)
+	assert.Equal(t, index.Boost{"sofa": 0.5}, srh.Paraphrase("couch"))
+
+	//同义词召回的文档按权重降低得分
+	docs, explains := srh.Explain("couch")
+	assert.Equal(t, []int32{2, 1}, docIDs(docs))
+	assert.InDelta(t, docs[0].Score/2, docs[1].Score, 0.001)
+	assert.Equal(t, 0.5, explains[1].Terms[0].Boost)
+	assert.Equal(t, []int32{2, 1}, docIDs(srh.Search("couch")))
+}
+
+func docIDs(docs []index.Doc) []int32 {
+	ids := make([]int32, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+	return ids
+}
+
+func TestSearcherUpdate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "update")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{
+		{ID: 1, Text: "donut on a plate"},
+		{ID: 2, Text: "donut in a glass"},
+	})
+	full.Close()
+
+	srh := NewSearcher(filepath.Join(dir, "idx"))
+	srh.Update(index.Document{ID: 1, Text: "fork and knife"})
+	(*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).Sync()
+
+	//全量索引中的旧版本不再命中
+	assert.Equal(t, []int32{2}, docIDs(srh.Search("donut")))
+	assert.Equal(t, []int32{1}, docIDs(srh.Search("fork")))
+
+	//增量索引中再次更新, 旧版本直接替换
+	srh.Update(index.Document{ID: 1, Text: "spoon"})
+	(*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).Sync()
+	assert.Equal(t, 0, len(srh.Search("fork")))
+	assert.Equal(t, []int32{1}, docIDs(srh.Search("spoon")))
+
+	//合并到辅助索引后仍只有新版本
+	srh.Drain(0)
+	srh.draining.Wait()
+	assert.Equal(t, []int32{2}, docIDs(srh.Search("donut")))
+	assert.Equal(t, []int32{1}, docIDs(srh.Search("spoon")))
+
+	//删除后更新只恢复新版本, 辅助索引中的旧版本被覆盖
+	srh.Del(index.Document{ID: 2})
+	srh.Update(index.Document{ID: 2, Text: "cup"})
+	srh.Update(index.Document{ID: 1, Text: "cup plate"})
+	(*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).Sync()
+	assert.Equal(t, 0, len(srh.Search("donut")))
+	assert.Equal(t, 0, len(srh.Search("spoon")))
+	assert.Equal(t, []int{1, 2}, sortedIDs(srh.Search("cup")))
+}
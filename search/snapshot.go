@@ -0,0 +1,465 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+)
+
+// 快照目录结构:
+//   snapshot.json   快照描述
+//   full.*          全量索引文件的拷贝(全量索引不可变, 直接拷贝), btree或mmap格式
+//   aux.N.run       辅助索引导出的run文件
+//   incr.run        增量索引导出的run文件
+//   deleted.roaring 已删除的文档
+//   superseded.roaring 全量索引中被更新覆盖的旧版本, 辅助索引导出时已剔除
+
+const (
+	SnapshotVersion    = 1
+	snapshotMeta       = "snapshot.json"
+	snapshotFull       = "full"
+	snapshotIncr       = "incr.run"
+	snapshotDeleted    = "deleted.roaring"
+	snapshotSuperseded = "superseded.roaring"
+)
+
+// SegmentInfo 快照中的一个索引
+type SegmentInfo struct {
+	File       string          `json:"file"`
+	DocNum     int             `json:"doc_num"`
+	TokenCount int             `json:"token_count"`
+	DataRange  index.DataRange `json:"data_range"`
+}
+
+// SnapshotInfo 快照描述
+type SnapshotInfo struct {
+	Version    int           `json:"version"`
+	Created    time.Time     `json:"created"`
+	Full       SegmentInfo   `json:"full"`
+	Aux        []SegmentInfo `json:"aux"`
+	Incr       *SegmentInfo  `json:"incr,omitempty"`
+	Deleted    uint64        `json:"deleted"`
+	Superseded uint64        `json:"superseded,omitempty"`
+}
+
+func segmentInfo(file string, p *index.Property) SegmentInfo {
+	return SegmentInfo{File: file, DocNum: p.DocNum(), TokenCount: p.TokenCount(), DataRange: p.DataRange()}
+}
+
+// Snapshot 将全量、辅助、增量索引及删除列表的一致视图保存到dir, dir不能已存在.
+// 只在获取各层索引时短暂阻塞写入(增量索引在内存中拷贝), 拷贝文件时不阻塞读写
+func (srh *Searcher) Snapshot(dir string) (*SnapshotInfo, error) {
+	return srh.SnapshotWith(dir, nil)
+}
+
+// SnapshotWith 同Snapshot, 获取各层索引后调用captured(可以为nil), 调用方可以在保存文件前释放自己的锁
+func (srh *Searcher) SnapshotWith(dir string, captured func()) (*SnapshotInfo, error) {
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("snapshot dir %s already exists", dir)
+	}
+
+	view := srh.captureSnapshot()
+	defer view.release()
+	if captured != nil {
+		captured()
+	}
+
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0770); err != nil {
+		return nil, err
+	}
+	info, err := view.save(tmp)
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	log.Printf("snapshot %s: %d aux, incr %v, %d deleted", dir, len(info.Aux), info.Incr != nil, info.Deleted)
+	return info, nil
+}
+
+// snapshotView 快照时刻各层索引的引用及删除列表的拷贝
+type snapshotView struct {
+	full       index.Segment
+	superseded *roaring.Bitmap //全量索引中被覆盖的旧版本
+	aux        []*index.BTreeIndex
+	auxStale   []*roaring.Bitmap //辅助索引中被覆盖的旧版本, 与aux一一对应
+	incr       *index.HashMapIndex
+	deleted    *roaring.Bitmap
+}
+
+// captureSnapshot 独占写锁获取各层索引并增加引用计数, 进行中的Drain完成后才获取, 使增量数据不在两层之间
+func (srh *Searcher) captureSnapshot() *snapshotView {
+	for {
+		srh.draining.Wait()
+		srh.writeLock.Lock()
+		srh.filterLock.RLock()
+		idle := len(srh.drainingIncr) == 0
+		srh.filterLock.RUnlock()
+		if idle {
+			break
+		}
+		srh.writeLock.Unlock()
+	}
+	defer srh.writeLock.Unlock()
+
+	incr := (*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex))
+	incr.Sync()
+	view := &snapshotView{full: srh.acquireFull(), incr: incr.ReadIndex().Clone()}
+	view.superseded = srh.supersededOf(view.full)
+	for _, aux := range (*IndexArray)(atomic.LoadPointer(&srh.auxIndex)).Indices() {
+		if aux.Acquire() {
+			view.aux = append(view.aux, aux)
+			view.auxStale = append(view.auxStale, srh.supersededOf(aux))
+		}
+	}
+	srh.filterLock.RLock()
+	view.deleted = srh.roaringFilter.Clone()
+	srh.filterLock.RUnlock()
+	return view
+}
+
+func (v *snapshotView) release() {
+	v.full.Release()
+	for _, aux := range v.aux {
+		aux.Release()
+	}
+}
+
+// save 将快照写入dir
+func (v *snapshotView) save(dir string) (*SnapshotInfo, error) {
+	info := &SnapshotInfo{Version: SnapshotVersion, Created: time.Now()}
+
+	//1. 全量索引
+	if err := copySegment(v.full, filepath.Join(dir, snapshotFull)); err != nil {
+		return nil, err
+	}
+	info.Full = segmentInfo(snapshotFull, v.full.Property())
+	if v.superseded != nil {
+		info.Superseded = v.superseded.GetCardinality()
+		data, err := v.superseded.ToBytes()
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, snapshotSuperseded), data, 0660)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//2. 辅助索引
+	for i, aux := range v.aux {
+		name := "aux." + strconv.Itoa(i) + ".run"
+		if err := dumpSegment(aux, filepath.Join(dir, name), v.auxStale[i]); err != nil {
+			return nil, err
+		}
+		info.Aux = append(info.Aux, segmentInfo(name, aux.Property()))
+	}
+
+	//3. 增量索引
+	if v.incr.Property().DocNum() > 0 {
+		index.Drain(v.incr, filepath.Join(dir, snapshotIncr))
+		si := segmentInfo(snapshotIncr, v.incr.Property())
+		info.Incr = &si
+	}
+
+	//4. 删除列表
+	data, err := v.deleted.ToBytes()
+	info.Deleted = v.deleted.GetCardinality()
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, snapshotDeleted), data, 0660)
+	}
+	if err == nil {
+		data, _ = json.MarshalIndent(info, "", "  ")
+		err = ioutil.WriteFile(filepath.Join(dir, snapshotMeta), data, 0660)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// copySegment 拷贝全量索引文件并生成新的清单, 保留索引格式
+func copySegment(seg index.Segment, dst string) error {
+	src := seg.File()
+	exts := []string{".idx", ".kv", ".sum"}
+	format, sorted := index.FormatBTree, false
+	if m, err := index.ReadManifest(src); err == nil {
+		if err = m.Verify(filepath.Dir(src)); err != nil {
+			return err
+		}
+		exts, format, sorted = exts[:0], m.Format, m.Sorted
+		for _, f := range m.Files {
+			exts = append(exts, strings.TrimPrefix(f.Name, filepath.Base(src)))
+		}
+	}
+	for _, ext := range exts {
+		if err := copyFile(src+ext, dst+ext); err != nil {
+			return err
+		}
+	}
+	m, err := index.NewManifest(dst, seg.Property(), exts...)
+	if err != nil {
+		return err
+	}
+	m.Format, m.Sorted = format, sorted
+	return m.Write(dst)
+}
+
+// closeSegment 关闭索引但不删除文件
+func closeSegment(seg index.Segment) {
+	switch idx := seg.(type) {
+	case *index.BTreeIndex:
+		idx.BT.Close()
+	case *index.MmapIndex:
+		idx.Close()
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(dst, nil, 0660)
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// dumpSegment 按key顺序导出索引为run文件, 过滤deleted中的文档
+func dumpSegment(seg index.Segment, file string, deleted *roaring.Bitmap) error {
+	writer, err := index.NewRunWriter(file)
+	if err != nil {
+		return err
+	}
+	writer.SetProperty(*seg.Property()) //已删除的文档仍计入文档数
+
+	err = seg.Range(func(key string, pl index.PostingList) error {
+		if pl = filterDeleted(pl, deleted); len(pl) == 0 {
+			return nil
+		}
+		return writer.Write(key, pl)
+	})
+	if e := writer.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = index.SavePriors(file, filterPriors(seg.StaticScores(), deleted))
+	}
+	if err == nil {
+		err = index.SaveTimestamps(file, filterTimestamps(seg.Timestamps(), deleted))
+	}
+	if err == nil {
+		err = index.SaveVectors(file, filterVectors(seg.Vectors(), deleted))
+	}
+	return err
+}
+
+// filterRun 过滤run文件中已删除的文档
+func filterRun(src, dst string, deleted *roaring.Bitmap) error {
+	reader, err := index.OpenRunReader(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := index.NewRunWriter(dst)
+	if err != nil {
+		return err
+	}
+	writer.SetProperty(*reader.Property())
+	for {
+		key, pl, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writer.Close()
+			return err
+		}
+		if pl = filterDeleted(pl, deleted); len(pl) > 0 {
+			if err = writer.Write(key, pl); err != nil {
+				writer.Close()
+				return err
+			}
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	priors, err := index.LoadPriors(src)
+	if err != nil {
+		return err
+	}
+	if err = index.SavePriors(dst, filterPriors(priors, deleted)); err != nil {
+		return err
+	}
+	times, err := index.LoadTimestamps(src)
+	if err != nil {
+		return err
+	}
+	if err = index.SaveTimestamps(dst, filterTimestamps(times, deleted)); err != nil {
+		return err
+	}
+	vectors, err := index.LoadVectors(src)
+	if err != nil {
+		return err
+	}
+	return index.SaveVectors(dst, filterVectors(vectors, deleted))
+}
+
+// filterPriors 剔除已删除文档的静态分, 返回新的map
+func filterPriors(priors index.StaticScores, deleted *roaring.Bitmap) index.StaticScores {
+	result := make(index.StaticScores, len(priors))
+	for id, score := range priors {
+		if deleted == nil || !deleted.Contains(uint32(id)) {
+			result[id] = score
+		}
+	}
+	return result
+}
+
+// filterTimestamps 剔除已删除文档的时间, 返回新的map
+func filterTimestamps(times index.Timestamps, deleted *roaring.Bitmap) index.Timestamps {
+	result := make(index.Timestamps, len(times))
+	for id, ts := range times {
+		if deleted == nil || !deleted.Contains(uint32(id)) {
+			result[id] = ts
+		}
+	}
+	return result
+}
+
+// filterVectors 重建不含已删除文档的向量图, 没有删除的文档时返回h
+func filterVectors(h *index.HNSW, deleted *roaring.Bitmap) *index.HNSW {
+	if deleted == nil || deleted.IsEmpty() {
+		return h
+	}
+	return h.Filter(func(id int32) bool { return !deleted.Contains(uint32(id)) })
+}
+
+func filterDeleted(pl index.PostingList, deleted *roaring.Bitmap) index.PostingList {
+	if deleted == nil || deleted.IsEmpty() {
+		return pl
+	}
+	result := make(index.PostingList, 0, len(pl)) //pl可能引用只读的mmap内存, 不能原地修改
+	for _, doc := range pl {
+		if !deleted.Contains(uint32(doc.ID)) {
+			result = append(result, doc)
+		}
+	}
+	return result
+}
+
+// Restore 由快照重建索引file: 合并全量、辅助和增量索引并剔除已删除文档, 发布为新的全量索引
+func Restore(dir string, file string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotMeta))
+	if err != nil {
+		return fmt.Errorf("read snapshot %s: %v", dir, err)
+	}
+	info := SnapshotInfo{}
+	if err = json.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("corrupt snapshot %s: %v", dir, err)
+	}
+	if info.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", info.Version)
+	}
+
+	deleted := roaring.New()
+	if data, err = ioutil.ReadFile(filepath.Join(dir, snapshotDeleted)); err != nil {
+		return err
+	}
+	if err = deleted.UnmarshalBinary(data); err != nil {
+		return fmt.Errorf("corrupt deleted docs: %v", err)
+	}
+
+	//全量索引中被覆盖的旧版本与已删除的文档一起剔除, 新版本在辅助或增量索引中
+	fullDeleted := deleted.Clone()
+	if data, err = ioutil.ReadFile(filepath.Join(dir, snapshotSuperseded)); err == nil {
+		superseded := roaring.New()
+		if err = superseded.UnmarshalBinary(data); err != nil {
+			return fmt.Errorf("corrupt superseded docs: %v", err)
+		}
+		fullDeleted.Or(superseded)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	full, err := index.OpenSegment(filepath.Join(dir, info.Full.File))
+	if err != nil {
+		return err
+	}
+	format := index.FormatBTree
+	if _, ok := full.(*index.MmapIndex); ok {
+		format = index.FormatMmap
+	}
+
+	built, err := index.NewBuildDir(file)
+	if err != nil {
+		closeSegment(full)
+		return err
+	}
+	prefix := filepath.Join(filepath.Dir(built), "_tmp."+filepath.Base(built))
+	runs := []string{prefix + ".full"}
+	err = dumpSegment(full, runs[0], fullDeleted)
+	closeSegment(full)
+	if err != nil {
+		return err
+	}
+
+	segments := info.Aux
+	if info.Incr != nil {
+		segments = append(segments, *info.Incr)
+	}
+	for i, seg := range segments {
+		run := fmt.Sprintf("%s.%d", prefix, i)
+		if err = filterRun(filepath.Join(dir, seg.File), run, deleted); err != nil {
+			return err
+		}
+		runs = append(runs, run)
+	}
+
+	//恢复为快照中全量索引的格式
+	conf := config.Config{Store: config.Storage{IndexFile: built}, Build: config.Build{Format: format}}
+	if _, err = MergeAll(conf, runs); err != nil {
+		return err
+	}
+	for _, run := range runs {
+		os.Remove(run)
+		os.Remove(run + index.PriorSuffix)
+		os.Remove(run + index.TimestampSuffix)
+		os.Remove(run + index.VectorSuffix)
+	}
+
+	seg, err := index.Publish(file, built)
+	if err != nil {
+		return err
+	}
+	log.Printf("restored %s from snapshot %s", seg, dir)
+	return index.CleanupSegments(file)
+}
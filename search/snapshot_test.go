@@ -0,0 +1,128 @@
+package search
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/awesomefly/easysearch/config"
+	"github.com/awesomefly/easysearch/index"
+)
+
+func sortedIDs(docs []index.Doc) []int {
+	ids := index.PostingList(docs).IDs()
+	sort.Ints(ids)
+	return ids
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snapshot")
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "docs.jsonl")
+	ioutil.WriteFile(source, []byte("{\"id\": 1, \"text\": \"donut\", \"vector\": [1, 0]}\n{\"id\": 2, \"text\": \"donut glass\", \"vector\": [0, 1]}"), 0644)
+	conf := config.Config{
+		Store: config.Storage{
+			IndexFile: filepath.Join(dir, "idx"),
+			Source:    config.Source{Type: index.JSONSource, Path: source},
+		},
+	}
+	Index(conf)
+
+	srh := NewSearcher(conf.Store.IndexFile)
+	srh.Add(index.Document{ID: 3, Text: "donut plate", Vector: []float32{1, 1}})
+	srh.Drain(0) //id 3 写入辅助索引
+	srh.Add(index.Document{ID: 4, Text: "donut"})
+	srh.Del(index.Document{ID: 2})
+	srh.Update(index.Document{ID: 1, Text: "donut fork", Vector: []float32{1, 0}})
+
+	info, err := srh.Snapshot(filepath.Join(dir, "backup"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(info.Aux))
+	assert.NotNil(t, info.Incr)
+	assert.Equal(t, uint64(1), info.Deleted)
+	assert.Equal(t, uint64(1), info.Superseded)
+	assert.Equal(t, []int{1, 3, 4}, sortedIDs(srh.Search("donut")))
+
+	_, err = srh.Snapshot(filepath.Join(dir, "backup"))
+	assert.NotNil(t, err) //目录已存在
+
+	restored := filepath.Join(dir, "restored")
+	assert.Nil(t, Restore(filepath.Join(dir, "backup"), restored))
+	srh2 := NewSearcher(restored)
+	assert.Equal(t, []int{1, 3, 4}, sortedIDs(srh2.Search("donut")))
+	assert.Equal(t, 0, len(srh2.Search("glass")))
+	assert.Equal(t, []int{3}, sortedIDs(srh2.Search("plate")))
+	assert.Equal(t, []int{1}, sortedIDs(srh2.Search("fork")))
+	assert.Equal(t, []int32{1, 3}, srh2.full().Vectors().IDs()) //辅助索引合并到全量, 删除的文档不保留向量
+	docs, err := srh2.KNN([]float32{0, 1}, 3, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []int32{3, 1}, docIDs(docs))
+
+	//快照损坏时拒绝恢复
+	os.Truncate(filepath.Join(dir, "backup", "full.kv"), 1)
+	assert.NotNil(t, Restore(filepath.Join(dir, "backup"), restored))
+}
+
+func TestSnapshotConcurrentWrites(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snapshot")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{{ID: 1, Text: "donut"}})
+	full.Close()
+
+	srh := NewSearcher(filepath.Join(dir, "idx"))
+	srh.Add(index.Document{ID: 2, Text: "donut"})
+	view := srh.captureSnapshot()
+
+	//获取各层索引后写入不再阻塞, 也不进入快照
+	srh.Add(index.Document{ID: 3, Text: "donut"})
+	srh.Del(index.Document{ID: 1})
+	(*DoubleBuffer)(srh.incrIndex).Sync()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "backup"), 0770))
+	info, err := view.save(filepath.Join(dir, "backup"))
+	view.release()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, info.Incr.DocNum)
+	assert.Equal(t, uint64(0), info.Deleted)
+
+	restored := filepath.Join(dir, "restored")
+	assert.Nil(t, Restore(filepath.Join(dir, "backup"), restored))
+	assert.Equal(t, []int{1, 2}, sortedIDs(NewSearcher(restored).Search("donut")))
+}
+
+func TestSnapshotRestoreMmap(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snapshot")
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "docs.jsonl")
+	ioutil.WriteFile(source, []byte("{\"id\": 1, \"text\": \"donut\"}\n{\"id\": 2, \"text\": \"donut glass\"}"), 0644)
+	conf := config.Config{
+		Store: config.Storage{
+			IndexFile: filepath.Join(dir, "idx"),
+			Source:    config.Source{Type: index.JSONSource, Path: source},
+		},
+		Build: config.Build{Format: index.FormatMmap},
+	}
+	Index(conf)
+
+	srh := NewSearcher(conf.Store.IndexFile)
+	_, ok := srh.full().(*index.MmapIndex)
+	assert.True(t, ok)
+	assert.Equal(t, []int{1, 2}, sortedIDs(srh.Search("donut")))
+	srh.Del(index.Document{ID: 1})
+
+	_, err := srh.Snapshot(filepath.Join(dir, "backup"))
+	assert.Nil(t, err)
+	restored := filepath.Join(dir, "restored")
+	assert.Nil(t, Restore(filepath.Join(dir, "backup"), restored))
+	srh2 := NewSearcher(restored)
+	_, ok = srh2.full().(*index.MmapIndex)
+	assert.True(t, ok)
+	assert.Equal(t, []int{2}, sortedIDs(srh2.Search("donut")))
+}
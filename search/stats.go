@@ -0,0 +1,67 @@
+package search
+
+import (
+	"sync/atomic"
+
+	"github.com/awesomefly/easysearch/index"
+	"github.com/awesomefly/easysearch/metrics"
+)
+
+var (
+	drainDuration = metrics.Default.Histogram("easysearch_drain_duration_seconds",
+		"Time to merge a drained incremental index into the auxiliary index in seconds.", nil, "index")
+	mergeDuration = metrics.Default.Histogram("easysearch_merge_duration_seconds",
+		"Time to merge run files into a full index in seconds.", nil, "format")
+)
+
+// TierStats 一个索引层级的段数、文档数及大小
+type TierStats struct {
+	Tier     string //TierFull|TierAux|TierIncr
+	Segments int
+	Docs     int
+	Bytes    int64 //索引文件大小, 增量索引为估算的内存占用
+}
+
+// QueueDepth 增量索引双缓冲中等待写入的文档数(两个队列中较长的)
+func (b *DoubleBuffer) QueueDepth() int {
+	depth := 0
+	for _, q := range b.Queues {
+		if len(q) > depth {
+			depth = len(q)
+		}
+	}
+	return depth
+}
+
+// QueueDepth 当前增量索引等待写入的文档数
+func (srh *Searcher) QueueDepth() int {
+	return (*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).QueueDepth()
+}
+
+// Stats 全量、辅助、增量索引的统计
+func (srh *Searcher) Stats() []TierStats {
+	full := srh.full()
+	format := index.FormatBTree
+	if _, ok := full.(*index.MmapIndex); ok {
+		format = index.FormatMmap
+	}
+	stats := []TierStats{
+		{Tier: index.TierFull, Segments: 1, Docs: full.Property().DocNum(), Bytes: filesSize(full.File(), format)},
+		{Tier: index.TierAux},
+	}
+	for _, aux := range (*IndexArray)(atomic.LoadPointer(&srh.auxIndex)).Indices() {
+		stats[1].Segments++
+		stats[1].Docs += aux.Property().DocNum()
+		stats[1].Bytes += filesSize(aux.File(), index.FormatBTree)
+	}
+	incr := (*DoubleBuffer)(atomic.LoadPointer(&srh.incrIndex)).ReadIndex()
+	return append(stats, TierStats{Tier: index.TierIncr, Segments: 1, Docs: incr.Property().DocNum(), Bytes: int64(incr.MemSize())})
+}
+
+func filesSize(file string, format string) int64 {
+	var size int64
+	for _, f := range index.SegmentFiles(file, format) {
+		size += f.Size
+	}
+	return size
+}
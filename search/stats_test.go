@@ -0,0 +1,50 @@
+package search
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/awesomefly/easysearch/index"
+)
+
+func TestDoubleBufferQueueDepth(t *testing.T) {
+	b := &DoubleBuffer{Queues: []chan index.Document{make(chan index.Document, 4), make(chan index.Document, 4)}}
+	assert.Equal(t, 0, b.QueueDepth())
+	b.Add(index.Document{ID: 1})
+	b.Add(index.Document{ID: 2})
+	<-b.Queues[0]
+	assert.Equal(t, 2, b.QueueDepth())
+}
+
+func TestSearcherStats(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "stats")
+	defer os.RemoveAll(dir)
+
+	full := index.NewBTreeIndex(filepath.Join(dir, "idx"))
+	full.Add([]index.Document{
+		{ID: 1, Text: "donut on a glass plate"},
+		{ID: 2, Text: "only the donuts"},
+	})
+	full.Close()
+
+	srh := NewSearcher(filepath.Join(dir, "idx"))
+	srh.Add(index.Document{ID: 3, Text: "donut shop", Timestamp: 1})
+	(*DoubleBuffer)(srh.incrIndex).Sync()
+
+	stats := srh.Stats()
+	assert.Equal(t, 3, len(stats))
+	assert.Equal(t, index.TierFull, stats[0].Tier)
+	assert.Equal(t, 1, stats[0].Segments)
+	assert.Equal(t, 2, stats[0].Docs)
+	assert.True(t, stats[0].Bytes > 0)
+	assert.Equal(t, index.TierAux, stats[1].Tier)
+	assert.Equal(t, 0, stats[1].Docs)
+	assert.Equal(t, index.TierIncr, stats[2].Tier)
+	assert.Equal(t, 1, stats[2].Docs)
+	assert.True(t, stats[2].Bytes > 0)
+	assert.Equal(t, 0, srh.QueueDepth())
+}
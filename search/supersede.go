@@ -0,0 +1,105 @@
+package search
+
+import (
+	"sync/atomic"
+
+	"github.com/RoaringBitmap/roaring"
+
+	"github.com/awesomefly/easysearch/index"
+)
+
+// 更新文档时, 旧版本可能在全量、辅助索引或Drain中的增量索引里, 这些索引不可修改.
+// 按索引记录被新版本覆盖的文档, 检索时只过滤该索引中的旧版本, 新版本所在的索引不受影响.
+// 当前增量索引中的旧版本由HashMapIndex.Add直接替换
+
+// supersede 标记id在当前全量、辅助索引及Drain中的增量索引里的旧版本, 需要持有filterLock
+func (srh *Searcher) supersede(id int32) {
+	if srh.superseded == nil {
+		srh.superseded = make(map[index.Index]*roaring.Bitmap)
+	}
+	mark := func(idx index.Index) {
+		bm := srh.superseded[idx]
+		if bm == nil {
+			bm = roaring.New()
+			srh.superseded[idx] = bm
+		}
+		bm.Add(uint32(id))
+	}
+	mark(srh.full())
+	for _, aux := range (*IndexArray)(atomic.LoadPointer(&srh.auxIndex)).Indices() {
+		mark(aux)
+	}
+	for _, bm := range srh.drainingIncr {
+		bm.Add(uint32(id))
+	}
+}
+
+// filterSuperseded 过滤idx中已被新版本覆盖的文档
+func (srh *Searcher) filterSuperseded(idx index.Index, docs []index.Doc) []index.Doc {
+	srh.filterLock.RLock()
+	defer srh.filterLock.RUnlock()
+	bm := srh.superseded[idx]
+	if bm == nil || bm.IsEmpty() {
+		return docs
+	}
+	result := make([]index.Doc, 0, len(docs))
+	for _, doc := range docs {
+		if !bm.Contains(uint32(doc.ID)) {
+			result = append(result, doc)
+		}
+	}
+	return result
+}
+
+// supersededOf idx中已被覆盖的文档的拷贝, 没有时返回nil
+func (srh *Searcher) supersededOf(idx index.Index) *roaring.Bitmap {
+	srh.filterLock.RLock()
+	defer srh.filterLock.RUnlock()
+	if bm := srh.superseded[idx]; bm != nil && !bm.IsEmpty() {
+		return bm.Clone()
+	}
+	return nil
+}
+
+// beginDrain 记录Drain期间被覆盖的增量索引中的文档
+func (srh *Searcher) beginDrain(incr *DoubleBuffer) {
+	srh.filterLock.Lock()
+	defer srh.filterLock.Unlock()
+	if srh.drainingIncr == nil {
+		srh.drainingIncr = make(map[*DoubleBuffer]*roaring.Bitmap)
+	}
+	srh.drainingIncr[incr] = roaring.New()
+}
+
+// endDrain 增量索引合并到辅助索引, 需要持有filterLock. merged为合并时已剔除的oldAux中的旧版本,
+// 合并期间新标记的oldAux及incr中的旧版本都在newAux中, 由newAux继承. 没有合并(oldAux为nil)时只清理记录
+func (srh *Searcher) endDrain(incr *DoubleBuffer, oldAux, newAux index.Index, merged *roaring.Bitmap) {
+	defer delete(srh.drainingIncr, incr)
+	if oldAux == nil {
+		return
+	}
+	bm := roaring.New()
+	if old := srh.superseded[oldAux]; old != nil {
+		bm.Or(old)
+		if merged != nil {
+			bm.AndNot(merged)
+		}
+	}
+	if stale := srh.drainingIncr[incr]; stale != nil {
+		bm.Or(stale)
+	}
+	delete(srh.superseded, oldAux)
+	if !bm.IsEmpty() {
+		if srh.superseded == nil {
+			srh.superseded = make(map[index.Index]*roaring.Bitmap)
+		}
+		srh.superseded[newAux] = bm
+	}
+}
+
+// forget 索引被替换或淘汰后删除其记录
+func (srh *Searcher) forget(idx index.Index) {
+	srh.filterLock.Lock()
+	defer srh.filterLock.Unlock()
+	delete(srh.superseded, idx)
+}
@@ -15,12 +15,13 @@ func lowercaseFilter(tokens []string) []string {
 	return r
 }
 
+var stopwords = map[string]struct{}{
+	"a": {}, "and": {}, "be": {}, "have": {}, "i": {},
+	"in": {}, "of": {}, "that": {}, "the": {}, "to": {},
+}
+
 // stopwordFilter returns a slice of tokens with stop words removed.
 func stopwordFilter(tokens []string) []string {
-	var stopwords = map[string]struct{}{
-		"a": {}, "and": {}, "be": {}, "have": {}, "i": {},
-		"in": {}, "of": {}, "that": {}, "the": {}, "to": {},
-	}
 	r := make([]string, 0, len(tokens))
 	for _, token := range tokens {
 		if _, ok := stopwords[token]; !ok {
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats 缓存的命中统计
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int64
+	Size      int64 //所有元素的大小之和
+}
+
+// HitRate 命中率, 没有访问时为0
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// LRU 元素大小之和超过容量时淘汰最久未使用的元素, 并发安全. nil表示不缓存
+type LRU struct {
+	lock     sync.Mutex
+	capacity int64
+	ll       *list.List
+	items    map[string]*list.Element
+	stats    CacheStats
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+// NewLRU capacity为元素大小之和的上限, 如字节数或元素个数(每个元素大小为1)
+func NewLRU(capacity int64) *LRU {
+	return &LRU{capacity: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *LRU) Get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		c.stats.Hits++
+		return e.Value.(*lruEntry).value, true
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// Add 添加或替换元素, size超过容量时不缓存并返回false
+func (c *LRU) Add(key string, value interface{}, size int64) bool {
+	if c == nil || size > c.capacity {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, size: size})
+	c.stats.Size += size
+	c.stats.Entries++
+	for c.stats.Size > c.capacity {
+		c.removeElement(c.ll.Back())
+		c.stats.Evictions++
+	}
+	return true
+}
+
+func (c *LRU) Remove(key string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+// RemoveIf 删除key满足条件的元素, 返回删除的个数
+func (c *LRU) RemoveIf(fn func(key string) bool) int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := 0
+	for key, e := range c.items {
+		if fn(key) {
+			c.removeElement(e)
+			n++
+		}
+	}
+	return n
+}
+
+// Purge 删除所有元素, 保留命中统计
+func (c *LRU) Purge() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.stats.Entries, c.stats.Size = 0, 0
+}
+
+func (c *LRU) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+func (c *LRU) removeElement(e *list.Element) {
+	entry := c.ll.Remove(e).(*lruEntry)
+	delete(c.items, entry.key)
+	c.stats.Size -= entry.size
+	c.stats.Entries--
+}
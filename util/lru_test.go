@@ -0,0 +1,49 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU(t *testing.T) {
+	c := NewLRU(3)
+	assert.True(t, c.Add("a", 1, 1))
+	assert.True(t, c.Add("b", 2, 1))
+	assert.True(t, c.Add("c", 3, 1))
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	//淘汰最久未使用的b
+	assert.True(t, c.Add("d", 4, 1))
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1, Evictions: 1, Entries: 3, Size: 3}, c.Stats())
+
+	//替换及按大小淘汰
+	assert.True(t, c.Add("a", 5, 2))
+	_, ok = c.Get("c")
+	assert.False(t, ok)
+	v, _ = c.Get("a")
+	assert.Equal(t, 5, v)
+	assert.False(t, c.Add("big", 0, 4))
+	assert.Equal(t, int64(3), c.Stats().Size)
+
+	c.Add("x.1", 0, 1)
+	assert.Equal(t, 1, c.RemoveIf(func(key string) bool { return strings.HasPrefix(key, "x.") }))
+	c.Remove("d")
+	assert.Equal(t, int64(1), c.Stats().Entries)
+	c.Purge()
+	s := c.Stats()
+	assert.Equal(t, int64(0), s.Entries+s.Size)
+	assert.Equal(t, 0.5, s.HitRate())
+
+	//nil不缓存
+	var n *LRU
+	assert.False(t, n.Add("a", 1, 1))
+	_, ok = n.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, CacheStats{}, n.Stats())
+}
@@ -5,12 +5,17 @@ import (
 	"unicode"
 )
 
+// AnalyzerName 分词器标识, 写入索引清单, 分词规则变化后需要修改以拒绝加载旧索引
+const AnalyzerName = "standard-en-snowball"
+
+// isSeparator Split on any character that is not a letter or a number.
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
 // tokenize returns a slice of tokens for the given text.
 func tokenize(text string) []string {
-	return strings.FieldsFunc(text, func(r rune) bool {
-		// Split on any character that is not a letter or a number.
-		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
-	})
+	return strings.FieldsFunc(text, isSeparator)
 }
 
 // Analyze analyzes the text and returns a slice of tokens.
@@ -21,3 +26,43 @@ func Analyze(text string) []string {
 	tokens = stemmerFilter(tokens) //提取词干 smiling -> smile
 	return tokens
 }
+
+// Words 同Analyze, 但不提取词干, 用于在词向量模型中查找原词
+func Words(text string) []string {
+	tokens := tokenize(text)
+	tokens = lowercaseFilter(tokens)
+	return stopwordFilter(tokens)
+}
+
+// Token 分词结果及其在原文中的字节位置[Start, End)
+type Token struct {
+	Term  string
+	Start int
+	End   int
+}
+
+// AnalyzeOffsets 同Analyze, 同时返回每个词在原文中的位置, 用于把词干映射回原文
+func AnalyzeOffsets(text string) []Token {
+	var tokens []Token
+	start := -1
+	emit := func(end int) {
+		word := strings.ToLower(text[start:end])
+		if _, ok := stopwords[word]; !ok {
+			tokens = append(tokens, Token{Term: stemmerFilter([]string{word})[0], Start: start, End: end})
+		}
+		start = -1
+	}
+	for i, r := range text {
+		if isSeparator(r) {
+			if start >= 0 {
+				emit(i)
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		emit(len(text))
+	}
+	return tokens
+}
@@ -31,3 +31,20 @@ func TestTokenizer(t *testing.T) {
 		})
 	}
 }
+
+func TestAnalyzeOffsets(t *testing.T) {
+	text := "The Smiling cats, and DOGS!"
+	tokens := AnalyzeOffsets(text)
+	assert.Equal(t, []Token{{"smile", 4, 11}, {"cat", 12, 16}, {"dog", 22, 26}}, tokens)
+	assert.Equal(t, "Smiling", text[tokens[0].Start:tokens[0].End])
+
+	//与Analyze的结果一致
+	text = "Café naïve résumés, 2021年 北京"
+	var terms []string
+	for _, token := range AnalyzeOffsets(text) {
+		terms = append(terms, token.Term)
+		assert.NotEmpty(t, text[token.Start:token.End])
+	}
+	assert.Equal(t, Analyze(text), terms)
+	assert.Nil(t, AnalyzeOffsets(" ,"))
+}